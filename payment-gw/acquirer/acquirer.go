@@ -0,0 +1,134 @@
+package acquirer
+
+import (
+	"context"
+	"errors"
+)
+
+type Operation string
+
+const (
+	OperationAuthorize Operation = "authorize"
+	OperationCapture   Operation = "capture"
+	OperationRefund    Operation = "refund"
+	OperationVoid      Operation = "void"
+)
+
+func (o Operation) Valid() bool {
+	switch o {
+	case OperationAuthorize, OperationCapture, OperationRefund, OperationVoid:
+		return true
+	}
+	return false
+}
+
+// Response codes follow the ISO 8583 field 39 values used by most acquirers.
+const (
+	CodeApproved           = "00"
+	CodeDoNotHonor         = "05"
+	CodeInvalidTransaction = "12"
+	CodeTryAgain           = "19"
+	CodeNoRecord           = "25"
+	CodeStolenCard         = "43"
+	CodeInsufficientFunds  = "51"
+	CodeExpiredCard        = "54"
+	CodeCVVMismatch        = "N7"
+	CodeIssuerUnavailable  = "91"
+	CodeSystemError        = "96"
+)
+
+var reasons = map[string]string{
+	CodeApproved:           "approved",
+	CodeDoNotHonor:         "do not honor",
+	CodeInvalidTransaction: "invalid transaction",
+	CodeTryAgain:           "re-enter transaction",
+	CodeNoRecord:           "unable to locate record",
+	CodeStolenCard:         "stolen card",
+	CodeInsufficientFunds:  "insufficient funds",
+	CodeExpiredCard:        "expired card",
+	CodeCVVMismatch:        "CVV mismatch",
+	CodeIssuerUnavailable:  "issuer unavailable",
+	CodeSystemError:        "system malfunction",
+}
+
+// soft declines may be approved when the same request is retried later
+var softCodes = map[string]bool{
+	CodeTryAgain:          true,
+	CodeIssuerUnavailable: true,
+	CodeSystemError:       true,
+}
+
+func Reason(code string) string {
+	if r, ok := reasons[code]; ok {
+		return r
+	}
+	return "declined"
+}
+
+var (
+	ErrDeclined    = errors.New("declined by the acquirer")
+	ErrTimeout     = errors.New("acquirer did not respond in time")
+	ErrUnavailable = errors.New("acquirer is unavailable")
+)
+
+// DeclineError is returned when the acquirer processed the request and
+// refused it, as opposed to errors where the outcome is unknown.
+type DeclineError struct {
+	Operation Operation
+	Code      string
+	Reference string
+}
+
+func (e *DeclineError) Error() string {
+	return string(e.Operation) + " declined: " + e.Code + " " + Reason(e.Code)
+}
+
+func (e *DeclineError) Is(target error) bool {
+	return target == ErrDeclined
+}
+
+func (e *DeclineError) Soft() bool {
+	return softCodes[e.Code]
+}
+
+type Card struct {
+	Holder      string
+	Number      string
+	ExpiryMonth string
+	ExpiryYear  string
+	CVV         string
+}
+
+type AuthorizeRequest struct {
+	PaymentId  string
+	MerchantId string
+	Amount     int
+	Currency   string
+	Card       Card
+	// StatementDescriptor is shown on the statement of the cardholder
+	StatementDescriptor string
+}
+
+// Request refers to a payment authorized earlier by its processor reference
+// and the acquirer it was routed to.
+type Request struct {
+	PaymentId string
+	Acquirer  string
+	Reference string
+	Amount    int
+	Currency  string
+}
+
+type Response struct {
+	Acquirer  string
+	Reference string
+	Code      string
+}
+
+type Acquirer interface {
+	Name() string
+	Authorize(ctx context.Context, req AuthorizeRequest) (Response, error)
+	Capture(ctx context.Context, req Request) (Response, error)
+	Refund(ctx context.Context, req Request) (Response, error)
+	Void(ctx context.Context, req Request) (Response, error)
+}
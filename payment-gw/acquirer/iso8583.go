@@ -0,0 +1,367 @@
+package acquirer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"payment-gw/iso8583"
+
+	"github.com/rs/zerolog"
+)
+
+type ISO8583Config struct {
+	Address       string        `yaml:"address"`
+	TerminalId    string        `yaml:"terminal_id"`
+	AcceptorId    string        `yaml:"acceptor_id"`
+	InstitutionId string        `yaml:"institution_id"`
+	DialTimeout   time.Duration `yaml:"dial_timeout"`
+	EchoInterval  time.Duration `yaml:"echo_interval"`
+}
+
+func DefaultISO8583Config() ISO8583Config {
+	return ISO8583Config{
+		Address:       "localhost:8583",
+		TerminalId:    "PAYGW001",
+		AcceptorId:    "PAYMENTGATEWAY",
+		InstitutionId: "100001",
+		DialTimeout:   2 * time.Second,
+		EchoInterval:  30 * time.Second,
+	}
+}
+
+func (c ISO8583Config) Validate() error {
+	var errs []string
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		errs = append(errs, fmt.Sprintf("address must be host:port, got %q", c.Address))
+	}
+	if c.TerminalId == "" || len(c.TerminalId) > 8 {
+		errs = append(errs, "terminal_id must have 1 to 8 characters")
+	}
+	if c.AcceptorId == "" || len(c.AcceptorId) > 15 {
+		errs = append(errs, "acceptor_id must have 1 to 15 characters")
+	}
+	if c.InstitutionId == "" || len(c.InstitutionId) > 11 || strings.Trim(c.InstitutionId, "0123456789") != "" {
+		errs = append(errs, "institution_id must have 1 to 11 digits")
+	}
+	if c.DialTimeout <= 0 {
+		errs = append(errs, "dial_timeout must be positive")
+	}
+	if c.EchoInterval < 0 {
+		errs = append(errs, "echo_interval must not be negative")
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ISO8583 connects to a card network host over a single TCP link. Requests
+// are multiplexed on the link and their responses matched by the system trace
+// audit number, the link is dialed again on the next request once it breaks.
+type ISO8583 struct {
+	config ISO8583Config
+	now    func() time.Time
+
+	mu   sync.Mutex
+	link *link
+	stan int
+}
+
+func NewISO8583(c ISO8583Config) (*ISO8583, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &ISO8583{config: c, now: time.Now}, nil
+}
+
+func (c *ISO8583) Name() string {
+	return "iso8583"
+}
+
+// Authorize sends an authorization request (0100), the retrieval reference
+// number the host answers with becomes the processor reference.
+func (c *ISO8583) Authorize(ctx context.Context, req AuthorizeRequest) (Response, error) {
+	m := iso8583.NewMessage(iso8583.MTIAuthorizationRequest)
+	fields := map[int]string{
+		2:  req.Card.Number,
+		3:  iso8583.ProcessingCodePurchase,
+		14: req.Card.ExpiryYear + req.Card.ExpiryMonth,
+		// manual entry on an e-commerce channel
+		22: "012",
+		25: "59",
+	}
+	if req.Card.CVV != "" {
+		fields[48] = "CV" + req.Card.CVV
+	}
+	if req.StatementDescriptor != "" {
+		fields[43] = req.StatementDescriptor
+	}
+	resp, err := c.financial(ctx, m, fields, req.Amount, req.Currency)
+	if err != nil {
+		return Response{}, err
+	}
+	return c.response(OperationAuthorize, resp, strings.TrimSpace(resp.Get(37)))
+}
+
+// Capture completes an authorization with a financial request (0200).
+func (c *ISO8583) Capture(ctx context.Context, req Request) (Response, error) {
+	return c.operation(ctx, OperationCapture, iso8583.MTIFinancialRequest, iso8583.ProcessingCodePurchase, req)
+}
+
+func (c *ISO8583) Refund(ctx context.Context, req Request) (Response, error) {
+	return c.operation(ctx, OperationRefund, iso8583.MTIFinancialRequest, iso8583.ProcessingCodeRefund, req)
+}
+
+// Void reverses an authorization (0400), the original data elements refer to
+// the authorization request.
+func (c *ISO8583) Void(ctx context.Context, req Request) (Response, error) {
+	return c.operation(ctx, OperationVoid, iso8583.MTIReversalRequest, iso8583.ProcessingCodePurchase, req)
+}
+
+func (c *ISO8583) operation(ctx context.Context, op Operation, mti, processingCode string, req Request) (Response, error) {
+	m := iso8583.NewMessage(mti)
+	fields := map[int]string{3: processingCode, 37: req.Reference}
+	if mti == iso8583.MTIReversalRequest {
+		institution := strings.Repeat("0", 11-len(c.config.InstitutionId)) + c.config.InstitutionId
+		fields[90] = fmt.Sprintf("%s%06d%010d%s%011d", iso8583.MTIAuthorizationRequest, 0, 0, institution, 0)
+	}
+	resp, err := c.financial(ctx, m, fields, req.Amount, req.Currency)
+	if err != nil {
+		return Response{}, err
+	}
+	return c.response(op, resp, req.Reference)
+}
+
+// financial fills in the fields shared by all the payment messages and sends
+// the request.
+func (c *ISO8583) financial(ctx context.Context, m *iso8583.Message, fields map[int]string, amount int, currency string) (*iso8583.Message, error) {
+	code, ok := iso8583.CurrencyCode(currency)
+	if !ok {
+		return nil, fmt.Errorf("iso8583: unsupported currency %q", currency)
+	}
+	local := c.now()
+	fields[4] = strconv.Itoa(amount)
+	fields[12] = local.Format("150405")
+	fields[13] = local.Format("0102")
+	fields[32] = c.config.InstitutionId
+	fields[41] = c.config.TerminalId
+	fields[42] = c.config.AcceptorId
+	fields[49] = code
+	for f, v := range fields {
+		if err := m.Set(f, v); err != nil {
+			return nil, err
+		}
+	}
+	return c.send(ctx, m)
+}
+
+func (c *ISO8583) response(op Operation, m *iso8583.Message, reference string) (Response, error) {
+	code := m.Get(39)
+	if code == CodeApproved {
+		return Response{Reference: reference, Code: code}, nil
+	}
+	return Response{Reference: reference, Code: code}, &DeclineError{op, code, reference}
+}
+
+// Echo sends a network management echo test (0800), it fails when the host
+// does not answer or the link cannot be established.
+func (c *ISO8583) Echo(ctx context.Context) error {
+	m := iso8583.NewMessage(iso8583.MTINetworkManagementRequest)
+	m.Set(70, iso8583.NetworkManagementEcho)
+	resp, err := c.send(ctx, m)
+	if err != nil {
+		return err
+	}
+	if code := resp.Get(39); code != iso8583.ResponseCodeApproved {
+		return fmt.Errorf("%w: echo test answered with %q", ErrUnavailable, code)
+	}
+	return nil
+}
+
+// Run keeps the link alive with an echo test every echo_interval and closes
+// it when the context is done.
+func (c *ISO8583) Run(ctx context.Context) error {
+	defer c.Close()
+	if c.config.EchoInterval == 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	lg, _ := ctx.Value("logger").(*zerolog.Logger)
+	ticker := time.NewTicker(c.config.EchoInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		echoCtx, cancel := context.WithTimeout(ctx, c.config.DialTimeout)
+		err := c.Echo(echoCtx)
+		cancel()
+		if err != nil && lg != nil && ctx.Err() == nil {
+			lg.Warn().Err(err).Str("address", c.config.Address).Msg("iso8583 echo test failed")
+		}
+	}
+}
+
+func (c *ISO8583) Close() error {
+	c.mu.Lock()
+	l := c.link
+	c.link = nil
+	c.mu.Unlock()
+	if l != nil {
+		l.fail(net.ErrClosed)
+	}
+	return nil
+}
+
+func (c *ISO8583) send(ctx context.Context, m *iso8583.Message) (*iso8583.Message, error) {
+	l, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.Set(7, c.now().UTC().Format("0102150405"))
+	m.Set(11, c.nextSTAN())
+	return l.roundTrip(ctx, m)
+}
+
+func (c *ISO8583) nextSTAN() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stan = c.stan%999999 + 1
+	return fmt.Sprintf("%06d", c.stan)
+}
+
+// connect returns the open link, or dials the host and signs on.
+func (c *ISO8583) connect(ctx context.Context) (*link, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.link != nil && !c.link.broken() {
+		return c.link, nil
+	}
+
+	dialer := net.Dialer{Timeout: c.config.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.config.Address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ErrTimeout
+		}
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	l := newLink(conn)
+
+	c.stan = c.stan%999999 + 1
+	signOn := iso8583.NewMessage(iso8583.MTINetworkManagementRequest)
+	signOn.Set(7, c.now().UTC().Format("0102150405"))
+	signOn.Set(11, fmt.Sprintf("%06d", c.stan))
+	signOn.Set(70, iso8583.NetworkManagementSignOn)
+	resp, err := l.roundTrip(ctx, signOn)
+	if err == nil && resp.Get(39) != iso8583.ResponseCodeApproved {
+		err = fmt.Errorf("%w: sign on answered with %q", ErrUnavailable, resp.Get(39))
+	}
+	if err != nil {
+		l.fail(err)
+		return nil, err
+	}
+	c.link = l
+	return l, nil
+}
+
+type link struct {
+	conn net.Conn
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]chan *iso8583.Message
+	err     error
+}
+
+func newLink(conn net.Conn) *link {
+	l := &link{conn: conn, pending: map[string]chan *iso8583.Message{}}
+	go l.read()
+	return l
+}
+
+func (l *link) read() {
+	for {
+		m, err := iso8583.ReadMessage(l.conn)
+		if err != nil {
+			l.fail(err)
+			return
+		}
+		l.mu.Lock()
+		ch, ok := l.pending[m.Get(11)]
+		delete(l.pending, m.Get(11))
+		l.mu.Unlock()
+		// late responses to requests that timed out are dropped
+		if ok {
+			ch <- m
+		}
+	}
+}
+
+func (l *link) roundTrip(ctx context.Context, m *iso8583.Message) (*iso8583.Message, error) {
+	stan := m.Get(11)
+	ch := make(chan *iso8583.Message, 1)
+	l.mu.Lock()
+	if l.err != nil {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, l.err)
+	}
+	l.pending[stan] = ch
+	l.mu.Unlock()
+
+	l.wmu.Lock()
+	deadline, _ := ctx.Deadline()
+	l.conn.SetWriteDeadline(deadline)
+	err := iso8583.WriteMessage(l.conn, m)
+	l.wmu.Unlock()
+	if err != nil {
+		l.fail(err)
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("%w: connection lost", ErrUnavailable)
+		}
+		if resp.MTI != iso8583.ResponseMTI(m.MTI) {
+			return nil, fmt.Errorf("%w: unexpected response %s to %s", ErrUnavailable, resp.MTI, m.MTI)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		delete(l.pending, stan)
+		l.mu.Unlock()
+		return nil, ErrTimeout
+	}
+}
+
+func (l *link) broken() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err != nil
+}
+
+// fail closes the link and releases the requests waiting on it.
+func (l *link) fail(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return
+	}
+	l.err = err
+	l.conn.Close()
+	for stan, ch := range l.pending {
+		close(ch)
+		delete(l.pending, stan)
+	}
+}
@@ -0,0 +1,113 @@
+package acquirer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"payment-gw/iso8583"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newISO8583(t *testing.T) (*ISO8583, *iso8583.Host) {
+	host := iso8583.NewHost()
+	assert.NoError(t, host.Listen("127.0.0.1:0"))
+	t.Cleanup(func() { host.Close() })
+
+	c := DefaultISO8583Config()
+	c.Address = host.Addr()
+	conn, err := NewISO8583(c)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn, host
+}
+
+func TestISO8583Operations(t *testing.T) {
+	conn, host := newISO8583(t)
+	host.Declines["4000000000000119"] = CodeDoNotHonor
+	ctx := context.Background()
+	card := Card{Number: "5555555555554444", ExpiryMonth: "12", ExpiryYear: "30", CVV: "123"}
+
+	res, err := conn.Authorize(ctx, AuthorizeRequest{Amount: 1050, Currency: "EUR", Card: card})
+	assert.NoError(t, err)
+	assert.Equal(t, CodeApproved, res.Code)
+	assert.Len(t, res.Reference, 12)
+
+	_, err = conn.Authorize(ctx, AuthorizeRequest{Amount: 1050, Currency: "EUR", Card: card, StatementDescriptor: "ACME* ORDER 1234"})
+	assert.NoError(t, err, "the statement descriptor is sent as the card acceptor name")
+
+	req := Request{Reference: res.Reference, Amount: 1050, Currency: "EUR"}
+	_, err = conn.Capture(ctx, req)
+	assert.NoError(t, err)
+	_, err = conn.Refund(ctx, req)
+	assert.NoError(t, err)
+	_, err = conn.Void(ctx, req)
+	assert.NoError(t, err)
+
+	_, err = conn.Capture(ctx, Request{Reference: "000000000999", Amount: 1050, Currency: "EUR"})
+	var decline *DeclineError
+	assert.True(t, errors.As(err, &decline))
+	assert.Equal(t, CodeNoRecord, decline.Code)
+	assert.Equal(t, OperationCapture, decline.Operation)
+
+	card.Number = "4000000000000119"
+	_, err = conn.Authorize(ctx, AuthorizeRequest{Amount: 1050, Currency: "EUR", Card: card})
+	assert.True(t, errors.As(err, &decline))
+	assert.Equal(t, CodeDoNotHonor, decline.Code)
+
+	_, err = conn.Authorize(ctx, AuthorizeRequest{Amount: 1050, Currency: "XXX", Card: card})
+	assert.Error(t, err)
+	assert.NoError(t, conn.Echo(ctx))
+}
+
+func TestISO8583ConcurrentRequests(t *testing.T) {
+	conn, host := newISO8583(t)
+	host.Latency = 10 * time.Millisecond
+
+	var wg sync.WaitGroup
+	references := make([]string, 20)
+	for i := range references {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := conn.Authorize(context.Background(), AuthorizeRequest{Amount: 100 + i, Currency: "USD", Card: Card{Number: "5555555555554444", ExpiryMonth: "01", ExpiryYear: "30"}})
+			assert.NoError(t, err)
+			references[i] = res.Reference
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, r := range references {
+		assert.False(t, seen[r], "every request gets its own response")
+		seen[r] = true
+	}
+}
+
+func TestISO8583Failures(t *testing.T) {
+	conn, host := newISO8583(t)
+	host.Latency = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, ErrTimeout, conn.Echo(ctx))
+
+	host.Close()
+	err := conn.Echo(context.Background())
+	assert.True(t, errors.Is(err, ErrUnavailable))
+
+	c := DefaultISO8583Config()
+	c.Address = host.Addr()
+	conn, err = NewISO8583(c)
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(conn.Echo(context.Background()), ErrUnavailable), "the host is down")
+
+	err = ISO8583Config{Address: "localhost", TerminalId: "TERMINAL01", InstitutionId: "1a"}.Validate()
+	assert.Error(t, err)
+	for _, msg := range []string{"address", "terminal_id", "acceptor_id", "institution_id", "dial_timeout"} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
@@ -0,0 +1,303 @@
+package acquirer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario makes the simulator misbehave for matching requests. A request
+// matches when the operation is the same and the card number and the amount
+// suffix, where set, match too. The amount suffix is compared with the amount
+// in minor units, so "51" matches 10.51.
+type Scenario struct {
+	Name         string        `yaml:"name"`
+	Operation    Operation     `yaml:"operation"`
+	CardNumber   string        `yaml:"card_number"`
+	AmountSuffix string        `yaml:"amount_suffix"`
+	Code         string        `yaml:"code"`
+	Sequence     []string      `yaml:"sequence"`
+	Latency      time.Duration `yaml:"latency"`
+	Timeout      bool          `yaml:"timeout"`
+	ErrorRate    float64       `yaml:"error_rate"`
+}
+
+type SimulatorConfig struct {
+	Latency       time.Duration `yaml:"latency"`
+	ErrorRate     float64       `yaml:"error_rate"`
+	Seed          int64         `yaml:"seed"`
+	Scenarios     []Scenario    `yaml:"scenarios"`
+	ScenariosFile string        `yaml:"scenarios_file"`
+}
+
+// DefaultSimulatorConfig declines the test card numbers the gateway always
+// accepted, one for each of authorization, capture and refund.
+func DefaultSimulatorConfig() SimulatorConfig {
+	return SimulatorConfig{Scenarios: []Scenario{
+		{Name: "authorization declined", Operation: OperationAuthorize, CardNumber: "4000000000000119", Code: CodeDoNotHonor},
+		{Name: "capture declined", Operation: OperationCapture, CardNumber: "4000000000000259", Code: CodeDoNotHonor},
+		{Name: "refund declined", Operation: OperationRefund, CardNumber: "4000000000003238", Code: CodeDoNotHonor},
+	}}
+}
+
+func LoadScenarios(path string) ([]Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	file := struct {
+		Scenarios []Scenario `yaml:"scenarios"`
+	}{}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file.Scenarios, nil
+}
+
+// Load returns the inline scenarios followed by the ones from the scenarios
+// file, if any.
+func (c SimulatorConfig) Load() ([]Scenario, error) {
+	scenarios := append([]Scenario(nil), c.Scenarios...)
+	if c.ScenariosFile != "" {
+		loaded, err := LoadScenarios(c.ScenariosFile)
+		if err != nil {
+			return nil, err
+		}
+		scenarios = append(scenarios, loaded...)
+	}
+	for i := range scenarios {
+		if scenarios[i].Operation == "" {
+			scenarios[i].Operation = OperationAuthorize
+		}
+	}
+	return scenarios, nil
+}
+
+func (c SimulatorConfig) Validate() error {
+	var errs []string
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	if c.Latency < 0 {
+		add("latency must not be negative")
+	}
+	if c.ErrorRate < 0 || c.ErrorRate > 1 {
+		add("error_rate must be between 0 and 1")
+	}
+
+	scenarios, err := c.Load()
+	if err != nil {
+		return err
+	}
+	for i, s := range scenarios {
+		name := s.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		if !s.Operation.Valid() {
+			add("scenario %s: operation must be authorize, capture, refund or void, got %q", name, s.Operation)
+		}
+		if s.CardNumber != "" && (len(s.CardNumber) != 16 || strings.Trim(s.CardNumber, "0123456789") != "") {
+			add("scenario %s: card_number must have 16 digits", name)
+		}
+		if strings.Trim(s.AmountSuffix, "0123456789") != "" {
+			add("scenario %s: amount_suffix must only contain digits", name)
+		}
+		if s.Code != "" && len(s.Sequence) > 0 {
+			add("scenario %s: code and sequence cannot be used together", name)
+		}
+		for _, code := range append([]string{s.Code}, s.Sequence...) {
+			if code != "" && len(code) != 2 {
+				add("scenario %s: response code %q must have 2 characters", name, code)
+			}
+		}
+		if s.Latency < 0 {
+			add("scenario %s: latency must not be negative", name)
+		}
+		if s.ErrorRate < 0 || s.ErrorRate > 1 {
+			add("scenario %s: error_rate must be between 0 and 1", name)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Simulator is an in-process acquirer for development and tests. Scenarios
+// for capture, refund and void with a card number are remembered in memory
+// for the reference issued at authorization, like a sandbox would on its
+// side, and so are the positions in response sequences. A sequence starts
+// over once all its responses were played.
+type Simulator struct {
+	config    SimulatorConfig
+	scenarios []Scenario
+
+	mu        sync.Mutex
+	rand      *rand.Rand
+	scheduled map[string][]int
+	attempts  map[string]int
+}
+
+func NewSimulator(c SimulatorConfig) (*Simulator, error) {
+	scenarios, err := c.Load()
+	if err != nil {
+		return nil, err
+	}
+	seed := c.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Simulator{
+		config:    c,
+		scenarios: scenarios,
+		rand:      rand.New(rand.NewSource(seed)),
+		scheduled: map[string][]int{},
+		attempts:  map[string]int{},
+	}, nil
+}
+
+func (s *Simulator) Name() string {
+	return "simulator"
+}
+
+func (s *Simulator) Authorize(ctx context.Context, req AuthorizeRequest) (Response, error) {
+	reference := "sim_" + xid.New().String()
+
+	var later []int
+	match := -1
+	for i, sc := range s.scenarios {
+		if sc.CardNumber != "" && sc.CardNumber != req.Card.Number {
+			continue
+		}
+		if sc.Operation != OperationAuthorize {
+			if sc.CardNumber != "" {
+				later = append(later, i)
+			}
+			continue
+		}
+		if match < 0 && matchesAmount(sc, req.Amount) {
+			match = i
+		}
+	}
+
+	res, err := s.respond(ctx, OperationAuthorize, match, req.Card.Number, reference)
+	if err == nil && len(later) > 0 {
+		s.mu.Lock()
+		s.scheduled[reference] = later
+		s.mu.Unlock()
+	}
+	return res, err
+}
+
+func (s *Simulator) Capture(ctx context.Context, req Request) (Response, error) {
+	return s.operation(ctx, OperationCapture, req)
+}
+
+func (s *Simulator) Refund(ctx context.Context, req Request) (Response, error) {
+	return s.operation(ctx, OperationRefund, req)
+}
+
+func (s *Simulator) Void(ctx context.Context, req Request) (Response, error) {
+	return s.operation(ctx, OperationVoid, req)
+}
+
+func (s *Simulator) operation(ctx context.Context, op Operation, req Request) (Response, error) {
+	s.mu.Lock()
+	scheduled := s.scheduled[req.Reference]
+	s.mu.Unlock()
+
+	match := -1
+	for i, sc := range s.scenarios {
+		if sc.Operation != op || !matchesAmount(sc, req.Amount) {
+			continue
+		}
+		if sc.CardNumber != "" && !contains(scheduled, i) {
+			continue
+		}
+		match = i
+		break
+	}
+	return s.respond(ctx, op, match, req.Reference, req.Reference)
+}
+
+// respond plays the matched scenario, or approves after the configured
+// latency and error rate when nothing matched. The key identifies the card or
+// payment a response sequence advances for.
+func (s *Simulator) respond(ctx context.Context, op Operation, match int, key, reference string) (Response, error) {
+	var sc Scenario
+	if match >= 0 {
+		sc = s.scenarios[match]
+	}
+
+	if err := sleep(ctx, s.config.Latency+sc.Latency); err != nil {
+		return Response{}, err
+	}
+	if sc.Timeout {
+		<-ctx.Done()
+		return Response{}, ErrTimeout
+	}
+
+	rate := s.config.ErrorRate
+	if sc.ErrorRate > 0 {
+		rate = sc.ErrorRate
+	}
+	s.mu.Lock()
+	failed := rate > 0 && s.rand.Float64() < rate
+	code := sc.Code
+	if len(sc.Sequence) > 0 {
+		attempt := fmt.Sprintf("%d:%s", match, key)
+		code = sc.Sequence[s.attempts[attempt]%len(sc.Sequence)]
+		s.attempts[attempt]++
+	}
+	s.mu.Unlock()
+	if failed {
+		return Response{}, ErrUnavailable
+	}
+
+	if code == "" || code == CodeApproved {
+		return Response{Reference: reference, Code: CodeApproved}, nil
+	}
+	return Response{Reference: reference, Code: code}, &DeclineError{op, code, reference}
+}
+
+func matchesAmount(sc Scenario, amount int) bool {
+	return sc.AmountSuffix == "" || strings.HasSuffix(fmt.Sprintf("%03d", amount), sc.AmountSuffix)
+}
+
+func contains(indexes []int, i int) bool {
+	for _, j := range indexes {
+		if j == i {
+			return true
+		}
+	}
+	return false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ErrTimeout
+	}
+}
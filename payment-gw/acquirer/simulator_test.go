@@ -0,0 +1,120 @@
+package acquirer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulatorDeclines(t *testing.T) {
+	s, err := NewSimulator(DefaultSimulatorConfig())
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	res, err := s.Authorize(ctx, AuthorizeRequest{Amount: 100, Card: Card{Number: "4000000000000119"}})
+	assert.True(t, errors.Is(err, ErrDeclined))
+	var decline *DeclineError
+	assert.True(t, errors.As(err, &decline))
+	assert.Equal(t, CodeDoNotHonor, decline.Code)
+	assert.Equal(t, OperationAuthorize, decline.Operation)
+	assert.NotEmpty(t, res.Reference)
+
+	res, err = s.Authorize(ctx, AuthorizeRequest{Amount: 100, Card: Card{Number: "4000000000000259"}})
+	assert.NoError(t, err)
+	assert.Equal(t, CodeApproved, res.Code)
+	_, err = s.Capture(ctx, Request{Reference: res.Reference, Amount: 100})
+	assert.True(t, errors.Is(err, ErrDeclined))
+	_, err = s.Void(ctx, Request{Reference: res.Reference, Amount: 100})
+	assert.NoError(t, err)
+
+	res, err = s.Authorize(ctx, AuthorizeRequest{Amount: 100, Card: Card{Number: "5555555555554444"}})
+	assert.NoError(t, err)
+	_, err = s.Capture(ctx, Request{Reference: res.Reference, Amount: 100})
+	assert.NoError(t, err)
+	_, err = s.Refund(ctx, Request{Reference: res.Reference, Amount: 100})
+	assert.NoError(t, err)
+}
+
+func TestSimulatorAmountSuffixAndSequence(t *testing.T) {
+	s, err := NewSimulator(SimulatorConfig{Scenarios: []Scenario{
+		{AmountSuffix: "51", Code: CodeInsufficientFunds},
+		{CardNumber: "4000000000000341", Sequence: []string{CodeIssuerUnavailable, CodeApproved}},
+	}})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	_, err = s.Authorize(ctx, AuthorizeRequest{Amount: 1051, Card: Card{Number: "5555555555554444"}})
+	var decline *DeclineError
+	assert.True(t, errors.As(err, &decline))
+	assert.Equal(t, CodeInsufficientFunds, decline.Code)
+	assert.False(t, decline.Soft())
+
+	_, err = s.Authorize(ctx, AuthorizeRequest{Amount: 1050, Card: Card{Number: "5555555555554444"}})
+	assert.NoError(t, err)
+
+	card := Card{Number: "4000000000000341"}
+	_, err = s.Authorize(ctx, AuthorizeRequest{Amount: 100, Card: card})
+	assert.True(t, errors.As(err, &decline))
+	assert.True(t, decline.Soft())
+	_, err = s.Authorize(ctx, AuthorizeRequest{Amount: 100, Card: card})
+	assert.NoError(t, err)
+	_, err = s.Authorize(ctx, AuthorizeRequest{Amount: 100, Card: card})
+	assert.True(t, errors.Is(err, ErrDeclined), "the sequence starts over")
+}
+
+func TestSimulatorLatencyAndTimeout(t *testing.T) {
+	s, err := NewSimulator(SimulatorConfig{Scenarios: []Scenario{
+		{CardNumber: "4000000000000408", Timeout: true},
+		{AmountSuffix: "77", Latency: 20 * time.Millisecond},
+	}})
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, err = s.Authorize(context.Background(), AuthorizeRequest{Amount: 177})
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.Authorize(ctx, AuthorizeRequest{Amount: 177})
+	assert.Equal(t, ErrTimeout, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.Authorize(ctx, AuthorizeRequest{Amount: 100, Card: Card{Number: "4000000000000408"}})
+	assert.Equal(t, ErrTimeout, err)
+}
+
+func TestSimulatorErrorRate(t *testing.T) {
+	s, err := NewSimulator(SimulatorConfig{ErrorRate: 0.5, Seed: 1})
+	assert.NoError(t, err)
+
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := s.Authorize(context.Background(), AuthorizeRequest{Amount: 100}); err != nil {
+			assert.Equal(t, ErrUnavailable, err)
+			failed++
+		}
+	}
+	assert.InDelta(t, 500, failed, 60)
+}
+
+func TestSimulatorScenariosFile(t *testing.T) {
+	c := SimulatorConfig{Scenarios: DefaultSimulatorConfig().Scenarios, ScenariosFile: "../testdata/scenarios.yaml"}
+	assert.NoError(t, c.Validate())
+	scenarios, err := c.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "authorization declined", scenarios[0].Name)
+	assert.Equal(t, OperationAuthorize, scenarios[len(c.Scenarios)].Operation, "operation defaults to authorize")
+
+	err = SimulatorConfig{ErrorRate: 2, Scenarios: []Scenario{
+		{Name: "broken", Operation: "settle", CardNumber: "4000", Code: "05", Sequence: []string{"91"}},
+	}}.Validate()
+	assert.Error(t, err)
+	for _, msg := range []string{"error_rate", "operation", "card_number", "code and sequence"} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
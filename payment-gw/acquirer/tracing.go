@@ -0,0 +1,60 @@
+package acquirer
+
+import (
+	"context"
+	"payment-gw/tracing"
+)
+
+type tracedAcquirer struct {
+	name string
+	next Acquirer
+}
+
+// NewTracedAcquirer records a client span for every call, name tells apart
+// several connectors of the same kind.
+func NewTracedAcquirer(name string, next Acquirer) Acquirer {
+	return tracedAcquirer{name: name, next: next}
+}
+
+func (t tracedAcquirer) Name() string {
+	return t.next.Name()
+}
+
+func (t tracedAcquirer) start(ctx context.Context, op Operation, paymentId string, amount int) (context.Context, *tracing.Span) {
+	return tracing.Start(ctx, "acquirer."+string(op), tracing.WithKind(tracing.KindClient), tracing.WithAttributes(
+		tracing.String("acquirer.name", t.name), tracing.String("acquirer.connector", t.next.Name()), tracing.String("payment.id", paymentId), tracing.Int("payment.amount", amount)))
+}
+
+func (t tracedAcquirer) end(span *tracing.Span, res Response, err error) {
+	span.SetAttributes(tracing.String("acquirer.reference", res.Reference), tracing.String("acquirer.code", res.Code))
+	span.RecordError(err)
+	span.End()
+}
+
+func (t tracedAcquirer) Authorize(ctx context.Context, req AuthorizeRequest) (Response, error) {
+	ctx, span := t.start(ctx, OperationAuthorize, req.PaymentId, req.Amount)
+	res, err := t.next.Authorize(ctx, req)
+	t.end(span, res, err)
+	return res, err
+}
+
+func (t tracedAcquirer) Capture(ctx context.Context, req Request) (Response, error) {
+	ctx, span := t.start(ctx, OperationCapture, req.PaymentId, req.Amount)
+	res, err := t.next.Capture(ctx, req)
+	t.end(span, res, err)
+	return res, err
+}
+
+func (t tracedAcquirer) Refund(ctx context.Context, req Request) (Response, error) {
+	ctx, span := t.start(ctx, OperationRefund, req.PaymentId, req.Amount)
+	res, err := t.next.Refund(ctx, req)
+	t.end(span, res, err)
+	return res, err
+}
+
+func (t tracedAcquirer) Void(ctx context.Context, req Request) (Response, error) {
+	ctx, span := t.start(ctx, OperationVoid, req.PaymentId, req.Amount)
+	res, err := t.next.Void(ctx, req)
+	t.end(span, res, err)
+	return res, err
+}
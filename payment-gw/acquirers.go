@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"payment-gw/acquirer"
+	"payment-gw/routing"
+)
+
+// newAcquirer builds the configured connectors and routes between them. The
+// links of ISO 8583 connectors are kept alive by a worker.
+func newAcquirer(c Config, workers *workerGroup) (acquirer.Acquirer, error) {
+	routes := make([]routing.Route, 0, len(c.Acquirers))
+	for _, ac := range c.Acquirers {
+		var conn acquirer.Acquirer
+		switch ac.Connector {
+		case "iso8583":
+			iso, err := acquirer.NewISO8583(ac.ISO8583)
+			if err != nil {
+				return nil, err
+			}
+			workers.Go("iso8583-"+ac.Name, iso.Run)
+			conn = iso
+		default:
+			simulator, err := acquirer.NewSimulator(ac.Simulator)
+			if err != nil {
+				return nil, err
+			}
+			conn = simulator
+		}
+		routes = append(routes, routing.Route{Name: ac.Name, Acquirer: acquirer.NewTracedAcquirer(ac.Name, conn), Cost: ac.Cost})
+	}
+	return routing.NewRouter(routing.Config{
+		AttemptTimeout: c.Routing.AttemptTimeout,
+		Reserve:        c.Routing.Reserve,
+		MinAttempt:     c.Routing.MinAttempt,
+		CircuitBreaker: c.Routing.CircuitBreaker,
+		Default:        c.Routing.Default,
+		Rules:          c.Routing.Rules,
+	}, routes...)
+}
+
+// respondWithFailure tells apart failures of the acquirer, where the outcome
+// of the operation is unknown, from internal errors. They carry an error_code
+// clients can act on, e.g. retry later while the circuit is open.
+func respondWithFailure(w http.ResponseWriter, err error) {
+	var status int
+	var code string
+	switch {
+	case errors.Is(err, routing.ErrCircuitOpen):
+		status, code = http.StatusServiceUnavailable, "acquirer_circuit_open"
+	case errors.Is(err, routing.ErrBudgetExhausted):
+		status, code = http.StatusGatewayTimeout, "deadline_exceeded"
+	case errors.Is(err, acquirer.ErrTimeout):
+		status, code = http.StatusGatewayTimeout, "acquirer_timeout"
+	case errors.Is(err, acquirer.ErrUnavailable):
+		status, code = http.StatusBadGateway, "acquirer_unavailable"
+	default:
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	respondWithJSON(w, status, map[string]string{"error": http.StatusText(status), "error_code": code})
+}
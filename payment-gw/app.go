@@ -2,12 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/cipher"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"payment-gw/dispute"
+	"payment-gw/events"
+	"payment-gw/fraud"
+	"payment-gw/fx"
 	"payment-gw/gateway"
+	"payment-gw/ledger"
 	"payment-gw/merchant"
-
+	"payment-gw/metrics"
+	"payment-gw/paymentlink"
+	"payment-gw/reconciliation"
+	"payment-gw/risk"
+	"payment-gw/settlement"
+	"payment-gw/threeds"
+	"payment-gw/tracing"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -25,77 +42,305 @@ var (
 )
 
 type App struct {
-	router   *mux.Router
-	db       *mongo.Client
-	lg       *zerolog.Logger
-	gateway  gateway.GatewayRepository
-	merchant merchant.MerchantRepository
-	dbname   string
-}
+	router         *mux.Router
+	db             *mongo.Client
+	lg             *zerolog.Logger
+	gateway        gateway.GatewayRepository
+	merchant       merchant.MerchantRepository
+	rates          fx.RateProvider
+	cards          cipher.AEAD
+	ledger         ledger.LedgerRepository
+	settlement     settlement.SettlementRepository
+	reconciliation reconciliation.ReconciliationRepository
+	dispute        dispute.DisputeRepository
+	events         events.EventRepository
+	risk           risk.RiskRepository
+	fraud          fraud.ScreeningRepository
+	threeds        threeds.ChallengeRepository
+	paymentLinks   paymentlink.LinkRepository
+	dbname         string
+	tracer         *tracing.Provider
+	workers        *workerGroup
+	server         *http.Server
+	cfg            Config
 
-type Config struct {
-	dbName     string
-	dbUsername string
-	dbPassword string
-	dbPort     string
+	shuttingDown int32
 }
 
-func (a *App) Initialize(c Config) {
-	a.dbname = c.dbName
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	credential := options.Credential{
-		Username: c.dbUsername,
-		Password: c.dbPassword,
+func (a *App) Initialize(c Config) error {
+	a.cfg = c
+	a.dbname = c.Mongo.Database
+
+	lg := log.With().Caller().Logger()
+	a.lg = &lg
+
+	a.workers = newWorkerGroup(a.lg)
+	acq, err := newAcquirer(c, a.workers)
+	if err != nil {
+		return err
 	}
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:"+c.dbPort).SetAuth(credential))
+
+	a.rates, err = newRateProvider(c)
 	if err != nil {
-		log.Fatal().Err(err).Msg("")
+		return err
 	}
 
-	err = client.Ping(ctx, readpref.Primary())
+	client, err := connectDB(c, a.lg)
 	if err != nil {
-		log.Fatal().Err(err).Msg("")
+		return err
 	}
 	a.db = client
 
-	lg := log.With().Caller().Logger()
-	a.lg = &lg
+	a.tracer = newTracerProvider(c)
+	tracing.SetProvider(a.tracer)
 
 	a.router = mux.NewRouter()
 	a.initializeRoutes()
-	a.gateway = gateway.NewRepository(a.db.Database(a.dbname))
-	a.merchant = merchant.NewRepository(a.db.Database(a.dbname))
+	a.cards, err = newCardCipher(c, a.lg)
+	if err != nil {
+		return err
+	}
+	a.gateway = gateway.NewTracedRepository(gateway.NewRepository(a.db.Database(a.dbname), acq, c.Fees, a.rates, a.cards))
+	a.merchant = merchant.NewTracedRepository(merchant.NewRepository(a.db.Database(a.dbname)))
+	a.ledger = ledger.NewTracedRepository(ledger.NewRepository(a.db.Database(a.dbname)))
+	if c.Ledger.CheckInterval > 0 {
+		a.workers.Go("ledger-checker", a.checkLedger)
+	}
+	a.settlement = settlement.NewTracedRepository(settlement.NewRepository(a.db.Database(a.dbname)))
+	if c.Settlement.Interval > 0 {
+		job, err := settlement.NewJob(a.db.Database(a.dbname), c.Settlement, settlement.SimulatedPayer{}, time.Now)
+		if err != nil {
+			return err
+		}
+		a.workers.Go("settlement", job.Run)
+	}
+	a.reconciliation = reconciliation.NewTracedRepository(reconciliation.NewRepository(a.db.Database(a.dbname), c.Reconciliation))
+	a.dispute = dispute.NewTracedRepository(dispute.NewRepository(a.db.Database(a.dbname), c.Disputes))
+	a.events = events.NewTracedRepository(events.NewRepository(a.db.Database(a.dbname)))
+	a.risk = risk.NewTracedRepository(risk.NewRepository(a.db.Database(a.dbname)))
+	if c.Fraud.FingerprintKey == "" {
+		a.lg.Warn().Msg("fraud.fingerprint_key is not set, card attempts are not counted across restarts and instances")
+	}
+	screening, err := fraud.NewRepository(a.db.Database(a.dbname), c.Fraud)
+	if err != nil {
+		return err
+	}
+	a.fraud = fraud.NewTracedRepository(screening)
+	a.threeds = threeds.NewTracedRepository(threeds.NewRepository(a.db.Database(a.dbname), c.ThreeDS))
+	a.paymentLinks = paymentlink.NewTracedRepository(paymentlink.NewRepository(a.db.Database(a.dbname), a.cfg.PaymentLinks))
+	if c.Reviews.ExpiryInterval > 0 {
+		a.workers.Go("review-expiry", a.expireReviews)
+	}
+	if c.Captures.Interval > 0 {
+		a.workers.Go("scheduled-captures", a.captureScheduled)
+	}
+	return nil
 }
 
-func (a *App) Run(addr string) {
-	log.Fatal().Err(http.ListenAndServe(addr, a.router))
-	defer func() {
-		if err := a.db.Disconnect(context.Background()); err != nil {
-			panic(err)
+// connectDB connects to Mongo and pings the primary. With connect_attempts
+// greater than one failed attempts are retried with exponential backoff, which
+// lets the application start before the database is up.
+func connectDB(c Config, lg *zerolog.Logger) (*mongo.Client, error) {
+	opts := options.Client().ApplyURI(c.Mongo.URI)
+	if c.Mongo.Username != "" {
+		opts.SetAuth(options.Credential{
+			Username: c.Mongo.Username,
+			Password: c.Mongo.Password,
+		})
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		client, err := tryConnectDB(opts, c.Mongo.ConnectTimeout)
+		if err == nil {
+			return client, nil
+		}
+		if attempt >= c.Mongo.ConnectAttempts {
+			return nil, fmt.Errorf("could not connect to the database after %d attempt(s): %w", attempt, err)
 		}
+		lg.Warn().Err(err).Int("attempt", attempt).Dur("retry_in", backoff).Msg("database is not available")
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func tryConnectDB(opts *options.ClientOptions, timeout time.Duration) (*mongo.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
+
+// Run serves HTTP on the configured address until the listener fails or the
+// process receives SIGINT or SIGTERM, then shuts the application down gracefully.
+func (a *App) Run() error {
+	addr := a.cfg.Server.ListenAddr
+	a.server = &http.Server{
+		Addr:              addr,
+		Handler:           a.router,
+		ReadTimeout:       a.cfg.Server.ReadTimeout,
+		ReadHeaderTimeout: a.cfg.Server.ReadTimeout,
+		WriteTimeout:      a.cfg.Server.WriteTimeout,
+		IdleTimeout:       a.cfg.Server.IdleTimeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if a.cfg.TLS.CertFile != "" {
+		tlsConfig, err := a.tlsConfig()
+		if err != nil {
+			return err
+		}
+		a.server.TLSConfig = tlsConfig
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		a.lg.Info().Str("addr", addr).Bool("tls", a.server.TLSConfig != nil).Msg("server started")
+		if a.server.TLSConfig != nil {
+			serverErr <- a.server.ListenAndServeTLS("", "")
+			return
+		}
+		serverErr <- a.server.ListenAndServe()
 	}()
+
+	var err error
+	select {
+	case err = <-serverErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	case <-ctx.Done():
+		a.lg.Info().Msg("shutdown signal received")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if shutdownErr := a.Shutdown(shutdownCtx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// Shutdown stops accepting requests, waits for in-flight requests to finish,
+// stops the background workers, flushes traces and closes the DB client. All
+// steps are attempted even if one of them fails and the first error is returned.
+func (a *App) Shutdown(ctx context.Context) error {
+	var firstErr error
+	step := func(name string, fn func(context.Context) error) {
+		if err := fn(ctx); err != nil {
+			a.lg.Error().Err(err).Str("step", name).Msg("shutdown")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	a.markShuttingDown()
+	if a.cfg.Server.DrainDelay > 0 {
+		a.lg.Info().Dur("delay", a.cfg.Server.DrainDelay).Msg("reporting not ready before closing the listener")
+		select {
+		case <-time.After(a.cfg.Server.DrainDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	if a.server != nil {
+		step("http server", a.server.Shutdown)
+	}
+	step("workers", a.workers.Stop)
+	step("tracer", a.tracer.Shutdown)
+	step("database", a.db.Disconnect)
+	a.lg.Info().Msg("shutdown complete")
+	return firstErr
 }
 
 func (a *App) initializeRoutes() {
 	xid := `.{20}`
+	reference := `[A-Za-z0-9_.:-]{1,64}`
+
+	a.router.Use(a.trace)
+	a.router.Use(a.measure)
+	if a.cfg.Features.Metrics {
+		a.router.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+	}
+	a.router.HandleFunc("/healthz", a.liveness).Methods(http.MethodGet)
+	a.router.HandleFunc("/readyz", a.readiness).Methods(http.MethodGet)
 
 	addLoggerRouter := a.router.NewRoute().Subrouter()
-	addLoggerRouter.HandleFunc("/merchant/register", a.register).Methods(http.MethodPost)
+	addLoggerRouter.HandleFunc("/merchant/register", traceHandler("register", a.register)).Methods(http.MethodPost)
+	addLoggerRouter.HandleFunc("/3ds/challenge/{challenge_id:"+xid+"}", traceHandler("challengePage", a.challengePage)).Methods(http.MethodGet)
+	addLoggerRouter.HandleFunc("/3ds/challenge/{challenge_id:"+xid+"}", traceHandler("completeChallenge", a.completeChallenge)).Methods(http.MethodPost)
+	addLoggerRouter.HandleFunc("/checkout/{link_id:"+xid+"}", traceHandler("checkoutPage", a.checkoutPage)).Methods(http.MethodGet)
+	addLoggerRouter.HandleFunc("/checkout/{link_id:"+xid+"}", traceHandler("checkout", a.checkout)).Methods(http.MethodPost)
 	addLoggerRouter.Use(a.addLogger)
 
 	needAuthenticationRouter := a.router.NewRoute().Subrouter()
-	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/authorize", a.authorize).Methods(http.MethodPost)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/authorize", traceHandler("authorize", a.authorize)).Methods(http.MethodPost)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/balance/{currency:[A-Z]{3}}", traceHandler("balance", a.balance)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/settlement-currency", traceHandler("getSettlementCurrency", a.getSettlementCurrency)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/settlement-currency", traceHandler("setSettlementCurrency", a.setSettlementCurrency)).Methods(http.MethodPut)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/settlements", traceHandler("listSettlements", a.listSettlements)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/settlements/{batch_id:"+xid+"}", traceHandler("getSettlement", a.getSettlement)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/payouts", traceHandler("listPayouts", a.listPayouts)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/disputes", traceHandler("listDisputes", a.listDisputes)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/disputes/{dispute_id:"+xid+"}", traceHandler("getDispute", a.getDispute)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/disputes/{dispute_id:"+xid+"}/evidence", traceHandler("addEvidence", a.addEvidence)).Methods(http.MethodPost)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/disputes/{dispute_id:"+xid+"}/submit", traceHandler("submitDispute", a.submitDispute)).Methods(http.MethodPost)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/events", traceHandler("listEvents", a.listEvents)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/reviews", traceHandler("listReviews", a.listReviews)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/payment-links", traceHandler("createPaymentLink", a.createPaymentLink)).Methods(http.MethodPost)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/payment-links", traceHandler("listPaymentLinks", a.listPaymentLinks)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/payment-links/{link_id:"+xid+"}", traceHandler("getPaymentLink", a.getPaymentLink)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/payment-links/{link_id:"+xid+"}/deactivate", traceHandler("deactivatePaymentLink", a.deactivatePaymentLink)).Methods(http.MethodPost)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/payments", traceHandler("listPayments", a.listPayments)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/payments/reference/{reference:"+reference+"}", traceHandler("getPaymentByReference", a.getPaymentByReference)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/connected-accounts", traceHandler("createConnectedAccount", a.createConnectedAccount)).Methods(http.MethodPost)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/connected-accounts", traceHandler("listConnectedAccounts", a.listConnectedAccounts)).Methods(http.MethodGet)
+	needAuthenticationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/transfers", traceHandler("listTransfers", a.listTransfers)).Methods(http.MethodGet)
 	needAuthenticationRouter.Use(a.addLogger)
-	needAuthenticationRouter.Use(a.needAuthentication)
+	needAuthenticationRouter.Use(traceMiddleware("needAuthentication", a.needAuthentication))
+
+	certificateRouter := a.router.NewRoute().Subrouter()
+	certificateRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/certificate", traceHandler("setCertificate", a.setCertificate)).Methods(http.MethodPut)
+	certificateRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/certificate", traceHandler("deleteCertificate", a.deleteCertificate)).Methods(http.MethodDelete)
+	certificateRouter.Use(a.addLogger)
+	certificateRouter.Use(traceMiddleware("needAuthentication", func(next http.Handler) http.Handler {
+		return a.needSecretKey(a.needClientCertificate(false, next))
+	}))
+
+	adminRouter := a.router.NewRoute().Subrouter()
+	adminRouter.HandleFunc("/reconciliations", traceHandler("reconcile", a.reconcile)).Methods(http.MethodPost)
+	adminRouter.HandleFunc("/reconciliations", traceHandler("listReconciliations", a.listReconciliations)).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/reconciliations/{run_id:"+xid+"}", traceHandler("getReconciliation", a.getReconciliation)).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/merchants/{merchant_id:"+xid+"}/risk", traceHandler("getRiskSettings", a.getRiskSettings)).Methods(http.MethodGet)
+	adminRouter.HandleFunc("/merchants/{merchant_id:"+xid+"}/risk", traceHandler("setRiskSettings", a.setRiskSettings)).Methods(http.MethodPut)
+	adminRouter.HandleFunc("/simulator/disputes", traceHandler("simulateDispute", a.simulateDispute)).Methods(http.MethodPost)
+	adminRouter.HandleFunc("/simulator/disputes/{dispute_id:"+xid+"}/decision", traceHandler("simulateDisputeDecision", a.simulateDisputeDecision)).Methods(http.MethodPost)
+	adminRouter.Use(a.addLogger)
+	adminRouter.Use(traceMiddleware("needAdminKey", a.needAdminKey))
 
 	needAutorizationRouter := a.router.NewRoute().Subrouter()
-	needAutorizationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/capture/{payment_id:"+xid+"}", a.capture).Methods(http.MethodPost)
-	needAutorizationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/refund/{payment_id:"+xid+"}", a.refund).Methods(http.MethodPost)
-	needAutorizationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/void/{payment_id:"+xid+"}", a.void).Methods(http.MethodPost)
+	needAutorizationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/confirm/{payment_id:"+xid+"}", traceHandler("confirm", a.confirm)).Methods(http.MethodPost)
+	needAutorizationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/capture/{payment_id:"+xid+"}", traceHandler("capture", a.capture)).Methods(http.MethodPost)
+	needAutorizationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/refund/{payment_id:"+xid+"}", traceHandler("refund", a.refund)).Methods(http.MethodPost)
+	needAutorizationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/void/{payment_id:"+xid+"}", traceHandler("void", a.void)).Methods(http.MethodPost)
+	needAutorizationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/payment/{payment_id:"+xid+"}", traceHandler("getPayment", a.getPayment)).Methods(http.MethodGet)
+	needAutorizationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/reviews/{payment_id:"+xid+"}/approve", traceHandler("approveReview", a.approveReview)).Methods(http.MethodPost)
+	needAutorizationRouter.HandleFunc("/merchant/{merchant_id:"+xid+"}/reviews/{payment_id:"+xid+"}/reject", traceHandler("rejectReview", a.rejectReview)).Methods(http.MethodPost)
 	needAutorizationRouter.Use(a.addLogger)
-	needAutorizationRouter.Use(a.needAuthentication)
-	needAutorizationRouter.Use(a.needAutorization)
+	needAutorizationRouter.Use(traceMiddleware("needAuthentication", a.needAuthentication))
+	needAutorizationRouter.Use(traceMiddleware("needAutorization", a.needAutorization))
 }
 
 func (a *App) collection(name string) *mongo.Collection {
@@ -103,6 +348,10 @@ func (a *App) collection(name string) *mongo.Collection {
 }
 
 func (a *App) needAuthentication(next http.Handler) http.Handler {
+	return a.needSecretKey(a.needClientCertificate(true, next))
+}
+
+func (a *App) needSecretKey(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		lg := r.Context().Value("logger").(*zerolog.Logger)
@@ -128,6 +377,72 @@ func (a *App) needAuthentication(next http.Handler) http.Handler {
 	})
 }
 
+// needClientCertificate rejects requests whose TLS client certificate does not
+// match the one registered by the merchant. Without requireRegistered,
+// merchants that have not registered a certificate yet are let through even
+// when client_auth is "require", so they are able to register one.
+func (a *App) needClientCertificate(requireRegistered bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lg := r.Context().Value("logger").(*zerolog.Logger)
+		merchantId := mux.Vars(r)["merchant_id"]
+
+		err := a.verifyClientCertificate(r, merchantId, requireRegistered)
+		if errors.Is(err, ErrClientCertificateMismatch) || errors.Is(err, ErrClientCertificateNotRegistered) {
+			lg.Debug().Msg(err.Error())
+			respondWithError(w, http.StatusForbidden, err.Error())
+			return
+		} else if err != nil {
+			lg.Error().Msg(err.Error())
+			respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// verifyClientCertificate checks that the certificate presented in the TLS
+// handshake is the one the merchant registered.
+func (a *App) verifyClientCertificate(r *http.Request, merchantId string, requireRegistered bool) error {
+	if a.cfg.TLS.ClientAuth == clientAuthNone || a.cfg.TLS.ClientAuth == "" {
+		return nil
+	}
+
+	expected, err := a.merchant.GetClientCertFingerprint(r.Context(), merchantId)
+	if err != nil {
+		return err
+	}
+	if expected == "" {
+		if requireRegistered && a.cfg.TLS.ClientAuth == clientAuthRequire {
+			return ErrClientCertificateNotRegistered
+		}
+		return nil
+	}
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ErrClientCertificateMismatch
+	}
+	if subtle.ConstantTimeCompare([]byte(certificateFingerprint(r.TLS.PeerCertificates[0])), []byte(expected)) != 1 {
+		return ErrClientCertificateMismatch
+	}
+	return nil
+}
+
+// needAdminKey lets through the requests of operators, which send the admin
+// key in the Authorization header.
+func (a *App) needAdminKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lg := r.Context().Value("logger").(*zerolog.Logger)
+		key := a.cfg.Admin.Key
+		if key == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(key)) != 1 {
+			lg.Debug().Msg(AdminKeyInvalid.Error())
+			respondWithError(w, http.StatusForbidden, AdminKeyInvalid.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (a *App) needAutorization(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -142,10 +457,19 @@ func (a *App) needAutorization(next http.Handler) http.Handler {
 			return
 		}
 
+		// platforms act on behalf of their connected accounts
 		if merchantId != merchantIdFromPayment {
-			lg.Debug().Msg(err.Error())
-			respondWithError(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
-			return
+			platformId, err := a.merchant.GetPlatformId(r.Context(), merchantIdFromPayment)
+			if err != nil {
+				lg.Error().Msg(err.Error())
+				respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+				return
+			}
+			if merchantId != platformId {
+				lg.Debug().Str("owner_id", merchantIdFromPayment).Msg("payment belongs to another merchant")
+				respondWithError(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+				return
+			}
 		}
 
 		next.ServeHTTP(w, r)
@@ -166,6 +490,10 @@ func (a *App) addLogger(next http.Handler) http.Handler {
 			sublog = sublog.With().Str("payment_id", paymentId).Logger()
 		}
 
+		if sc := tracing.SpanFromContext(r.Context()).SpanContext(); sc.IsValid() {
+			sublog = sublog.With().Str("trace_id", sc.TraceID.String()).Str("span_id", sc.SpanID.String()).Logger()
+		}
+
 		sublog.Debug().Str("method", r.Method).Str("url", r.URL.Path).Msg("")
 		ctx := context.WithValue(r.Context(), "logger", &sublog)
 		r = r.WithContext(ctx)
@@ -173,6 +501,18 @@ func (a *App) addLogger(next http.Handler) http.Handler {
 	})
 }
 
+// publicURL is the address of a page shoppers open, under the configured base
+// URL or else the address the request was sent to.
+func publicURL(r *http.Request, base, path string) string {
+	if base == "" {
+		base = "http://" + r.Host
+		if r.TLS != nil {
+			base = "https://" + r.Host
+		}
+	}
+	return base + path
+}
+
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]string{"error": message})
 }
@@ -2,13 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net/http"
+	"payment-gw/acquirer"
 	"payment-gw/gateway"
 	"testing"
 
 	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	authorizationFailureCardNumber = "4000000000000119"
+	captureFailureCardNumber       = "4000000000000259"
+	refundFailureCardNumber        = "4000000000003238"
 )
 
 type authorizationPayload struct {
@@ -96,6 +105,32 @@ func Test_AutorizationFailureCardNumber(t *testing.T) {
 	assert.Equal(t, gateway.ErrBasedOnCreditCardNumber.Error(), errorMessage)
 }
 
+func Test_AutorizationDeclineCode(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	p := createAuthorizationPayload(authorizationPayload{CardNumber: authorizationFailureCardNumber})
+	req, _ := http.NewRequest(http.MethodPost, "/merchant/"+merchantId+"/authorize", bytes.NewBuffer(p))
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(req)
+
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	declineCode, _ := j.GetString("decline_code")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Equal(t, acquirer.CodeDoNotHonor, declineCode)
+}
+
+func Test_AutorizationRecordsProcessorReference(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{}, merchantId, secretKey)
+
+	payment := gateway.Payment{}
+	err := a.collection(gateway.PaymentsCol).FindOne(context.Background(), bson.M{"id": paymentId}).Decode(&payment)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, payment.ProcessorReference)
+	assert.Equal(t, a.cfg.Acquirers[0].Name, payment.Acquirer)
+}
+
 func Test_AutorizationSuccess(t *testing.T) {
 	clearTable()
 	merchantId, secretKey := register(t)
@@ -4,34 +4,115 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"payment-gw/acquirer"
+	"payment-gw/fraud"
+	"payment-gw/fx"
 	"payment-gw/gateway"
-	"strconv"
+	"payment-gw/risk"
+	"payment-gw/threeds"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 	"gopkg.in/validator.v2"
 )
 
+// Statuses of a payment in the authorize and confirm responses, and of the
+// payments made with a payment link.
 const (
-	authorizationFailureCardNumber = "4000000000000119"
-	captureFailureCardNumber       = "4000000000000259"
-	refundFailureCardNumber        = "4000000000003238"
+	statusAuthorized     = "authorized"
+	statusCaptured       = "captured"
+	statusHeld           = "held"
+	statusRequiresAction = "requires_action"
 )
 
+// Capture modes of an authorization: captured later by the merchant, in the
+// same request, or by the scheduler some hours after it is authorized.
+const (
+	captureManual    = "manual"
+	captureAutomatic = "automatic"
+	captureDelayed   = "delayed"
+)
+
+type authorizeResponse struct {
+	Id                 string                    `json:"payment_id"`
+	Status             string                    `json:"status"`
+	AvailableToCapture string                    `json:"available_to_capture"`
+	AvailableToRefund  string                    `json:"available_to_refund"`
+	Currency           string                    `json:"currency"`
+	Screening          screeningResponse         `json:"screening"`
+	Authentication     *authenticationResponse   `json:"authentication,omitempty"`
+	NextAction         *nextActionResponse       `json:"next_action,omitempty"`
+	ExpiresAt          *time.Time                `json:"expires_at,omitempty"`
+	ScheduledCapture   *scheduledCaptureResponse `json:"scheduled_capture,omitempty"`
+	CaptureError       string                    `json:"capture_error,omitempty"`
+	DeclineCode        string                    `json:"decline_code,omitempty"`
+	detailsResponse
+}
+
+// authorizeRequest is a card payment to authorize, sent to the authorize
+// endpoint or entered on a checkout page.
+type authorizeRequest struct {
+	NameSurname string `json:"name_surname" validate:"regexp=^[A-Za-z]{1\\,16} [A-Za-z]{1\\,16}$"`
+	CardNumber  string `json:"card_number" validate:"regexp=^[0-9]{16}$"`
+	ExpiryMonth string `json:"expiry_month" validate:"regexp=^[0-9]{2}$"`
+	ExpiryYear  string `json:"expiry_year" validate:"regexp=^[0-9]{2}$"`
+	CCV         string `json:"CCV" validate:"regexp=^[0-9]{3}$"`
+	Amount      string `json:"amount" validate:"regexp=^[0-9]{1\\,10}[.][0-9]{2}$"`
+	Currency    string `json:"currency" validate:"regexp=^[A-Z]{3}$"`
+	ShopperIP   string `json:"shopper_ip,omitempty"`
+	Country     string `json:"country,omitempty" validate:"regexp=^([A-Z]{2})?$"`
+	ThreeDS     bool   `json:"three_ds,omitempty"`
+	Capture     string `json:"capture,omitempty" validate:"regexp=^(manual|automatic|delayed)?$"`
+	// CaptureDelayHours is the delay of a delayed capture
+	CaptureDelayHours int `json:"capture_delay_hours,omitempty"`
+	// Splits send parts of the captures to connected accounts of the merchant
+	Splits []splitRequest `json:"splits,omitempty"`
+	// Reference is the id of the payment for the merchant, unique per merchant
+	Reference           string            `json:"reference,omitempty" validate:"regexp=^([A-Za-z0-9_.:-]{1\\,64})?$"`
+	Description         string            `json:"description,omitempty" validate:"max=1000"`
+	StatementDescriptor string            `json:"statement_descriptor,omitempty" validate:"regexp=^([A-Za-z0-9 .*-]{5\\,22})?$"`
+	Metadata            map[string]string `json:"metadata,omitempty"`
+}
+
+func (req authorizeRequest) details() gateway.Details {
+	return gateway.Details{Reference: req.Reference, Description: req.Description, StatementDescriptor: req.StatementDescriptor, Metadata: req.Metadata}
+}
+
+// validate checks the fields of the request and returns its amount in minor
+// units.
+func (req authorizeRequest) validate(maxCaptureDelay time.Duration) (int, error) {
+	if err := validator.Validate(req); err != nil {
+		return 0, err
+	}
+	if req.ShopperIP != "" && net.ParseIP(req.ShopperIP) == nil {
+		return 0, errors.New("ShopperIP: invalid IP address")
+	}
+	if req.StatementDescriptor != "" && strings.IndexFunc(req.StatementDescriptor, unicode.IsLetter) < 0 {
+		return 0, errors.New("StatementDescriptor: needs at least one letter")
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		return 0, err
+	}
+	maxHours := int(maxCaptureDelay / time.Hour)
+	if req.Capture == captureDelayed && (req.CaptureDelayHours < 1 || req.CaptureDelayHours > maxHours) {
+		return 0, fmt.Errorf("CaptureDelayHours: must be between 1 and %d", maxHours)
+	}
+	if req.Capture != captureDelayed && req.CaptureDelayHours != 0 {
+		return 0, errors.New("CaptureDelayHours: only allowed with a delayed capture")
+	}
+	return parseMinorUnits(req.Amount)
+}
+
 func (a *App) authorize(w http.ResponseWriter, r *http.Request) {
 	lg := r.Context().Value("logger").(*zerolog.Logger)
 	w.Header().Set("Content-Type", "application/json")
-	req := struct {
-		NameSurname string `json:"name_surname" validate:"regexp=^[A-Za-z]{1\\,16} [A-Za-z]{1\\,16}$"`
-		CardNumber  string `json:"card_number" validate:"regexp=^[0-9]{16}$"`
-		ExpiryMonth string `json:"expiry_month" validate:"regexp=^[0-9]{2}$"`
-		ExpiryYear  string `json:"expiry_year" validate:"regexp=^[0-9]{2}$"`
-		CCV         string `json:"CCV" validate:"regexp=^[0-9]{3}$"`
-		Amount      string `json:"amount" validate:"regexp=^[0-9]{1\\,10}[.][0-9]{2}$"`
-		Currency    string `json:"currency" validate:"regexp=^[A-Z]{3}$"`
-	}{}
+	req := authorizeRequest{}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		lg.Debug().Msg(err.Error())
@@ -40,54 +121,227 @@ func (a *App) authorize(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if err := validator.Validate(req); err != nil {
+	amount, err := req.validate(a.cfg.Captures.MaxDelay)
+	if err != nil {
 		lg.Debug().Msg(err.Error())
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
 	defer cancel()
 
-	amount, err := strconv.ParseFloat(req.Amount, 64)
+	res, err := a.authorizePayment(ctx, r, mux.Vars(r)["merchant_id"], req, amount)
 	if err != nil {
-		lg.Debug().Msg(err.Error())
-		respondWithError(w, http.StatusBadRequest, err.Error())
+		respondWithAuthorizeError(w, err)
+		return
+	}
+	if res.Status == statusHeld || res.Status == statusRequiresAction {
+		respondWithJSON(w, http.StatusAccepted, res)
 		return
 	}
+	respondWithJSON(w, http.StatusOK, res)
+}
 
-	merchantId := mux.Vars(r)["merchant_id"]
-	id, err := a.gateway.Authorize(ctx, int(amount*100), req.Currency, merchantId, getMockFailure(req.CardNumber))
-	if errors.Is(gateway.ErrBasedOnCreditCardNumber, err) || errors.Is(gateway.ErrAmountIsZero, err) {
+// authorization is a screened payment on its way to the gateway: the
+// operation it goes through and the status the payment ends in.
+type authorization struct {
+	gwReq     gateway.AuthorizeRequest
+	status    string
+	authorize func(ctx context.Context, req gateway.AuthorizeRequest) (string, error)
+	expiresAt *time.Time
+}
+
+// operation is the name of the gateway operation in the metrics.
+func (auth authorization) operation() string {
+	return map[string]string{statusAuthorized: "authorize", statusHeld: "hold", statusRequiresAction: "require_action"}[auth.status]
+}
+
+// authorizePayment screens the payment, authenticates the shopper when asked
+// to and authorizes it, holds it for review or waits for the challenge. It is
+// captured right away or later as the request asks. The outcome is logged and
+// measured, errors are answered with respondWithAuthorizeError.
+func (a *App) authorizePayment(ctx context.Context, r *http.Request, merchantId string, req authorizeRequest, amount int) (authorizeResponse, error) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	splits, err := parseSplits(req.Splits)
+	if err == nil {
+		err = a.checkDestinations(ctx, merchantId, splits)
+	}
+	if errors.Is(err, gateway.ErrInvalidSplit) {
 		lg.Debug().Msg(err.Error())
-		respondWithError(w, http.StatusBadRequest, err.Error())
-		return
+		return authorizeResponse{}, err
 	}
 	if err != nil {
 		lg.Error().Msg(err.Error())
-		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return authorizeResponse{}, err
+	}
+
+	attempt, err := a.screen(ctx, lg, merchantId, req, amount)
+	if err != nil {
+		return authorizeResponse{}, err
+	}
+
+	card := acquirer.Card{Holder: req.NameSurname, Number: req.CardNumber, ExpiryMonth: req.ExpiryMonth, ExpiryYear: req.ExpiryYear, CVV: req.CCV}
+	auth := authorization{status: statusAuthorized, authorize: a.gateway.Authorize, gwReq: gateway.AuthorizeRequest{MerchantId: merchantId,
+		Amount: amount, Currency: req.Currency, Card: card, Screening: attempt.Screening, Splits: splits, Details: req.details()}}
+	if req.ThreeDS {
+		if err := a.authenticate(ctx, lg, attempt, req, &auth); err != nil {
+			return authorizeResponse{}, err
+		}
+	}
+	a.holdForReview(attempt, &auth)
+	scheduleCapture(req, &auth)
+
+	id, err := auth.authorize(ctx, auth.gwReq)
+	a.completeScreening(ctx, attempt, auth.status, err)
+	if err != nil {
+		logAuthorizeError(lg, auth.operation(), req.Currency, amount, err)
+		return authorizeResponse{}, err
+	}
+
+	res := authorizeResponse{Id: id, Status: auth.status, AvailableToCapture: req.Amount, AvailableToRefund: "0.00", Currency: req.Currency,
+		Screening: screeningResponse{attempt.Screening.Decision, attempt.Screening.Rules}, ExpiresAt: auth.expiresAt,
+		detailsResponse: createDetailsResponse(auth.gwReq.Details)}
+	if auth.gwReq.ScheduledCapture != nil {
+		res.ScheduledCapture = createScheduledCaptureResponse(*auth.gwReq.ScheduledCapture)
+	}
+	if auth.gwReq.Authentication != nil {
+		res.Authentication = createAuthenticationResponse(*auth.gwReq.Authentication)
+	}
+	if auth.status == statusRequiresAction {
+		challenge, err := a.threeds.Create(ctx, id, merchantId, req.CardNumber, amount, req.Currency)
+		if err != nil {
+			recordOperation(auth.operation(), req.Currency, amount, outcomeError)
+			lg.Error().Msg(err.Error())
+			// the shopper cannot authenticate the payment, nobody will
+			// confirm it
+			if _, err := a.gateway.Abandon(ctx, id); err != nil {
+				lg.Error().Str("payment_id", id).Msg("payment without a challenge not voided: " + err.Error())
+			}
+			return authorizeResponse{}, err
+		}
+		res.NextAction = &nextActionResponse{"redirect_to_url", a.challengeURL(r, challenge.Id), challenge.ExpiresAt}
+	}
+	recordOperation(auth.operation(), req.Currency, amount, outcomeSuccess)
+
+	if auth.status != statusAuthorized {
+		res.AvailableToCapture = "0.00"
+	}
+	if req.Capture == captureAutomatic && auth.status == statusAuthorized {
+		a.captureAuthorized(ctx, &res, amount)
+	}
+	return res, nil
+}
+
+// screen records the attempt and applies the fraud rules to it, blocked
+// attempts are rejected.
+func (a *App) screen(ctx context.Context, lg *zerolog.Logger, merchantId string, req authorizeRequest, amount int) (fraud.Attempt, error) {
+	attempt, err := a.fraud.Screen(ctx, fraud.NewAttempt(merchantId, req.CardNumber, req.ShopperIP, req.Country, amount, req.Currency))
+	if err != nil {
+		recordOperation("authorize", req.Currency, amount, outcomeError)
+		lg.Error().Msg(err.Error())
+		return fraud.Attempt{}, err
+	}
+	if attempt.Screening.Decision == fraud.DecisionBlock {
+		recordOperation("authorize", req.Currency, amount, outcomeRejected)
+		lg.Info().Str("attempt_id", attempt.Id).Strs("rules", attempt.Screening.Rules).Msg(fraud.ErrBlocked.Error())
+		return fraud.Attempt{}, fraud.ErrBlocked
+	}
+	return attempt, nil
+}
+
+// authenticate runs 3-D Secure: frictionless authentications go with the
+// authorization, challenges make the payment wait for the shopper.
+func (a *App) authenticate(ctx context.Context, lg *zerolog.Logger, attempt fraud.Attempt, req authorizeRequest, auth *authorization) error {
+	result := threeds.Authenticate(req.CardNumber)
+	switch result.Status {
+	case threeds.StatusFailed:
+		a.completeScreening(ctx, attempt, auth.status, gateway.ErrAuthenticationFailed)
+		recordOperation("authorize", req.Currency, auth.gwReq.Amount, outcomeRejected)
+		lg.Debug().Msg(gateway.ErrAuthenticationFailed.Error())
+		return gateway.ErrAuthenticationFailed
+	case threeds.StatusPending:
+		expiresAt := time.Now().Add(a.cfg.ThreeDS.ChallengeTimeout)
+		auth.status = statusRequiresAction
+		auth.authorize = func(ctx context.Context, req gateway.AuthorizeRequest) (string, error) {
+			return a.gateway.RequireAction(ctx, req, expiresAt)
+		}
+	default:
+		auth.gwReq.Authentication = &result
+	}
+	return nil
+}
+
+// holdForReview holds the payments the screening asked to review, the
+// acquirer authorizes them once approved. Payments waiting for a challenge
+// are held when it is completed.
+func (a *App) holdForReview(attempt fraud.Attempt, auth *authorization) {
+	if auth.status != statusAuthorized || attempt.Screening.Decision != fraud.DecisionReview {
 		return
 	}
+	at := time.Now().Add(a.cfg.Reviews.HoldTime).UTC()
+	auth.status, auth.expiresAt = statusHeld, &at
+	auth.authorize = func(ctx context.Context, req gateway.AuthorizeRequest) (string, error) {
+		return a.gateway.Hold(ctx, req, at)
+	}
+}
 
-	res := struct {
-		Id                 string `json:"payment_id"`
-		AvailableToCapture string `json:"available_to_capture"`
-		AvailableToRefund  string `json:"available_to_refund"`
-		Currency           string `json:"currency"`
-	}{id, req.Amount, "0.00", req.Currency}
+// scheduleCapture schedules the delayed captures. Automatic captures of
+// payments not authorized yet are made by the scheduler once they are.
+func scheduleCapture(req authorizeRequest, auth *authorization) {
+	switch now := time.Now(); {
+	case req.Capture == captureDelayed:
+		auth.gwReq.ScheduledCapture = gateway.NewScheduledCapture(time.Duration(req.CaptureDelayHours)*time.Hour, auth.status == statusAuthorized, now)
+	case req.Capture == captureAutomatic && auth.status != statusAuthorized:
+		auth.gwReq.ScheduledCapture = gateway.NewScheduledCapture(0, false, now)
+	}
+}
 
-	respondWithJSON(w, http.StatusOK, res)
+// logAuthorizeError logs and measures a failed gateway operation, the
+// declines and refusals at debug level.
+func logAuthorizeError(lg *zerolog.Logger, operation, currency string, amount int, err error) {
+	switch {
+	case errors.Is(err, gateway.ErrBasedOnCreditCardNumber):
+		recordOperation(operation, currency, amount, operationOutcome(err))
+		lg.Debug().Str("decline_code", declineCode(err)).Msg(err.Error())
+	case risk.Code(err) != "":
+		recordOperation(operation, currency, amount, operationOutcome(err))
+		lg.Debug().Str("error_code", risk.Code(err)).Msg(err.Error())
+	case errors.Is(err, gateway.ErrAmountIsZero), errors.Is(err, fx.ErrNoRate), errors.Is(err, gateway.ErrInvalidSplit),
+		errors.Is(err, gateway.ErrDuplicateReference):
+		recordOperation(operation, currency, amount, operationOutcome(err))
+		lg.Debug().Msg(err.Error())
+	default:
+		recordOperation(operation, currency, amount, outcomeError)
+		lg.Error().Msg(err.Error())
+	}
 }
 
-func getMockFailure(cardNumber string) gateway.MockFailure {
-	switch cardNumber {
-	case authorizationFailureCardNumber:
-		return gateway.AuthorizationFailure
-	case captureFailureCardNumber:
-		return gateway.CaptureFailure
-	case refundFailureCardNumber:
-		return gateway.RefundFailure
+// respondWithAuthorizeError answers an authorization that failed: declines,
+// limits and fraud blocks with their codes, the others as failures.
+func respondWithAuthorizeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fraud.ErrBlocked):
+		respondWithBlocked(w)
+	case errors.Is(err, gateway.ErrAuthenticationFailed):
+		respondWithAuthenticationFailed(w)
+	case errors.Is(err, gateway.ErrBasedOnCreditCardNumber):
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error(), "decline_code": declineCode(err)})
+	case risk.Code(err) != "":
+		respondWithLimitError(w, err)
+	case errors.Is(err, gateway.ErrDuplicateReference):
+		respondWithError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, gateway.ErrAmountIsZero), errors.Is(err, fx.ErrNoRate), errors.Is(err, gateway.ErrInvalidSplit):
+		respondWithError(w, http.StatusBadRequest, err.Error())
 	default:
-		return gateway.NoFailure
+		respondWithFailure(w, err)
+	}
+}
+
+func declineCode(err error) string {
+	var d *gateway.DeclineError
+	if errors.As(err, &d) {
+		return d.Code
 	}
+	return ""
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"payment-gw/metrics"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+var ledgerUnbalanced = metrics.NewGaugeVec("ledger_unbalanced_entries",
+	"Number of journal entries whose postings do not sum to zero, as of the last check.")
+
+type balanceResponse struct {
+	MerchantId string `json:"merchant_id"`
+	Currency   string `json:"currency"`
+	Pending    string `json:"pending"`
+	Available  string `json:"available"`
+}
+
+func formatMinorUnits(amount int) string {
+	return strconv.FormatFloat(float64(amount)/100, 'f', 2, 64)
+}
+
+// parseMinorUnits parses a decimal amount, rounding to the nearest minor unit
+// since most decimal amounts have no exact binary representation. An empty
+// amount is zero.
+func parseMinorUnits(amount string) (int, error) {
+	if amount == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Round(f * 100)), nil
+}
+
+func (a *App) balance(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	balance, err := a.ledger.Balance(ctx, mux.Vars(r)["merchant_id"], mux.Vars(r)["currency"])
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, balanceResponse{
+		MerchantId: balance.MerchantId,
+		Currency:   balance.Currency,
+		Pending:    formatMinorUnits(balance.Pending),
+		Available:  formatMinorUnits(balance.Available),
+	})
+}
+
+// checkLedger verifies every check interval that the books sum to zero.
+// Imbalances can only come from a bug, they are logged and exported as a
+// metric to alert on.
+func (a *App) checkLedger(ctx context.Context) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	ticker := time.NewTicker(a.cfg.Ledger.CheckInterval)
+	defer ticker.Stop()
+	for {
+		report, err := a.ledger.Check(ctx)
+		if err != nil && ctx.Err() == nil {
+			lg.Warn().Err(err).Msg("could not check the ledger")
+		} else if err == nil {
+			ledgerUnbalanced.WithLabelValues().Set(float64(len(report.Unbalanced)))
+			if !report.OK() {
+				lg.Error().Strs("entries", report.Unbalanced).Interface("totals", report.Totals).Msg("ledger does not balance")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"payment-gw/ledger"
+	"testing"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Balance(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{Amount: "10.00", Currency: "EUR"}, merchantId, secretKey)
+	code, _, _, _ := sendCaptureRequest("10.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	code, _, _, _ = sendRefundRequest("4.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	sendAuthorizationRequest(authorizationPayload{Amount: "5.00", Currency: "EUR"}, merchantId, secretKey)
+
+	req, _ := http.NewRequest(http.MethodGet, "/merchant/"+merchantId+"/balance/EUR", nil)
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	j, err := jsonvalue.Unmarshal(response.Body.Bytes())
+	assert.NoError(t, err)
+	pending, _ := j.GetString("pending")
+	available, _ := j.GetString("available")
+	assert.Equal(t, "6.00", pending, "authorizations are not booked, only captures and refunds")
+	assert.Equal(t, "0.00", available)
+
+	req, _ = http.NewRequest(http.MethodGet, "/merchant/"+merchantId+"/balance/USD", nil)
+	req.Header.Set("Authorization", secretKey)
+	response = executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, `{"merchant_id":"`+merchantId+`","currency":"USD","pending":"0.00","available":"0.00"}`, response.Body.String())
+
+	req, _ = http.NewRequest(http.MethodGet, "/merchant/"+merchantId+"/balance/EUR", nil)
+	req.Header.Set("Authorization", "wrong")
+	assert.Equal(t, http.StatusForbidden, executeRequest(req).Code)
+}
+
+func Test_LedgerBalances(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	for _, amount := range []string{"10.00", "0.99", "120.50"} {
+		_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{Amount: amount}, merchantId, secretKey)
+		sendCaptureRequest(amount, merchantId, paymentId, secretKey)
+		sendRefundRequest("0.50", merchantId, paymentId, secretKey)
+	}
+
+	report, err := a.ledger.Check(context.WithValue(context.Background(), "logger", a.lg))
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 6, report.Entries)
+}
+
+func Test_LedgerPostedOnce(t *testing.T) {
+	clearTable()
+	ctx := context.Background()
+	entries := ledger.CaptureEntries("payment", "merchant", "EUR", 1000, 0)
+
+	assert.NoError(t, ledger.Post(ctx, a.db.Database(a.dbname), "payment/1", entries...))
+	err := ledger.Post(ctx, a.db.Database(a.dbname), "payment/1", entries...)
+	assert.True(t, errors.Is(err, ledger.ErrPosted))
+}
@@ -0,0 +1,173 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateHalfOpen
+	StateOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateHalfOpen:
+		return "half-open"
+	case StateOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+type Outcome int
+
+const (
+	Success Outcome = iota
+	Failure
+	// Ignored releases the call without counting it, e.g. when the caller
+	// gave up on it.
+	Ignored
+)
+
+type Settings struct {
+	// FailureThreshold is the number of consecutive failures opening the
+	// circuit.
+	FailureThreshold int `yaml:"failure_threshold"`
+	// OpenTimeout is how long calls fail fast before trial calls are let
+	// through.
+	OpenTimeout time.Duration `yaml:"open_timeout"`
+	// HalfOpenRequests is the number of trial calls let through at once,
+	// all of them must succeed to close the circuit.
+	HalfOpenRequests int `yaml:"half_open_requests"`
+}
+
+// Breaker stops calls to a dependency after it kept failing and lets a few
+// trial calls through once OpenTimeout passed.
+type Breaker struct {
+	name     string
+	settings Settings
+	onChange func(name string, from, to State)
+	now      func() time.Time
+
+	mu        sync.Mutex
+	state     State
+	failures  int
+	successes int
+	inFlight  int
+	openedAt  time.Time
+	// generation changes with every transition
+	generation int
+}
+
+func New(name string, s Settings, onChange func(name string, from, to State)) *Breaker {
+	if s.FailureThreshold < 1 {
+		s.FailureThreshold = 1
+	}
+	if s.HalfOpenRequests < 1 {
+		s.HalfOpenRequests = 1
+	}
+	return &Breaker{name: name, settings: s, onChange: onChange, now: time.Now}
+}
+
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire()
+	return b.state
+}
+
+// Allow returns ErrOpen while calls must fail fast. Otherwise the caller has
+// to report the outcome of the call with done.
+func (b *Breaker) Allow() (done func(Outcome), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire()
+
+	switch b.state {
+	case StateOpen:
+		return nil, ErrOpen
+	case StateHalfOpen:
+		if b.inFlight >= b.settings.HalfOpenRequests {
+			return nil, ErrOpen
+		}
+		b.inFlight++
+	}
+
+	generation := b.generation
+	var once sync.Once
+	return func(outcome Outcome) {
+		once.Do(func() { b.record(generation, outcome) })
+	}, nil
+}
+
+func (b *Breaker) record(generation int, outcome Outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// outcomes of calls started before the last transition say nothing about
+	// the current state
+	if generation != b.generation {
+		return
+	}
+	if b.state == StateHalfOpen {
+		b.inFlight--
+	}
+	if outcome == Ignored {
+		return
+	}
+
+	switch b.state {
+	case StateClosed:
+		if outcome == Success {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.settings.FailureThreshold {
+			b.transition(StateOpen)
+		}
+	case StateHalfOpen:
+		if outcome == Failure {
+			b.transition(StateOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.settings.HalfOpenRequests {
+			b.transition(StateClosed)
+		}
+	}
+}
+
+func (b *Breaker) expire() {
+	if b.state == StateOpen && b.now().Sub(b.openedAt) >= b.settings.OpenTimeout {
+		b.transition(StateHalfOpen)
+	}
+}
+
+func (b *Breaker) transition(to State) {
+	from := b.state
+	b.state = to
+	b.generation++
+	b.failures = 0
+	b.successes = 0
+	b.inFlight = 0
+	if to == StateOpen {
+		b.openedAt = b.now()
+	}
+	if b.onChange != nil {
+		b.onChange(b.name, from, to)
+	}
+}
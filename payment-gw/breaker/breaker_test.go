@@ -0,0 +1,87 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type transition struct {
+	from, to State
+}
+
+func newTestBreaker(s Settings) (*Breaker, *time.Time, *[]transition) {
+	now := time.Unix(0, 0)
+	var transitions []transition
+	b := New("test", s, func(_ string, from, to State) {
+		transitions = append(transitions, transition{from, to})
+	})
+	b.now = func() time.Time { return now }
+	return b, &now, &transitions
+}
+
+func call(t *testing.T, b *Breaker, outcome Outcome) {
+	done, err := b.Allow()
+	assert.NoError(t, err)
+	done(outcome)
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b, _, transitions := newTestBreaker(Settings{FailureThreshold: 3, OpenTimeout: time.Minute})
+
+	call(t, b, Failure)
+	call(t, b, Failure)
+	call(t, b, Success)
+	call(t, b, Failure)
+	call(t, b, Failure)
+	assert.Equal(t, StateClosed, b.State(), "a success resets the count")
+	call(t, b, Ignored)
+	assert.Equal(t, StateClosed, b.State())
+
+	call(t, b, Failure)
+	assert.Equal(t, StateOpen, b.State())
+	_, err := b.Allow()
+	assert.Equal(t, ErrOpen, err)
+	assert.Equal(t, []transition{{StateClosed, StateOpen}}, *transitions)
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b, now, transitions := newTestBreaker(Settings{FailureThreshold: 1, OpenTimeout: time.Minute, HalfOpenRequests: 2})
+
+	call(t, b, Failure)
+	*now = now.Add(time.Minute)
+	assert.Equal(t, StateHalfOpen, b.State())
+
+	first, err := b.Allow()
+	assert.NoError(t, err)
+	second, err := b.Allow()
+	assert.NoError(t, err)
+	_, err = b.Allow()
+	assert.Equal(t, ErrOpen, err, "only HalfOpenRequests trial calls at once")
+
+	first(Success)
+	assert.Equal(t, StateHalfOpen, b.State())
+	second(Success)
+	assert.Equal(t, StateClosed, b.State())
+
+	call(t, b, Failure)
+	*now = now.Add(time.Minute)
+	call(t, b, Failure)
+	assert.Equal(t, StateOpen, b.State(), "a failed trial call opens the circuit again")
+
+	assert.Equal(t, []transition{
+		{StateClosed, StateOpen}, {StateOpen, StateHalfOpen}, {StateHalfOpen, StateClosed},
+		{StateClosed, StateOpen}, {StateOpen, StateHalfOpen}, {StateHalfOpen, StateOpen},
+	}, *transitions)
+}
+
+func TestBreakerIgnoresStaleOutcomes(t *testing.T) {
+	b, _, _ := newTestBreaker(Settings{FailureThreshold: 1, OpenTimeout: time.Minute})
+
+	slow, err := b.Allow()
+	assert.NoError(t, err)
+	call(t, b, Failure)
+	slow(Success)
+	assert.Equal(t, StateOpen, b.State())
+}
@@ -18,7 +18,12 @@ type captureResponse struct {
 	AvailableToCapture string `json:"available_to_capture"`
 	AvailableToRefund  string `json:"available_to_refund"`
 	Currency           string `json:"currency,omitempty"`
+	Fee                string `json:"fee,omitempty"`
+	Net                string `json:"net,omitempty"`
+	SettlementCurrency string `json:"settlement_currency,omitempty"`
+	SettlementNet      string `json:"settlement_net,omitempty"`
 	Error              string `json:"error,omitempty"`
+	DeclineCode        string `json:"decline_code,omitempty"`
 }
 
 func (a *App) capture(w http.ResponseWriter, r *http.Request) {
@@ -26,6 +31,8 @@ func (a *App) capture(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	req := struct {
 		Amount string `json:"amount" validate:"regexp=^[0-9]{1\\,10}[.][0-9]{2}$"`
+		// Splits replace the splits of the authorization for this capture
+		Splits []splitRequest `json:"splits"`
 	}{}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -41,53 +48,154 @@ func (a *App) capture(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
 	defer cancel()
 
-	amount, err := strconv.ParseFloat(req.Amount, 64)
+	amount, err := parseMinorUnits(req.Amount)
 	if err != nil {
 		lg.Debug().Msg(err.Error())
 		respondWithError(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
 		return
 	}
 
-	payment, err := a.gateway.Capture(ctx, mux.Vars(r)["payment_id"], int(amount*100))
+	paymentId := mux.Vars(r)["payment_id"]
+	splits, err := parseSplits(req.Splits)
+	if err == nil && splits != nil {
+		err = a.checkPaymentDestinations(ctx, paymentId, splits)
+	}
+	if errors.Is(err, gateway.ErrInvalidSplit) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	payment, err := a.gateway.Capture(ctx, paymentId, amount, splits)
 	res := createCaptureResponse(payment, err)
-	if errors.Is(gateway.ErrPaymentIsCancelled, err) || errors.Is(gateway.ErrAlreadyRefunded, err) ||
-		errors.Is(gateway.ErrAmountIsZero, err) || errors.Is(gateway.ErrCaptureToHigh, err) || errors.Is(gateway.ErrBasedOnCreditCardNumber, err) {
+	if errors.Is(err, gateway.ErrPaymentIsCancelled) || errors.Is(err, gateway.ErrAlreadyRefunded) || errors.Is(err, gateway.ErrInvalidSplit) ||
+		errors.Is(err, gateway.ErrPaymentOnHold) || errors.Is(err, gateway.ErrPaymentRequiresAction) ||
+		errors.Is(err, gateway.ErrAmountIsZero) || errors.Is(err, gateway.ErrCaptureToHigh) || errors.Is(err, gateway.ErrBasedOnCreditCardNumber) {
+		recordOperation("capture", payment.Currency, amount, operationOutcome(err))
 		lg.Debug().Msg(err.Error())
 		respondWithJSON(w, http.StatusBadRequest, res)
 		return
 	}
+	if errors.Is(err, gateway.ErrOperationInProgress) || errors.Is(err, gateway.ErrOptimisticLocking) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
 	if err != nil {
+		recordOperation("capture", payment.Currency, amount, outcomeError)
 		lg.Error().Msg(err.Error())
-		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		respondWithFailure(w, err)
 		return
 	}
+	recordOperation("capture", payment.Currency, amount, outcomeSuccess)
 
 	respondWithJSON(w, http.StatusOK, res)
 }
 
 func createCaptureResponse(p gateway.Payment, err error) captureResponse {
-	availableToRefund := float64(p.Captured-p.Refunded) / 100
+	availableToRefund := float64(p.Refundable()) / 100
 	availableToCapture := float64(p.Authorized-p.Captured) / 100
 
-	res := captureResponse{strconv.FormatFloat(availableToCapture, 'f', 2, 64), strconv.FormatFloat(availableToRefund, 'f', 2, 64), p.Currency, ""}
-	if errors.Is(gateway.ErrAlreadyRefunded, err) {
+	res := captureResponse{strconv.FormatFloat(availableToCapture, 'f', 2, 64), strconv.FormatFloat(availableToRefund, 'f', 2, 64), p.Currency, "", "", "", "", "", declineCode(err)}
+	if errors.Is(err, gateway.ErrAlreadyRefunded) {
 		res.Error = err.Error()
 		res.AvailableToCapture = "0.00"
 		return res
 	}
-	if errors.Is(gateway.ErrPaymentIsCancelled, err) {
+	if errors.Is(err, gateway.ErrPaymentIsCancelled) {
 		res.Error = err.Error()
 		res.AvailableToCapture = "0.00"
 		res.AvailableToRefund = "0.00"
 		return res
 	}
-	if errors.Is(gateway.ErrAmountIsZero, err) || errors.Is(gateway.ErrCaptureToHigh, err) || errors.Is(gateway.ErrBasedOnCreditCardNumber, err) {
+	if errors.Is(err, gateway.ErrAmountIsZero) || errors.Is(err, gateway.ErrCaptureToHigh) || errors.Is(err, gateway.ErrBasedOnCreditCardNumber) ||
+		errors.Is(err, gateway.ErrPaymentOnHold) || errors.Is(err, gateway.ErrPaymentRequiresAction) || errors.Is(err, gateway.ErrInvalidSplit) {
 		res.Error = err.Error()
 		return res
 	}
 
+	if err == nil {
+		res.Fee, res.Net = formatMinorUnits(p.Fees), formatMinorUnits(p.Net())
+		if p.Settlement.Currency != "" {
+			res.SettlementCurrency, res.SettlementNet = p.Settlement.Currency, formatMinorUnits(p.Settlement.Net())
+		}
+	}
 	return res
 }
+
+// checkPaymentDestinations makes sure the splits of a capture only send money
+// to connected accounts of the merchant of the payment, which is not the
+// merchant capturing it when a platform acts on behalf of it.
+func (a *App) checkPaymentDestinations(ctx context.Context, paymentId string, splits []gateway.Split) error {
+	merchantId, err := a.gateway.GetMerchantIdByPaymentId(ctx, paymentId)
+	if err != nil {
+		return err
+	}
+	return a.checkDestinations(ctx, merchantId, splits)
+}
+
+type scheduledCaptureResponse struct {
+	Status    string     `json:"status"`
+	CaptureAt *time.Time `json:"capture_at,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+func createScheduledCaptureResponse(c gateway.ScheduledCapture) *scheduledCaptureResponse {
+	res := &scheduledCaptureResponse{Status: c.Status, Error: c.Error}
+	if !c.At.IsZero() {
+		res.CaptureAt = &c.At
+	}
+	return res
+}
+
+// captureAuthorized makes the automatic capture of a payment authorized in the
+// same request. The authorization stands when the capture fails, the error is
+// returned along with it.
+func (a *App) captureAuthorized(ctx context.Context, res *authorizeResponse, amount int) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	p, err := a.gateway.Capture(ctx, res.Id, amount, nil)
+	if errors.Is(err, gateway.ErrBasedOnCreditCardNumber) {
+		recordOperation("capture", res.Currency, amount, operationOutcome(err))
+		lg.Debug().Str("decline_code", declineCode(err)).Msg(err.Error())
+		res.CaptureError, res.DeclineCode = err.Error(), declineCode(err)
+		return
+	}
+	if err != nil {
+		recordOperation("capture", res.Currency, amount, outcomeError)
+		lg.Error().Msg(err.Error())
+		res.CaptureError = err.Error()
+		return
+	}
+	recordOperation("capture", res.Currency, amount, outcomeSuccess)
+	res.Status, res.AvailableToCapture, res.AvailableToRefund = statusCaptured, "0.00", formatMinorUnits(p.Refundable())
+}
+
+// captureScheduled makes every capture interval the scheduled captures that
+// are due.
+func (a *App) captureScheduled(ctx context.Context) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	ticker := time.NewTicker(a.cfg.Captures.Interval)
+	defer ticker.Stop()
+	for {
+		captured, err := a.gateway.CaptureScheduled(ctx, time.Now())
+		if err != nil && ctx.Err() == nil {
+			lg.Warn().Err(err).Msg("could not make scheduled captures")
+		} else if captured > 0 {
+			lg.Info().Int("captured", captured).Msg("scheduled captures made")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
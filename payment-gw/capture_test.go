@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"payment-gw/fraud"
 	"payment-gw/gateway"
 	"testing"
+	"time"
 
 	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 func sendCaptureRequest(amount, merchantId, paymentId, secretKey string) (responseCode int, errorMessage, availableToCapture, availableToRefund string) {
@@ -82,6 +87,28 @@ func Test_CaptureFailureCardNumber(t *testing.T) {
 	assert.Equal(t, "0.00", availableToRefund)
 }
 
+func Test_OperationInProgress(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{CardNumber: captureFailureCardNumber, Amount: "10.00"}, merchantId, secretKey)
+	responseCode, _, _, _ := sendCaptureRequest("10.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, responseCode)
+	var payment gateway.Payment
+	assert.NoError(t, a.collection(gateway.PaymentsCol).FindOne(context.Background(), bson.M{"id": paymentId}).Decode(&payment))
+	assert.Empty(t, payment.InProgress, "a declined capture gives back its claim")
+
+	_, err := a.collection(gateway.PaymentsCol).UpdateOne(context.Background(), bson.M{"id": paymentId},
+		bson.M{"$set": bson.M{"inprogress": "capture"}, "$inc": bson.M{"version": 1}})
+	assert.NoError(t, err)
+	responseCode, errorMessage, _, _ := sendCaptureRequest("10.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusConflict, responseCode)
+	assert.Equal(t, gateway.ErrOperationInProgress.Error(), errorMessage)
+	responseCode, errorMessage, _, _ = sendVoidRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusConflict, responseCode)
+	assert.Equal(t, gateway.ErrOperationInProgress.Error(), errorMessage)
+}
+
 func Test_CaptureZeroAmount(t *testing.T) {
 	clearTable()
 	merchantId, secretKey := register(t)
@@ -128,3 +155,136 @@ func Test_CaptureRefundedTransaction(t *testing.T) {
 	assert.Equal(t, gateway.ErrAlreadyRefunded.Error(), errorMessage)
 	assert.Equal(t, http.StatusBadRequest, responseCode)
 }
+
+func sendCaptureModeAuthorization(p authorizationPayload, capture string, delayHours int, merchantId, secretKey string) (int, *jsonvalue.V) {
+	body := map[string]interface{}{}
+	json.Unmarshal(createAuthorizationPayload(p), &body)
+	body["capture"] = capture
+	if delayHours != 0 {
+		body["capture_delay_hours"] = delayHours
+	}
+	payload, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, "/merchant/"+merchantId+"/authorize", bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(req)
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	return response.Code, j
+}
+
+func Test_InvalidCaptureMode(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	for _, tt := range []struct {
+		capture    string
+		delayHours int
+	}{{"later", 0}, {"delayed", 0}, {"delayed", 1000}, {"automatic", 2}} {
+		code, _ := sendCaptureModeAuthorization(authorizationPayload{}, tt.capture, tt.delayHours, merchantId, secretKey)
+		assert.Equal(t, http.StatusBadRequest, code, tt.capture)
+	}
+}
+
+func Test_AutomaticCapture(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	code, j := sendCaptureModeAuthorization(authorizationPayload{}, "automatic", 0, merchantId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("status")
+	assert.Equal(t, "captured", status)
+	availableToCapture, _ := j.GetString("available_to_capture")
+	assert.Equal(t, "0.00", availableToCapture)
+	availableToRefund, _ := j.GetString("available_to_refund")
+	assert.Equal(t, "100.00", availableToRefund)
+
+	// the authorization stands when the capture is declined
+	code, j = sendCaptureModeAuthorization(authorizationPayload{CardNumber: captureFailureCardNumber}, "automatic", 0, merchantId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ = j.GetString("status")
+	assert.Equal(t, "authorized", status)
+	declineCode, _ := j.GetString("decline_code")
+	assert.NotEmpty(t, declineCode)
+	availableToCapture, _ = j.GetString("available_to_capture")
+	assert.Equal(t, "100.00", availableToCapture)
+}
+
+func Test_DelayedCapture(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	ctx := context.WithValue(context.Background(), "logger", a.lg)
+
+	code, j := sendCaptureModeAuthorization(authorizationPayload{}, "delayed", 2, merchantId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("scheduled_capture", "status")
+	assert.Equal(t, gateway.CaptureScheduled, status)
+	paymentId, _ := j.GetString("payment_id")
+
+	code, j = sendCaptureModeAuthorization(authorizationPayload{}, "delayed", 2, merchantId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	voidedId, _ := j.GetString("payment_id")
+	code, _, _, _ = sendVoidRequest(merchantId, voidedId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+
+	captured, err := a.gateway.CaptureScheduled(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, captured)
+
+	captured, err = a.gateway.CaptureScheduled(ctx, time.Now().Add(3*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, captured)
+
+	_, p := sendPaymentRequest(merchantId, paymentId, secretKey)
+	amount, _ := p.GetString("captured")
+	assert.Equal(t, "100.00", amount)
+	status, _ = p.GetString("scheduled_capture", "status")
+	assert.Equal(t, gateway.CaptureCaptured, status)
+
+	_, p = sendPaymentRequest(merchantId, voidedId, secretKey)
+	amount, _ = p.GetString("captured")
+	assert.Equal(t, "0.00", amount)
+	status, _ = p.GetString("scheduled_capture", "status")
+	assert.Equal(t, gateway.CaptureCancelled, status)
+}
+
+func Test_DelayedCaptureDeclined(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	ctx := context.WithValue(context.Background(), "logger", a.lg)
+
+	_, j := sendCaptureModeAuthorization(authorizationPayload{CardNumber: captureFailureCardNumber}, "delayed", 1, merchantId, secretKey)
+	paymentId, _ := j.GetString("payment_id")
+
+	captured, err := a.gateway.CaptureScheduled(ctx, time.Now().Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, captured)
+
+	_, p := sendPaymentRequest(merchantId, paymentId, secretKey)
+	status, _ := p.GetString("scheduled_capture", "status")
+	assert.Equal(t, gateway.CaptureFailed, status)
+	captureError, _ := p.GetString("scheduled_capture", "error")
+	assert.NotEmpty(t, captureError)
+}
+
+func Test_AutomaticCaptureOfHeldPayment(t *testing.T) {
+	clearTable()
+	withFraud(t, fraud.Config{Rules: []fraud.Rule{{Name: "large amount", When: "amount > 50", Action: fraud.DecisionReview}}})
+	merchantId, secretKey := register(t)
+	ctx := context.WithValue(context.Background(), "logger", a.lg)
+
+	code, j := sendCaptureModeAuthorization(authorizationPayload{}, "automatic", 0, merchantId, secretKey)
+	assert.Equal(t, http.StatusAccepted, code)
+	status, _ := j.GetString("scheduled_capture", "status")
+	assert.Equal(t, gateway.CaptureWaiting, status)
+	paymentId, _ := j.GetString("payment_id")
+
+	code, _ = sendRequest(http.MethodPost, "/merchant/"+merchantId+"/reviews/"+paymentId+"/approve", secretKey, []byte(`{"reviewer":"Jane Doe"}`))
+	assert.Equal(t, http.StatusOK, code)
+
+	captured, err := a.gateway.CaptureScheduled(ctx, time.Now().Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, captured)
+
+	_, p := sendPaymentRequest(merchantId, paymentId, secretKey)
+	amount, _ := p.GetString("captured")
+	assert.Equal(t, "100.00", amount)
+}
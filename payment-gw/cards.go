@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"payment-gw/gateway"
+
+	"github.com/rs/zerolog"
+)
+
+// newCardCipher encrypts the cards kept on payments with the configured key,
+// or with a random one that does not outlive the process.
+func newCardCipher(c Config, lg *zerolog.Logger) (cipher.AEAD, error) {
+	key, err := hex.DecodeString(c.Cards.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		lg.Warn().Msg("cards.encryption_key is not set, payments held for review or waiting for 3-D Secure cannot be authorized after a restart")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return gateway.NewCardCipher(key)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+type certificateResponse struct {
+	MerchantId  string `json:"merchant_id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// setCertificate registers the client certificate the merchant will present
+// when calling the API over mutual TLS. Either the PEM encoded certificate or
+// its SHA-256 fingerprint can be sent.
+func (a *App) setCertificate(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+	req := struct {
+		Certificate string `json:"certificate"`
+		Fingerprint string `json:"fingerprint"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	fingerprint, err := parseClientCertificate(req.Certificate, req.Fingerprint)
+	if err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	merchantId := mux.Vars(r)["merchant_id"]
+	if err := a.merchant.SetClientCertFingerprint(ctx, merchantId, fingerprint); err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, certificateResponse{merchantId, fingerprint})
+}
+
+func (a *App) deleteCertificate(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	merchantId := mux.Vars(r)["merchant_id"]
+	if err := a.merchant.SetClientCertFingerprint(ctx, merchantId, ""); err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, certificateResponse{merchantId, ""})
+}
+
+func parseClientCertificate(certificate, fingerprint string) (string, error) {
+	if (certificate == "") == (fingerprint == "") {
+		return "", ErrInvalidClientCertificate
+	}
+	if fingerprint != "" {
+		return normalizeFingerprint(fingerprint)
+	}
+
+	block, _ := pem.Decode([]byte(certificate))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", ErrInvalidClientCertificate
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", ErrInvalidClientCertificate
+	}
+	return certificateFingerprint(cert), nil
+}
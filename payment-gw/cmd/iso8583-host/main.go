@@ -0,0 +1,49 @@
+// Command iso8583-host runs the ISO 8583 card network host simulator the
+// iso8583 acquirer connector can be pointed at during development.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"payment-gw/iso8583"
+
+	"github.com/rs/zerolog/log"
+)
+
+type declines map[string]string
+
+func (d declines) String() string {
+	return fmt.Sprint(map[string]string(d))
+}
+
+func (d declines) Set(v string) error {
+	card, code, ok := strings.Cut(v, "=")
+	if !ok || len(code) != 2 {
+		return fmt.Errorf("expected card_number=response_code, got %q", v)
+	}
+	d[card] = code
+	return nil
+}
+
+func main() {
+	host := iso8583.NewHost()
+	listen := flag.String("listen", "localhost:8583", "address to listen on")
+	flag.DurationVar(&host.Latency, "latency", 0, "delay of every response")
+	flag.Var(declines(host.Declines), "decline", "decline authorizations of a card, as card_number=response_code; repeatable")
+	flag.Parse()
+
+	if err := host.Listen(*listen); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+	log.Info().Str("addr", host.Addr()).Msg("iso8583 host started")
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	host.Close()
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"payment-gw/acquirer"
+	"payment-gw/breaker"
+	"payment-gw/dispute"
+	"payment-gw/fraud"
+	"payment-gw/fx"
+	"payment-gw/paymentlink"
+	"payment-gw/pricing"
+	"payment-gw/reconciliation"
+	"payment-gw/routing"
+	"payment-gw/settlement"
+	"payment-gw/threeds"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
+)
+
+type MongoConfig struct {
+	URI             string        `yaml:"uri"`
+	Database        string        `yaml:"database"`
+	Username        string        `yaml:"username"`
+	Password        string        `yaml:"password"`
+	ConnectTimeout  time.Duration `yaml:"connect_timeout"`
+	ConnectAttempts int           `yaml:"connect_attempts"`
+}
+
+type ServerConfig struct {
+	ListenAddr      string        `yaml:"listen_addr"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	HandlerTimeout  time.Duration `yaml:"handler_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	DrainDelay      time.Duration `yaml:"drain_delay"`
+}
+
+type TLSConfig struct {
+	CertFile       string        `yaml:"cert_file"`
+	KeyFile        string        `yaml:"key_file"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	ClientAuth     string        `yaml:"client_auth"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+type TracingConfig struct {
+	Exporter     string `yaml:"exporter"`
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+}
+
+type AcquirerConfig struct {
+	Name      string                   `yaml:"name"`
+	Connector string                   `yaml:"connector"`
+	Cost      routing.Cost             `yaml:"cost"`
+	Simulator acquirer.SimulatorConfig `yaml:"simulator"`
+	ISO8583   acquirer.ISO8583Config   `yaml:"iso8583"`
+}
+
+type RoutingConfig struct {
+	AttemptTimeout time.Duration    `yaml:"attempt_timeout"`
+	Reserve        time.Duration    `yaml:"reserve"`
+	MinAttempt     time.Duration    `yaml:"min_attempt"`
+	CircuitBreaker breaker.Settings `yaml:"circuit_breaker"`
+	Default        []string         `yaml:"default"`
+	Rules          []routing.Rule   `yaml:"rules"`
+}
+
+type LedgerConfig struct {
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+// ReviewsConfig is the manual review of the payments the fraud screening
+// holds.
+type ReviewsConfig struct {
+	// HoldTime is how long a payment waits for a decision before it expires
+	HoldTime time.Duration `yaml:"hold_time"`
+	// ExpiryInterval is how often expired payments are declined
+	ExpiryInterval time.Duration `yaml:"expiry_interval"`
+}
+
+// CapturesConfig is the capture of the payments authorized with a delayed
+// capture.
+type CapturesConfig struct {
+	// MaxDelay is the longest delay of a capture, authorizations expire
+	// at the issuer after some days
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// Interval is how often due captures are made
+	Interval time.Duration `yaml:"interval"`
+}
+
+// CardsConfig encrypts the cards kept on payments until they are authorized,
+// the ones held for review or waiting for 3-D Secure.
+type CardsConfig struct {
+	// EncryptionKey is the AES-256 key of the card numbers as 64 hex digits,
+	// a random one is used when empty so the payments cannot be authorized
+	// after a restart
+	EncryptionKey string `yaml:"encryption_key"`
+}
+
+// AdminConfig protects the operator endpoints, they are disabled without a
+// key.
+type AdminConfig struct {
+	Key string `yaml:"key"`
+}
+
+type FeaturesConfig struct {
+	Metrics bool `yaml:"metrics"`
+}
+
+type Config struct {
+	Mongo          MongoConfig           `yaml:"mongo"`
+	Server         ServerConfig          `yaml:"server"`
+	TLS            TLSConfig             `yaml:"tls"`
+	Log            LogConfig             `yaml:"log"`
+	Tracing        TracingConfig         `yaml:"tracing"`
+	Acquirers      []AcquirerConfig      `yaml:"acquirers"`
+	Routing        RoutingConfig         `yaml:"routing"`
+	Fees           pricing.Config        `yaml:"fees"`
+	FX             fx.Config             `yaml:"fx"`
+	Ledger         LedgerConfig          `yaml:"ledger"`
+	Settlement     settlement.Config     `yaml:"settlement"`
+	Reconciliation reconciliation.Config `yaml:"reconciliation"`
+	Disputes       dispute.Config        `yaml:"disputes"`
+	Fraud          fraud.Config          `yaml:"fraud"`
+	Reviews        ReviewsConfig         `yaml:"reviews"`
+	Captures       CapturesConfig        `yaml:"captures"`
+	ThreeDS        threeds.Config        `yaml:"three_ds"`
+	PaymentLinks   paymentlink.Config    `yaml:"payment_links"`
+	Cards          CardsConfig           `yaml:"cards"`
+	Admin          AdminConfig           `yaml:"admin"`
+	Features       FeaturesConfig        `yaml:"features"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Mongo: MongoConfig{
+			URI:             "mongodb://localhost:27017",
+			Database:        "task",
+			ConnectTimeout:  5 * time.Second,
+			ConnectAttempts: 10,
+		},
+		Server: ServerConfig{
+			ListenAddr:      ":8080",
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    15 * time.Second,
+			IdleTimeout:     60 * time.Second,
+			HandlerTimeout:  3 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+			DrainDelay:      5 * time.Second,
+		},
+		TLS: TLSConfig{
+			ReloadInterval: 30 * time.Second,
+			ClientAuth:     clientAuthNone,
+		},
+		Log: LogConfig{
+			Level:  "debug",
+			Format: "json",
+		},
+		Tracing: TracingConfig{
+			Exporter:     "none",
+			OTLPEndpoint: "http://localhost:4318",
+		},
+		Acquirers: []AcquirerConfig{{
+			Name:      "simulator",
+			Connector: "simulator",
+			Simulator: acquirer.DefaultSimulatorConfig(),
+		}},
+		Routing: RoutingConfig{
+			AttemptTimeout: 2 * time.Second,
+			Reserve:        250 * time.Millisecond,
+			MinAttempt:     100 * time.Millisecond,
+			CircuitBreaker: breaker.Settings{
+				FailureThreshold: 5,
+				OpenTimeout:      30 * time.Second,
+				HalfOpenRequests: 1,
+			},
+		},
+		Ledger: LedgerConfig{
+			CheckInterval: time.Hour,
+		},
+		Settlement: settlement.Config{
+			Interval: time.Hour,
+			TimeZone: "UTC",
+		},
+		Reconciliation: reconciliation.Config{
+			TimeZone: "UTC",
+		},
+		Disputes: dispute.Config{
+			EvidenceDir:     "evidence",
+			MaxEvidenceSize: 5 << 20,
+			ResponseWindow:  7 * 24 * time.Hour,
+		},
+		Reviews: ReviewsConfig{
+			HoldTime:       24 * time.Hour,
+			ExpiryInterval: time.Minute,
+		},
+		Captures: CapturesConfig{
+			MaxDelay: 7 * 24 * time.Hour,
+			Interval: time.Minute,
+		},
+		ThreeDS: threeds.Config{
+			ChallengeTimeout: 10 * time.Minute,
+		},
+		PaymentLinks: paymentlink.Config{
+			DefaultExpiry:    24 * time.Hour,
+			MaxExpiry:        90 * 24 * time.Hour,
+			MaxFailures:      10,
+			MaxFailuresPerIP: 5,
+			FailureWindow:    time.Hour,
+		},
+		Features: FeaturesConfig{
+			Metrics: true,
+		},
+	}
+}
+
+// LoadConfig builds the configuration from defaults, an optional YAML file,
+// environment variables and command line flags, each source overriding the
+// previous one, and validates the result.
+func LoadConfig(args []string, getenv func(string) string) (Config, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("payment-gw", flag.ContinueOnError)
+	configFile := fs.String("config", getenv("PAYMENT_GW_CONFIG"), "path to a YAML configuration file")
+	var flags Config
+	fs.StringVar(&flags.Server.ListenAddr, "listen", "", "address to listen on, e.g. :8080")
+	fs.DurationVar(&flags.Server.HandlerTimeout, "handler-timeout", 0, "timeout of a single request handler")
+	fs.StringVar(&flags.Mongo.URI, "mongo-uri", "", "MongoDB connection string")
+	fs.StringVar(&flags.Mongo.Database, "mongo-database", "", "MongoDB database name")
+	fs.StringVar(&flags.Log.Level, "log-level", "", "log level: trace, debug, info, warn, error")
+	fs.StringVar(&flags.Log.Format, "log-format", "", "log format: json or console")
+	fs.StringVar(&flags.TLS.CertFile, "tls-cert", "", "path to the TLS certificate")
+	fs.StringVar(&flags.TLS.KeyFile, "tls-key", "", "path to the TLS private key")
+	fs.StringVar(&flags.TLS.ClientAuth, "tls-client-auth", "", "merchant client certificates: none, optional or require")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if *configFile != "" {
+		if err := c.loadFile(*configFile); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := c.loadEnv(getenv); err != nil {
+		return Config{}, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			c.Server.ListenAddr = flags.Server.ListenAddr
+		case "handler-timeout":
+			c.Server.HandlerTimeout = flags.Server.HandlerTimeout
+		case "mongo-uri":
+			c.Mongo.URI = flags.Mongo.URI
+		case "mongo-database":
+			c.Mongo.Database = flags.Mongo.Database
+		case "log-level":
+			c.Log.Level = flags.Log.Level
+		case "log-format":
+			c.Log.Format = flags.Log.Format
+		case "tls-cert":
+			c.TLS.CertFile = flags.TLS.CertFile
+		case "tls-key":
+			c.TLS.KeyFile = flags.TLS.KeyFile
+		case "tls-client-auth":
+			c.TLS.ClientAuth = flags.TLS.ClientAuth
+		}
+	})
+
+	if err := c.Validate(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv(getenv func(string) string) error {
+	var errs []string
+	str := func(name string, dst *string) {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	dur := func(name string, dst *time.Duration) {
+		if v := getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				return
+			}
+			*dst = d
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v := getenv(name); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				return
+			}
+			*dst = i
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v := getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+				return
+			}
+			*dst = b
+		}
+	}
+
+	// variables used by the docker-compose setup
+	if port := getenv("MONGO_PORT_NUMBER"); port != "" {
+		c.Mongo.URI = "mongodb://localhost:" + port
+	}
+	str("MONGO_ROOT_USERNAME", &c.Mongo.Username)
+	str("MONGO_ROOT_PASSWORD", &c.Mongo.Password)
+	if port := getenv("APP_PORT_NUMBER"); port != "" {
+		c.Server.ListenAddr = ":" + port
+	}
+
+	str("MONGO_URI", &c.Mongo.URI)
+	str("MONGO_DATABASE", &c.Mongo.Database)
+	str("MONGO_USERNAME", &c.Mongo.Username)
+	str("MONGO_PASSWORD", &c.Mongo.Password)
+	dur("MONGO_CONNECT_TIMEOUT", &c.Mongo.ConnectTimeout)
+	integer("MONGO_CONNECT_ATTEMPTS", &c.Mongo.ConnectAttempts)
+	str("LISTEN_ADDR", &c.Server.ListenAddr)
+	dur("READ_TIMEOUT", &c.Server.ReadTimeout)
+	dur("WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	dur("IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	dur("HANDLER_TIMEOUT", &c.Server.HandlerTimeout)
+	dur("SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+	dur("DRAIN_DELAY", &c.Server.DrainDelay)
+	str("TLS_CERT_FILE", &c.TLS.CertFile)
+	str("TLS_KEY_FILE", &c.TLS.KeyFile)
+	dur("TLS_RELOAD_INTERVAL", &c.TLS.ReloadInterval)
+	str("TLS_CLIENT_AUTH", &c.TLS.ClientAuth)
+	str("LOG_LEVEL", &c.Log.Level)
+	str("LOG_FORMAT", &c.Log.Format)
+	str("OTEL_TRACES_EXPORTER", &c.Tracing.Exporter)
+	str("OTEL_EXPORTER_OTLP_ENDPOINT", &c.Tracing.OTLPEndpoint)
+	str("FX_RATES_FILE", &c.FX.RatesFile)
+	str("DISPUTES_EVIDENCE_DIR", &c.Disputes.EvidenceDir)
+	str("THREE_DS_BASE_URL", &c.ThreeDS.BaseURL)
+	str("PAYMENT_LINKS_BASE_URL", &c.PaymentLinks.BaseURL)
+	str("ADMIN_KEY", &c.Admin.Key)
+	str("CARD_ENCRYPTION_KEY", &c.Cards.EncryptionKey)
+	str("FRAUD_FINGERPRINT_KEY", &c.Fraud.FingerprintKey)
+	boolean("FEATURE_METRICS", &c.Features.Metrics)
+
+	if len(errs) > 0 {
+		return errors.New("invalid environment: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Validate reports every problem found in the configuration at once, so a
+// broken deployment can be fixed in a single pass.
+func (c Config) Validate() error {
+	var errs []string
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if c.Mongo.URI == "" {
+		add("mongo.uri is required")
+	} else if err := validateMongoURI(c.Mongo.URI); err != nil {
+		add("mongo.uri is invalid: %v", err)
+	}
+	if c.Mongo.Database == "" {
+		add("mongo.database is required")
+	}
+	if c.Mongo.ConnectTimeout <= 0 {
+		add("mongo.connect_timeout must be positive")
+	}
+	if c.Mongo.ConnectAttempts < 1 {
+		add("mongo.connect_attempts must be at least 1")
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.ListenAddr); err != nil {
+		add("server.listen_addr %q is invalid: %v", c.Server.ListenAddr, err)
+	}
+	for name, d := range map[string]time.Duration{
+		"server.read_timeout":     c.Server.ReadTimeout,
+		"server.write_timeout":    c.Server.WriteTimeout,
+		"server.idle_timeout":     c.Server.IdleTimeout,
+		"server.handler_timeout":  c.Server.HandlerTimeout,
+		"server.shutdown_timeout": c.Server.ShutdownTimeout,
+	} {
+		if d <= 0 {
+			add("%s must be positive", name)
+		}
+	}
+	if c.Server.DrainDelay < 0 {
+		add("server.drain_delay must not be negative")
+	}
+	if c.Server.WriteTimeout > 0 && c.Server.HandlerTimeout >= c.Server.WriteTimeout {
+		add("server.handler_timeout (%s) must be shorter than server.write_timeout (%s)", c.Server.HandlerTimeout, c.Server.WriteTimeout)
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		add("tls.cert_file and tls.key_file must be set together")
+	}
+	for name, path := range map[string]string{"tls.cert_file": c.TLS.CertFile, "tls.key_file": c.TLS.KeyFile} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			add("%s: %v", name, err)
+		}
+	}
+	if c.TLS.CertFile != "" && c.TLS.ReloadInterval <= 0 {
+		add("tls.reload_interval must be positive")
+	}
+	switch c.TLS.ClientAuth {
+	case clientAuthNone:
+	case clientAuthOptional, clientAuthRequire:
+		if c.TLS.CertFile == "" {
+			add("tls.client_auth %q requires tls.cert_file and tls.key_file", c.TLS.ClientAuth)
+		}
+	default:
+		add("tls.client_auth must be none, optional or require, got %q", c.TLS.ClientAuth)
+	}
+
+	if _, err := zerolog.ParseLevel(c.Log.Level); err != nil || c.Log.Level == "" {
+		add("log.level %q is invalid", c.Log.Level)
+	}
+	if c.Log.Format != "json" && c.Log.Format != "console" {
+		add("log.format must be json or console, got %q", c.Log.Format)
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.OTLPEndpoint == "" {
+			add("tracing.otlp_endpoint is required with the otlp exporter")
+		}
+	default:
+		add("tracing.exporter must be none, stdout or otlp, got %q", c.Tracing.Exporter)
+	}
+
+	acquirers := map[string]bool{}
+	if len(c.Acquirers) == 0 {
+		add("at least one acquirer is required")
+	}
+	for i, acq := range c.Acquirers {
+		if acq.Name == "" {
+			add("acquirers[%d].name is required", i)
+		} else if acquirers[acq.Name] {
+			add("acquirers[%d].name %q is used twice", i, acq.Name)
+		}
+		acquirers[acq.Name] = true
+		switch acq.Connector {
+		case "simulator":
+			if err := acq.Simulator.Validate(); err != nil {
+				add("acquirers[%d].simulator: %v", i, err)
+			}
+		case "iso8583":
+			if err := acq.ISO8583.Validate(); err != nil {
+				add("acquirers[%d].iso8583: %v", i, err)
+			}
+		default:
+			add("acquirers[%d].connector must be simulator or iso8583, got %q", i, acq.Connector)
+		}
+		if acq.Cost.Percent < 0 || acq.Cost.Fixed < 0 {
+			add("acquirers[%d].cost must not be negative", i)
+		}
+	}
+
+	for name, d := range map[string]time.Duration{
+		"routing.attempt_timeout":              c.Routing.AttemptTimeout,
+		"routing.reserve":                      c.Routing.Reserve,
+		"routing.min_attempt":                  c.Routing.MinAttempt,
+		"routing.circuit_breaker.open_timeout": c.Routing.CircuitBreaker.OpenTimeout,
+	} {
+		if d < 0 {
+			add("%s must not be negative", name)
+		}
+	}
+	if c.Routing.Reserve+c.Routing.MinAttempt >= c.Server.HandlerTimeout {
+		add("routing.reserve and routing.min_attempt leave no time for the acquirer within server.handler_timeout")
+	}
+	if cb := c.Routing.CircuitBreaker; cb.FailureThreshold < 0 || cb.HalfOpenRequests < 0 {
+		add("routing.circuit_breaker thresholds must not be negative")
+	}
+	for _, name := range c.Routing.Default {
+		if !acquirers[name] {
+			add("routing.default: unknown acquirer %q", name)
+		}
+	}
+	for i, rule := range c.Routing.Rules {
+		if len(rule.Acquirers) == 0 {
+			add("routing.rules[%d].acquirers is required", i)
+		}
+		for _, name := range rule.Acquirers {
+			if !acquirers[name] {
+				add("routing.rules[%d]: unknown acquirer %q", i, name)
+			}
+		}
+		if rule.Strategy != "" && rule.Strategy != routing.StrategyOrdered && rule.Strategy != routing.StrategyCheapest {
+			add("routing.rules[%d].strategy must be ordered or cheapest, got %q", i, rule.Strategy)
+		}
+		if rule.MinAmount < 0 || rule.MaxAmount < 0 || rule.MaxAmount > 0 && rule.MaxAmount < rule.MinAmount {
+			add("routing.rules[%d]: invalid amount range", i)
+		}
+	}
+
+	if err := c.Fees.Validate(); err != nil {
+		add("fees: %v", err)
+	}
+	if c.Ledger.CheckInterval < 0 {
+		add("ledger.check_interval must not be negative")
+	}
+	if c.Settlement.Interval < 0 {
+		add("settlement.interval must not be negative")
+	}
+	if _, err := time.LoadLocation(c.Settlement.TimeZone); err != nil {
+		add("settlement.time_zone: %v", err)
+	}
+	if err := c.Reconciliation.Validate(); err != nil {
+		add("reconciliation: %v", err)
+	}
+	if err := c.Disputes.Validate(); err != nil {
+		add("disputes: %v", err)
+	}
+	if err := c.Fraud.Validate(); err != nil {
+		add("fraud: %v", err)
+	}
+	if c.Reviews.HoldTime <= 0 {
+		add("reviews.hold_time must be positive")
+	}
+	if c.Reviews.ExpiryInterval < 0 {
+		add("reviews.expiry_interval must not be negative")
+	}
+	if c.Captures.MaxDelay < time.Hour {
+		add("captures.max_delay must be at least 1h")
+	}
+	if c.Captures.Interval < 0 {
+		add("captures.interval must not be negative")
+	}
+	if err := c.ThreeDS.Validate(); err != nil {
+		add("three_ds: %v", err)
+	}
+	if err := c.PaymentLinks.Validate(); err != nil {
+		add("payment_links: %v", err)
+	}
+	if key, err := hex.DecodeString(c.Cards.EncryptionKey); err != nil || len(key) != 0 && len(key) != 32 {
+		add("cards.encryption_key must be 64 hex digits")
+	}
+	for name := range c.Reconciliation.Formats {
+		if !acquirers[name] {
+			add("reconciliation.formats: unknown acquirer %q", name)
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New("invalid configuration:\n  - " + strings.Join(errs, "\n  - "))
+	}
+	return nil
+}
+
+func (c Config) hasAcquirer(name string) bool {
+	for _, acq := range c.Acquirers {
+		if acq.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) simulatedAcquirer(name string) bool {
+	for _, acq := range c.Acquirers {
+		if acq.Name == name {
+			return acq.Connector == "simulator"
+		}
+	}
+	return false
+}
+
+// validateMongoURI checks the connection string without touching the network,
+// mongodb+srv:// URIs are only resolved when connecting.
+func validateMongoURI(uri string) error {
+	switch {
+	case strings.HasPrefix(uri, "mongodb://"):
+		return options.Client().ApplyURI(uri).Validate()
+	case strings.HasPrefix(uri, "mongodb+srv://"):
+		u, err := url.Parse(uri)
+		if err != nil {
+			return err
+		}
+		if u.Hostname() == "" || u.Port() != "" {
+			return errors.New("mongodb+srv:// requires a single host name without a port")
+		}
+		return nil
+	default:
+		return errors.New(`scheme must be "mongodb://" or "mongodb+srv://"`)
+	}
+}
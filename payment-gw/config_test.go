@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func envFrom(m map[string]string) func(string) string {
+	return func(key string) string {
+		return m[key]
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func Test_ConfigDefaults(t *testing.T) {
+	c, err := LoadConfig(nil, envFrom(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultConfig(), c)
+}
+
+func Test_ConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+mongo:
+  uri: mongodb+srv://cluster0.example.net/?retryWrites=true
+  database: payments
+server:
+  listen_addr: ":9000"
+  handler_timeout: 5s
+log:
+  level: info
+`)
+	env := envFrom(map[string]string{
+		"PAYMENT_GW_CONFIG": path,
+		"LISTEN_ADDR":       ":9100",
+		"LOG_LEVEL":         "warn",
+	})
+
+	c, err := LoadConfig([]string{"-log-level", "error"}, env)
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb+srv://cluster0.example.net/?retryWrites=true", c.Mongo.URI)
+	assert.Equal(t, "payments", c.Mongo.Database)
+	assert.Equal(t, 5*time.Second, c.Server.HandlerTimeout)
+	assert.Equal(t, ":9100", c.Server.ListenAddr)
+	assert.Equal(t, "error", c.Log.Level)
+}
+
+func Test_ConfigLegacyEnvironment(t *testing.T) {
+	c, err := LoadConfig(nil, envFrom(map[string]string{
+		"MONGO_ROOT_USERNAME": "root",
+		"MONGO_ROOT_PASSWORD": "rootpassword",
+		"MONGO_PORT_NUMBER":   "27020",
+		"APP_PORT_NUMBER":     "8081",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb://localhost:27020", c.Mongo.URI)
+	assert.Equal(t, "root", c.Mongo.Username)
+	assert.Equal(t, "rootpassword", c.Mongo.Password)
+	assert.Equal(t, ":8081", c.Server.ListenAddr)
+}
+
+func Test_ConfigUnknownFileField(t *testing.T) {
+	path := writeConfigFile(t, "server:\n  listen: \":9000\"\n")
+	_, err := LoadConfig([]string{"-config", path}, envFrom(nil))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "listen")
+}
+
+func Test_ConfigValidation(t *testing.T) {
+	_, err := LoadConfig([]string{"-handler-timeout", "20s", "-tls-cert", "cert.pem", "-log-format", "xml"}, envFrom(map[string]string{
+		"MONGO_URI":       "localhost:27017",
+		"DRAIN_DELAY":     "-1s",
+		"MONGO_DATABASE":  "",
+		"FEATURE_METRICS": "yes please",
+	}))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "FEATURE_METRICS")
+
+	_, err = LoadConfig([]string{"-handler-timeout", "20s", "-tls-cert", "cert.pem", "-log-format", "xml", "-mongo-uri", "localhost:27017"}, envFrom(nil))
+	assert.Error(t, err)
+	for _, msg := range []string{
+		"mongo.uri is invalid",
+		"server.handler_timeout (20s) must be shorter than server.write_timeout (15s)",
+		"tls.cert_file and tls.key_file must be set together",
+		"tls.cert_file: stat cert.pem",
+		`log.format must be json or console, got "xml"`,
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+
+	_, err = LoadConfig(nil, envFrom(map[string]string{"CARD_ENCRYPTION_KEY": "secret"}))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cards.encryption_key must be 64 hex digits")
+}
+
+func Test_ConfigExampleFile(t *testing.T) {
+	c, err := LoadConfig([]string{"-config", "config.example.yaml"}, envFrom(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultConfig().Acquirers, c.Acquirers)
+	assert.Equal(t, defaultConfig().Routing.AttemptTimeout, c.Routing.AttemptTimeout)
+	assert.Equal(t, defaultConfig().Routing.CircuitBreaker, c.Routing.CircuitBreaker)
+	assert.Empty(t, c.Routing.Default)
+	assert.Empty(t, c.Routing.Rules)
+}
+
+func Test_ConfigRoutingValidation(t *testing.T) {
+	path := writeConfigFile(t, `
+acquirers:
+  - name: primary
+    connector: simulator
+  - name: primary
+    connector: simulator
+routing:
+  default: [backup]
+  rules:
+    - currencies: [EUR]
+      acquirers: [primary, backup]
+      strategy: random
+`)
+	_, err := LoadConfig([]string{"-config", path}, envFrom(nil))
+	assert.Error(t, err)
+	for _, msg := range []string{
+		`acquirers[1].name "primary" is used twice`,
+		`routing.default: unknown acquirer "backup"`,
+		`routing.rules[0]: unknown acquirer "backup"`,
+		"routing.rules[0].strategy must be ordered or cheapest",
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
+
+func Test_ConfigISO8583Connector(t *testing.T) {
+	path := writeConfigFile(t, `
+acquirers:
+  - name: network
+    connector: iso8583
+    iso8583:
+      address: localhost:8583
+      terminal_id: PAYGW001
+      acceptor_id: PAYMENTGATEWAY
+      institution_id: "100001"
+      dial_timeout: 1s
+      echo_interval: 30s
+`)
+	c, err := LoadConfig([]string{"-config", path}, envFrom(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:8583", c.Acquirers[0].ISO8583.Address)
+	assert.Equal(t, time.Second, c.Acquirers[0].ISO8583.DialTimeout)
+
+	path = writeConfigFile(t, `
+acquirers:
+  - name: network
+    connector: iso8583
+    iso8583:
+      address: localhost
+  - name: other
+    connector: visanet
+`)
+	_, err = LoadConfig([]string{"-config", path}, envFrom(nil))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "acquirers[0].iso8583: address must be host:port")
+	assert.Contains(t, err.Error(), `acquirers[1].connector must be simulator or iso8583, got "visanet"`)
+}
+
+func Test_ConfigReconciliationFormats(t *testing.T) {
+	path := writeConfigFile(t, `
+reconciliation:
+  formats:
+    simulator:
+      delimiter: ";"
+      columns: {reference: TXN_REF, type: TXN_TYPE, amount: AMOUNT_MINOR, currency: CCY}
+      types: {SALE: capture, CREDIT: refund}
+      amounts: minor
+`)
+	c, err := LoadConfig([]string{"-config", path}, envFrom(map[string]string{"ADMIN_KEY": "secret"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", c.Admin.Key)
+	assert.Equal(t, "TXN_REF", c.Reconciliation.Formats["simulator"].Columns.Reference)
+
+	path = writeConfigFile(t, `
+reconciliation:
+  time_zone: Nowhere/Town
+  formats:
+    network:
+      delimiter: ","
+      columns: {reference: ref, type: type, amount: amount, currency: currency}
+      types: {SALE: capture}
+      amounts: cents
+`)
+	_, err = LoadConfig([]string{"-config", path}, envFrom(nil))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "reconciliation: formats.network: amounts must be decimal or minor")
+	assert.Contains(t, err.Error(), "time_zone: unknown time zone Nowhere/Town")
+	assert.Contains(t, err.Error(), `reconciliation.formats: unknown acquirer "network"`)
+}
+
+func Test_ConfigFraudRules(t *testing.T) {
+	path := writeConfigFile(t, `
+fraud:
+  rules:
+    - name: card velocity
+      when: attempts(card, 10m) >= 5
+      action: block
+`)
+	c, err := LoadConfig([]string{"-config", path}, envFrom(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "card velocity", c.Fraud.Rules[0].Name)
+
+	path = writeConfigFile(t, `
+fraud:
+  rules:
+    - name: card velocity
+      when: attempts(card, soon) >= 5
+      action: deny
+`)
+	_, err = LoadConfig([]string{"-config", path}, envFrom(nil))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "fraud: invalid rule")
+	assert.Contains(t, err.Error(), `rules[0].action must be review or block, got "deny"`)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"payment-gw/gateway"
+	"payment-gw/merchant"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"gopkg.in/validator.v2"
+)
+
+// splitRequest sends a part of a payment to a connected account, either an
+// amount or a percentage of the amount it comes with.
+type splitRequest struct {
+	Destination    string  `json:"destination" validate:"regexp=^[0-9a-v]{20}$"`
+	Amount         string  `json:"amount,omitempty" validate:"regexp=^([0-9]{1\\,10}[.][0-9]{2})?$"`
+	Percentage     float64 `json:"percentage,omitempty"`
+	ApplicationFee string  `json:"application_fee,omitempty" validate:"regexp=^([0-9]{1\\,10}[.][0-9]{2})?$"`
+}
+
+type connectedAccountResponse struct {
+	MerchantId string    `json:"merchant_id"`
+	PlatformId string    `json:"platform_id"`
+	Name       string    `json:"name,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type transferResponse struct {
+	PaymentId      string `json:"payment_id,omitempty"`
+	PlatformId     string `json:"platform_id,omitempty"`
+	Destination    string `json:"destination"`
+	Currency       string `json:"currency"`
+	Amount         string `json:"amount"`
+	ApplicationFee string `json:"application_fee"`
+	Net            string `json:"net"`
+	Reversed       string `json:"reversed"`
+}
+
+func createTransferResponse(p gateway.Payment, t gateway.Transfer) transferResponse {
+	return transferResponse{Destination: t.Destination, Currency: p.Currency, Amount: formatMinorUnits(t.Amount),
+		ApplicationFee: formatMinorUnits(t.ApplicationFee), Net: formatMinorUnits(t.Net()), Reversed: formatMinorUnits(t.Reversed)}
+}
+
+// parseSplits converts the splits of a request, nil when it has none.
+func parseSplits(reqs []splitRequest) ([]gateway.Split, error) {
+	if reqs == nil {
+		return nil, nil
+	}
+	splits := make([]gateway.Split, 0, len(reqs))
+	for _, req := range reqs {
+		if err := validator.Validate(req); err != nil {
+			return nil, fmt.Errorf("%w: %v", gateway.ErrInvalidSplit, err)
+		}
+		amount, err := parseMinorUnits(req.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", gateway.ErrInvalidSplit, err)
+		}
+		fee, err := parseMinorUnits(req.ApplicationFee)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", gateway.ErrInvalidSplit, err)
+		}
+		splits = append(splits, gateway.Split{Destination: req.Destination, Amount: amount, Percentage: req.Percentage, ApplicationFee: fee})
+	}
+	return splits, nil
+}
+
+// checkDestinations makes sure the splits only send money to connected
+// accounts of the platform.
+func (a *App) checkDestinations(ctx context.Context, platformId string, splits []gateway.Split) error {
+	for _, s := range splits {
+		id, err := a.merchant.GetPlatformId(ctx, s.Destination)
+		if err != nil && !errors.Is(err, merchant.ErrMerchantNotFound) {
+			return err
+		}
+		if err != nil || id != platformId {
+			return fmt.Errorf("%w: %s is not a connected account of the merchant", gateway.ErrInvalidSplit, s.Destination)
+		}
+	}
+	return nil
+}
+
+// createConnectedAccount onboards a merchant under the platform, it gets a
+// secret key of its own to see its balance, settlements and transfers.
+func (a *App) createConnectedAccount(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+	req := struct {
+		Name string `json:"name" validate:"max=200"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validator.Validate(req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	account, secretKey, err := a.merchant.Connect(ctx, mux.Vars(r)["merchant_id"], req.Name)
+	if errors.Is(err, merchant.ErrNotPlatform) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	res := struct {
+		connectedAccountResponse
+		SecretKey string `json:"secret_key"`
+	}{connectedAccountResponse{account.Id, account.PlatformId, account.Name, account.CreatedAt}, secretKey}
+	respondWithJSON(w, http.StatusCreated, res)
+}
+
+func (a *App) listConnectedAccounts(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	accounts, err := a.merchant.ListConnected(ctx, mux.Vars(r)["merchant_id"])
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	res := make([]connectedAccountResponse, 0, len(accounts))
+	for _, c := range accounts {
+		res = append(res, connectedAccountResponse{c.Id, c.PlatformId, c.Name, c.CreatedAt})
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// listTransfers reports to a connected account what it got from the payments
+// of its platform.
+func (a *App) listTransfers(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	accountId := mux.Vars(r)["merchant_id"]
+	payments, err := a.gateway.TransfersTo(ctx, accountId)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	res := []transferResponse{}
+	for _, p := range payments {
+		for _, t := range p.Transfers {
+			if t.Destination == accountId {
+				transfer := createTransferResponse(p, t)
+				transfer.PaymentId, transfer.PlatformId = p.Id, p.MerchantId
+				res = append(res, transfer)
+			}
+		}
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
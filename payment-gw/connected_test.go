@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"payment-gw/gateway"
+	"payment-gw/merchant"
+	"strings"
+	"testing"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/stretchr/testify/assert"
+)
+
+func connectAccount(t *testing.T, platformId, platformKey, name string) (string, string) {
+	code, j := sendRequest(http.MethodPost, "/merchant/"+platformId+"/connected-accounts", platformKey, []byte(`{"name":"`+name+`"}`))
+	assert.Equal(t, http.StatusCreated, code)
+	accountId, _ := j.GetString("merchant_id")
+	secretKey, _ := j.GetString("secret_key")
+	return accountId, secretKey
+}
+
+func sendSplitAuthorization(p authorizationPayload, splits, merchantId, secretKey string) (int, *jsonvalue.V) {
+	body := map[string]interface{}{}
+	json.Unmarshal(createAuthorizationPayload(p), &body)
+	body["splits"] = json.RawMessage(splits)
+	payload, _ := json.Marshal(body)
+	return sendRequest(http.MethodPost, "/merchant/"+merchantId+"/authorize", secretKey, payload)
+}
+
+func pendingBalance(t *testing.T, merchantId, secretKey, currency string) string {
+	code, j := sendRequest(http.MethodGet, "/merchant/"+merchantId+"/balance/"+currency, secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	pending, _ := j.GetString("pending")
+	return pending
+}
+
+func Test_ConnectedAccounts(t *testing.T) {
+	clearTable()
+	platformId, platformKey := register(t)
+	sellerId, sellerKey := connectAccount(t, platformId, platformKey, "Seller One")
+
+	code, j := sendRequest(http.MethodGet, "/merchant/"+platformId+"/connected-accounts", platformKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, j.Len())
+	id, _ := j.GetString(0, "merchant_id")
+	assert.Equal(t, sellerId, id)
+	name, _ := j.GetString(0, "name")
+	assert.Equal(t, "Seller One", name)
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+sellerId+"/balance/USD", sellerKey, nil)
+	assert.Equal(t, http.StatusOK, code, "a connected account has a key of its own")
+
+	code, j = sendRequest(http.MethodPost, "/merchant/"+sellerId+"/connected-accounts", sellerKey, []byte(`{}`))
+	assert.Equal(t, http.StatusConflict, code)
+	message, _ := j.GetString("error")
+	assert.Equal(t, merchant.ErrNotPlatform.Error(), message)
+}
+
+func Test_InvalidSplits(t *testing.T) {
+	clearTable()
+	platformId, platformKey := register(t)
+	sellerId, _ := connectAccount(t, platformId, platformKey, "Seller")
+	otherId, _ := register(t)
+
+	for _, splits := range []string{
+		`[{"destination":"` + otherId + `","amount":"10.00"}]`,
+		`[{"destination":"` + platformId + `","amount":"10.00"}]`,
+		`[{"destination":"` + sellerId + `"}]`,
+		`[{"destination":"` + sellerId + `","amount":"10.00","percentage":10}]`,
+		`[{"destination":"` + sellerId + `","percentage":101}]`,
+		`[{"destination":"` + sellerId + `","amount":"80.00"},{"destination":"` + sellerId + `","percentage":30}]`,
+		`[{"destination":"` + sellerId + `","amount":"10.00","application_fee":"10.01"}]`,
+		`[{"destination":"` + sellerId + `","amount":"10"}]`,
+	} {
+		code, j := sendSplitAuthorization(authorizationPayload{Amount: "100.00"}, splits, platformId, platformKey)
+		assert.Equal(t, http.StatusBadRequest, code, splits)
+		message, _ := j.GetString("error")
+		assert.True(t, strings.HasPrefix(message, gateway.ErrInvalidSplit.Error()), message)
+	}
+}
+
+func Test_SplitPayment(t *testing.T) {
+	clearTable()
+	platformId, platformKey := register(t)
+	sellerId, sellerKey := connectAccount(t, platformId, platformKey, "Seller")
+	courierId, courierKey := connectAccount(t, platformId, platformKey, "Courier")
+
+	code, j := sendSplitAuthorization(authorizationPayload{Amount: "100.00"}, `[
+		{"destination":"`+sellerId+`","percentage":60,"application_fee":"5.00"},
+		{"destination":"`+courierId+`","amount":"20.00"}]`, platformId, platformKey)
+	assert.Equal(t, http.StatusOK, code)
+	paymentId, _ := j.GetString("payment_id")
+
+	code, _, _, _ = sendCaptureRequest("100.00", platformId, paymentId, platformKey)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "55.00", pendingBalance(t, sellerId, sellerKey, "USD"))
+	assert.Equal(t, "20.00", pendingBalance(t, courierId, courierKey, "USD"))
+	assert.Equal(t, "25.00", pendingBalance(t, platformId, platformKey, "USD"))
+
+	code, _, _, _ = sendRefundRequest("50.00", platformId, paymentId, platformKey)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "27.50", pendingBalance(t, sellerId, sellerKey, "USD"), "refunds reverse the transfers proportionally")
+	assert.Equal(t, "10.00", pendingBalance(t, courierId, courierKey, "USD"))
+	assert.Equal(t, "12.50", pendingBalance(t, platformId, platformKey, "USD"))
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+sellerId+"/transfers", sellerKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, j.Len())
+	for field, value := range map[string]string{"payment_id": paymentId, "platform_id": platformId, "amount": "60.00",
+		"application_fee": "5.00", "net": "55.00", "reversed": "27.50"} {
+		got, _ := j.GetString(0, field)
+		assert.Equal(t, value, got, field)
+	}
+
+	code, j = sendPaymentRequest(platformId, paymentId, platformKey)
+	assert.Equal(t, http.StatusOK, code)
+	splits, _ := j.GetArray("splits")
+	assert.Equal(t, 2, splits.Len())
+	transfers, _ := j.GetArray("transfers")
+	assert.Equal(t, 2, transfers.Len())
+}
+
+func Test_SplitsOfCapture(t *testing.T) {
+	clearTable()
+	platformId, platformKey := register(t)
+	sellerId, sellerKey := connectAccount(t, platformId, platformKey, "Seller")
+
+	code, j := sendSplitAuthorization(authorizationPayload{Amount: "100.00"}, `[{"destination":"`+sellerId+`","amount":"50.00"}]`, platformId, platformKey)
+	assert.Equal(t, http.StatusOK, code)
+	paymentId, _ := j.GetString("payment_id")
+
+	code, _, _, _ = sendCaptureRequest("40.00", platformId, paymentId, platformKey)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "20.00", pendingBalance(t, sellerId, sellerKey, "USD"), "the splits of the authorization scale to the capture")
+
+	payload := []byte(`{"amount":"60.00","splits":[{"destination":"` + sellerId + `","amount":"10.00","application_fee":"1.00"}]}`)
+	code, _ = sendRequest(http.MethodPost, "/merchant/"+platformId+"/capture/"+paymentId, platformKey, payload)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "29.00", pendingBalance(t, sellerId, sellerKey, "USD"))
+	assert.Equal(t, "71.00", pendingBalance(t, platformId, platformKey, "USD"))
+}
+
+func Test_PlatformActsOnBehalfOfConnectedAccount(t *testing.T) {
+	clearTable()
+	platformId, platformKey := register(t)
+	sellerId, sellerKey := connectAccount(t, platformId, platformKey, "Seller")
+	otherId, otherKey := register(t)
+
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{Amount: "30.00"}, sellerId, sellerKey)
+
+	code, _, _, _ := sendCaptureRequest("30.00", platformId, paymentId, platformKey)
+	assert.Equal(t, http.StatusOK, code)
+	code, j := sendPaymentRequest(platformId, paymentId, platformKey)
+	assert.Equal(t, http.StatusOK, code)
+	owner, _ := j.GetString("merchant_id")
+	assert.Equal(t, sellerId, owner)
+
+	code, _ = sendPaymentRequest(otherId, paymentId, otherKey)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	_, _, platformPayment, _, _ := sendAuthorizationRequest(authorizationPayload{Amount: "30.00"}, platformId, platformKey)
+	code, _ = sendPaymentRequest(sellerId, platformPayment, sellerKey)
+	assert.Equal(t, http.StatusForbidden, code, "connected accounts do not act on behalf of their platform")
+}
+
+func Test_LostDisputeReversesTransfers(t *testing.T) {
+	clearTable()
+	platformId, platformKey := register(t)
+	sellerId, sellerKey := connectAccount(t, platformId, platformKey, "Seller")
+
+	code, j := sendSplitAuthorization(authorizationPayload{Amount: "100.00"}, `[{"destination":"`+sellerId+`","percentage":60}]`, platformId, platformKey)
+	assert.Equal(t, http.StatusOK, code)
+	paymentId, _ := j.GetString("payment_id")
+	code, _, _, _ = sendCaptureRequest("100.00", platformId, paymentId, platformKey)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "60.00", pendingBalance(t, sellerId, sellerKey, "USD"))
+
+	disputeId := openDispute(t, paymentId, "13.1")
+	assert.Equal(t, http.StatusOK, decideDispute(disputeId, "lost"))
+	assert.Equal(t, "0.00", pendingBalance(t, sellerId, sellerKey, "USD"), "a lost dispute reverses the transfers like a refund")
+	assert.Equal(t, "0.00", pendingBalance(t, platformId, platformKey, "USD"))
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+sellerId+"/transfers", sellerKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	reversed, _ := j.GetString(0, "reversed")
+	assert.Equal(t, "60.00", reversed)
+}
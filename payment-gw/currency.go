@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"payment-gw/fx"
+	"payment-gw/merchant"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"gopkg.in/validator.v2"
+)
+
+type settlementCurrencyResponse struct {
+	MerchantId         string `json:"merchant_id"`
+	SettlementCurrency string `json:"settlement_currency"`
+}
+
+// newRateProvider reads the rate table of the configuration, without one
+// payments are only accepted in the settlement currency of the merchant.
+func newRateProvider(c Config) (fx.RateProvider, error) {
+	if c.FX.RatesFile == "" {
+		return fx.NoRates{}, nil
+	}
+	return fx.LoadTable(c.FX.RatesFile)
+}
+
+func (a *App) getSettlementCurrency(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	merchantId := mux.Vars(r)["merchant_id"]
+	currency, err := a.merchant.GetSettlementCurrency(ctx, merchantId)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, settlementCurrencyResponse{merchantId, currency})
+}
+
+// setSettlementCurrency sets the currency the merchant is paid in. Payments
+// authorized afterwards in other currencies are converted to it, an empty
+// currency settles payments in the currency they were made in.
+func (a *App) setSettlementCurrency(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+	req := struct {
+		Currency string `json:"settlement_currency" validate:"regexp=^([A-Z]{3})?$"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validator.Validate(req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	merchantId := mux.Vars(r)["merchant_id"]
+	if err := a.merchant.SetSettlementCurrency(ctx, merchantId, req.Currency); errors.Is(err, merchant.ErrMerchantNotFound) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, settlementCurrencyResponse{merchantId, req.Currency})
+}
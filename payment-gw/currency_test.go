@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SettlementCurrency(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	code, j := sendRequest(http.MethodGet, "/merchant/"+merchantId+"/settlement-currency", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	currency, _ := j.GetString("settlement_currency")
+	assert.Equal(t, "", currency)
+
+	code, _ = sendRequest(http.MethodPut, "/merchant/"+merchantId+"/settlement-currency", secretKey, []byte(`{"settlement_currency":"eur"}`))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = sendRequest(http.MethodPut, "/merchant/"+merchantId+"/settlement-currency", secretKey, []byte(`{"settlement_currency":"EUR"}`))
+	assert.Equal(t, http.StatusOK, code)
+	_, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/settlement-currency", secretKey, nil)
+	currency, _ = j.GetString("settlement_currency")
+	assert.Equal(t, "EUR", currency)
+
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{Amount: "108.50"}, merchantId, secretKey)
+	code, _, _, _ = sendCaptureRequest("108.50", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	code, _, _, _ = sendRefundRequest("10.85", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, j = sendPaymentRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	for _, tc := range []struct {
+		path     []interface{}
+		expected string
+	}{
+		{[]interface{}{"currency"}, "USD"},
+		{[]interface{}{"captured"}, "108.50"},
+		{[]interface{}{"net"}, "97.65"},
+		{[]interface{}{"settlement", "currency"}, "EUR"},
+		{[]interface{}{"settlement", "authorized"}, "100.00"},
+		{[]interface{}{"settlement", "captured"}, "100.00"},
+		{[]interface{}{"settlement", "refunded"}, "10.00"},
+		{[]interface{}{"settlement", "net"}, "90.00"},
+	} {
+		actual, _ := j.GetString(tc.path[0], tc.path[1:]...)
+		assert.Equal(t, tc.expected, actual, tc.path)
+	}
+	rate, _ := j.GetFloat64("settlement", "rate")
+	assert.Equal(t, 0.921659, rate, "the rate is locked at authorization")
+	settlementAmount, _ := j.GetString("operations", 1, "settlement_amount")
+	assert.Equal(t, "10.00", settlementAmount)
+
+	ctx := context.WithValue(context.Background(), "logger", a.lg)
+	balance, err := a.ledger.Balance(ctx, merchantId, "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, 9000, balance.Pending, "the ledger books the payment in the settlement currency")
+	balance, err = a.ledger.Balance(ctx, merchantId, "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, balance.Pending)
+
+	code, _, _, _, _ = sendAuthorizationRequest(authorizationPayload{Currency: "JPY"}, merchantId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, code, "there is no rate from JPY to EUR")
+	_, _, paymentId, _, _ = sendAuthorizationRequest(authorizationPayload{Currency: "EUR"}, merchantId, secretKey)
+	_, j = sendPaymentRequest(merchantId, paymentId, secretKey)
+	rate, _ = j.GetFloat64("settlement", "rate")
+	assert.Equal(t, float64(1), rate)
+
+	code, _ = sendRequest(http.MethodPut, "/merchant/"+merchantId+"/settlement-currency", secretKey, []byte(`{"settlement_currency":""}`))
+	assert.Equal(t, http.StatusOK, code)
+	_, _, paymentId, _, _ = sendAuthorizationRequest(authorizationPayload{Currency: "JPY"}, merchantId, secretKey)
+	_, j = sendPaymentRequest(merchantId, paymentId, secretKey)
+	currency, _ = j.GetString("settlement", "currency")
+	assert.Equal(t, "JPY", currency, "without a settlement currency payments settle in their own")
+}
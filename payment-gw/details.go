@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"payment-gw/gateway"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+)
+
+// Bounds of the metadata of a payment.
+const (
+	maxMetadataKeys        = 20
+	maxMetadataValueLength = 500
+)
+
+// Page sizes of the list of payments.
+const (
+	defaultPaymentsLimit = 20
+	maxPaymentsLimit     = 100
+)
+
+var metadataKey = regexp.MustCompile(`^[A-Za-z0-9_-]{1,40}$`)
+
+type detailsResponse struct {
+	Reference           string            `json:"reference,omitempty"`
+	Description         string            `json:"description,omitempty"`
+	StatementDescriptor string            `json:"statement_descriptor,omitempty"`
+	Metadata            map[string]string `json:"metadata,omitempty"`
+}
+
+func createDetailsResponse(d gateway.Details) detailsResponse {
+	return detailsResponse{d.Reference, d.Description, d.StatementDescriptor, d.Metadata}
+}
+
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataKeys {
+		return fmt.Errorf("Metadata: at most %d keys", maxMetadataKeys)
+	}
+	for key, value := range metadata {
+		if !metadataKey.MatchString(key) {
+			return fmt.Errorf("Metadata: invalid key %q", key)
+		}
+		if utf8.RuneCountInString(value) > maxMetadataValueLength {
+			return fmt.Errorf("Metadata: the value of %s is longer than %d characters", key, maxMetadataValueLength)
+		}
+	}
+	return nil
+}
+
+// metadataFilter reads the metadata[key]=value parameters of a query.
+func metadataFilter(query url.Values) (map[string]string, error) {
+	filter := map[string]string{}
+	for param, values := range query {
+		if !strings.HasPrefix(param, "metadata[") || !strings.HasSuffix(param, "]") {
+			continue
+		}
+		key := strings.TrimSuffix(strings.TrimPrefix(param, "metadata["), "]")
+		if !metadataKey.MatchString(key) {
+			return nil, fmt.Errorf("invalid metadata key %q", key)
+		}
+		filter[key] = values[0]
+	}
+	return filter, nil
+}
+
+// pageFilter reads the limit and starting_after parameters of a query, the
+// limit is defaultPaymentsLimit when not given.
+func pageFilter(query url.Values) (gateway.Filter, error) {
+	f := gateway.Filter{Limit: defaultPaymentsLimit, StartingAfter: query.Get("starting_after")}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPaymentsLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxPaymentsLimit)
+		}
+		f.Limit = n
+	}
+	if f.StartingAfter != "" {
+		if _, err := xid.FromString(f.StartingAfter); err != nil {
+			return f, fmt.Errorf("invalid starting_after %q", f.StartingAfter)
+		}
+	}
+	return f, nil
+}
+
+// listPayments lists the payments of the merchant, the ones having the given
+// metadata values with metadata[key]=value (an empty value for any), a page
+// of limit payments at a time, starting after the payment starting_after.
+func (a *App) listPayments(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	filter, err := pageFilter(r.URL.Query())
+	if err == nil {
+		filter.Metadata, err = metadataFilter(r.URL.Query())
+	}
+	if err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	payments, err := a.gateway.List(ctx, mux.Vars(r)["merchant_id"], filter)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	res := make([]paymentResponse, 0, len(payments))
+	for _, p := range payments {
+		res = append(res, createPaymentResponse(p))
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// getPaymentByReference finds a payment of the merchant by the reference it
+// was authorized with.
+func (a *App) getPaymentByReference(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	p, err := a.gateway.GetByReference(ctx, mux.Vars(r)["merchant_id"], mux.Vars(r)["reference"])
+	if errors.Is(err, gateway.ErrPaymentNotFound) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, createPaymentResponse(p))
+}
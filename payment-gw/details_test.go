@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"payment-gw/gateway"
+	"strings"
+	"testing"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/stretchr/testify/assert"
+)
+
+func sendDetailedAuthorization(details map[string]interface{}, merchantId, secretKey string) (int, *jsonvalue.V) {
+	body := map[string]interface{}{}
+	json.Unmarshal(createAuthorizationPayload(authorizationPayload{Amount: "25.00"}), &body)
+	for k, v := range details {
+		body[k] = v
+	}
+	payload, _ := json.Marshal(body)
+	return sendRequest(http.MethodPost, "/merchant/"+merchantId+"/authorize", secretKey, payload)
+}
+
+func Test_InvalidPaymentDetails(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	tooMany := map[string]string{}
+	for i := 0; i <= maxMetadataKeys; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+	for _, details := range []map[string]interface{}{
+		{"metadata": tooMany},
+		{"metadata": map[string]string{"order.id": "1"}},
+		{"metadata": map[string]string{"note": strings.Repeat("x", maxMetadataValueLength+1)}},
+		{"reference": "order 1"},
+		{"reference": strings.Repeat("r", 65)},
+		{"statement_descriptor": "ACME"},
+		{"statement_descriptor": "123456"},
+		{"statement_descriptor": "ACME* ORDER 1234 AND MORE"},
+		{"description": strings.Repeat("d", 1001)},
+	} {
+		code, _ := sendDetailedAuthorization(details, merchantId, secretKey)
+		assert.Equal(t, http.StatusBadRequest, code, details)
+	}
+}
+
+func Test_PaymentDetails(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	details := map[string]interface{}{"reference": "order-1001", "description": "Two yoga classes",
+		"statement_descriptor": "ACME* YOGA", "metadata": map[string]string{"order_id": "1001", "channel": "web"}}
+
+	code, j := sendDetailedAuthorization(details, merchantId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	paymentId, _ := j.GetString("payment_id")
+	reference, _ := j.GetString("reference")
+	assert.Equal(t, "order-1001", reference)
+
+	code, j = sendPaymentRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	for field, value := range map[string]string{"reference": "order-1001", "description": "Two yoga classes", "statement_descriptor": "ACME* YOGA"} {
+		got, _ := j.GetString(field)
+		assert.Equal(t, value, got, field)
+	}
+	orderId, _ := j.GetString("metadata", "order_id")
+	assert.Equal(t, "1001", orderId)
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payments/reference/order-1001", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	id, _ := j.GetString("payment_id")
+	assert.Equal(t, paymentId, id)
+
+	code, j = sendDetailedAuthorization(map[string]interface{}{"reference": "order-1001"}, merchantId, secretKey)
+	assert.Equal(t, http.StatusConflict, code)
+	message, _ := j.GetString("error")
+	assert.Equal(t, gateway.ErrDuplicateReference.Error(), message)
+
+	otherId, otherKey := register(t)
+	code, _ = sendDetailedAuthorization(map[string]interface{}{"reference": "order-1001"}, otherId, otherKey)
+	assert.Equal(t, http.StatusOK, code, "references are unique per merchant")
+	code, _ = sendRequest(http.MethodGet, "/merchant/"+otherId+"/payments/reference/order-1002", otherKey, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func Test_DeclinedPaymentGivesBackItsReference(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	body := map[string]interface{}{}
+	json.Unmarshal(createAuthorizationPayload(authorizationPayload{CardNumber: authorizationFailureCardNumber}), &body)
+	body["reference"] = "order-7"
+	payload, _ := json.Marshal(body)
+	code, _ := sendRequest(http.MethodPost, "/merchant/"+merchantId+"/authorize", secretKey, payload)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = sendDetailedAuthorization(map[string]interface{}{"reference": "order-7"}, merchantId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func Test_ListPaymentsByMetadata(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	sendDetailedAuthorization(map[string]interface{}{"metadata": map[string]string{"order_id": "1", "channel": "web"}}, merchantId, secretKey)
+	sendDetailedAuthorization(map[string]interface{}{"metadata": map[string]string{"order_id": "2", "channel": "web"}}, merchantId, secretKey)
+	sendDetailedAuthorization(map[string]interface{}{"metadata": map[string]string{"order_id": "3", "channel": "pos"}}, merchantId, secretKey)
+	sendDetailedAuthorization(nil, merchantId, secretKey)
+
+	for query, count := range map[string]int{"": 4, "metadata[channel]=web": 2, "metadata[channel]=web&metadata[order_id]=2": 1,
+		"metadata[order_id]=": 3, "metadata[channel]=kiosk": 0} {
+		code, j := sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payments?"+query, secretKey, nil)
+		assert.Equal(t, http.StatusOK, code, query)
+		assert.Equal(t, count, j.Len(), query)
+	}
+
+	code, _ := sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payments?"+url.Values{"metadata[$where]": {"1"}}.Encode(), secretKey, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	otherId, otherKey := register(t)
+	code, j := sendRequest(http.MethodGet, "/merchant/"+otherId+"/payments", otherKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0, j.Len())
+}
+
+func Test_ListPaymentsPages(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{}, merchantId, secretKey)
+		ids = append(ids, paymentId)
+	}
+	payments := "/merchant/" + merchantId + "/payments"
+
+	code, j := sendRequest(http.MethodGet, payments+"?limit=2", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, j.Len())
+	first, _ := j.GetString(0, "payment_id")
+	last, _ := j.GetString(1, "payment_id")
+	assert.Equal(t, ids[4], first, "the latest payment comes first")
+
+	code, j = sendRequest(http.MethodGet, payments+"?limit=2&starting_after="+last, secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, j.Len())
+	next, _ := j.GetString(0, "payment_id")
+	assert.Equal(t, ids[2], next)
+
+	code, j = sendRequest(http.MethodGet, payments+"?starting_after="+ids[1], secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, j.Len())
+
+	for _, query := range []string{"limit=0", "limit=101", "limit=ten", "starting_after=nope"} {
+		code, _ = sendRequest(http.MethodGet, payments+"?"+query, secretKey, nil)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
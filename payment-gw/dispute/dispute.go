@@ -0,0 +1,507 @@
+package dispute
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"payment-gw/events"
+	"payment-gw/gateway"
+	"payment-gw/ledger"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const DisputesCol = "disputes"
+
+const (
+	// StatusOpened is a dispute the card network notified
+	StatusOpened = "opened"
+	// StatusEvidenceRequired waits for the merchant to defend the payment
+	StatusEvidenceRequired = "evidence_required"
+	// StatusUnderReview is decided by the issuer on the submitted evidence
+	StatusUnderReview = "under_review"
+	// StatusWon keeps the money with the merchant
+	StatusWon = "won"
+	// StatusLost charges the disputed amount back from the merchant
+	StatusLost = "lost"
+)
+
+const (
+	EvidenceText = "text"
+	EvidenceFile = "file"
+)
+
+// transitions lists the statuses a dispute can move to from each status.
+var transitions = map[string][]string{
+	StatusOpened:           {StatusEvidenceRequired, StatusUnderReview, StatusWon, StatusLost},
+	StatusEvidenceRequired: {StatusUnderReview, StatusWon, StatusLost},
+	StatusUnderReview:      {StatusWon, StatusLost},
+}
+
+// Reasons are the reason codes the card networks open disputes with.
+var Reasons = map[string]string{
+	"10.4": "Other fraud, card absent environment",
+	"12.6": "Duplicate processing",
+	"13.1": "Merchandise or services not received",
+	"13.2": "Cancelled recurring transaction",
+	"13.3": "Not as described or defective merchandise",
+	"13.6": "Credit not processed",
+	"13.7": "Cancelled merchandise or services",
+}
+
+// evidenceTypes are the content types of the files accepted as evidence.
+var evidenceTypes = map[string]string{
+	"application/pdf":           ".pdf",
+	"image/png":                 ".png",
+	"image/jpeg":                ".jpg",
+	"text/plain; charset=utf-8": ".txt",
+}
+
+var (
+	ErrDisputeNotFound    = errors.New("dispute not found")
+	ErrUnknownReason      = errors.New("unknown dispute reason code")
+	ErrNotDisputable      = errors.New("only captured payments can be disputed")
+	ErrDisputeAmount      = errors.New("dispute amount is higher than the captured amount not refunded")
+	ErrAlreadyDisputed    = errors.New("payment has an open dispute")
+	ErrInvalidTransition  = errors.New("dispute cannot move to this status")
+	ErrEvidenceClosed     = errors.New("evidence can only be added before the dispute is submitted")
+	ErrNoEvidence         = errors.New("evidence is required to submit the dispute")
+	ErrEmptyEvidence      = errors.New("evidence text or file is required")
+	ErrEvidenceTooLarge   = errors.New("evidence file is too large")
+	ErrEvidenceType       = errors.New("evidence file must be a PDF, PNG, JPEG or text file")
+	ErrConcurrentDecision = errors.New("dispute was updated concurrently")
+)
+
+type Evidence struct {
+	Id          string    `bson:"id"`
+	Kind        string    `bson:"kind"`
+	Text        string    `bson:"text,omitempty"`
+	FileName    string    `bson:"filename,omitempty"`
+	ContentType string    `bson:"contenttype,omitempty"`
+	Size        int64     `bson:"size,omitempty"`
+	Path        string    `bson:"path,omitempty"`
+	AddedAt     time.Time `bson:"addedat"`
+}
+
+type Transition struct {
+	Status string    `bson:"status"`
+	At     time.Time `bson:"at"`
+}
+
+// Dispute is a cardholder contesting a captured payment. Amounts are in minor
+// units; the merchant has until DueBy to submit evidence.
+type Dispute struct {
+	Id         string       `bson:"id"`
+	PaymentId  string       `bson:"paymentid"`
+	MerchantId string       `bson:"merchantid"`
+	Currency   string       `bson:"currency"`
+	Amount     int          `bson:"amount"`
+	ReasonCode string       `bson:"reasoncode"`
+	Status     string       `bson:"status"`
+	DueBy      time.Time    `bson:"dueby"`
+	Evidence   []Evidence   `bson:"evidence"`
+	History    []Transition `bson:"history"`
+	CreatedAt  time.Time    `bson:"createdat"`
+	UpdatedAt  time.Time    `bson:"updatedat"`
+	Version    int          `bson:"version"`
+}
+
+func (d Dispute) Closed() bool {
+	return d.Status == StatusWon || d.Status == StatusLost
+}
+
+func (d Dispute) CanMoveTo(status string) bool {
+	for _, s := range transitions[d.Status] {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+type Config struct {
+	// EvidenceDir is where the files submitted as evidence are stored
+	EvidenceDir string `yaml:"evidence_dir"`
+	// MaxEvidenceSize is the size limit of an evidence file in bytes
+	MaxEvidenceSize int64 `yaml:"max_evidence_size"`
+	// ResponseWindow is the time merchants have to submit evidence
+	ResponseWindow time.Duration `yaml:"response_window"`
+}
+
+func (c Config) Validate() error {
+	var errs []string
+	if c.EvidenceDir == "" {
+		errs = append(errs, "evidence_dir is required")
+	}
+	if c.MaxEvidenceSize <= 0 {
+		errs = append(errs, "max_evidence_size must be positive")
+	}
+	if c.ResponseWindow <= 0 {
+		errs = append(errs, "response_window must be positive")
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// File is an evidence file uploaded by the merchant.
+type File struct {
+	Name    string
+	Content io.Reader
+}
+
+type DisputeRepository interface {
+	Open(ctx context.Context, paymentId, reasonCode string, amount int) (Dispute, error)
+	Get(ctx context.Context, merchantId, disputeId string) (Dispute, error)
+	List(ctx context.Context, merchantId string) ([]Dispute, error)
+	AddEvidence(ctx context.Context, merchantId, disputeId, text string, files []File) (Dispute, error)
+	Submit(ctx context.Context, merchantId, disputeId string) (Dispute, error)
+	Decide(ctx context.Context, disputeId, status string) (Dispute, error)
+}
+
+type MongoDisputeRepository struct {
+	db     *mongo.Database
+	config Config
+}
+
+func NewRepository(db *mongo.Database, c Config) MongoDisputeRepository {
+	return MongoDisputeRepository{db: db, config: c}
+}
+
+// Open opens a dispute on a captured payment for amount, or for all of the
+// captured amount not refunded when amount is zero.
+func (m MongoDisputeRepository) Open(ctx context.Context, paymentId, reasonCode string, amount int) (Dispute, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	if _, ok := Reasons[reasonCode]; !ok {
+		return Dispute{}, ErrUnknownReason
+	}
+
+	var d Dispute
+	err := m.transaction(ctx, func(sc mongo.SessionContext) error {
+		var p gateway.Payment
+		if err := m.db.Collection(gateway.PaymentsCol).FindOne(sc, bson.M{"id": paymentId}).Decode(&p); err != nil {
+			return err
+		}
+		if p.Captured == 0 {
+			return ErrNotDisputable
+		}
+		disputed := amount
+		if disputed == 0 {
+			disputed = p.Refundable()
+		}
+		if disputed <= 0 || disputed > p.Refundable() {
+			return ErrDisputeAmount
+		}
+		open, err := m.db.Collection(DisputesCol).CountDocuments(sc, bson.M{"paymentid": paymentId,
+			"status": bson.M{"$nin": []string{StatusWon, StatusLost}}})
+		if err != nil {
+			return err
+		}
+		if open > 0 {
+			return ErrAlreadyDisputed
+		}
+
+		now := time.Now().UTC()
+		d = Dispute{Id: xid.New().String(), PaymentId: p.Id, MerchantId: p.MerchantId, Currency: p.Currency, Amount: disputed,
+			ReasonCode: reasonCode, Status: StatusOpened, DueBy: now.Add(m.config.ResponseWindow), Evidence: []Evidence{},
+			History: []Transition{{StatusOpened, now}}, CreatedAt: now, UpdatedAt: now}
+		// the version check serializes disputes opened on the payment concurrently
+		res, err := m.db.Collection(gateway.PaymentsCol).UpdateOne(sc, bson.M{"id": p.Id, "version": p.Version},
+			bson.M{"$push": bson.M{"disputes": d.Id}, "$inc": bson.M{"version": 1}})
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount == 0 {
+			return gateway.ErrOptimisticLocking
+		}
+		if _, err := m.db.Collection(DisputesCol).InsertOne(sc, d); err != nil {
+			return err
+		}
+		return m.emit(sc, d)
+	})
+	if err != nil {
+		if !isDisputeError(err) {
+			lg.Error().Msg(err.Error())
+		}
+		return Dispute{}, err
+	}
+	return d, nil
+}
+
+func (m MongoDisputeRepository) Get(ctx context.Context, merchantId, disputeId string) (Dispute, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	var d Dispute
+	err := m.db.Collection(DisputesCol).FindOne(ctx, bson.M{"merchantid": merchantId, "id": disputeId}).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Dispute{}, ErrDisputeNotFound
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		return Dispute{}, err
+	}
+	return d, nil
+}
+
+func (m MongoDisputeRepository) List(ctx context.Context, merchantId string) ([]Dispute, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	disputes := []Dispute{}
+	cursor, err := m.db.Collection(DisputesCol).Find(ctx, bson.M{"merchantid": merchantId},
+		options.Find().SetSort(bson.M{"createdat": -1}))
+	if err == nil {
+		err = cursor.All(ctx, &disputes)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+	return disputes, nil
+}
+
+// AddEvidence stores the text and files the merchant defends the payment
+// with, the files are written to the evidence directory of the dispute.
+func (m MongoDisputeRepository) AddEvidence(ctx context.Context, merchantId, disputeId, text string, files []File) (Dispute, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	if strings.TrimSpace(text) == "" && len(files) == 0 {
+		return Dispute{}, ErrEmptyEvidence
+	}
+	d, err := m.Get(ctx, merchantId, disputeId)
+	if err != nil {
+		return Dispute{}, err
+	}
+	if d.Status != StatusOpened && d.Status != StatusEvidenceRequired {
+		return d, ErrEvidenceClosed
+	}
+
+	now := time.Now().UTC()
+	var evidence []Evidence
+	if strings.TrimSpace(text) != "" {
+		evidence = append(evidence, Evidence{Id: xid.New().String(), Kind: EvidenceText, Text: text, AddedAt: now})
+	}
+	for _, f := range files {
+		e, err := m.store(d.Id, f)
+		if err != nil {
+			removeFiles(evidence)
+			return d, err
+		}
+		e.AddedAt = now
+		evidence = append(evidence, e)
+	}
+
+	res, err := m.db.Collection(DisputesCol).UpdateOne(ctx, bson.M{"id": d.Id, "version": d.Version,
+		"status": bson.M{"$in": []string{StatusOpened, StatusEvidenceRequired}}},
+		bson.M{"$push": bson.M{"evidence": bson.M{"$each": evidence}}, "$set": bson.M{"updatedat": now}, "$inc": bson.M{"version": 1}})
+	if err == nil && res.ModifiedCount == 0 {
+		err = ErrConcurrentDecision
+	}
+	if err != nil {
+		removeFiles(evidence)
+		if !errors.Is(err, ErrConcurrentDecision) {
+			lg.Error().Msg(err.Error())
+		}
+		return d, err
+	}
+	d.Evidence = append(d.Evidence, evidence...)
+	d.UpdatedAt = now
+	d.Version++
+	return d, nil
+}
+
+// store writes an evidence file, its content type is detected from the
+// content rather than trusted from the upload.
+func (m MongoDisputeRepository) store(disputeId string, f File) (Evidence, error) {
+	e := Evidence{Id: xid.New().String(), Kind: EvidenceFile, FileName: filepath.Base(f.Name)}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f.Content, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return e, err
+	}
+	head = head[:n]
+	e.ContentType = http.DetectContentType(head)
+	ext, ok := evidenceTypes[e.ContentType]
+	if n == 0 || !ok {
+		return e, ErrEvidenceType
+	}
+
+	dir := filepath.Join(m.config.EvidenceDir, disputeId)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return e, err
+	}
+	e.Path = filepath.Join(dir, e.Id+ext)
+	out, err := os.OpenFile(e.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return e, err
+	}
+	content := io.MultiReader(bytes.NewReader(head), f.Content)
+	e.Size, err = io.Copy(out, io.LimitReader(content, m.config.MaxEvidenceSize+1))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && e.Size > m.config.MaxEvidenceSize {
+		err = ErrEvidenceTooLarge
+	}
+	if err != nil {
+		os.Remove(e.Path)
+		return e, err
+	}
+	return e, nil
+}
+
+func removeFiles(evidence []Evidence) {
+	for _, e := range evidence {
+		if e.Path != "" {
+			os.Remove(e.Path)
+		}
+	}
+}
+
+// Submit sends the evidence of the merchant to the issuer for review.
+func (m MongoDisputeRepository) Submit(ctx context.Context, merchantId, disputeId string) (Dispute, error) {
+	d, err := m.Get(ctx, merchantId, disputeId)
+	if err != nil {
+		return Dispute{}, err
+	}
+	if len(d.Evidence) == 0 {
+		return d, ErrNoEvidence
+	}
+	return m.move(ctx, d, StatusUnderReview)
+}
+
+// Decide records a decision of the card network: a request for evidence or
+// the outcome of the dispute. A lost dispute charges the amount back from
+// the merchant.
+func (m MongoDisputeRepository) Decide(ctx context.Context, disputeId, status string) (Dispute, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	var d Dispute
+	err := m.db.Collection(DisputesCol).FindOne(ctx, bson.M{"id": disputeId}).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Dispute{}, ErrDisputeNotFound
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		return Dispute{}, err
+	}
+	if status == StatusUnderReview {
+		return d, ErrInvalidTransition
+	}
+	return m.move(ctx, d, status)
+}
+
+func (m MongoDisputeRepository) move(ctx context.Context, d Dispute, status string) (Dispute, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	if !d.CanMoveTo(status) {
+		return d, ErrInvalidTransition
+	}
+
+	now := time.Now().UTC()
+	err := m.transaction(ctx, func(sc mongo.SessionContext) error {
+		res, err := m.db.Collection(DisputesCol).UpdateOne(sc, bson.M{"id": d.Id, "version": d.Version}, bson.M{
+			"$set":  bson.M{"status": status, "updatedat": now},
+			"$push": bson.M{"history": Transition{status, now}},
+			"$inc":  bson.M{"version": 1},
+		})
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount == 0 {
+			return ErrConcurrentDecision
+		}
+		moved := d
+		moved.Status = status
+		if status == StatusLost {
+			if err := m.chargeback(sc, moved, now); err != nil {
+				return err
+			}
+		}
+		return m.emit(sc, moved)
+	})
+	if err != nil {
+		if !isDisputeError(err) {
+			lg.Error().Msg(err.Error())
+		}
+		return d, err
+	}
+	d.Status = status
+	d.History = append(d.History, Transition{status, now})
+	d.UpdatedAt = now
+	d.Version++
+	return d, nil
+}
+
+// chargeback takes the disputed amount back from the merchant, on the
+// payment and in the ledger, and its share of the transfers of the payment
+// back from the connected accounts. Refunds made while the dispute was open
+// are not charged back a second time: the amount is capped at what is still
+// refundable.
+func (m MongoDisputeRepository) chargeback(sc mongo.SessionContext, d Dispute, now time.Time) error {
+	var p gateway.Payment
+	if err := m.db.Collection(gateway.PaymentsCol).FindOne(sc, bson.M{"id": d.PaymentId}).Decode(&p); errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("payment %s of dispute %s not found", d.PaymentId, d.Id)
+	} else if err != nil {
+		return err
+	}
+	// a refund at the acquirer would be saved over the chargeback
+	if p.InProgress != "" {
+		return gateway.ErrOperationInProgress
+	}
+	amount := d.Amount
+	if amount > p.Refundable() {
+		amount = p.Refundable()
+	}
+	if amount <= 0 {
+		return nil
+	}
+
+	op := p.NewOperation(gateway.OperationChargeback, amount, 0, now)
+	p.Chargebacks += op.Amount
+	entries := ledger.ChargebackEntries(d.PaymentId, d.MerchantId, p.SettlementCurrency(), op.SettlementAmount)
+	entries = append(entries, p.ReverseTransfers()...)
+	res, err := m.db.Collection(gateway.PaymentsCol).UpdateOne(sc, bson.M{"id": d.PaymentId, "version": p.Version}, bson.M{
+		"$inc":  bson.M{"chargebacks": op.Amount, "settlement.chargebacks": op.SettlementAmount, "version": 1},
+		"$push": bson.M{"operations": op},
+		"$set":  bson.M{"transfers": p.Transfers},
+	})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return gateway.ErrOptimisticLocking
+	}
+	return ledger.Post(sc, m.db, "dispute/"+d.Id, entries...)
+}
+
+func (m MongoDisputeRepository) emit(sc mongo.SessionContext, d Dispute) error {
+	return events.Emit(sc, m.db, events.Event{Type: "dispute." + d.Status, MerchantId: d.MerchantId, PaymentId: d.PaymentId,
+		Data: map[string]string{"dispute_id": d.Id, "status": d.Status, "reason_code": d.ReasonCode,
+			"amount": strconv.FormatFloat(float64(d.Amount)/100, 'f', 2, 64), "currency": d.Currency}})
+}
+
+func (m MongoDisputeRepository) transaction(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	return m.db.Client().UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, fn(sc)
+		})
+		return err
+	})
+}
+
+func isDisputeError(err error) bool {
+	for _, target := range []error{ErrNotDisputable, ErrDisputeAmount, ErrAlreadyDisputed, ErrConcurrentDecision,
+		gateway.ErrOptimisticLocking, gateway.ErrOperationInProgress, mongo.ErrNoDocuments} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
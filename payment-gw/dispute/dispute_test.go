@@ -0,0 +1,69 @@
+package dispute
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanMoveTo(t *testing.T) {
+	for _, tc := range []struct {
+		from, to string
+		ok       bool
+	}{
+		{StatusOpened, StatusEvidenceRequired, true},
+		{StatusOpened, StatusLost, true},
+		{StatusEvidenceRequired, StatusUnderReview, true},
+		{StatusEvidenceRequired, StatusOpened, false},
+		{StatusUnderReview, StatusWon, true},
+		{StatusUnderReview, StatusEvidenceRequired, false},
+		{StatusWon, StatusLost, false},
+		{StatusLost, StatusWon, false},
+		{StatusOpened, "closed", false},
+	} {
+		assert.Equal(t, tc.ok, Dispute{Status: tc.from}.CanMoveTo(tc.to), "%s to %s", tc.from, tc.to)
+	}
+	assert.True(t, Dispute{Status: StatusLost}.Closed())
+	assert.False(t, Dispute{Status: StatusUnderReview}.Closed())
+}
+
+func TestStore(t *testing.T) {
+	m := MongoDisputeRepository{config: Config{EvidenceDir: t.TempDir(), MaxEvidenceSize: 1024}}
+
+	e, err := m.store("d1", File{Name: "../../receipt.pdf", Content: strings.NewReader("%PDF-1.4\nreceipt")})
+	assert.NoError(t, err)
+	assert.Equal(t, "receipt.pdf", e.FileName, "the path of the upload is dropped")
+	assert.Equal(t, "application/pdf", e.ContentType)
+	assert.Equal(t, int64(16), e.Size)
+	content, err := os.ReadFile(e.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, "%PDF-1.4\nreceipt", string(content))
+
+	e, err = m.store("d1", File{Name: "notes.txt", Content: strings.NewReader("delivered on time")})
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", e.ContentType)
+
+	_, err = m.store("d1", File{Name: "big.txt", Content: bytes.NewReader(bytes.Repeat([]byte("a"), 1025))})
+	assert.True(t, errors.Is(err, ErrEvidenceTooLarge))
+	_, err = m.store("d1", File{Name: "run.exe", Content: bytes.NewReader([]byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff"))})
+	assert.True(t, errors.Is(err, ErrEvidenceType))
+	_, err = m.store("d1", File{Name: "empty.txt", Content: strings.NewReader("")})
+	assert.True(t, errors.Is(err, ErrEvidenceType))
+
+	entries, err := os.ReadDir(m.config.EvidenceDir + "/d1")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2, "rejected files are removed")
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{EvidenceDir: "evidence", MaxEvidenceSize: 1, ResponseWindow: 1}.Validate())
+	err := Config{}.Validate()
+	assert.Error(t, err)
+	for _, msg := range []string{"evidence_dir is required", "max_evidence_size must be positive", "response_window must be positive"} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
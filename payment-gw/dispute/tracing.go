@@ -0,0 +1,67 @@
+package dispute
+
+import (
+	"context"
+	"payment-gw/tracing"
+)
+
+type tracedRepository struct {
+	next DisputeRepository
+}
+
+func NewTracedRepository(next DisputeRepository) DisputeRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) Open(ctx context.Context, paymentId, reasonCode string, amount int) (Dispute, error) {
+	ctx, span := tracing.Start(ctx, "dispute.Open", tracing.WithAttributes(
+		tracing.String("payment.id", paymentId), tracing.String("dispute.reason_code", reasonCode), tracing.Int("dispute.amount", amount)))
+	defer span.End()
+	d, err := t.next.Open(ctx, paymentId, reasonCode, amount)
+	span.RecordError(err)
+	return d, err
+}
+
+func (t tracedRepository) Get(ctx context.Context, merchantId, disputeId string) (Dispute, error) {
+	ctx, span := tracing.Start(ctx, "dispute.Get", tracing.WithAttributes(
+		tracing.String("merchant.id", merchantId), tracing.String("dispute.id", disputeId)))
+	defer span.End()
+	d, err := t.next.Get(ctx, merchantId, disputeId)
+	span.RecordError(err)
+	return d, err
+}
+
+func (t tracedRepository) List(ctx context.Context, merchantId string) ([]Dispute, error) {
+	ctx, span := tracing.Start(ctx, "dispute.List", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	disputes, err := t.next.List(ctx, merchantId)
+	span.RecordError(err)
+	return disputes, err
+}
+
+func (t tracedRepository) AddEvidence(ctx context.Context, merchantId, disputeId, text string, files []File) (Dispute, error) {
+	ctx, span := tracing.Start(ctx, "dispute.AddEvidence", tracing.WithAttributes(
+		tracing.String("merchant.id", merchantId), tracing.String("dispute.id", disputeId), tracing.Int("dispute.evidence_files", len(files))))
+	defer span.End()
+	d, err := t.next.AddEvidence(ctx, merchantId, disputeId, text, files)
+	span.RecordError(err)
+	return d, err
+}
+
+func (t tracedRepository) Submit(ctx context.Context, merchantId, disputeId string) (Dispute, error) {
+	ctx, span := tracing.Start(ctx, "dispute.Submit", tracing.WithAttributes(
+		tracing.String("merchant.id", merchantId), tracing.String("dispute.id", disputeId)))
+	defer span.End()
+	d, err := t.next.Submit(ctx, merchantId, disputeId)
+	span.RecordError(err)
+	return d, err
+}
+
+func (t tracedRepository) Decide(ctx context.Context, disputeId, status string) (Dispute, error) {
+	ctx, span := tracing.Start(ctx, "dispute.Decide", tracing.WithAttributes(
+		tracing.String("dispute.id", disputeId), tracing.String("dispute.status", status)))
+	defer span.End()
+	d, err := t.next.Decide(ctx, disputeId, status)
+	span.RecordError(err)
+	return d, err
+}
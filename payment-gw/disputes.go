@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"payment-gw/dispute"
+	"payment-gw/gateway"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/validator.v2"
+)
+
+// maxEvidenceFiles limits the files of a single evidence upload.
+const maxEvidenceFiles = 10
+
+var ErrNotSimulated = errors.New("disputes can only be simulated on payments of a simulator acquirer")
+
+type evidenceResponse struct {
+	EvidenceId  string    `json:"evidence_id"`
+	Kind        string    `json:"kind"`
+	Text        string    `json:"text,omitempty"`
+	FileName    string    `json:"file_name,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	AddedAt     time.Time `json:"added_at"`
+}
+
+type transitionResponse struct {
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+type disputeResponse struct {
+	DisputeId  string               `json:"dispute_id"`
+	PaymentId  string               `json:"payment_id"`
+	Currency   string               `json:"currency"`
+	Amount     string               `json:"amount"`
+	ReasonCode string               `json:"reason_code"`
+	Reason     string               `json:"reason"`
+	Status     string               `json:"status"`
+	DueBy      time.Time            `json:"due_by"`
+	Evidence   []evidenceResponse   `json:"evidence"`
+	History    []transitionResponse `json:"history"`
+	CreatedAt  time.Time            `json:"created_at"`
+	UpdatedAt  time.Time            `json:"updated_at"`
+}
+
+func createDisputeResponse(d dispute.Dispute) disputeResponse {
+	res := disputeResponse{d.Id, d.PaymentId, d.Currency, formatMinorUnits(d.Amount), d.ReasonCode, dispute.Reasons[d.ReasonCode],
+		d.Status, d.DueBy, []evidenceResponse{}, []transitionResponse{}, d.CreatedAt, d.UpdatedAt}
+	for _, e := range d.Evidence {
+		res.Evidence = append(res.Evidence, evidenceResponse{e.Id, e.Kind, e.Text, e.FileName, e.ContentType, e.Size, e.AddedAt})
+	}
+	for _, t := range d.History {
+		res.History = append(res.History, transitionResponse{t.Status, t.At})
+	}
+	return res
+}
+
+// respondWithDisputeError answers the errors of the dispute operations.
+func respondWithDisputeError(w http.ResponseWriter, lg *zerolog.Logger, err error) {
+	switch {
+	case errors.Is(err, dispute.ErrDisputeNotFound), errors.Is(err, mongo.ErrNoDocuments):
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, dispute.ErrConcurrentDecision), errors.Is(err, gateway.ErrOptimisticLocking),
+		errors.Is(err, gateway.ErrOperationInProgress):
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, dispute.ErrUnknownReason), errors.Is(err, dispute.ErrNotDisputable), errors.Is(err, dispute.ErrDisputeAmount),
+		errors.Is(err, dispute.ErrAlreadyDisputed), errors.Is(err, dispute.ErrInvalidTransition), errors.Is(err, dispute.ErrEvidenceClosed),
+		errors.Is(err, dispute.ErrNoEvidence), errors.Is(err, dispute.ErrEmptyEvidence), errors.Is(err, dispute.ErrEvidenceTooLarge),
+		errors.Is(err, dispute.ErrEvidenceType), errors.Is(err, ErrNotSimulated):
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	default:
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+func (a *App) listDisputes(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	disputes, err := a.dispute.List(ctx, mux.Vars(r)["merchant_id"])
+	if err != nil {
+		respondWithDisputeError(w, lg, err)
+		return
+	}
+
+	res := make([]disputeResponse, 0, len(disputes))
+	for _, d := range disputes {
+		res = append(res, createDisputeResponse(d))
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+func (a *App) getDispute(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	d, err := a.dispute.Get(ctx, mux.Vars(r)["merchant_id"], mux.Vars(r)["dispute_id"])
+	if err != nil {
+		respondWithDisputeError(w, lg, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, createDisputeResponse(d))
+}
+
+// addEvidence takes a JSON body with a text, or a multipart form with a text
+// field and files.
+func (a *App) addEvidence(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	var text string
+	var files []dispute.File
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxEvidenceFiles*a.cfg.Disputes.MaxEvidenceSize+1<<20)
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			lg.Debug().Msg(err.Error())
+			respondWithError(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		text = r.FormValue("text")
+		if len(r.MultipartForm.File["file"]) > maxEvidenceFiles {
+			lg.Debug().Int("files", len(r.MultipartForm.File["file"])).Msg("too many evidence files")
+			respondWithError(w, http.StatusBadRequest, "at most "+strconv.Itoa(maxEvidenceFiles)+" files can be uploaded at once")
+			return
+		}
+		for _, fh := range r.MultipartForm.File["file"] {
+			f, err := fh.Open()
+			if err != nil {
+				lg.Error().Msg(err.Error())
+				respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+				return
+			}
+			defer f.Close()
+			files = append(files, dispute.File{Name: fh.Filename, Content: f})
+		}
+	} else {
+		req := struct {
+			Text string `json:"text"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			lg.Debug().Msg(err.Error())
+			respondWithError(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+			return
+		}
+		defer r.Body.Close()
+		text = req.Text
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	d, err := a.dispute.AddEvidence(ctx, mux.Vars(r)["merchant_id"], mux.Vars(r)["dispute_id"], text, files)
+	if err != nil {
+		respondWithDisputeError(w, lg, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, createDisputeResponse(d))
+}
+
+func (a *App) submitDispute(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	d, err := a.dispute.Submit(ctx, mux.Vars(r)["merchant_id"], mux.Vars(r)["dispute_id"])
+	if err != nil {
+		respondWithDisputeError(w, lg, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, createDisputeResponse(d))
+}
+
+// simulateDispute opens a dispute as the card network would, on a captured
+// payment routed to a simulator acquirer.
+func (a *App) simulateDispute(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+	req := struct {
+		PaymentId  string `json:"payment_id"`
+		ReasonCode string `json:"reason_code"`
+		Amount     string `json:"amount" validate:"regexp=^([0-9]{1\\,10}[.][0-9]{2})?$"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validator.Validate(req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	amount, err := parseMinorUnits(req.Amount)
+	if err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	p, err := a.gateway.Get(ctx, req.PaymentId)
+	if err != nil {
+		respondWithDisputeError(w, lg, err)
+		return
+	}
+	if !a.cfg.simulatedAcquirer(p.Acquirer) {
+		respondWithDisputeError(w, lg, ErrNotSimulated)
+		return
+	}
+
+	d, err := a.dispute.Open(ctx, p.Id, req.ReasonCode, amount)
+	if err != nil {
+		respondWithDisputeError(w, lg, err)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, createDisputeResponse(d))
+}
+
+// simulateDisputeDecision requests evidence or decides the outcome of a
+// dispute as the card network would.
+func (a *App) simulateDisputeDecision(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+	req := struct {
+		Status string `json:"status"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	defer r.Body.Close()
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	d, err := a.dispute.Decide(ctx, mux.Vars(r)["dispute_id"], req.Status)
+	if err != nil {
+		respondWithDisputeError(w, lg, err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, createDisputeResponse(d))
+}
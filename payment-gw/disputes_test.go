@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"testing"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/stretchr/testify/assert"
+)
+
+func openDispute(t *testing.T, paymentId, reasonCode string) string {
+	code, j := sendRequest(http.MethodPost, "/simulator/disputes", adminKey,
+		[]byte(`{"payment_id":"`+paymentId+`","reason_code":"`+reasonCode+`"}`))
+	assert.Equal(t, http.StatusCreated, code)
+	disputeId, _ := j.GetString("dispute_id")
+	return disputeId
+}
+
+func decideDispute(disputeId, status string) int {
+	code, _ := sendRequest(http.MethodPost, "/simulator/disputes/"+disputeId+"/decision", adminKey, []byte(`{"status":"`+status+`"}`))
+	return code
+}
+
+func sendEvidenceForm(merchantId, disputeId, secretKey, text, fileName string, file []byte) (int, *jsonvalue.V) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("text", text)
+	part, _ := form.CreateFormFile("file", fileName)
+	part.Write(file)
+	form.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, "/merchant/"+merchantId+"/disputes/"+disputeId+"/evidence", body)
+	req.Header.Set("Authorization", secretKey)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	response := executeRequest(req)
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	return response.Code, j
+}
+
+func capturedPayment(t *testing.T, merchantId, secretKey string) string {
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{}, merchantId, secretKey)
+	code, _, _, _ := sendCaptureRequest("100.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	return paymentId
+}
+
+func Test_DisputeLost(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	paymentId := capturedPayment(t, merchantId, secretKey)
+	disputes := "/merchant/" + merchantId + "/disputes/"
+
+	disputeId := openDispute(t, paymentId, "13.1")
+	code, _ := sendRequest(http.MethodPost, "/simulator/disputes", adminKey, []byte(`{"payment_id":"`+paymentId+`","reason_code":"13.1"}`))
+	assert.Equal(t, http.StatusBadRequest, code, "the payment already has an open dispute")
+
+	assert.Equal(t, http.StatusOK, decideDispute(disputeId, "evidence_required"))
+	code, _ = sendRequest(http.MethodPost, disputes+disputeId+"/submit", secretKey, nil)
+	assert.Equal(t, http.StatusBadRequest, code, "evidence is required")
+
+	code, j := sendEvidenceForm(merchantId, disputeId, secretKey, "The parcel was delivered", "proof.pdf", []byte("%PDF-1.4\ndelivery proof"))
+	assert.Equal(t, http.StatusOK, code)
+	evidence, _ := j.Get("evidence")
+	assert.Equal(t, 2, evidence.Len())
+	kind, _ := j.GetString("evidence", 1, "kind")
+	contentType, _ := j.GetString("evidence", 1, "content_type")
+	assert.Equal(t, "file", kind)
+	assert.Equal(t, "application/pdf", contentType)
+
+	code, j = sendRequest(http.MethodPost, disputes+disputeId+"/submit", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("status")
+	assert.Equal(t, "under_review", status)
+	code, _ = sendRequest(http.MethodPost, disputes+disputeId+"/evidence", secretKey, []byte(`{"text":"more"}`))
+	assert.Equal(t, http.StatusBadRequest, code, "evidence is closed once submitted")
+
+	assert.Equal(t, http.StatusOK, decideDispute(disputeId, "lost"))
+	assert.Equal(t, http.StatusBadRequest, decideDispute(disputeId, "won"), "the dispute is closed")
+
+	code, j = sendPaymentRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	net, _ := j.GetString("net")
+	operation, _ := j.GetString("operations", 1, "type")
+	assert.Equal(t, "0.00", net)
+	assert.Equal(t, "chargeback", operation)
+
+	balance, err := a.ledger.Balance(context.WithValue(context.Background(), "logger", a.lg), merchantId, "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, balance.Pending, "the chargeback takes the captured amount back")
+
+	code, _, _, _ = sendRefundRequest("1.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, code, "nothing is left to refund")
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/events", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 4, j.Len())
+	eventType, _ := j.GetString(0, "type")
+	eventDispute, _ := j.GetString(0, "data", "dispute_id")
+	assert.Equal(t, "dispute.lost", eventType)
+	assert.Equal(t, disputeId, eventDispute)
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/events?type=dispute.opened", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, j.Len())
+}
+
+func Test_DisputeLostAfterRefund(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	paymentId := capturedPayment(t, merchantId, secretKey)
+	disputeId := openDispute(t, paymentId, "13.6")
+
+	code, _, _, _ := sendRefundRequest("40.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, decideDispute(disputeId, "lost"))
+
+	code, j := sendPaymentRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	operation, _ := j.GetString("operations", 2, "type")
+	chargeback, _ := j.GetString("operations", 2, "amount")
+	assert.Equal(t, "chargeback", operation)
+	assert.Equal(t, "60.00", chargeback, "the refunded amount is not charged back")
+}
+
+func Test_DisputeWon(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	otherId, otherKey := register(t)
+	paymentId := capturedPayment(t, merchantId, secretKey)
+	disputes := "/merchant/" + merchantId + "/disputes/"
+
+	disputeId := openDispute(t, paymentId, "10.4")
+	code, _ := sendRequest(http.MethodGet, "/merchant/"+otherId+"/disputes/"+disputeId, otherKey, nil)
+	assert.Equal(t, http.StatusNotFound, code, "disputes of other merchants are not found")
+
+	code, _ = sendRequest(http.MethodPost, disputes+disputeId+"/evidence", secretKey, []byte(`{"text":""}`))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = sendEvidenceForm(merchantId, disputeId, secretKey, "", "tool.exe", []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff"))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = sendRequest(http.MethodPost, disputes+disputeId+"/evidence", secretKey, []byte(`{"text":"3-D Secure authenticated"}`))
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = sendRequest(http.MethodPost, disputes+disputeId+"/submit", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, decideDispute(disputeId, "won"))
+
+	code, j := sendRequest(http.MethodGet, "/merchant/"+merchantId+"/disputes", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString(0, "status")
+	reason, _ := j.GetString(0, "reason")
+	history, _ := j.Get(0, "history")
+	assert.Equal(t, "won", status)
+	assert.Equal(t, "Other fraud, card absent environment", reason)
+	assert.Equal(t, 3, history.Len())
+
+	_, j = sendPaymentRequest(merchantId, paymentId, secretKey)
+	net, _ := j.GetString("net")
+	assert.Equal(t, "100.00", net, "a won dispute keeps the money with the merchant")
+
+	openDispute(t, paymentId, "13.3")
+}
+
+func Test_DisputeSimulatorErrors(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	_, _, authorized, _, _ := sendAuthorizationRequest(authorizationPayload{}, merchantId, secretKey)
+	paymentId := capturedPayment(t, merchantId, secretKey)
+
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{`{"payment_id":"` + authorized + `","reason_code":"13.1"}`, http.StatusBadRequest},
+		{`{"payment_id":"` + paymentId + `","reason_code":"99.9"}`, http.StatusBadRequest},
+		{`{"payment_id":"` + paymentId + `","reason_code":"13.1","amount":"100.01"}`, http.StatusBadRequest},
+		{`{"payment_id":"` + paymentId + `","reason_code":"13.1","amount":"1"}`, http.StatusBadRequest},
+		{`{"payment_id":"cbs5ed2ngh6v0ckfvvng","reason_code":"13.1"}`, http.StatusNotFound},
+	} {
+		code, _ := sendRequest(http.MethodPost, "/simulator/disputes", adminKey, []byte(tc.body))
+		assert.Equal(t, tc.code, code, tc.body)
+	}
+
+	code, _ := sendRequest(http.MethodPost, "/simulator/disputes", secretKey, []byte(`{"payment_id":"`+paymentId+`","reason_code":"13.1"}`))
+	assert.Equal(t, http.StatusForbidden, code, "merchants cannot open disputes")
+
+	code, j := sendRequest(http.MethodPost, "/simulator/disputes", adminKey, []byte(`{"payment_id":"`+paymentId+`","reason_code":"13.1","amount":"40.00"}`))
+	assert.Equal(t, http.StatusCreated, code)
+	amount, _ := j.GetString("amount")
+	assert.Equal(t, "40.00", amount)
+	disputeId, _ := j.GetString("dispute_id")
+	assert.Equal(t, http.StatusBadRequest, decideDispute(disputeId, "under_review"), "only merchants submit disputes")
+	assert.Equal(t, http.StatusBadRequest, decideDispute(disputeId, "closed"))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+type eventResponse struct {
+	EventId   string            `json:"event_id"`
+	Type      string            `json:"type"`
+	PaymentId string            `json:"payment_id,omitempty"`
+	Data      map[string]string `json:"data,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+func (a *App) listEvents(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	list, err := a.events.List(ctx, mux.Vars(r)["merchant_id"], r.URL.Query().Get("type"))
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	res := make([]eventResponse, 0, len(list))
+	for _, e := range list {
+		res = append(res, eventResponse{e.Id, e.Type, e.PaymentId, e.Data, e.CreatedAt})
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,71 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const EventsCol = "events"
+
+// Event tells a merchant that something happened to one of its payments.
+// Data holds the details, e.g. the id and status of a dispute.
+type Event struct {
+	Id         string            `bson:"id"`
+	Type       string            `bson:"type"`
+	MerchantId string            `bson:"merchantid"`
+	PaymentId  string            `bson:"paymentid,omitempty"`
+	Data       map[string]string `bson:"data,omitempty"`
+	CreatedAt  time.Time         `bson:"createdat"`
+}
+
+// Emit records the event. With ctx being a session context it is part of its
+// transaction, so events are only emitted for changes that were committed.
+func Emit(ctx context.Context, db *mongo.Database, e Event) error {
+	if e.Id == "" {
+		e.Id = xid.New().String()
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	_, err := db.Collection(EventsCol).InsertOne(ctx, e)
+	return err
+}
+
+type EventRepository interface {
+	List(ctx context.Context, merchantId, eventType string) ([]Event, error)
+}
+
+type MongoEventRepository struct {
+	db *mongo.Database
+}
+
+func NewRepository(db *mongo.Database) MongoEventRepository {
+	return MongoEventRepository{db: db}
+}
+
+// List returns the events of the merchant, newest first, optionally only the
+// ones of a type.
+func (m MongoEventRepository) List(ctx context.Context, merchantId, eventType string) ([]Event, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	filter := bson.M{"merchantid": merchantId}
+	if eventType != "" {
+		filter["type"] = eventType
+	}
+	events := []Event{}
+	cursor, err := m.db.Collection(EventsCol).Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}, {Key: "id", Value: -1}}))
+	if err == nil {
+		err = cursor.All(ctx, &events)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+	return events, nil
+}
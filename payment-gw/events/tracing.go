@@ -0,0 +1,23 @@
+package events
+
+import (
+	"context"
+	"payment-gw/tracing"
+)
+
+type tracedRepository struct {
+	next EventRepository
+}
+
+func NewTracedRepository(next EventRepository) EventRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) List(ctx context.Context, merchantId, eventType string) ([]Event, error) {
+	ctx, span := tracing.Start(ctx, "events.List", tracing.WithAttributes(
+		tracing.String("merchant.id", merchantId), tracing.String("event.type", eventType)))
+	defer span.End()
+	events, err := t.next.List(ctx, merchantId, eventType)
+	span.RecordError(err)
+	return events, err
+}
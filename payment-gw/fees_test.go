@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"payment-gw/acquirer"
+	"payment-gw/gateway"
+	"payment-gw/pricing"
+	"testing"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/stretchr/testify/assert"
+)
+
+// withFees replaces the gateway for the test by one charging the fees.
+func withFees(t *testing.T, fees pricing.Config) {
+	acq, err := acquirer.NewSimulator(acquirer.SimulatorConfig{})
+	assert.NoError(t, err)
+	saved := a.gateway
+	a.gateway = gateway.NewRepository(a.db.Database(a.dbname), acq, fees, a.rates, a.cards)
+	t.Cleanup(func() { a.gateway = saved })
+}
+
+func sendPaymentRequest(merchantId, paymentId, secretKey string) (int, *jsonvalue.V) {
+	req, _ := http.NewRequest(http.MethodGet, "/merchant/"+merchantId+"/payment/"+paymentId, nil)
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(req)
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	return response.Code, j
+}
+
+func Test_CaptureFees(t *testing.T) {
+	clearTable()
+	withFees(t, pricing.Config{Default: pricing.Schedule{
+		Fee:       pricing.Fee{Percent: 1.5, Fixed: 25},
+		Refunds:   pricing.RefundReturn,
+		Overrides: []pricing.Override{{Brands: []string{"mastercard"}, Fee: pricing.Fee{Percent: 3}}},
+	}})
+	merchantId, secretKey := register(t)
+
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{CardNumber: "4111111111111111", Amount: "100.00", Currency: "EUR"}, merchantId, secretKey)
+	payload := []byte(`{"amount":"100.00"}`)
+	req, _ := http.NewRequest(http.MethodPost, "/merchant/"+merchantId+"/capture/"+paymentId, bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	fee, _ := j.GetString("fee")
+	net, _ := j.GetString("net")
+	assert.Equal(t, "1.75", fee)
+	assert.Equal(t, "98.25", net)
+
+	code, _, _, _ := sendRefundRequest("50.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+
+	code, j = sendPaymentRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	fee, _ = j.GetString("fee")
+	net, _ = j.GetString("net")
+	brand, _ := j.GetString("brand")
+	refundFee, _ := j.GetString("operations", 1, "fee")
+	assert.Equal(t, "0.87", fee, "half of the capture fee is returned with the refund")
+	assert.Equal(t, "49.13", net)
+	assert.Equal(t, "visa", brand)
+	assert.Equal(t, "-0.88", refundFee)
+
+	balance, err := a.ledger.Balance(context.WithValue(context.Background(), "logger", a.lg), merchantId, "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, 4913, balance.Pending, "the ledger agrees with the payment")
+
+	_, _, paymentId, _, _ = sendAuthorizationRequest(authorizationPayload{CardNumber: "5555555555554444", Amount: "10.00", Currency: "EUR"}, merchantId, secretKey)
+	sendCaptureRequest("10.00", merchantId, paymentId, secretKey)
+	_, j = sendPaymentRequest(merchantId, paymentId, secretKey)
+	fee, _ = j.GetString("fee")
+	assert.Equal(t, "0.30", fee, "mastercard override")
+}
+
+func Test_GetPaymentOfAnotherMerchant(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	otherId, otherKey := register(t)
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{}, merchantId, secretKey)
+
+	code, j := sendPaymentRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	authorized, _ := j.GetString("authorized")
+	net, _ := j.GetString("net")
+	assert.Equal(t, "100.00", authorized)
+	assert.Equal(t, "0.00", net)
+
+	code, _ = sendPaymentRequest(otherId, paymentId, otherKey)
+	assert.Equal(t, http.StatusForbidden, code)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"payment-gw/fraud"
+	"payment-gw/gateway"
+)
+
+// respondWithBlocked answers authorizations the fraud screening blocked,
+// they never reach the acquirer.
+func respondWithBlocked(w http.ResponseWriter) {
+	respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": fraud.ErrBlocked.Error(), "error_code": "fraud_blocked"})
+}
+
+// completeScreening records the outcome of the authorization of a screened
+// attempt, the declines of the acquirer count in the card testing rules.
+func (a *App) completeScreening(ctx context.Context, attempt fraud.Attempt, status string, err error) {
+	outcome := fraud.OutcomeApproved
+	switch {
+	case err == nil && status == statusHeld:
+		outcome = fraud.OutcomeHeld
+	case err == nil && status == statusRequiresAction:
+		outcome = fraud.OutcomeRequiresAction
+	case errors.Is(err, gateway.ErrBasedOnCreditCardNumber):
+		outcome = fraud.OutcomeDeclined
+	case err != nil:
+		outcome = fraud.OutcomeFailed
+	}
+	a.fraud.Complete(ctx, attempt.Id, outcome)
+}
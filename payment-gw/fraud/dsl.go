@@ -0,0 +1,476 @@
+package fraud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The conditions of the rules are expressions such as
+//
+//	attempts(card, 10m) >= 5
+//	bin in ["400000", "510510"] or country in ["KP"]
+//	amount > 1000 and currency == "USD"
+//	declines(ip, 1h, 5.00) >= 3
+//
+// Expressions combine comparisons (==, !=, <, <=, >, >=, in, not in) with
+// and, or, not and parentheses. The fields are amount (in major units),
+// currency, bin, country, ip and merchant. attempts(source, window) counts the
+// authorizations of the card, ip or merchant within the window before the
+// screened one, declines(source, window[, below]) counts those the acquirer
+// declined, only below an amount when given.
+
+var ErrInvalidRule = errors.New("invalid rule")
+
+type kind int
+
+const (
+	kindBool kind = iota
+	kindNumber
+	kindString
+	kindList
+)
+
+func (k kind) String() string {
+	return [...]string{"bool", "number", "string", "list"}[k]
+}
+
+type value struct {
+	b    bool
+	n    float64
+	s    string
+	list []value
+}
+
+func (v value) equal(o value) bool {
+	return v.b == o.b && v.n == o.n && v.s == o.s
+}
+
+// env is what expressions are evaluated against.
+type env struct {
+	ctx     context.Context
+	attempt Attempt
+	counter Counter
+	counts  map[Query]int
+}
+
+func (e *env) count(q Query) (int, error) {
+	if n, ok := e.counts[q]; ok {
+		return n, nil
+	}
+	n, err := e.counter.Count(e.ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	e.counts[q] = n
+	return n, nil
+}
+
+type node interface {
+	kind() kind
+	eval(e *env) (value, error)
+}
+
+type literal struct {
+	k kind
+	v value
+}
+
+func (l literal) kind() kind               { return l.k }
+func (l literal) eval(*env) (value, error) { return l.v, nil }
+
+var fields = map[string]kind{
+	"amount":   kindNumber,
+	"currency": kindString,
+	"bin":      kindString,
+	"country":  kindString,
+	"ip":       kindString,
+	"merchant": kindString,
+}
+
+type field string
+
+func (f field) kind() kind { return fields[string(f)] }
+
+func (f field) eval(e *env) (value, error) {
+	a := e.attempt
+	switch f {
+	case "amount":
+		return value{n: float64(a.Amount) / 100}, nil
+	case "currency":
+		return value{s: a.Currency}, nil
+	case "bin":
+		return value{s: a.BIN}, nil
+	case "country":
+		return value{s: a.Country}, nil
+	case "ip":
+		return value{s: a.IP}, nil
+	}
+	return value{s: a.MerchantId}, nil
+}
+
+type list []node
+
+func (l list) kind() kind { return kindList }
+
+func (l list) eval(e *env) (value, error) {
+	v := value{list: make([]value, 0, len(l))}
+	for _, n := range l {
+		item, err := n.eval(e)
+		if err != nil {
+			return value{}, err
+		}
+		v.list = append(v.list, item)
+	}
+	return v, nil
+}
+
+// call counts attempts of a source within a window.
+type call struct {
+	declines bool
+	source   string
+	window   time.Duration
+	below    int
+}
+
+func (c call) kind() kind { return kindNumber }
+
+func (c call) eval(e *env) (value, error) {
+	q := Query{Source: c.source, Value: e.attempt.source(c.source), Window: c.window, Declined: c.declines, Below: c.below,
+		Except: e.attempt.Id}
+	if q.Value == "" {
+		return value{}, nil
+	}
+	n, err := e.count(q)
+	return value{n: float64(n)}, err
+}
+
+type logical struct {
+	op          string
+	left, right node
+}
+
+func (l logical) kind() kind { return kindBool }
+
+func (l logical) eval(e *env) (value, error) {
+	left, err := l.left.eval(e)
+	if err != nil {
+		return value{}, err
+	}
+	if l.op == "and" && !left.b || l.op == "or" && left.b {
+		return left, nil
+	}
+	return l.right.eval(e)
+}
+
+type not struct{ operand node }
+
+func (n not) kind() kind { return kindBool }
+
+func (n not) eval(e *env) (value, error) {
+	v, err := n.operand.eval(e)
+	return value{b: !v.b}, err
+}
+
+type comparison struct {
+	op          string
+	left, right node
+}
+
+func (c comparison) kind() kind { return kindBool }
+
+func (c comparison) eval(e *env) (value, error) {
+	left, err := c.left.eval(e)
+	if err != nil {
+		return value{}, err
+	}
+	right, err := c.right.eval(e)
+	if err != nil {
+		return value{}, err
+	}
+	var b bool
+	switch c.op {
+	case "==":
+		b = left.equal(right)
+	case "!=":
+		b = !left.equal(right)
+	case "<":
+		b = left.n < right.n
+	case "<=":
+		b = left.n <= right.n
+	case ">":
+		b = left.n > right.n
+	case ">=":
+		b = left.n >= right.n
+	case "in", "not in":
+		for _, item := range right.list {
+			b = b || left.equal(item)
+		}
+		b = b != (c.op == "not in")
+	}
+	return value{b: b}, nil
+}
+
+type token struct {
+	text string
+	pos  int
+	str  bool
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{s[i+1 : i+1+end], i, true})
+			i += end + 2
+		case strings.ContainsRune("()[],", c):
+			tokens = append(tokens, token{string(c), i, false})
+			i++
+		case strings.ContainsRune("=!<>", c):
+			end := i + 1
+			if end < len(s) && s[end] == '=' {
+				end++
+			}
+			tokens = append(tokens, token{s[i:end], i, false})
+			i = end
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '.' || c == '_':
+			end := i
+			for end < len(s) && (unicode.IsLetter(rune(s[end])) || unicode.IsDigit(rune(s[end])) || s[end] == '.' || s[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, token{s[i:end], i, false})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	src    string
+	tokens []token
+	pos    int
+}
+
+// compile parses a condition and checks its types.
+func compile(s string) (node, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{src: s, tokens: tokens}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if n.kind() != kindBool {
+		return nil, fmt.Errorf("condition is a %s, not a bool", n.kind())
+	}
+	return n, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	pos := len(p.src)
+	if p.pos < len(p.tokens) {
+		pos = p.tokens[p.pos].pos
+	}
+	return fmt.Errorf(format+" at %d", append(args, pos)...)
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].str {
+		return p.tokens[p.pos].text
+	}
+	return ""
+}
+
+func (p *parser) accept(text string) bool {
+	if p.peek() == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("expected %q", text)
+	}
+	return nil
+}
+
+func (p *parser) or() (node, error) {
+	return p.logical("or", p.and)
+}
+
+func (p *parser) and() (node, error) {
+	return p.logical("and", p.not)
+}
+
+func (p *parser) logical(op string, next func() (node, error)) (node, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(op) {
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if left.kind() != kindBool || right.kind() != kindBool {
+			return nil, p.errorf("%s needs bool operands", op)
+		}
+		left = logical{op, left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (node, error) {
+	if p.accept("not") {
+		operand, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		if operand.kind() != kindBool {
+			return nil, p.errorf("not needs a bool operand")
+		}
+		return not{operand}, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=", "in":
+		p.pos++
+	case "not":
+		p.pos++
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		op = "not in"
+	default:
+		return left, nil
+	}
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case op == "in" || op == "not in":
+		if right.kind() != kindList || left.kind() == kindList || left.kind() == kindBool {
+			return nil, p.errorf("%s needs a number or string and a list", op)
+		}
+		for _, item := range right.(list) {
+			if item.kind() != left.kind() {
+				return nil, p.errorf("%s list of a %s holds a %s", op, left.kind(), item.kind())
+			}
+		}
+	case op == "==" || op == "!=":
+		if left.kind() != right.kind() || left.kind() == kindList {
+			return nil, p.errorf("cannot compare a %s with a %s", left.kind(), right.kind())
+		}
+	default:
+		if left.kind() != kindNumber || right.kind() != kindNumber {
+			return nil, p.errorf("%s needs numbers", op)
+		}
+	}
+	return comparison{op, left, right}, nil
+}
+
+func (p *parser) operand() (node, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, p.errorf("unexpected end")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch {
+	case t.str:
+		return literal{kindString, value{s: t.text}}, nil
+	case t.text == "(":
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case t.text == "[":
+		var l list
+		for !p.accept("]") {
+			if len(l) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			item, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, item)
+		}
+		return l, nil
+	case t.text == "true" || t.text == "false":
+		return literal{kindBool, value{b: t.text == "true"}}, nil
+	case t.text == "attempts" || t.text == "declines":
+		return p.call(t.text)
+	}
+	if _, ok := fields[t.text]; ok {
+		return field(t.text), nil
+	}
+	if n, err := strconv.ParseFloat(t.text, 64); err == nil {
+		return literal{kindNumber, value{n: n}}, nil
+	}
+	p.pos--
+	return nil, p.errorf("unknown %q", t.text)
+}
+
+func (p *parser) call(name string) (node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	c := call{declines: name == "declines"}
+	c.source = p.peek()
+	if !sources[c.source] {
+		return nil, p.errorf("%s counts by card, ip or merchant", name)
+	}
+	p.pos++
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	window, err := time.ParseDuration(p.peek())
+	if err != nil || window <= 0 {
+		return nil, p.errorf("%s needs a window such as 10m or 24h", name)
+	}
+	c.window = window
+	p.pos++
+	if c.declines && p.accept(",") {
+		below, err := strconv.ParseFloat(p.peek(), 64)
+		if err != nil || below <= 0 {
+			return nil, p.errorf("declines needs a positive amount")
+		}
+		c.below = int(math.Round(below * 100))
+		p.pos++
+	}
+	return c, p.expect(")")
+}
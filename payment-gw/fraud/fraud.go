@@ -0,0 +1,303 @@
+package fraud
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const AttemptsCol = "fraud_attempts"
+
+// Decisions of the screening, from the least to the most severe.
+const (
+	DecisionAllow  = "allow"
+	DecisionReview = "review"
+	DecisionBlock  = "block"
+)
+
+// Outcomes of screened authorizations.
+const (
+	OutcomeApproved       = "approved"
+	OutcomeHeld           = "held"
+	OutcomeRequiresAction = "requires_action"
+	OutcomeDeclined       = "declined"
+	OutcomeBlocked        = "blocked"
+	OutcomeFailed         = "failed"
+)
+
+var ErrBlocked = errors.New("payment blocked by fraud screening")
+
+var severity = map[string]int{DecisionAllow: 0, DecisionReview: 1, DecisionBlock: 2}
+
+// sources attempts are counted by.
+var sources = map[string]bool{"card": true, "ip": true, "merchant": true}
+
+type Rule struct {
+	Name string `yaml:"name"`
+	// When is the condition of the rule, see dsl.go
+	When string `yaml:"when"`
+	// Action is review or block
+	Action string `yaml:"action"`
+}
+
+type Config struct {
+	// Rules are all evaluated, the most severe action of the triggered ones
+	// is the decision
+	Rules []Rule `yaml:"rules"`
+	// FingerprintKey is the secret the card numbers are fingerprinted with,
+	// a random one is used when empty so the attempts of a card are only
+	// known to the process that screened them
+	FingerprintKey string `yaml:"fingerprint_key"`
+}
+
+func (c Config) Validate() error {
+	if c.FingerprintKey != "" && len(c.FingerprintKey) < 32 {
+		return errors.New("fingerprint_key must be at least 32 characters")
+	}
+	var errs []string
+	names := map[string]bool{}
+	for i, r := range c.Rules {
+		switch {
+		case r.Name == "":
+			errs = append(errs, fmt.Sprintf("rules[%d]: name is required", i))
+		case names[r.Name]:
+			errs = append(errs, fmt.Sprintf("rules[%d]: duplicate name %q", i, r.Name))
+		}
+		names[r.Name] = true
+		if r.Action != DecisionReview && r.Action != DecisionBlock {
+			errs = append(errs, fmt.Sprintf("rules[%d].action must be review or block, got %q", i, r.Action))
+		}
+		if _, err := compile(r.When); err != nil {
+			errs = append(errs, fmt.Sprintf("rules[%d].when: %v", i, err))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%w: %s", ErrInvalidRule, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Screening is the decision on an authorization and the rules that triggered
+// it.
+type Screening struct {
+	Decision string   `bson:"decision"`
+	Rules    []string `bson:"rules"`
+}
+
+// Attempt is an authorization as seen by the screening. Cards are known by a
+// fingerprint of their number keyed with a secret, so it cannot be reversed
+// by hashing every card number of a BIN, and their BIN, never by their
+// number.
+type Attempt struct {
+	Id         string    `bson:"id"`
+	MerchantId string    `bson:"merchantid"`
+	Card       string    `bson:"card"`
+	BIN        string    `bson:"bin"`
+	IP         string    `bson:"ip,omitempty"`
+	Country    string    `bson:"country,omitempty"`
+	Amount     int       `bson:"amount"`
+	Currency   string    `bson:"currency"`
+	Screening  Screening `bson:"screening"`
+	Outcome    string    `bson:"outcome,omitempty"`
+	CreatedAt  time.Time `bson:"createdat"`
+	// number is the card number until the screener fingerprints it
+	number string
+}
+
+func NewAttempt(merchantId, cardNumber, ip, country string, amount int, currency string) Attempt {
+	bin := cardNumber
+	if len(bin) > 6 {
+		bin = bin[:6]
+	}
+	return Attempt{MerchantId: merchantId, BIN: bin, IP: ip, Country: country, Amount: amount, Currency: currency,
+		number: cardNumber}
+}
+
+func (a Attempt) source(name string) string {
+	switch name {
+	case "card":
+		return a.Card
+	case "ip":
+		return a.IP
+	}
+	return a.MerchantId
+}
+
+// Query counts the attempts of a source within a window, only the declined
+// ones below an amount when set. Except is the attempt being screened, which
+// is not counted.
+type Query struct {
+	Source   string
+	Value    string
+	Window   time.Duration
+	Declined bool
+	Below    int
+	Except   string
+}
+
+type Counter interface {
+	Count(ctx context.Context, q Query) (int, error)
+}
+
+type compiledRule struct {
+	Rule
+	condition node
+}
+
+// Screener evaluates the rules against attempts.
+type Screener struct {
+	rules   []compiledRule
+	counter Counter
+	key     []byte
+}
+
+func NewScreener(c Config, counter Counter) (Screener, error) {
+	if err := c.Validate(); err != nil {
+		return Screener{}, err
+	}
+	s := Screener{counter: counter, key: []byte(c.FingerprintKey)}
+	if len(s.key) == 0 {
+		s.key = make([]byte, 32)
+		if _, err := rand.Read(s.key); err != nil {
+			return Screener{}, err
+		}
+	}
+	for _, r := range c.Rules {
+		condition, _ := compile(r.When)
+		s.rules = append(s.rules, compiledRule{r, condition})
+	}
+	return s, nil
+}
+
+// fingerprint replaces the card number of an attempt with its HMAC.
+func (s Screener) fingerprint(a Attempt) Attempt {
+	if a.number == "" {
+		return a
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(a.number))
+	a.Card, a.number = hex.EncodeToString(mac.Sum(nil)), ""
+	return a
+}
+
+func (s Screener) Screen(ctx context.Context, a Attempt) (Screening, error) {
+	a = s.fingerprint(a)
+	e := &env{ctx: ctx, attempt: a, counter: s.counter, counts: map[Query]int{}}
+	screening := Screening{Decision: DecisionAllow, Rules: []string{}}
+	for _, r := range s.rules {
+		v, err := r.condition.eval(e)
+		if err != nil {
+			return Screening{}, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		if !v.b {
+			continue
+		}
+		screening.Rules = append(screening.Rules, r.Name)
+		if severity[r.Action] > severity[screening.Decision] {
+			screening.Decision = r.Action
+		}
+	}
+	return screening, nil
+}
+
+type ScreeningRepository interface {
+	// Screen saves an attempt and decides on it, so the attempts screened
+	// concurrently count each other
+	Screen(ctx context.Context, a Attempt) (Attempt, error)
+	// Complete records the outcome of the authorization of an attempt
+	Complete(ctx context.Context, attemptId, outcome string) error
+}
+
+type MongoScreeningRepository struct {
+	db       *mongo.Database
+	screener Screener
+	now      func() time.Time
+}
+
+func NewRepository(db *mongo.Database, c Config) (MongoScreeningRepository, error) {
+	m := MongoScreeningRepository{db: db, now: time.Now}
+	screener, err := NewScreener(c, m)
+	if err != nil {
+		return MongoScreeningRepository{}, err
+	}
+	m.screener = screener
+	return m, nil
+}
+
+// Screen inserts the attempt before counting the others, an attempt screened
+// at the same time is either inserted before the counts of this one or counts
+// this one.
+func (m MongoScreeningRepository) Screen(ctx context.Context, a Attempt) (Attempt, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	a = m.screener.fingerprint(a)
+	a.Id, a.CreatedAt = xid.New().String(), m.now().UTC()
+	a.Screening = Screening{Decision: DecisionAllow, Rules: []string{}}
+	if _, err := m.db.Collection(AttemptsCol).InsertOne(ctx, a); err != nil {
+		lg.Error().Msg(err.Error())
+		return Attempt{}, err
+	}
+
+	screening, err := m.screener.Screen(ctx, a)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		m.Complete(ctx, a.Id, OutcomeFailed)
+		return Attempt{}, err
+	}
+	a.Screening = screening
+	update := bson.M{"screening": screening}
+	if screening.Decision == DecisionBlock {
+		a.Outcome = OutcomeBlocked
+		update["outcome"] = OutcomeBlocked
+	}
+	if _, err := m.db.Collection(AttemptsCol).UpdateOne(ctx, bson.M{"id": a.Id}, bson.M{"$set": update}); err != nil {
+		lg.Error().Msg(err.Error())
+		return Attempt{}, err
+	}
+	return a, nil
+}
+
+func (m MongoScreeningRepository) Complete(ctx context.Context, attemptId, outcome string) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	if _, err := m.db.Collection(AttemptsCol).UpdateOne(ctx, bson.M{"id": attemptId},
+		bson.M{"$set": bson.M{"outcome": outcome}}); err != nil {
+		lg.Error().Msg(err.Error())
+		return err
+	}
+	return nil
+}
+
+func (m MongoScreeningRepository) Count(ctx context.Context, q Query) (int, error) {
+	filter := bson.M{"createdat": bson.M{"$gte": m.now().UTC().Add(-q.Window)}}
+	switch q.Source {
+	case "card":
+		filter["card"] = q.Value
+	case "ip":
+		filter["ip"] = q.Value
+	default:
+		filter["merchantid"] = q.Value
+	}
+	if q.Declined {
+		filter["outcome"] = OutcomeDeclined
+	}
+	if q.Below > 0 {
+		filter["amount"] = bson.M{"$lt": q.Below}
+	}
+	if q.Except != "" {
+		filter["id"] = bson.M{"$ne": q.Except}
+	}
+	n, err := m.db.Collection(AttemptsCol).CountDocuments(ctx, filter)
+	return int(n), err
+}
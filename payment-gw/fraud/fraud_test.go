@@ -0,0 +1,132 @@
+package fraud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// counter answers queries with fixed counts and records them.
+type counter struct {
+	counts  map[Query]int
+	queries []Query
+}
+
+func (c *counter) Count(ctx context.Context, q Query) (int, error) {
+	c.queries = append(c.queries, q)
+	return c.counts[q], nil
+}
+
+func TestCompile(t *testing.T) {
+	for _, cond := range []string{
+		`attempts(card, 10m) >= 5`,
+		`bin in ["400000", "510510"] or country in ["KP"]`,
+		`amount > 1000 and currency == "USD"`,
+		`declines(ip, 1h, 5.00) >= 3`,
+		`not (country not in ["PL", "DE"]) and (merchant != "x" or true)`,
+		`amount in [1, 2.5]`,
+	} {
+		_, err := compile(cond)
+		assert.NoError(t, err, cond)
+	}
+
+	for cond, msg := range map[string]string{
+		`amount > "1000"`:              `> needs numbers at 15`,
+		`currency == 3`:                `cannot compare a string with a number`,
+		`attempts(bin, 10m) > 1`:       `attempts counts by card, ip or merchant at 9`,
+		`attempts(card, soon) > 1`:     `attempts needs a window such as 10m or 24h`,
+		`attempts(card, 1h, 5.00) > 1`: `expected ")"`,
+		`declines(ip, 1h, 0) > 1`:      `declines needs a positive amount`,
+		`amount > 10 and`:              `unexpected end at 15`,
+		`amount`:                       `condition is a number, not a bool`,
+		`country in ["PL", 1]`:         `in list of a string holds a number`,
+		`bin in "400000"`:              `in needs a number or string and a list`,
+		`velocity(card) > 1`:           `unknown "velocity" at 0`,
+		`amount > 10 amount`:           `unexpected "amount" at 12`,
+		`country == "PL`:               `unterminated string at 11`,
+		`amount > 10 & true`:           `unexpected '&' at 12`,
+	} {
+		_, err := compile(cond)
+		if assert.Error(t, err, cond) {
+			assert.Contains(t, err.Error(), msg, cond)
+		}
+	}
+}
+
+func TestScreen(t *testing.T) {
+	c := &counter{counts: map[Query]int{}}
+	s, err := NewScreener(Config{Rules: []Rule{
+		{Name: "card_velocity", When: `attempts(card, 10m) >= 5`, Action: DecisionBlock},
+		{Name: "blocked_bins", When: `bin in ["400000"] or country in ["KP"]`, Action: DecisionBlock},
+		{Name: "large_amount", When: `amount > 1000 and currency == "USD"`, Action: DecisionReview},
+		{Name: "card_testing", When: `declines(ip, 1h, 5.00) >= 3`, Action: DecisionBlock},
+		{Name: "busy_card", When: `attempts(card, 10m) >= 3`, Action: DecisionReview},
+	}}, c)
+	assert.NoError(t, err)
+
+	a := s.fingerprint(NewAttempt("m1", "5555555555554444", "203.0.113.7", "PL", 100001, "USD"))
+	assert.Equal(t, "555555", a.BIN)
+	assert.Len(t, a.Card, 64, "cards are known by a fingerprint")
+	assert.Empty(t, a.number)
+
+	screening, err := s.Screen(context.Background(), a)
+	assert.NoError(t, err)
+	assert.Equal(t, Screening{Decision: DecisionReview, Rules: []string{"large_amount"}}, screening)
+	assert.Len(t, c.queries, 2, "the count of the card is shared by two rules")
+
+	a.Currency = "EUR"
+	c.counts[Query{Source: "card", Value: a.Card, Window: 10 * time.Minute}] = 3
+	c.counts[Query{Source: "ip", Value: a.IP, Window: time.Hour, Declined: true, Below: 500}] = 3
+	screening, err = s.Screen(context.Background(), a)
+	assert.NoError(t, err)
+	assert.Equal(t, Screening{Decision: DecisionBlock, Rules: []string{"card_testing", "busy_card"}}, screening)
+
+	a = NewAttempt("m1", "4000000000000002", "", "", 100, "EUR")
+	screening, err = s.Screen(context.Background(), a)
+	assert.NoError(t, err)
+	assert.Equal(t, Screening{Decision: DecisionBlock, Rules: []string{"blocked_bins"}}, screening)
+	assert.Len(t, c.queries, 5, "attempts without an ip are not counted by ip")
+}
+
+func TestFingerprint(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	s1, err := NewScreener(Config{FingerprintKey: key}, &counter{})
+	assert.NoError(t, err)
+	s2, err := NewScreener(Config{FingerprintKey: key}, &counter{})
+	assert.NoError(t, err)
+	other, err := NewScreener(Config{}, &counter{})
+	assert.NoError(t, err)
+
+	a := NewAttempt("m1", "5555555555554444", "", "", 100, "EUR")
+	assert.Empty(t, a.Card)
+	assert.Equal(t, s1.fingerprint(a).Card, s2.fingerprint(a).Card, "the same key gives the same fingerprint")
+	assert.NotEqual(t, s1.fingerprint(a).Card, other.fingerprint(a).Card, "the fingerprint depends on the key")
+	sum := sha256.Sum256([]byte("5555555555554444"))
+	assert.NotEqual(t, hex.EncodeToString(sum[:]), s1.fingerprint(a).Card, "the fingerprint is keyed")
+
+	_, err = NewScreener(Config{FingerprintKey: "short"}, &counter{})
+	assert.Error(t, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	err := Config{Rules: []Rule{
+		{Name: "a", When: `amount > 1`, Action: DecisionBlock},
+		{Name: "a", When: `amount >`, Action: "deny"},
+		{When: `true`, Action: DecisionReview},
+	}}.Validate()
+	assert.True(t, errors.Is(err, ErrInvalidRule))
+	for _, msg := range []string{
+		`rules[1]: duplicate name "a"`,
+		`rules[1].action must be review or block, got "deny"`,
+		`rules[1].when: unexpected end at 8`,
+		`rules[2]: name is required`,
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
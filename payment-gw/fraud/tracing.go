@@ -0,0 +1,32 @@
+package fraud
+
+import (
+	"context"
+	"payment-gw/tracing"
+)
+
+type tracedRepository struct {
+	next ScreeningRepository
+}
+
+func NewTracedRepository(next ScreeningRepository) ScreeningRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) Screen(ctx context.Context, a Attempt) (Attempt, error) {
+	ctx, span := tracing.Start(ctx, "fraud.Screen", tracing.WithAttributes(tracing.String("merchant.id", a.MerchantId)))
+	defer span.End()
+	a, err := t.next.Screen(ctx, a)
+	span.SetAttributes(tracing.String("fraud.attempt_id", a.Id), tracing.String("fraud.decision", a.Screening.Decision))
+	span.RecordError(err)
+	return a, err
+}
+
+func (t tracedRepository) Complete(ctx context.Context, attemptId, outcome string) error {
+	ctx, span := tracing.Start(ctx, "fraud.Complete", tracing.WithAttributes(
+		tracing.String("fraud.attempt_id", attemptId), tracing.String("fraud.outcome", outcome)))
+	defer span.End()
+	err := t.next.Complete(ctx, attemptId, outcome)
+	span.RecordError(err)
+	return err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"payment-gw/fraud"
+	"testing"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/stretchr/testify/assert"
+)
+
+func withFraud(t *testing.T, c fraud.Config) {
+	screening, err := fraud.NewRepository(a.db.Database(a.dbname), c)
+	assert.NoError(t, err)
+	saved := a.fraud
+	a.fraud = screening
+	t.Cleanup(func() { a.fraud = saved })
+}
+
+func sendScreenedAuthorization(p authorizationPayload, shopperIP, country, merchantId, secretKey string) (int, *jsonvalue.V) {
+	body := map[string]string{}
+	json.Unmarshal(createAuthorizationPayload(p), &body)
+	body["shopper_ip"], body["country"] = shopperIP, country
+	payload, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, "/merchant/"+merchantId+"/authorize", bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(req)
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	return response.Code, j
+}
+
+func Test_FraudScreening(t *testing.T) {
+	clearTable()
+	withFraud(t, fraud.Config{Rules: []fraud.Rule{
+		{Name: "card velocity", When: "attempts(card, 10m) >= 4", Action: fraud.DecisionBlock},
+		{Name: "blocked bins", When: `bin in ["510510"]`, Action: fraud.DecisionBlock},
+		{Name: "high risk country", When: `country in ["KP", "IR"]`, Action: fraud.DecisionReview},
+		{Name: "large amount", When: `amount > 1000 and currency == "USD"`, Action: fraud.DecisionReview},
+		{Name: "card testing", When: "declines(ip, 1h, 20.00) >= 2", Action: fraud.DecisionBlock},
+	}})
+	merchantId, secretKey := register(t)
+
+	t.Run("allow", func(t *testing.T) {
+		code, j := sendScreenedAuthorization(authorizationPayload{CardNumber: "4111111111111111"}, "198.51.100.1", "PL", merchantId, secretKey)
+		assert.Equal(t, http.StatusOK, code)
+		decision, _ := j.GetString("screening", "decision")
+		assert.Equal(t, fraud.DecisionAllow, decision)
+
+		paymentId, _ := j.GetString("payment_id")
+		_, p := sendPaymentRequest(merchantId, paymentId, secretKey)
+		decision, _ = p.GetString("screening", "decision")
+		assert.Equal(t, fraud.DecisionAllow, decision)
+		rules, _ := p.Get("screening", "rules")
+		assert.Equal(t, 0, rules.Len())
+	})
+
+	t.Run("review is stored on the payment", func(t *testing.T) {
+		code, j := sendScreenedAuthorization(authorizationPayload{CardNumber: "4012888888881881", Amount: "1500.00"}, "198.51.100.2", "KP", merchantId, secretKey)
+		assert.Equal(t, http.StatusAccepted, code)
+		paymentId, _ := j.GetString("payment_id")
+
+		_, p := sendPaymentRequest(merchantId, paymentId, secretKey)
+		decision, _ := p.GetString("screening", "decision")
+		assert.Equal(t, fraud.DecisionReview, decision)
+		first, _ := p.GetString("screening", "rules", 0)
+		second, _ := p.GetString("screening", "rules", 1)
+		assert.Equal(t, []string{"high risk country", "large amount"}, []string{first, second})
+	})
+
+	t.Run("blocked bin", func(t *testing.T) {
+		code, j := sendScreenedAuthorization(authorizationPayload{CardNumber: "5105105105105100"}, "198.51.100.3", "PL", merchantId, secretKey)
+		assert.Equal(t, http.StatusBadRequest, code)
+		errorCode, _ := j.GetString("error_code")
+		assert.Equal(t, "fraud_blocked", errorCode)
+		_, err := j.GetString("payment_id")
+		assert.Error(t, err)
+	})
+
+	t.Run("card velocity", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			code, _ := sendScreenedAuthorization(authorizationPayload{CardNumber: "4242424242424242"}, "198.51.100.4", "PL", merchantId, secretKey)
+			assert.Equal(t, http.StatusOK, code)
+		}
+		code, j := sendScreenedAuthorization(authorizationPayload{CardNumber: "4242424242424242"}, "198.51.100.5", "PL", merchantId, secretKey)
+		assert.Equal(t, http.StatusBadRequest, code)
+		errorCode, _ := j.GetString("error_code")
+		assert.Equal(t, "fraud_blocked", errorCode)
+	})
+
+	t.Run("card testing", func(t *testing.T) {
+		for _, card := range []string{"4000056655665556", "4000002500003155"} {
+			code, j := sendScreenedAuthorization(authorizationPayload{CardNumber: card, Amount: "5.05"}, "203.0.113.7", "", merchantId, secretKey)
+			assert.Equal(t, http.StatusBadRequest, code)
+			declineCode, _ := j.GetString("decline_code")
+			assert.NotEmpty(t, declineCode)
+		}
+		// large declines do not count
+		code, _ := sendScreenedAuthorization(authorizationPayload{Amount: "50.05"}, "203.0.113.8", "", merchantId, secretKey)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = sendScreenedAuthorization(authorizationPayload{}, "203.0.113.8", "", merchantId, secretKey)
+		assert.Equal(t, http.StatusOK, code)
+
+		code, j := sendScreenedAuthorization(authorizationPayload{CardNumber: "4000003800000008"}, "203.0.113.7", "", merchantId, secretKey)
+		assert.Equal(t, http.StatusBadRequest, code)
+		errorCode, _ := j.GetString("error_code")
+		assert.Equal(t, "fraud_blocked", errorCode)
+	})
+
+	t.Run("invalid shopper ip", func(t *testing.T) {
+		code, _ := sendScreenedAuthorization(authorizationPayload{}, "not-an-ip", "PL", merchantId, secretKey)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
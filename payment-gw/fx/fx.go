@@ -0,0 +1,110 @@
+package fx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrNoRate           = errors.New("no exchange rate for the currency pair")
+	ErrInvalidRateTable = errors.New("invalid rate table")
+)
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// RateProvider quotes the rate converting an amount in from to an amount in
+// to. Same currency pairs are not asked for.
+type RateProvider interface {
+	Rate(ctx context.Context, from, to string) (float64, error)
+}
+
+// Convert converts an amount in minor units at rate, rounding half away from
+// zero.
+func Convert(amount int, rate float64) int {
+	return int(math.Round(float64(amount) * rate))
+}
+
+type Config struct {
+	// RatesFile is a YAML rate table, without one only payments in the
+	// settlement currency of the merchant are accepted
+	RatesFile string `yaml:"rates_file"`
+}
+
+// Table is a rate table against a base currency, read from a file for local
+// runs. Cross rates are derived through the base and rounded to six decimals.
+type Table struct {
+	// Base is the currency the rates are quoted against
+	Base string `yaml:"base"`
+	// Rates are the units of each currency one unit of the base buys
+	Rates map[string]float64 `yaml:"rates"`
+}
+
+func LoadTable(path string) (Table, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Table{}, err
+	}
+	var t Table
+	if err := yaml.Unmarshal(b, &t); err != nil {
+		return Table{}, fmt.Errorf("%w: %v", ErrInvalidRateTable, err)
+	}
+	if err := t.Validate(); err != nil {
+		return Table{}, err
+	}
+	return t, nil
+}
+
+func (t Table) Validate() error {
+	var errs []string
+	if !currencyCode.MatchString(t.Base) {
+		errs = append(errs, fmt.Sprintf("base must be a currency code, got %q", t.Base))
+	}
+	for currency, rate := range t.Rates {
+		if !currencyCode.MatchString(currency) {
+			errs = append(errs, fmt.Sprintf("rates: %q is not a currency code", currency))
+		}
+		if rate <= 0 {
+			errs = append(errs, fmt.Sprintf("rates.%s must be positive", currency))
+		}
+	}
+	if rate, ok := t.Rates[t.Base]; ok && rate != 1 {
+		errs = append(errs, fmt.Sprintf("rates.%s of the base must be 1", t.Base))
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%w: %s", ErrInvalidRateTable, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (t Table) Rate(ctx context.Context, from, to string) (float64, error) {
+	fromRate, ok := t.rate(from)
+	toRate, ok2 := t.rate(to)
+	if !ok || !ok2 {
+		return 0, fmt.Errorf("%w: %s to %s", ErrNoRate, from, to)
+	}
+	return math.Round(toRate/fromRate*1e6) / 1e6, nil
+}
+
+func (t Table) rate(currency string) (float64, bool) {
+	if currency == t.Base {
+		return 1, true
+	}
+	rate, ok := t.Rates[currency]
+	return rate, ok
+}
+
+// NoRates is the provider without a rate table.
+type NoRates struct{}
+
+func (NoRates) Rate(ctx context.Context, from, to string) (float64, error) {
+	return 0, fmt.Errorf("%w: %s to %s", ErrNoRate, from, to)
+}
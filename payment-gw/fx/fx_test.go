@@ -0,0 +1,57 @@
+package fx
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableRate(t *testing.T) {
+	table, err := LoadTable("testdata/rates.yaml")
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		from, to string
+		rate     float64
+	}{
+		{"EUR", "USD", 1.085},
+		{"USD", "EUR", 0.921659},
+		{"USD", "GBP", 0.788940},
+		{"GBP", "PLN", 5.035047},
+		{"PLN", "PLN", 1},
+	} {
+		rate, err := table.Rate(context.Background(), tc.from, tc.to)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.rate, rate, tc.from+" to "+tc.to)
+	}
+
+	_, err = table.Rate(context.Background(), "USD", "JPY")
+	assert.True(t, errors.Is(err, ErrNoRate))
+	_, err = NoRates{}.Rate(context.Background(), "USD", "EUR")
+	assert.True(t, errors.Is(err, ErrNoRate))
+}
+
+func TestConvert(t *testing.T) {
+	assert.Equal(t, 9217, Convert(10000, 0.921659))
+	assert.Equal(t, 1, Convert(1, 0.5), "halves round away from zero")
+	assert.Equal(t, -46, Convert(-50, 0.921659))
+	assert.Equal(t, 0, Convert(0, 1.085))
+}
+
+func TestTableValidate(t *testing.T) {
+	err := Table{Base: "euro", Rates: map[string]float64{"usd": 1.08, "GBP": 0}}.Validate()
+	assert.True(t, errors.Is(err, ErrInvalidRateTable))
+	for _, msg := range []string{
+		`base must be a currency code, got "euro"`,
+		`rates: "usd" is not a currency code`,
+		"rates.GBP must be positive",
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+	assert.Error(t, Table{Base: "EUR", Rates: map[string]float64{"EUR": 1.1}}.Validate())
+
+	_, err = LoadTable("testdata/missing.yaml")
+	assert.Error(t, err)
+}
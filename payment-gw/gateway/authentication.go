@@ -0,0 +1,202 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"payment-gw/acquirer"
+	"payment-gw/fraud"
+	"payment-gw/fx"
+	"payment-gw/risk"
+	"payment-gw/routing"
+	"payment-gw/threeds"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrPaymentRequiresAction = errors.New("payment requires the authentication of the shopper")
+	ErrNoActionRequired      = errors.New("payment does not require an action")
+	ErrAuthenticationFailed  = errors.New("authentication of the shopper failed")
+)
+
+// Authentication is the 3-D Secure authentication of the shopper. While the
+// shopper completes a challenge the payment requires an action, the amount
+// and the sealed card are kept until the merchant confirms it.
+type Authentication struct {
+	threeds.Result `bson:",inline"`
+	Amount         int         `bson:"amount"`
+	Card           *SealedCard `bson:"card,omitempty"`
+	// ExpiresAt is when the challenge expires, the payment is voided if it
+	// was not confirmed by then
+	ExpiresAt time.Time `bson:"expiresat,omitempty"`
+}
+
+func (req AuthorizeRequest) authentication() *Authentication {
+	if req.Authentication == nil {
+		return nil
+	}
+	return &Authentication{Result: *req.Authentication, Amount: req.Amount}
+}
+
+// RequiresAction tells whether the payment waits for the authentication of
+// the shopper.
+func (p Payment) RequiresAction() bool {
+	return p.Authentication != nil && p.Authentication.Status == threeds.StatusPending
+}
+
+// pendingError tells why nothing can be done with a payment yet.
+func (p Payment) pendingError() error {
+	switch {
+	case p.RequiresAction():
+		return ErrPaymentRequiresAction
+	case p.Held():
+		return ErrPaymentOnHold
+	case p.InProgress != "":
+		return ErrOperationInProgress
+	}
+	return nil
+}
+
+// RequireAction stores a payment whose shopper has to complete a challenge
+// expiring at expiresAt before it is authorized.
+func (g MongoGatewayRepository) RequireAction(ctx context.Context, req AuthorizeRequest, expiresAt time.Time) (string, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	if req.Amount <= 0 {
+		return "", ErrAmountIsZero
+	}
+	if err := ValidateSplits(req.Splits, req.Amount); err != nil {
+		return "", err
+	}
+
+	settlement, err := g.lockRate(ctx, req.MerchantId, req.Currency, req.Amount)
+	if err != nil {
+		if !errors.Is(err, fx.ErrNoRate) {
+			lg.Error().Msg(err.Error())
+		}
+		return "", err
+	}
+	settlement.Authorized = 0
+
+	paymentId := xid.New().String()
+	if err := g.takeReference(ctx, req.MerchantId, paymentId, req.Reference); err != nil {
+		if !errors.Is(err, ErrDuplicateReference) {
+			lg.Error().Msg(err.Error())
+		}
+		return "", err
+	}
+
+	card, err := g.seal(paymentId, req.Card)
+	if err == nil {
+		payment := Payment{Id: paymentId, Currency: req.Currency, MerchantId: req.MerchantId, Brand: routing.CardBrand(req.Card.Number),
+			Settlement: settlement, Screening: req.Screening, Authentication: &Authentication{
+				Result: threeds.Result{Status: threeds.StatusPending, Flow: threeds.FlowChallenge}, Amount: req.Amount, Card: card,
+				ExpiresAt: expiresAt.UTC()},
+			ScheduledCapture: req.ScheduledCapture, Splits: req.Splits, Details: req.Details}
+		_, err = g.db.Collection(PaymentsCol).InsertOne(ctx, payment)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		g.releaseReference(ctx, req.MerchantId, req.Reference)
+		return "", err
+	}
+	return paymentId, nil
+}
+
+// Confirm records the outcome of the challenge of a payment and authorizes
+// it when the shopper was authenticated, or holds it when the screening asked
+// for a review. The outcome is saved with a claim on the payment before the
+// acquirer is asked, so a payment is confirmed once and not voided meanwhile.
+func (g MongoGatewayRepository) Confirm(ctx context.Context, paymentId string, result threeds.Result, holdUntil time.Time) (Payment, error) {
+	p, err := g.Get(ctx, paymentId)
+	if err != nil {
+		return p, err
+	}
+	if !p.RequiresAction() {
+		return p, ErrNoActionRequired
+	}
+	sealed, amount := p.Authentication.Card, p.Authentication.Amount
+	p.Authentication.Result, p.Authentication.Card = result, nil
+	if result.Status != threeds.StatusAuthenticated {
+		return g.decline(ctx, p, ErrAuthenticationFailed)
+	}
+	p.InProgress = "authorize"
+	if p, err = g.save(ctx, "confirm", p, nil); err != nil {
+		return p, err
+	}
+
+	now := time.Now()
+	reservation, err := risk.Reserve(ctx, g.db, p.MerchantId, p.Currency, amount, now)
+	if err != nil {
+		return g.decline(ctx, p, err)
+	}
+
+	if p.Screening.Decision == fraud.DecisionReview {
+		p.InProgress = ""
+		p.Review = &Review{Status: ReviewPending, Amount: amount, Card: sealed, Reservation: reservation, HeldAt: now.UTC(), ExpiresAt: holdUntil.UTC()}
+		saved, err := g.save(ctx, "confirm", p, nil)
+		if err != nil {
+			risk.Release(ctx, g.db, reservation)
+		}
+		return saved, err
+	}
+
+	card, err := g.open(p.Id, *sealed)
+	if err != nil {
+		risk.Release(ctx, g.db, reservation)
+		return g.decline(ctx, p, err)
+	}
+	res, err := g.acquirer.Authorize(ctx, acquirer.AuthorizeRequest{
+		PaymentId: p.Id, MerchantId: p.MerchantId, Amount: amount, Currency: p.Currency, Card: card, StatementDescriptor: p.StatementDescriptor})
+	if err != nil {
+		risk.Release(ctx, g.db, reservation)
+		return g.decline(ctx, p, declined(err))
+	}
+	p.InProgress = ""
+	p.Authorized, p.Acquirer, p.ProcessorReference = amount, res.Acquirer, res.Reference
+	p.Settlement.Authorized, p.Reservation = p.Convert(amount), &reservation
+	p.scheduleCapture(now)
+	saved, err := g.save(ctx, "confirm", p, nil)
+	if err != nil {
+		g.voidUnsaved(ctx, p)
+		risk.Release(ctx, g.db, reservation)
+	}
+	return saved, err
+}
+
+// Abandon voids a payment whose challenge could not be started and gives its
+// reference back, the merchant was never told about it.
+func (g MongoGatewayRepository) Abandon(ctx context.Context, paymentId string) (Payment, error) {
+	p, err := g.Get(ctx, paymentId)
+	if err != nil {
+		return p, err
+	}
+	if !p.RequiresAction() {
+		return p, ErrNoActionRequired
+	}
+	if p, err = g.expireAction(ctx, p); err != nil {
+		return p, err
+	}
+	g.releaseReference(ctx, p.MerchantId, p.Reference)
+	return p, nil
+}
+
+// expireAction voids a payment whose shopper was not authenticated in time
+// and forgets its card.
+func (g MongoGatewayRepository) expireAction(ctx context.Context, p Payment) (Payment, error) {
+	p.Authentication.Result = threeds.Result{Status: threeds.StatusFailed, Flow: threeds.FlowChallenge}
+	p.Authentication.Card = nil
+	return g.decline(ctx, p, nil)
+}
+
+// decline voids a confirmed payment that will not be authorized.
+func (g MongoGatewayRepository) decline(ctx context.Context, p Payment, cause error) (Payment, error) {
+	p.Voided, p.InProgress = true, ""
+	p.completeCapture(CaptureCancelled, nil)
+	p, err := g.save(ctx, "confirm", p, nil)
+	if err != nil {
+		return p, err
+	}
+	return p, cause
+}
@@ -0,0 +1,58 @@
+package gateway
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"payment-gw/acquirer"
+)
+
+var ErrCardUnreadable = errors.New("card of the payment cannot be decrypted")
+
+// SealedCard is a card kept on a payment until it is authorized. The number
+// is encrypted with the card key of the gateway, bound to the payment, and
+// the CVV is never kept: the card is authorized without it.
+type SealedCard struct {
+	Holder string `bson:"holder"`
+	// Number is the nonce followed by the encrypted number
+	Number      []byte `bson:"number"`
+	Last4       string `bson:"last4"`
+	ExpiryMonth string `bson:"expirymonth"`
+	ExpiryYear  string `bson:"expiryyear"`
+}
+
+// NewCardCipher returns the cipher of the card numbers for an AES key of 16,
+// 24 or 32 bytes.
+func NewCardCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (g MongoGatewayRepository) seal(paymentId string, c acquirer.Card) (*SealedCard, error) {
+	nonce := make([]byte, g.cards.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	last4 := c.Number
+	if len(last4) > 4 {
+		last4 = last4[len(last4)-4:]
+	}
+	return &SealedCard{Holder: c.Holder, Number: g.cards.Seal(nonce, nonce, []byte(c.Number), []byte(paymentId)),
+		Last4: last4, ExpiryMonth: c.ExpiryMonth, ExpiryYear: c.ExpiryYear}, nil
+}
+
+func (g MongoGatewayRepository) open(paymentId string, c SealedCard) (acquirer.Card, error) {
+	n := g.cards.NonceSize()
+	if len(c.Number) < n {
+		return acquirer.Card{}, ErrCardUnreadable
+	}
+	number, err := g.cards.Open(nil, c.Number[:n], c.Number[n:], []byte(paymentId))
+	if err != nil {
+		return acquirer.Card{}, ErrCardUnreadable
+	}
+	return acquirer.Card{Holder: c.Holder, Number: string(number), ExpiryMonth: c.ExpiryMonth, ExpiryYear: c.ExpiryYear}, nil
+}
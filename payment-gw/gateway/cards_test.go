@@ -0,0 +1,34 @@
+package gateway
+
+import (
+	"bytes"
+	"errors"
+	"payment-gw/acquirer"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealCard(t *testing.T) {
+	cards, err := NewCardCipher(bytes.Repeat([]byte{7}, 32))
+	assert.NoError(t, err)
+	g := MongoGatewayRepository{cards: cards}
+	card := acquirer.Card{Holder: "Jane Doe", Number: "5555555555554444", ExpiryMonth: "12", ExpiryYear: "30", CVV: "123"}
+
+	sealed, err := g.seal("p1", card)
+	assert.NoError(t, err)
+	assert.Equal(t, "4444", sealed.Last4)
+	assert.False(t, bytes.Contains(sealed.Number, []byte(card.Number)))
+
+	opened, err := g.open("p1", *sealed)
+	assert.NoError(t, err)
+	card.CVV = ""
+	assert.Equal(t, card, opened, "the CVV is not kept")
+
+	_, err = g.open("p2", *sealed)
+	assert.True(t, errors.Is(err, ErrCardUnreadable), "the card is bound to its payment")
+	other, err := NewCardCipher(bytes.Repeat([]byte{8}, 32))
+	assert.NoError(t, err)
+	_, err = MongoGatewayRepository{cards: other}.open("p1", *sealed)
+	assert.True(t, errors.Is(err, ErrCardUnreadable))
+}
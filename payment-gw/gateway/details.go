@@ -0,0 +1,114 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReferencesCol keeps the references taken by the payments of each merchant.
+const ReferencesCol = "payment_references"
+
+var (
+	ErrDuplicateReference = errors.New("a payment with this reference already exists")
+	ErrPaymentNotFound    = errors.New("payment not found")
+)
+
+// Details are what the merchant tells about a payment. Reference is its own
+// id of the payment, unique per merchant.
+type Details struct {
+	Reference           string            `bson:"reference,omitempty"`
+	Description         string            `bson:"description,omitempty"`
+	StatementDescriptor string            `bson:"statementdescriptor,omitempty"`
+	Metadata            map[string]string `bson:"metadata,omitempty"`
+}
+
+// Filter selects the payments of a merchant, by the values of metadata keys.
+// An empty value matches every payment having the key. Limit bounds the
+// payments listed, the next page starts after the id of the last one.
+type Filter struct {
+	Metadata      map[string]string
+	Limit         int
+	StartingAfter string
+}
+
+func referenceId(merchantId, reference string) string {
+	return merchantId + "/" + reference
+}
+
+// takeReference keeps the reference of a payment about to be stored from
+// being used by another one. The reference is the id of its document, so two
+// payments racing for it cannot both take it.
+func (g MongoGatewayRepository) takeReference(ctx context.Context, merchantId, paymentId, reference string) error {
+	if reference == "" {
+		return nil
+	}
+	_, err := g.db.Collection(ReferencesCol).InsertOne(ctx, bson.M{"_id": referenceId(merchantId, reference),
+		"merchantid": merchantId, "reference": reference, "paymentid": paymentId})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateReference
+	}
+	return err
+}
+
+// releaseReference gives back the reference of a payment that was not stored.
+func (g MongoGatewayRepository) releaseReference(ctx context.Context, merchantId, reference string) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	if reference == "" {
+		return
+	}
+	if _, err := g.db.Collection(ReferencesCol).DeleteOne(ctx, bson.M{"_id": referenceId(merchantId, reference)}); err != nil {
+		lg.Error().Msg(err.Error())
+	}
+}
+
+func (g MongoGatewayRepository) GetByReference(ctx context.Context, merchantId, reference string) (Payment, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	result := Payment{}
+	err := g.db.Collection(PaymentsCol).FindOne(ctx, bson.M{"merchantid": merchantId, "reference": reference}).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return Payment{}, ErrPaymentNotFound
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Payment{}, err
+	}
+	return result, nil
+}
+
+// List returns the payments of the merchant matching the filter, the latest
+// first. Payment ids are xids, they sort by creation.
+func (g MongoGatewayRepository) List(ctx context.Context, merchantId string, f Filter) ([]Payment, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	query := bson.M{"merchantid": merchantId}
+	for key, value := range f.Metadata {
+		if value == "" {
+			query["metadata."+key] = bson.M{"$exists": true}
+		} else {
+			query["metadata."+key] = value
+		}
+	}
+
+	if f.StartingAfter != "" {
+		query["id"] = bson.M{"$lt": f.StartingAfter}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "id", Value: -1}})
+	if f.Limit > 0 {
+		opts.SetLimit(int64(f.Limit))
+	}
+
+	payments := []Payment{}
+	cursor, err := g.db.Collection(PaymentsCol).Find(ctx, query, opts)
+	if err == nil {
+		err = cursor.All(ctx, &payments)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+	return payments, nil
+}
@@ -2,7 +2,21 @@ package gateway
 
 import (
 	"context"
+	"crypto/cipher"
 	"errors"
+	"fmt"
+	"payment-gw/acquirer"
+	"payment-gw/events"
+	"payment-gw/fraud"
+	"payment-gw/fx"
+	"payment-gw/ledger"
+	"payment-gw/merchant"
+	"payment-gw/metrics"
+	"payment-gw/pricing"
+	"payment-gw/risk"
+	"payment-gw/routing"
+	"payment-gw/threeds"
+	"time"
 
 	"github.com/rs/xid"
 	"github.com/rs/zerolog"
@@ -12,6 +26,9 @@ import (
 
 const PaymentsCol = "payments"
 
+// OperationChargeback records a lost dispute on the payment.
+const OperationChargeback = "chargeback"
+
 var (
 	ErrCaptureToHigh           = errors.New("capture amount is higher than authorized")
 	ErrRefundToHigh            = errors.New("refund amount is higher than authorized")
@@ -22,67 +39,308 @@ var (
 	ErrAlreadyCaptured         = errors.New("cannot perfom this operation because payment was already captured")
 	ErrPaymentIsCancelled      = errors.New("payment is cancelled")
 	ErrNotCaptured             = errors.New("cannot refund non-captured transaction")
+	ErrOptimisticLocking       = errors.New("optimistic locking: could not update document")
+	ErrOperationInProgress     = errors.New("another operation on the payment is in progress")
 )
 
-type MockFailure uint8
+var optimisticLockConflicts = metrics.NewCounterVec("gateway_optimistic_lock_conflicts_total",
+	"Number of payment updates rejected because the document version changed concurrently.", "operation")
 
-const (
-	NoFailure            MockFailure = 0
-	AuthorizationFailure             = 1
-	CaptureFailure                   = 2
-	RefundFailure                    = 3
-)
+// DeclineError is returned when the acquirer declines an operation. It
+// matches ErrBasedOnCreditCardNumber and keeps its message, so the API
+// responds the same way it did before declines carried a code.
+type DeclineError struct {
+	Code   string
+	Reason string
+}
+
+func (e *DeclineError) Error() string {
+	return ErrBasedOnCreditCardNumber.Error()
+}
+
+func (e *DeclineError) Is(target error) bool {
+	return target == ErrBasedOnCreditCardNumber
+}
+
+func declined(err error) error {
+	var d *acquirer.DeclineError
+	if errors.As(err, &d) {
+		return &DeclineError{Code: d.Code, Reason: acquirer.Reason(d.Code)}
+	}
+	return err
+}
 
 type Payment struct {
-	Id         string      `bson:"id"`
-	Authorized int         `bson:"auhtorized"`
-	Captured   int         `bson:"captured"`
-	Refunded   int         `bson:"refunded"`
-	Currency   string      `bson:"currency"`
-	MerchantId string      `bson:"merchantid"`
-	Failure    MockFailure `bson:"mockfailure"`
-	Version    int         `bson:"version"`
-	Voided     bool        `bson:"voided"`
+	Id                 string `bson:"id"`
+	Authorized         int    `bson:"auhtorized"`
+	Captured           int    `bson:"captured"`
+	Refunded           int    `bson:"refunded"`
+	Currency           string `bson:"currency"`
+	MerchantId         string `bson:"merchantid"`
+	Acquirer           string `bson:"acquirer"`
+	ProcessorReference string `bson:"processorreference"`
+	Brand              string `bson:"brand"`
+	// Fees charged to the merchant for the operations on the payment
+	Fees int `bson:"fees"`
+	// Chargebacks is the amount taken back by lost disputes
+	Chargebacks int         `bson:"chargebacks"`
+	Disputes    []string    `bson:"disputes"`
+	Operations  []Operation `bson:"operations"`
+	// Settlement is the payment in the currency the merchant is paid in
+	Settlement Settlement `bson:"settlement"`
+	// Screening is the decision of the fraud screening on the authorization
+	Screening fraud.Screening `bson:"screening"`
+	// Authentication is set on the payments authenticated with 3-D Secure
+	Authentication *Authentication `bson:"authentication,omitempty"`
+	// Review is set on the payments the screening held for review
+	Review *Review `bson:"review,omitempty"`
+	// ScheduledCapture is set on the payments captured later automatically
+	ScheduledCapture *ScheduledCapture `bson:"scheduledcapture,omitempty"`
+	// Reservation is the amount the authorization counts in the volumes of
+	// the merchant, given back when the payment is voided
+	Reservation *risk.Reservation `bson:"reservation,omitempty"`
+	Details     `bson:",inline"`
+	// Splits are given with the authorization of a platform payment, they
+	// apply to the captures made without splits of their own
+	Splits []Split `bson:"splits,omitempty"`
+	// Transfers are the parts of the payment sent to connected accounts
+	Transfers []Transfer `bson:"transfers,omitempty"`
+	// InProgress is the operation sent to the acquirer and not saved yet, the
+	// payment takes no other operation meanwhile
+	InProgress string `bson:"inprogress,omitempty"`
+	Version    int    `bson:"version"`
+	Voided     bool   `bson:"voided"`
+}
+
+// Settlement holds the amounts of a payment in the settlement currency of the
+// merchant, converted at the rate locked at authorization. Payments made in
+// the settlement currency have a rate of 1.
+type Settlement struct {
+	Currency    string  `bson:"currency"`
+	Rate        float64 `bson:"rate"`
+	Authorized  int     `bson:"authorized"`
+	Captured    int     `bson:"captured"`
+	Refunded    int     `bson:"refunded"`
+	Chargebacks int     `bson:"chargebacks"`
+	Fees        int     `bson:"fees"`
+}
+
+func (s Settlement) Net() int {
+	return s.Captured - s.Refunded - s.Chargebacks - s.Fees
+}
+
+// Operation records a capture, refund or chargeback with the fee charged for
+// it, the fee of a refund is negative when the capture fee is returned.
+type Operation struct {
+	Type             string    `bson:"type"`
+	Amount           int       `bson:"amount"`
+	Fee              int       `bson:"fee"`
+	SettlementAmount int       `bson:"settlementamount"`
+	SettlementFee    int       `bson:"settlementfee"`
+	CreatedAt        time.Time `bson:"createdat"`
+}
+
+// Net is what the merchant is owed for the payment.
+func (p Payment) Net() int {
+	return p.Captured - p.Refunded - p.Chargebacks - p.Fees
+}
+
+// Refundable is the captured amount neither refunded nor charged back.
+func (p Payment) Refundable() int {
+	return p.Captured - p.Refunded - p.Chargebacks
+}
+
+func (p Payment) pricing() pricing.Payment {
+	captureFees := 0
+	for _, op := range p.Operations {
+		if op.Type == pricing.OperationCapture {
+			captureFees += op.Fee
+		}
+	}
+	return pricing.Payment{MerchantId: p.MerchantId, Brand: p.Brand, Currency: p.Currency, Captured: p.Captured, CaptureFees: captureFees}
+}
+
+// SettlementCurrency is the currency the ledger books the payment in.
+// Payments authorized before settlement currencies have none.
+func (p Payment) SettlementCurrency() string {
+	if p.Settlement.Currency == "" {
+		return p.Currency
+	}
+	return p.Settlement.Currency
+}
+
+// Convert converts an amount of the payment to its settlement currency.
+func (p Payment) Convert(amount int) int {
+	if p.Settlement.Rate == 0 {
+		return amount
+	}
+	return fx.Convert(amount, p.Settlement.Rate)
+}
+
+// convertPart converts an amount added to a total of the payment as the
+// difference of the converted totals, so partial operations round to no more
+// than the whole.
+func (p Payment) convertPart(total, amount int) int {
+	return p.Convert(total+amount) - p.Convert(total)
+}
+
+// NewOperation converts the amount and fee of an operation on the payment, it
+// is made before the amounts of the payment are updated. Refunds and
+// chargebacks are converted together so they never exceed the capture.
+func (p Payment) NewOperation(operation string, amount, fee int, at time.Time) Operation {
+	total := p.Captured
+	if operation != pricing.OperationCapture {
+		total = p.Refunded + p.Chargebacks
+	}
+	return Operation{Type: operation, Amount: amount, Fee: fee, SettlementAmount: p.convertPart(total, amount),
+		SettlementFee: p.convertPart(p.Fees, fee), CreatedAt: at}
+}
+
+func (p *Payment) record(operation string, amount, fee int) Operation {
+	op := p.NewOperation(operation, amount, fee, time.Now().UTC())
+	p.Fees += fee
+	p.Settlement.Fees += op.SettlementFee
+	p.Operations = append(p.Operations, op)
+	return op
+}
+
+// AuthorizeRequest is an authorization screened for fraud.
+type AuthorizeRequest struct {
+	MerchantId string
+	Amount     int
+	Currency   string
+	Card       acquirer.Card
+	Screening  fraud.Screening
+	// Authentication is the result of a frictionless 3-D Secure
+	// authentication, if any
+	Authentication *threeds.Result
+	// ScheduledCapture captures the payment later, if any
+	ScheduledCapture *ScheduledCapture
+	// Splits send parts of the payment to connected accounts
+	Splits []Split
+	Details
 }
 
 type GatewayRepository interface {
-	Authorize(ctx context.Context, amount int, currency, merchantId string, failure MockFailure) (string, error)
+	Authorize(ctx context.Context, req AuthorizeRequest) (string, error)
 	GetMerchantIdByPaymentId(ctx context.Context, paymentId string) (string, error)
-	Capture(ctx context.Context, paymentId string, amount int) (Payment, error)
+	Get(ctx context.Context, paymentId string) (Payment, error)
+	RequireAction(ctx context.Context, req AuthorizeRequest, expiresAt time.Time) (string, error)
+	Abandon(ctx context.Context, paymentId string) (Payment, error)
+	Confirm(ctx context.Context, paymentId string, result threeds.Result, holdUntil time.Time) (Payment, error)
+	Capture(ctx context.Context, paymentId string, amount int, splits []Split) (Payment, error)
 	Refund(ctx context.Context, paymentId string, amount int) (Payment, error)
 	Void(ctx context.Context, paymentId string) (Payment, error)
+	Hold(ctx context.Context, req AuthorizeRequest, expiresAt time.Time) (string, error)
+	Held(ctx context.Context, merchantId string) ([]Payment, error)
+	Approve(ctx context.Context, paymentId, reviewer, note string) (Payment, error)
+	Reject(ctx context.Context, paymentId, reviewer, note string) (Payment, error)
+	Expire(ctx context.Context, now time.Time) ([]Payment, error)
+	CaptureScheduled(ctx context.Context, now time.Time) (int, error)
+	TransfersTo(ctx context.Context, accountId string) ([]Payment, error)
+	GetByReference(ctx context.Context, merchantId, reference string) (Payment, error)
+	List(ctx context.Context, merchantId string, f Filter) ([]Payment, error)
 }
 
 type MongoGatewayRepository struct {
-	db *mongo.Database
+	db       *mongo.Database
+	acquirer acquirer.Acquirer
+	fees     pricing.Config
+	rates    fx.RateProvider
+	// cards encrypts the cards kept on payments, see NewCardCipher
+	cards cipher.AEAD
 }
 
-func NewRepository(db *mongo.Database) MongoGatewayRepository {
-	return MongoGatewayRepository{db: db}
+func NewRepository(db *mongo.Database, acq acquirer.Acquirer, fees pricing.Config, rates fx.RateProvider, cards cipher.AEAD) MongoGatewayRepository {
+	return MongoGatewayRepository{db: db, acquirer: acq, fees: fees, rates: rates, cards: cards}
 }
 
-func (g MongoGatewayRepository) Authorize(ctx context.Context, amount int, currency, merchantId string, failure MockFailure) (string, error) {
+func (g MongoGatewayRepository) Authorize(ctx context.Context, req AuthorizeRequest) (string, error) {
 	lg := ctx.Value("logger").(*zerolog.Logger)
+	amount, currency, merchantId, card := req.Amount, req.Currency, req.MerchantId, req.Card
 
-	if failure == AuthorizationFailure {
-		return "", ErrBasedOnCreditCardNumber
-	}
 	if amount <= 0 {
 		return "", ErrAmountIsZero
 	}
+	if err := ValidateSplits(req.Splits, amount); err != nil {
+		return "", err
+	}
+
+	settlement, err := g.lockRate(ctx, merchantId, currency, amount)
+	if err != nil {
+		if !errors.Is(err, fx.ErrNoRate) {
+			lg.Error().Msg(err.Error())
+		}
+		return "", err
+	}
 
 	paymentId := xid.New().String()
-	payment := Payment{Currency: currency, Authorized: amount, Id: paymentId, Failure: failure, MerchantId: merchantId}
-	_, err := g.db.Collection(PaymentsCol).InsertOne(ctx, payment)
+	if err := g.takeReference(ctx, merchantId, paymentId, req.Reference); err != nil {
+		if !errors.Is(err, ErrDuplicateReference) {
+			lg.Error().Msg(err.Error())
+		}
+		return "", err
+	}
+
+	reservation, err := risk.Reserve(ctx, g.db, merchantId, currency, amount, time.Now())
+	if err != nil {
+		if risk.Code(err) == "" {
+			lg.Error().Msg(err.Error())
+		}
+		g.releaseReference(ctx, merchantId, req.Reference)
+		return "", err
+	}
+
+	res, err := g.acquirer.Authorize(ctx, acquirer.AuthorizeRequest{
+		PaymentId: paymentId, MerchantId: merchantId, Amount: amount, Currency: currency, Card: card, StatementDescriptor: req.StatementDescriptor})
+	if err != nil {
+		risk.Release(ctx, g.db, reservation)
+		g.releaseReference(ctx, merchantId, req.Reference)
+		return "", declined(err)
+	}
+
+	payment := Payment{Currency: currency, Authorized: amount, Id: paymentId, MerchantId: merchantId, Acquirer: res.Acquirer,
+		ProcessorReference: res.Reference, Brand: routing.CardBrand(card.Number), Settlement: settlement,
+		Screening: req.Screening, Authentication: req.authentication(), ScheduledCapture: req.ScheduledCapture, Splits: req.Splits,
+		Details: req.Details, Reservation: &reservation}
+	_, err = g.db.Collection(PaymentsCol).InsertOne(ctx, payment)
 	if err != nil {
 		lg.Error().Msg(err.Error())
+		g.voidUnsaved(ctx, payment)
+		risk.Release(ctx, g.db, reservation)
+		g.releaseReference(ctx, merchantId, req.Reference)
 		return "", err
 	}
 
 	return paymentId, nil
 }
 
-func (g MongoGatewayRepository) Capture(ctx context.Context, paymentId string, amount int) (Payment, error) {
+// lockRate quotes the rate from the currency of a payment to the settlement
+// currency of the merchant, it holds for every operation on the payment.
+func (g MongoGatewayRepository) lockRate(ctx context.Context, merchantId, currency string, amount int) (Settlement, error) {
+	m := struct {
+		SettlementCurrency string `bson:"settlementcurrency"`
+	}{}
+	if err := g.db.Collection(merchant.MerchantCol).FindOne(ctx, bson.M{"id": merchantId}).Decode(&m); err != nil {
+		return Settlement{}, err
+	}
+
+	s := Settlement{Currency: currency, Rate: 1}
+	if m.SettlementCurrency != "" && m.SettlementCurrency != currency {
+		rate, err := g.rates.Rate(ctx, currency, m.SettlementCurrency)
+		if err != nil {
+			return Settlement{}, err
+		}
+		s = Settlement{Currency: m.SettlementCurrency, Rate: rate}
+	}
+	s.Authorized = fx.Convert(amount, s.Rate)
+	return s, nil
+}
+
+// Capture captures amount of the payment and sends parts of it to connected
+// accounts as the splits say, or as the splits of the authorization say when
+// there are none.
+func (g MongoGatewayRepository) Capture(ctx context.Context, paymentId string, amount int, splits []Split) (Payment, error) {
 	lg := ctx.Value("logger").(*zerolog.Logger)
 	result := Payment{}
 	if err := g.db.Collection(PaymentsCol).FindOne(ctx, bson.M{"id": paymentId}).Decode(&result); err != nil {
@@ -94,8 +352,8 @@ func (g MongoGatewayRepository) Capture(ctx context.Context, paymentId string, a
 		return result, ErrPaymentIsCancelled
 	}
 
-	if result.Failure == CaptureFailure {
-		return result, ErrBasedOnCreditCardNumber
+	if err := result.pendingError(); err != nil {
+		return result, err
 	}
 
 	if amount <= 0 {
@@ -109,28 +367,31 @@ func (g MongoGatewayRepository) Capture(ctx context.Context, paymentId string, a
 	if result.Refunded > 0 {
 		return result, ErrAlreadyRefunded
 	}
-	result.Captured += amount
 
-	filter := bson.M{"id": paymentId, "version": result.Version}
-	result.Version++
-
-	updateResult, err := g.db.Collection(PaymentsCol).ReplaceOne(ctx, filter, result)
-	if err != nil {
-		lg.Error().Msg(err.Error())
-		return Payment{}, err
+	base := amount
+	if splits == nil {
+		splits, base = result.Splits, result.Authorized
+	} else if err := ValidateSplits(splits, amount); err != nil {
+		return result, err
 	}
 
-	if updateResult.ModifiedCount == 0 {
-		if err := g.db.Collection(PaymentsCol).FindOne(ctx, bson.M{"id": paymentId}).Decode(&result); err != nil {
-			lg.Error().Msg(err.Error())
-			return Payment{}, err
-		}
-		err := errors.New("optimistic locking: could not update document")
-		lg.Debug().Msg(err.Error())
+	result, err := g.claim(ctx, "capture", result)
+	if err != nil {
 		return result, err
 	}
+	if _, err := g.acquirer.Capture(ctx, result.acquirerRequest(amount)); err != nil {
+		return g.unclaim(ctx, "capture", result, declined(err))
+	}
+	fee := g.fees.CaptureFee(result.pricing(), amount)
+	result.InProgress = ""
+	op := result.record(pricing.OperationCapture, amount, fee)
+	result.Captured += amount
+	result.Settlement.Captured += op.SettlementAmount
+	result.completeCapture(CaptureCaptured, nil)
 
-	return result, nil
+	entries := ledger.CaptureEntries(result.Id, result.MerchantId, result.SettlementCurrency(), op.SettlementAmount, op.SettlementFee)
+	entries = append(entries, result.transfer(splits, base, amount)...)
+	return g.save(ctx, "capture", result, entries)
 }
 
 func (g MongoGatewayRepository) Refund(ctx context.Context, paymentId string, amount int) (Payment, error) {
@@ -145,43 +406,39 @@ func (g MongoGatewayRepository) Refund(ctx context.Context, paymentId string, am
 		return result, ErrPaymentIsCancelled
 	}
 
-	if result.Captured == 0 {
-		return result, ErrNotCaptured
+	if err := result.pendingError(); err != nil {
+		return result, err
 	}
 
-	if result.Failure == RefundFailure {
-		return result, ErrBasedOnCreditCardNumber
+	if result.Captured == 0 {
+		return result, ErrNotCaptured
 	}
 
 	if amount <= 0 {
 		return result, ErrAmountIsZero
 	}
 
-	if result.Captured < result.Refunded+amount {
+	if result.Refundable() < amount {
 		return result, ErrRefundToHigh
 	}
 
-	result.Refunded += amount
-
-	filter := bson.M{"id": paymentId, "version": result.Version}
-	result.Version++
-
-	updateResult, err := g.db.Collection(PaymentsCol).ReplaceOne(ctx, filter, result)
+	result, err := g.claim(ctx, "refund", result)
 	if err != nil {
-		lg.Error().Msg(err.Error())
 		return result, err
 	}
-
-	if updateResult.ModifiedCount == 0 {
-		if err := g.db.Collection(PaymentsCol).FindOne(ctx, bson.M{"id": paymentId}).Decode(&result); err != nil {
-			lg.Error().Msg(err.Error())
-			return Payment{}, err
-		}
-		err := errors.New("optimistic locking: could not update document")
-		lg.Debug().Msg(err.Error())
-		return result, err
+	if _, err := g.acquirer.Refund(ctx, result.acquirerRequest(amount)); err != nil {
+		return g.unclaim(ctx, "refund", result, declined(err))
 	}
-	return result, nil
+
+	fee := g.fees.RefundFee(result.pricing(), amount)
+	result.InProgress = ""
+	op := result.record(pricing.OperationRefund, amount, fee)
+	result.Refunded += amount
+	result.Settlement.Refunded += op.SettlementAmount
+
+	entries := ledger.RefundEntries(result.Id, result.MerchantId, result.SettlementCurrency(), op.SettlementAmount, op.SettlementFee)
+	entries = append(entries, result.ReverseTransfers()...)
+	return g.save(ctx, "refund", result, entries)
 }
 
 func (g MongoGatewayRepository) Void(ctx context.Context, paymentId string) (Payment, error) {
@@ -194,6 +451,9 @@ func (g MongoGatewayRepository) Void(ctx context.Context, paymentId string) (Pay
 	if result.Voided {
 		return result, ErrAlreadyVoided
 	}
+	if err := result.pendingError(); err != nil {
+		return result, err
+	}
 
 	if result.Refunded != 0 {
 		return result, ErrAlreadyRefunded
@@ -201,23 +461,109 @@ func (g MongoGatewayRepository) Void(ctx context.Context, paymentId string) (Pay
 	if result.Captured != 0 {
 		return result, ErrAlreadyCaptured
 	}
-	filter := bson.M{"id": paymentId, "version": result.Version}
-	result.Version++
-	result.Voided = true
-	updateResult, err := g.db.Collection(PaymentsCol).ReplaceOne(ctx, filter, result)
+
+	result, err := g.claim(ctx, "void", result)
 	if err != nil {
-		lg.Error().Msg(err.Error())
 		return result, err
 	}
+	if _, err := g.acquirer.Void(ctx, result.acquirerRequest(result.Authorized)); err != nil {
+		return g.unclaim(ctx, "void", result, declined(err))
+	}
+	result.Voided, result.InProgress = true, ""
+	result.completeCapture(CaptureCancelled, nil)
+	result, err = g.save(ctx, "void", result, nil)
+	if err != nil || result.Reservation == nil {
+		return result, err
+	}
+	return result, risk.Release(ctx, g.db, *result.Reservation)
+}
+
+// claim saves that an operation is sent to the acquirer before it is, so an
+// operation made concurrently fails on the version instead of being sent too.
+// The payment keeps the claim when the operation cannot be saved afterwards,
+// an operator has to check it with the acquirer.
+func (g MongoGatewayRepository) claim(ctx context.Context, operation string, p Payment) (Payment, error) {
+	p.InProgress = operation
+	return g.save(ctx, operation, p, nil)
+}
+
+// voidUnsaved voids the authorization of a payment that could not be saved.
+// Nobody can capture or void it through the gateway, so the authorization is
+// not left holding the funds of the shopper.
+func (g MongoGatewayRepository) voidUnsaved(ctx context.Context, p Payment) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	if _, err := g.acquirer.Void(ctx, p.acquirerRequest(p.Authorized)); err != nil {
+		lg.Error().Err(err).Str("payment_id", p.Id).Str("processor_reference", p.ProcessorReference).
+			Msg("could not void the authorization of a payment that was not saved")
+	}
+}
 
-	if updateResult.ModifiedCount == 0 {
-		if err := g.db.Collection(PaymentsCol).FindOne(ctx, bson.M{"id": paymentId}).Decode(&result); err != nil {
+// unclaim gives back the claim of an operation the acquirer did not make.
+func (g MongoGatewayRepository) unclaim(ctx context.Context, operation string, p Payment, cause error) (Payment, error) {
+	p.InProgress = ""
+	p, err := g.save(ctx, operation, p, nil)
+	if err != nil {
+		return p, err
+	}
+	return p, cause
+}
+
+// save replaces the payment unless its version changed since it was read, and
+// posts the journal entries and emits the events of the operation in the same
+// transaction.
+func (g MongoGatewayRepository) save(ctx context.Context, operation string, result Payment, entries []ledger.Entry, emitted ...events.Event) (Payment, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	filter := bson.M{"id": result.Id, "version": result.Version}
+	result.Version++
+
+	err := g.db.Client().UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			updateResult, err := g.db.Collection(PaymentsCol).ReplaceOne(sc, filter, result)
+			if err != nil {
+				return nil, err
+			}
+			if updateResult.ModifiedCount == 0 {
+				return nil, ErrOptimisticLocking
+			}
+			if err := ledger.Post(sc, g.db, fmt.Sprintf("%s/%d", result.Id, result.Version), entries...); err != nil {
+				return nil, err
+			}
+			for _, e := range emitted {
+				if err := events.Emit(sc, g.db, e); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+		return err
+	})
+
+	if errors.Is(err, ErrOptimisticLocking) {
+		if err := g.db.Collection(PaymentsCol).FindOne(ctx, bson.M{"id": result.Id}).Decode(&result); err != nil {
 			lg.Error().Msg(err.Error())
 			return Payment{}, err
 		}
-		err := errors.New("optimistic locking: could not update document")
-		lg.Debug().Msg(err.Error())
-		return result, err
+		optimisticLockConflicts.WithLabelValues(operation).Inc()
+		lg.Debug().Msg(ErrOptimisticLocking.Error())
+		return result, ErrOptimisticLocking
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Payment{}, err
+	}
+	return result, nil
+}
+
+func (p Payment) acquirerRequest(amount int) acquirer.Request {
+	return acquirer.Request{PaymentId: p.Id, Acquirer: p.Acquirer, Reference: p.ProcessorReference, Amount: amount, Currency: p.Currency}
+}
+
+func (g MongoGatewayRepository) Get(ctx context.Context, paymentId string) (Payment, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	result := Payment{}
+	if err := g.db.Collection(PaymentsCol).FindOne(ctx, bson.M{"id": paymentId}).Decode(&result); err != nil {
+		lg.Error().Msg(err.Error())
+		return Payment{}, err
 	}
 	return result, nil
 }
@@ -0,0 +1,25 @@
+package gateway
+
+import (
+	"payment-gw/pricing"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOperationConvertsTotals(t *testing.T) {
+	p := Payment{Authorized: 3, Settlement: Settlement{Currency: "USD", Rate: 0.5, Authorized: 2}}
+	for i := 0; i < 3; i++ {
+		op := p.record(pricing.OperationCapture, 1, 0)
+		p.Captured++
+		p.Settlement.Captured += op.SettlementAmount
+	}
+	assert.Equal(t, p.Settlement.Authorized, p.Settlement.Captured, "partial captures add up to the authorization")
+
+	for i := 0; i < 3; i++ {
+		op := p.record(pricing.OperationRefund, 1, 0)
+		p.Refunded++
+		p.Settlement.Refunded += op.SettlementAmount
+	}
+	assert.Equal(t, p.Settlement.Captured, p.Settlement.Refunded, "partial refunds add up to the capture")
+}
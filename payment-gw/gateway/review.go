@@ -0,0 +1,252 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"payment-gw/acquirer"
+	"payment-gw/events"
+	"payment-gw/fx"
+	"payment-gw/risk"
+	"payment-gw/routing"
+	"payment-gw/threeds"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses of the review of a held payment.
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+	ReviewExpired  = "expired"
+	// ReviewDeclined is an approved payment the acquirer did not authorize
+	ReviewDeclined = "declined"
+)
+
+var (
+	ErrPaymentOnHold = errors.New("payment is on hold pending review")
+	ErrNotHeld       = errors.New("payment is not held for review")
+	ErrReviewDecided = errors.New("review of the payment was already decided")
+)
+
+// Review is the manual review of a payment the fraud screening held. Nothing
+// is authorized until the payment is approved, the card is kept sealed for
+// the authorization until then. Rejected, expired and declined payments are
+// voided.
+type Review struct {
+	Status      string           `bson:"status"`
+	Amount      int              `bson:"amount"`
+	Card        *SealedCard      `bson:"card,omitempty"`
+	Reservation risk.Reservation `bson:"reservation"`
+	HeldAt      time.Time        `bson:"heldat"`
+	ExpiresAt   time.Time        `bson:"expiresat"`
+	Reviewer    string           `bson:"reviewer"`
+	Note        string           `bson:"note"`
+	DecidedAt   time.Time        `bson:"decidedat"`
+}
+
+// Held tells whether the payment waits for a review decision.
+func (p Payment) Held() bool {
+	return p.Review != nil && p.Review.Status == ReviewPending
+}
+
+// Hold stores a payment for review instead of authorizing it. Its amount
+// counts in the volumes of the merchant until it is decided.
+func (g MongoGatewayRepository) Hold(ctx context.Context, req AuthorizeRequest, expiresAt time.Time) (string, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	if req.Amount <= 0 {
+		return "", ErrAmountIsZero
+	}
+	if err := ValidateSplits(req.Splits, req.Amount); err != nil {
+		return "", err
+	}
+
+	settlement, err := g.lockRate(ctx, req.MerchantId, req.Currency, req.Amount)
+	if err != nil {
+		if !errors.Is(err, fx.ErrNoRate) {
+			lg.Error().Msg(err.Error())
+		}
+		return "", err
+	}
+	settlement.Authorized = 0
+
+	paymentId := xid.New().String()
+	if err := g.takeReference(ctx, req.MerchantId, paymentId, req.Reference); err != nil {
+		if !errors.Is(err, ErrDuplicateReference) {
+			lg.Error().Msg(err.Error())
+		}
+		return "", err
+	}
+
+	now := time.Now()
+	reservation, err := risk.Reserve(ctx, g.db, req.MerchantId, req.Currency, req.Amount, now)
+	if err != nil {
+		if risk.Code(err) == "" {
+			lg.Error().Msg(err.Error())
+		}
+		g.releaseReference(ctx, req.MerchantId, req.Reference)
+		return "", err
+	}
+
+	card, err := g.seal(paymentId, req.Card)
+	if err == nil {
+		payment := Payment{Id: paymentId, Currency: req.Currency, MerchantId: req.MerchantId, Brand: routing.CardBrand(req.Card.Number),
+			Settlement: settlement, Screening: req.Screening, Authentication: req.authentication(), ScheduledCapture: req.ScheduledCapture, Splits: req.Splits,
+			Details: req.Details, Review: &Review{Status: ReviewPending, Amount: req.Amount, Card: card,
+				Reservation: reservation, HeldAt: now.UTC(), ExpiresAt: expiresAt.UTC()}}
+		_, err = g.db.Collection(PaymentsCol).InsertOne(ctx, payment)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		risk.Release(ctx, g.db, reservation)
+		g.releaseReference(ctx, req.MerchantId, req.Reference)
+		return "", err
+	}
+	return paymentId, nil
+}
+
+// Held returns the payments of the merchant pending review, the ones
+// expiring first first.
+func (g MongoGatewayRepository) Held(ctx context.Context, merchantId string) ([]Payment, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	payments := []Payment{}
+	cursor, err := g.db.Collection(PaymentsCol).Find(ctx, bson.M{"merchantid": merchantId, "review.status": ReviewPending},
+		options.Find().SetSort(bson.D{{Key: "review.expiresat", Value: 1}}))
+	if err == nil {
+		err = cursor.All(ctx, &payments)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+	return payments, nil
+}
+
+// Approve authorizes a held payment. The decision is saved with a claim on
+// the payment before the acquirer is asked, so a payment expiring or voided
+// meanwhile is not authorized.
+func (g MongoGatewayRepository) Approve(ctx context.Context, paymentId, reviewer, note string) (Payment, error) {
+	p, err := g.pending(ctx, paymentId)
+	if err != nil {
+		return p, err
+	}
+	card, err := g.open(p.Id, *p.Review.Card)
+	if err != nil {
+		return p, err
+	}
+	p.decide(ReviewApproved, reviewer, note)
+	p.InProgress = "authorize"
+	if p, err = g.save(ctx, "approve", p, nil); err != nil {
+		return p, err
+	}
+
+	amount := p.Review.Amount
+	res, err := g.acquirer.Authorize(ctx, acquirer.AuthorizeRequest{
+		PaymentId: p.Id, MerchantId: p.MerchantId, Amount: amount, Currency: p.Currency, Card: card, StatementDescriptor: p.StatementDescriptor})
+	p.InProgress = ""
+	if err != nil {
+		p.Review.Status, p.Voided = ReviewDeclined, true
+		return g.release(ctx, "approve", p, declined(err))
+	}
+	p.Authorized, p.Acquirer, p.ProcessorReference = amount, res.Acquirer, res.Reference
+	p.Settlement.Authorized, p.Reservation = p.Convert(amount), &p.Review.Reservation
+	p.scheduleCapture(time.Now())
+	saved, err := g.save(ctx, "approve", p, nil, reviewEvent(p))
+	if err != nil {
+		g.voidUnsaved(ctx, p)
+		risk.Release(ctx, g.db, p.Review.Reservation)
+	}
+	return saved, err
+}
+
+// Reject declines a held payment.
+func (g MongoGatewayRepository) Reject(ctx context.Context, paymentId, reviewer, note string) (Payment, error) {
+	p, err := g.pending(ctx, paymentId)
+	if err != nil {
+		return p, err
+	}
+	p.decide(ReviewRejected, reviewer, note)
+	p.Voided = true
+	return g.release(ctx, "reject", p, nil)
+}
+
+// Expire declines the held payments whose review expired before now and
+// voids the payments whose challenge expired, and returns them.
+func (g MongoGatewayRepository) Expire(ctx context.Context, now time.Time) ([]Payment, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	var payments []Payment
+	cursor, err := g.db.Collection(PaymentsCol).Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"review.status": ReviewPending, "review.expiresat": bson.M{"$lte": now.UTC()}},
+		bson.M{"authentication.status": threeds.StatusPending, "authentication.expiresat": bson.M{"$lte": now.UTC()}},
+	}})
+	if err == nil {
+		err = cursor.All(ctx, &payments)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+
+	expired := []Payment{}
+	for _, p := range payments {
+		var err error
+		if p.RequiresAction() {
+			p, err = g.expireAction(ctx, p)
+		} else {
+			p.decide(ReviewExpired, "", "")
+			p.Voided = true
+			p, err = g.release(ctx, "expire", p, nil)
+		}
+		if errors.Is(err, ErrOptimisticLocking) {
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		expired = append(expired, p)
+	}
+	return expired, nil
+}
+
+func (g MongoGatewayRepository) pending(ctx context.Context, paymentId string) (Payment, error) {
+	p, err := g.Get(ctx, paymentId)
+	if err != nil {
+		return p, err
+	}
+	if p.Review == nil {
+		return p, ErrNotHeld
+	}
+	if !p.Held() {
+		return p, ErrReviewDecided
+	}
+	return p, nil
+}
+
+func (p *Payment) decide(status, reviewer, note string) {
+	p.Review.Status, p.Review.Reviewer, p.Review.Note = status, reviewer, note
+	p.Review.DecidedAt = time.Now().UTC()
+	p.Review.Card = nil
+}
+
+// release saves a payment that will not be authorized and takes its amount
+// back from the volumes of the merchant.
+func (g MongoGatewayRepository) release(ctx context.Context, operation string, p Payment, cause error) (Payment, error) {
+	p.completeCapture(CaptureCancelled, nil)
+	p, err := g.save(ctx, operation, p, nil, reviewEvent(p))
+	if err != nil {
+		return p, err
+	}
+	if err := risk.Release(ctx, g.db, p.Review.Reservation); err != nil {
+		return p, err
+	}
+	return p, cause
+}
+
+func reviewEvent(p Payment) events.Event {
+	return events.Event{Type: "review." + p.Review.Status, MerchantId: p.MerchantId, PaymentId: p.Id,
+		Data: map[string]string{"status": p.Review.Status, "reviewer": p.Review.Reviewer, "note": p.Review.Note}}
+}
@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses of a scheduled capture.
+const (
+	// CaptureWaiting is the capture of a payment held for review or waiting
+	// for the authentication of the shopper, it is scheduled once the
+	// payment is authorized
+	CaptureWaiting   = "waiting"
+	CaptureScheduled = "scheduled"
+	CaptureCaptured  = "captured"
+	CaptureCancelled = "cancelled"
+	CaptureFailed    = "failed"
+)
+
+// ScheduledCapture captures the whole payment After its authorization. A
+// capture made before by the merchant completes it, a void cancels it.
+type ScheduledCapture struct {
+	Status string        `bson:"status"`
+	After  time.Duration `bson:"after"`
+	At     time.Time     `bson:"at,omitempty"`
+	// Error is why a failed capture was not made
+	Error  string    `bson:"error,omitempty"`
+	DoneAt time.Time `bson:"doneat,omitempty"`
+}
+
+// NewScheduledCapture schedules the capture of a payment authorized at now,
+// or waits for the authorization of a payment that is not.
+func NewScheduledCapture(after time.Duration, authorized bool, now time.Time) *ScheduledCapture {
+	c := &ScheduledCapture{Status: CaptureWaiting, After: after}
+	if authorized {
+		c.schedule(now)
+	}
+	return c
+}
+
+func (c *ScheduledCapture) schedule(now time.Time) {
+	c.Status, c.At = CaptureScheduled, now.Add(c.After).UTC()
+}
+
+// scheduleCapture schedules the waiting capture of a payment just authorized.
+func (p *Payment) scheduleCapture(now time.Time) {
+	if c := p.ScheduledCapture; c != nil && c.Status == CaptureWaiting {
+		c.schedule(now)
+	}
+}
+
+// completeCapture ends the scheduled capture of a payment that will not be
+// captured by it, with the status it ends in.
+func (p *Payment) completeCapture(status string, cause error) {
+	c := p.ScheduledCapture
+	if c == nil || (c.Status != CaptureWaiting && c.Status != CaptureScheduled) {
+		return
+	}
+	c.Status, c.DoneAt = status, time.Now().UTC()
+	if cause != nil {
+		c.Error = cause.Error()
+	}
+}
+
+// captureFailed tells whether a scheduled capture will not succeed if tried
+// again, unlike when the acquirer could not be reached or the payment changed
+// meanwhile.
+func captureFailed(err error) bool {
+	return errors.Is(err, ErrBasedOnCreditCardNumber) || errors.Is(err, ErrPaymentIsCancelled) || errors.Is(err, ErrAlreadyRefunded) ||
+		errors.Is(err, ErrCaptureToHigh) || errors.Is(err, ErrAmountIsZero)
+}
+
+// CaptureScheduled captures the payments whose scheduled capture is due at now
+// and returns how many were. Captures that will not succeed are marked
+// failed, the others are tried again on the next call.
+func (g MongoGatewayRepository) CaptureScheduled(ctx context.Context, now time.Time) (int, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	var payments []Payment
+	cursor, err := g.db.Collection(PaymentsCol).Find(ctx, bson.M{"scheduledcapture.status": CaptureScheduled,
+		"scheduledcapture.at": bson.M{"$lte": now.UTC()}, "voided": false},
+		options.Find().SetSort(bson.D{{Key: "scheduledcapture.at", Value: 1}}))
+	if err == nil {
+		err = cursor.All(ctx, &payments)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return 0, err
+	}
+
+	captured := 0
+	for _, p := range payments {
+		_, err := g.Capture(ctx, p.Id, p.Authorized-p.Captured, nil)
+		if err == nil {
+			captured++
+			continue
+		}
+		if !captureFailed(err) {
+			lg.Warn().Str("payment_id", p.Id).Err(err).Msg("scheduled capture will be tried again")
+			continue
+		}
+		if err := g.failCapture(ctx, p.Id, err); err != nil && !errors.Is(err, ErrOptimisticLocking) {
+			return captured, err
+		}
+	}
+	return captured, nil
+}
+
+func (g MongoGatewayRepository) failCapture(ctx context.Context, paymentId string, cause error) error {
+	p, err := g.Get(ctx, paymentId)
+	if err != nil {
+		return err
+	}
+	p.completeCapture(CaptureFailed, cause)
+	_, err = g.save(ctx, "scheduled_capture", p, nil)
+	return err
+}
@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"payment-gw/ledger"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrInvalidSplit = errors.New("invalid split")
+
+// Split sends a part of the captures of a platform payment to one of its
+// connected accounts. The part is Amount, in minor units of the amount the
+// split was given with, or Percentage of it. The platform keeps the
+// ApplicationFee out of the part.
+type Split struct {
+	Destination    string  `bson:"destination"`
+	Amount         int     `bson:"amount,omitempty"`
+	Percentage     float64 `bson:"percentage,omitempty"`
+	ApplicationFee int     `bson:"applicationfee,omitempty"`
+}
+
+// Transfer is what a connected account got from a payment: its parts of the
+// captures, the application fees kept by the platform out of them, and the
+// amount refunds took back.
+type Transfer struct {
+	Destination    string `bson:"destination"`
+	Amount         int    `bson:"amount"`
+	ApplicationFee int    `bson:"applicationfee"`
+	Reversed       int    `bson:"reversed"`
+}
+
+// Net is what the connected account was sent.
+func (t Transfer) Net() int {
+	return t.Amount - t.ApplicationFee
+}
+
+// share is the part of a capture of amount, the split being given with base.
+// Parts are rounded down so they never add up to more than the capture.
+func (s Split) share(base, amount int) int {
+	if s.Percentage > 0 {
+		return int(float64(amount) * s.Percentage / 100)
+	}
+	return scale(s.Amount, base, amount)
+}
+
+func scale(v, base, amount int) int {
+	if base == 0 {
+		return 0
+	}
+	return v * amount / base
+}
+
+// ValidateSplits checks the splits given with amount: each one has either an
+// amount or a percentage, its application fee fits in its part, and the parts
+// fit in the amount.
+func ValidateSplits(splits []Split, amount int) error {
+	total := 0
+	for _, s := range splits {
+		if (s.Amount > 0) == (s.Percentage > 0) {
+			return fmt.Errorf("%w: the split to %s needs either an amount or a percentage", ErrInvalidSplit, s.Destination)
+		}
+		if s.Amount < 0 || s.Percentage < 0 || s.Percentage > 100 || s.ApplicationFee < 0 {
+			return fmt.Errorf("%w: the split to %s is out of range", ErrInvalidSplit, s.Destination)
+		}
+		share := s.share(amount, amount)
+		if s.ApplicationFee > share {
+			return fmt.Errorf("%w: the application fee of the split to %s is higher than its part", ErrInvalidSplit, s.Destination)
+		}
+		total += share
+	}
+	if total > amount {
+		return fmt.Errorf("%w: the splits are higher than the amount", ErrInvalidSplit)
+	}
+	return nil
+}
+
+// transfer sends the parts of a capture of amount to the connected accounts,
+// the splits being given with base, and returns the entries booking them.
+func (p *Payment) transfer(splits []Split, base, amount int) []ledger.Entry {
+	var entries []ledger.Entry
+	for _, s := range splits {
+		t := Transfer{Destination: s.Destination, Amount: s.share(base, amount), ApplicationFee: scale(s.ApplicationFee, base, amount)}
+		i := p.transferTo(s.Destination)
+		net := p.convertPart(p.Transfers[i].Net(), t.Net())
+		p.Transfers[i].Amount += t.Amount
+		p.Transfers[i].ApplicationFee += t.ApplicationFee
+		if net != 0 {
+			entries = append(entries, ledger.TransferEntries(p.Id, p.MerchantId, t.Destination, p.SettlementCurrency(), net)...)
+		}
+	}
+	return entries
+}
+
+func (p *Payment) transferTo(destination string) int {
+	for i, t := range p.Transfers {
+		if t.Destination == destination {
+			return i
+		}
+	}
+	p.Transfers = append(p.Transfers, Transfer{Destination: destination})
+	return len(p.Transfers) - 1
+}
+
+// ReverseTransfers takes back from the connected accounts the share of what
+// they were sent that was refunded or charged back, and returns the entries
+// booking it.
+func (p *Payment) ReverseTransfers() []ledger.Entry {
+	var entries []ledger.Entry
+	for i := range p.Transfers {
+		t := &p.Transfers[i]
+		reversed := scale(t.Net(), p.Captured, p.Refunded+p.Chargebacks)
+		if reversed <= t.Reversed {
+			continue
+		}
+		amount := p.convertPart(t.Reversed, reversed-t.Reversed)
+		t.Reversed = reversed
+		if amount != 0 {
+			entries = append(entries, ledger.TransferEntries(p.Id, p.MerchantId, t.Destination, p.SettlementCurrency(), -amount)...)
+		}
+	}
+	return entries
+}
+
+// TransfersTo returns the payments that sent a part to the connected account.
+func (g MongoGatewayRepository) TransfersTo(ctx context.Context, accountId string) ([]Payment, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	var payments []Payment
+	cursor, err := g.db.Collection(PaymentsCol).Find(ctx, bson.M{"transfers.destination": accountId},
+		options.Find().SetSort(bson.D{{Key: "id", Value: 1}}))
+	if err == nil {
+		err = cursor.All(ctx, &payments)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+	return payments, nil
+}
@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSplits(t *testing.T) {
+	assert.NoError(t, ValidateSplits(nil, 1000))
+	assert.NoError(t, ValidateSplits([]Split{{Destination: "a", Percentage: 60, ApplicationFee: 100}, {Destination: "b", Amount: 400}}, 1000))
+
+	for _, splits := range [][]Split{
+		{{Destination: "a"}},
+		{{Destination: "a", Amount: 100, Percentage: 10}},
+		{{Destination: "a", Percentage: 100.5}},
+		{{Destination: "a", Amount: 100, ApplicationFee: 101}},
+		{{Destination: "a", Amount: 600}, {Destination: "b", Percentage: 50}},
+	} {
+		assert.True(t, errors.Is(ValidateSplits(splits, 1000), ErrInvalidSplit), "%v", splits)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	p := Payment{Id: "p1", MerchantId: "platform", Currency: "EUR"}
+	splits := []Split{{Destination: "a", Amount: 500, ApplicationFee: 50}, {Destination: "b", Percentage: 33.3}}
+
+	entries := p.transfer(splits, 1000, 400)
+	assert.Equal(t, []Transfer{{Destination: "a", Amount: 200, ApplicationFee: 20}, {Destination: "b", Amount: 133}}, p.Transfers,
+		"parts scale to the capture and round down")
+	assert.Len(t, entries, 4)
+	assert.Equal(t, 180, entries[0].Postings[0].Amount)
+
+	p.transfer(splits, 1000, 600)
+	assert.Equal(t, 500, p.Transfers[0].Amount)
+	assert.Equal(t, 450, p.Transfers[0].Net())
+}
+
+func TestReverseTransfers(t *testing.T) {
+	p := Payment{Id: "p1", MerchantId: "platform", Currency: "EUR", Captured: 1000,
+		Transfers: []Transfer{{Destination: "a", Amount: 500, ApplicationFee: 50}}}
+
+	p.Refunded = 333
+	entries := p.ReverseTransfers()
+	assert.Equal(t, 149, p.Transfers[0].Reversed)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, -149, entries[0].Postings[0].Amount)
+
+	p.Refunded = 1000
+	p.ReverseTransfers()
+	assert.Equal(t, 450, p.Transfers[0].Reversed, "a full refund takes back everything")
+	assert.Empty(t, p.ReverseTransfers())
+}
+
+func TestReverseTransfersOfChargebacks(t *testing.T) {
+	p := Payment{Id: "p1", MerchantId: "platform", Currency: "EUR", Captured: 1000, Refunded: 200,
+		Transfers: []Transfer{{Destination: "a", Amount: 500, ApplicationFee: 50, Reversed: 90}}}
+
+	p.Chargebacks = 300
+	entries := p.ReverseTransfers()
+	assert.Equal(t, 225, p.Transfers[0].Reversed, "chargebacks take back their share like refunds")
+	assert.Equal(t, -135, entries[0].Postings[0].Amount)
+}
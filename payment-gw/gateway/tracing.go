@@ -0,0 +1,174 @@
+package gateway
+
+import (
+	"context"
+	"payment-gw/threeds"
+	"payment-gw/tracing"
+	"time"
+)
+
+type tracedRepository struct {
+	next GatewayRepository
+}
+
+func NewTracedRepository(next GatewayRepository) GatewayRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) Authorize(ctx context.Context, req AuthorizeRequest) (string, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Authorize", tracing.WithAttributes(
+		tracing.String("merchant.id", req.MerchantId), tracing.String("payment.currency", req.Currency), tracing.Int("payment.amount", req.Amount)))
+	defer span.End()
+	paymentId, err := t.next.Authorize(ctx, req)
+	span.SetAttributes(tracing.String("payment.id", paymentId))
+	span.RecordError(err)
+	return paymentId, err
+}
+
+func (t tracedRepository) GetMerchantIdByPaymentId(ctx context.Context, paymentId string) (string, error) {
+	ctx, span := tracing.Start(ctx, "gateway.GetMerchantIdByPaymentId", tracing.WithAttributes(tracing.String("payment.id", paymentId)))
+	defer span.End()
+	merchantId, err := t.next.GetMerchantIdByPaymentId(ctx, paymentId)
+	span.RecordError(err)
+	return merchantId, err
+}
+
+func (t tracedRepository) Get(ctx context.Context, paymentId string) (Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Get", tracing.WithAttributes(tracing.String("payment.id", paymentId)))
+	defer span.End()
+	payment, err := t.next.Get(ctx, paymentId)
+	span.RecordError(err)
+	return payment, err
+}
+
+func (t tracedRepository) Capture(ctx context.Context, paymentId string, amount int, splits []Split) (Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Capture", tracing.WithAttributes(tracing.String("payment.id", paymentId), tracing.Int("payment.amount", amount),
+		tracing.Int("payment.splits", len(splits))))
+	defer span.End()
+	payment, err := t.next.Capture(ctx, paymentId, amount, splits)
+	span.RecordError(err)
+	return payment, err
+}
+
+func (t tracedRepository) Refund(ctx context.Context, paymentId string, amount int) (Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Refund", tracing.WithAttributes(tracing.String("payment.id", paymentId), tracing.Int("payment.amount", amount)))
+	defer span.End()
+	payment, err := t.next.Refund(ctx, paymentId, amount)
+	span.RecordError(err)
+	return payment, err
+}
+
+func (t tracedRepository) Void(ctx context.Context, paymentId string) (Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Void", tracing.WithAttributes(tracing.String("payment.id", paymentId)))
+	defer span.End()
+	payment, err := t.next.Void(ctx, paymentId)
+	span.RecordError(err)
+	return payment, err
+}
+
+func (t tracedRepository) Hold(ctx context.Context, req AuthorizeRequest, expiresAt time.Time) (string, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Hold", tracing.WithAttributes(
+		tracing.String("merchant.id", req.MerchantId), tracing.String("payment.currency", req.Currency), tracing.Int("payment.amount", req.Amount)))
+	defer span.End()
+	paymentId, err := t.next.Hold(ctx, req, expiresAt)
+	span.SetAttributes(tracing.String("payment.id", paymentId))
+	span.RecordError(err)
+	return paymentId, err
+}
+
+func (t tracedRepository) Held(ctx context.Context, merchantId string) ([]Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Held", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	payments, err := t.next.Held(ctx, merchantId)
+	span.RecordError(err)
+	return payments, err
+}
+
+func (t tracedRepository) Approve(ctx context.Context, paymentId, reviewer, note string) (Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Approve", tracing.WithAttributes(tracing.String("payment.id", paymentId)))
+	defer span.End()
+	payment, err := t.next.Approve(ctx, paymentId, reviewer, note)
+	span.RecordError(err)
+	return payment, err
+}
+
+func (t tracedRepository) Reject(ctx context.Context, paymentId, reviewer, note string) (Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Reject", tracing.WithAttributes(tracing.String("payment.id", paymentId)))
+	defer span.End()
+	payment, err := t.next.Reject(ctx, paymentId, reviewer, note)
+	span.RecordError(err)
+	return payment, err
+}
+
+func (t tracedRepository) Expire(ctx context.Context, now time.Time) ([]Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Expire")
+	defer span.End()
+	expired, err := t.next.Expire(ctx, now)
+	span.SetAttributes(tracing.Int("payment.expired", len(expired)))
+	span.RecordError(err)
+	return expired, err
+}
+
+func (t tracedRepository) RequireAction(ctx context.Context, req AuthorizeRequest, expiresAt time.Time) (string, error) {
+	ctx, span := tracing.Start(ctx, "gateway.RequireAction", tracing.WithAttributes(
+		tracing.String("merchant.id", req.MerchantId), tracing.String("payment.currency", req.Currency), tracing.Int("payment.amount", req.Amount)))
+	defer span.End()
+	paymentId, err := t.next.RequireAction(ctx, req, expiresAt)
+	span.SetAttributes(tracing.String("payment.id", paymentId))
+	span.RecordError(err)
+	return paymentId, err
+}
+
+func (t tracedRepository) Abandon(ctx context.Context, paymentId string) (Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Abandon", tracing.WithAttributes(tracing.String("payment.id", paymentId)))
+	defer span.End()
+	payment, err := t.next.Abandon(ctx, paymentId)
+	span.RecordError(err)
+	return payment, err
+}
+
+func (t tracedRepository) Confirm(ctx context.Context, paymentId string, result threeds.Result, holdUntil time.Time) (Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.Confirm", tracing.WithAttributes(
+		tracing.String("payment.id", paymentId), tracing.String("threeds.status", result.Status)))
+	defer span.End()
+	payment, err := t.next.Confirm(ctx, paymentId, result, holdUntil)
+	span.RecordError(err)
+	return payment, err
+}
+
+func (t tracedRepository) CaptureScheduled(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := tracing.Start(ctx, "gateway.CaptureScheduled")
+	defer span.End()
+	captured, err := t.next.CaptureScheduled(ctx, now)
+	span.SetAttributes(tracing.Int("payment.captured", captured))
+	span.RecordError(err)
+	return captured, err
+}
+
+func (t tracedRepository) TransfersTo(ctx context.Context, accountId string) ([]Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.TransfersTo", tracing.WithAttributes(tracing.String("merchant.id", accountId)))
+	defer span.End()
+	payments, err := t.next.TransfersTo(ctx, accountId)
+	span.SetAttributes(tracing.Int("payment.count", len(payments)))
+	span.RecordError(err)
+	return payments, err
+}
+
+func (t tracedRepository) GetByReference(ctx context.Context, merchantId, reference string) (Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.GetByReference", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	payment, err := t.next.GetByReference(ctx, merchantId, reference)
+	span.SetAttributes(tracing.String("payment.id", payment.Id))
+	span.RecordError(err)
+	return payment, err
+}
+
+func (t tracedRepository) List(ctx context.Context, merchantId string, f Filter) ([]Payment, error) {
+	ctx, span := tracing.Start(ctx, "gateway.List", tracing.WithAttributes(
+		tracing.String("merchant.id", merchantId), tracing.Int("payment.metadata_filters", len(f.Metadata)), tracing.Int("payment.limit", f.Limit)))
+	defer span.End()
+	payments, err := t.next.List(ctx, merchantId, f)
+	span.SetAttributes(tracing.Int("payment.count", len(payments)))
+	span.RecordError(err)
+	return payments, err
+}
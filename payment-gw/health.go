@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	statusUp   = "up"
+	statusDown = "down"
+)
+
+type dependencyStatus struct {
+	Status  string            `json:"status"`
+	Error   string            `json:"error,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+type readinessResponse struct {
+	Status string                      `json:"status"`
+	Checks map[string]dependencyStatus `json:"checks"`
+}
+
+func (a *App) markShuttingDown() {
+	atomic.StoreInt32(&a.shuttingDown, 1)
+}
+
+func (a *App) isShuttingDown() bool {
+	return atomic.LoadInt32(&a.shuttingDown) == 1
+}
+
+func (a *App) liveness(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+func (a *App) readiness(w http.ResponseWriter, r *http.Request) {
+	res := readinessResponse{Status: "ready", Checks: map[string]dependencyStatus{
+		"database": a.checkDatabase(r.Context()),
+		"workers":  a.workers.check(),
+	}}
+	if a.isShuttingDown() {
+		res.Checks["server"] = dependencyStatus{Status: statusDown, Error: "shutting down"}
+	} else {
+		res.Checks["server"] = dependencyStatus{Status: statusUp}
+	}
+
+	code := http.StatusOK
+	for _, c := range res.Checks {
+		if c.Status != statusUp {
+			res.Status = "not_ready"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	respondWithJSON(w, code, res)
+}
+
+func (a *App) checkDatabase(ctx context.Context) dependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := a.db.Ping(ctx, readpref.Primary()); err != nil {
+		return dependencyStatus{Status: statusDown, Error: err.Error()}
+	}
+	return dependencyStatus{Status: statusUp}
+}
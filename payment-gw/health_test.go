@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/stretchr/testify/assert"
+)
+
+func sendReadinessRequest() (responseCode int, j *jsonvalue.V) {
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	response := executeRequest(req)
+	j, _ = jsonvalue.Unmarshal(response.Body.Bytes())
+	return response.Code, j
+}
+
+func Test_Liveness(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code)
+}
+
+func Test_Readiness(t *testing.T) {
+	responseCode, j := sendReadinessRequest()
+	assert.Equal(t, http.StatusOK, responseCode)
+	status, _ := j.GetString("status")
+	assert.Equal(t, "ready", status)
+	database, _ := j.GetString("checks", "database", "status")
+	assert.Equal(t, statusUp, database)
+}
+
+func Test_NotReadyDuringShutdown(t *testing.T) {
+	a.markShuttingDown()
+	defer atomic.StoreInt32(&a.shuttingDown, 0)
+
+	responseCode, j := sendReadinessRequest()
+	assert.Equal(t, http.StatusServiceUnavailable, responseCode)
+	server, _ := j.GetString("checks", "server", "status")
+	assert.Equal(t, statusDown, server)
+}
+
+func Test_NotReadyWhenWorkerFailed(t *testing.T) {
+	workers := a.workers
+	a.workers = newWorkerGroup(a.lg)
+	defer func() { a.workers = workers }()
+
+	done := make(chan struct{})
+	a.workers.Go("broken", func(ctx context.Context) error {
+		defer close(done)
+		return errors.New("boom")
+	})
+	<-done
+	a.workers.Stop(context.Background())
+
+	responseCode, j := sendReadinessRequest()
+	assert.Equal(t, http.StatusServiceUnavailable, responseCode)
+	broken, _ := j.GetString("checks", "workers", "details", "broken")
+	assert.Equal(t, workerFailed, broken)
+}
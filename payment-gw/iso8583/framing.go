@@ -0,0 +1,37 @@
+package iso8583
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const maxMessageSize = 1<<16 - 1
+
+// WriteMessage writes the packed message prefixed with its length as two
+// bytes in network byte order, the usual framing of ISO 8583 over TCP.
+func WriteMessage(w io.Writer, m *Message) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("%w: %d bytes", ErrMalformed, len(data))
+	}
+	frame := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	_, err = w.Write(append(frame, data...))
+	return err
+}
+
+func ReadMessage(r io.Reader) (*Message, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return Unpack(data)
+}
@@ -0,0 +1,164 @@
+package iso8583
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Host simulates the card network on a local TCP port. It approves every
+// authorization unless the card number is listed in Declines, and approves
+// captures, refunds and reversals of authorizations it has issued.
+type Host struct {
+	// Declines maps card numbers to the response code of their authorizations
+	Declines map[string]string
+	// Latency delays every response
+	Latency time.Duration
+
+	mu             sync.Mutex
+	listener       net.Listener
+	conns          map[net.Conn]struct{}
+	authorizations map[string]string
+	rrn            int
+	wg             sync.WaitGroup
+}
+
+func NewHost() *Host {
+	return &Host{
+		Declines:       map[string]string{},
+		conns:          map[net.Conn]struct{}{},
+		authorizations: map[string]string{},
+	}
+}
+
+func (h *Host) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.listener = l
+	h.mu.Unlock()
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.serve(l)
+	}()
+	return nil
+}
+
+func (h *Host) Addr() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.listener == nil {
+		return ""
+	}
+	return h.listener.Addr().String()
+}
+
+// Close stops accepting connections, drops the open ones and waits for them
+// to finish.
+func (h *Host) Close() error {
+	h.mu.Lock()
+	var err error
+	if h.listener != nil {
+		err = h.listener.Close()
+	}
+	for c := range h.conns {
+		c.Close()
+	}
+	h.mu.Unlock()
+	h.wg.Wait()
+	return err
+}
+
+func (h *Host) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		h.mu.Lock()
+		h.conns[conn] = struct{}{}
+		h.mu.Unlock()
+
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.handle(conn)
+			h.mu.Lock()
+			delete(h.conns, conn)
+			h.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (h *Host) handle(conn net.Conn) {
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		req, err := ReadMessage(conn)
+		if err != nil {
+			// a malformed frame leaves the stream out of sync, so the
+			// connection is dropped just like on EOF
+			return
+		}
+
+		// requests are answered concurrently, as a real host would, so
+		// responses may arrive out of order
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h.Latency > 0 {
+				time.Sleep(h.Latency)
+			}
+			resp := h.Respond(req)
+			wmu.Lock()
+			defer wmu.Unlock()
+			WriteMessage(conn, resp)
+		}()
+	}
+}
+
+// Respond builds the answer of the host to a request.
+func (h *Host) Respond(req *Message) *Message {
+	resp := NewMessage(ResponseMTI(req.MTI))
+	for _, f := range []int{2, 3, 4, 7, 11, 12, 13, 32, 37, 41, 42, 49, 70} {
+		if req.Has(f) {
+			resp.fields[f] = req.fields[f]
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	code := ResponseCodeApproved
+	switch req.MTI {
+	case MTINetworkManagementRequest:
+	case MTIAuthorizationRequest:
+		if declined, ok := h.Declines[req.Get(2)]; ok {
+			code = declined
+			break
+		}
+		h.rrn++
+		rrn := fmt.Sprintf("%012d", h.rrn)
+		auth := fmt.Sprintf("%06d", h.rrn%1000000)
+		h.authorizations[rrn] = auth
+		resp.fields[37] = rrn
+		resp.fields[38] = auth
+	case MTIFinancialRequest, MTIReversalRequest:
+		auth, ok := h.authorizations[req.Get(37)]
+		if !ok {
+			code = ResponseCodeNoRecord
+			break
+		}
+		resp.fields[38] = auth
+	default:
+		code = ResponseCodeInvalidTransaction
+	}
+	resp.fields[39] = code
+	return resp
+}
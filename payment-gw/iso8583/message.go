@@ -0,0 +1,187 @@
+package iso8583
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnknownField = errors.New("iso8583: field is not in the spec")
+	ErrInvalidValue = errors.New("iso8583: invalid field value")
+	ErrMalformed    = errors.New("iso8583: malformed message")
+)
+
+type Message struct {
+	MTI    string
+	fields map[int]string
+}
+
+func NewMessage(mti string) *Message {
+	return &Message{MTI: mti, fields: map[int]string{}}
+}
+
+// Set stores the value of a field, numeric fixed fields shorter than the spec
+// are padded with leading zeros and alphanumeric ones with trailing spaces.
+func (m *Message) Set(field int, value string) error {
+	spec, ok := Spec[field]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownField, field)
+	}
+	if spec.Format == Fixed && len(value) < spec.Length {
+		if spec.Kind == N {
+			value = strings.Repeat("0", spec.Length-len(value)) + value
+		} else {
+			value += strings.Repeat(" ", spec.Length-len(value))
+		}
+	}
+	if err := validate(field, spec, value); err != nil {
+		return err
+	}
+	m.fields[field] = value
+	return nil
+}
+
+func (m *Message) Get(field int) string {
+	return m.fields[field]
+}
+
+func (m *Message) Has(field int) bool {
+	_, ok := m.fields[field]
+	return ok
+}
+
+func (m *Message) Fields() []int {
+	fields := make([]int, 0, len(m.fields))
+	for f := range m.fields {
+		fields = append(fields, f)
+	}
+	sort.Ints(fields)
+	return fields
+}
+
+func validate(field int, spec Field, value string) error {
+	if spec.Format == Fixed && len(value) != spec.Length || len(value) > spec.Length {
+		return fmt.Errorf("%w: field %d must be %d characters long, got %d", ErrInvalidValue, field, spec.Length, len(value))
+	}
+	for _, c := range value {
+		var ok bool
+		switch spec.Kind {
+		case N:
+			ok = c >= '0' && c <= '9'
+		case AN:
+			ok = c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == ' '
+		case ANS:
+			ok = c >= 0x20 && c <= 0x7e
+		}
+		if !ok {
+			return fmt.Errorf("%w: field %d contains %q", ErrInvalidValue, field, c)
+		}
+	}
+	return nil
+}
+
+// Pack encodes the message as the MTI, the primary bitmap, the secondary
+// bitmap when a field above 64 is present, and the fields in order.
+func (m *Message) Pack() ([]byte, error) {
+	if len(m.MTI) != 4 || strings.Trim(m.MTI, "0123456789") != "" {
+		return nil, fmt.Errorf("%w: MTI %q", ErrMalformed, m.MTI)
+	}
+
+	fields := m.Fields()
+	bitmap := make([]byte, 8)
+	if len(fields) > 0 && fields[len(fields)-1] > 64 {
+		bitmap = make([]byte, 16)
+		bitmap[0] |= 0x80
+	}
+	for _, f := range fields {
+		bitmap[(f-1)/8] |= 0x80 >> ((f - 1) % 8)
+	}
+
+	out := append([]byte(m.MTI), bitmap...)
+	for _, f := range fields {
+		spec := Spec[f]
+		value := m.fields[f]
+		switch spec.Format {
+		case LLVAR:
+			out = append(out, fmt.Sprintf("%02d", len(value))...)
+		case LLLVAR:
+			out = append(out, fmt.Sprintf("%03d", len(value))...)
+		}
+		out = append(out, value...)
+	}
+	return out, nil
+}
+
+func Unpack(data []byte) (*Message, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMalformed, len(data))
+	}
+	m := NewMessage(string(data[:4]))
+	bitmap := data[4:12]
+	pos := 12
+	if bitmap[0]&0x80 != 0 {
+		if len(data) < 20 {
+			return nil, fmt.Errorf("%w: truncated secondary bitmap", ErrMalformed)
+		}
+		bitmap = data[4:20]
+		pos = 20
+	}
+
+	for f := 2; f <= len(bitmap)*8; f++ {
+		if bitmap[(f-1)/8]&(0x80>>((f-1)%8)) == 0 {
+			continue
+		}
+		spec, ok := Spec[f]
+		if !ok {
+			return nil, fmt.Errorf("%w: %d", ErrUnknownField, f)
+		}
+
+		length := spec.Length
+		if prefix := map[Format]int{LLVAR: 2, LLLVAR: 3}[spec.Format]; prefix > 0 {
+			if pos+prefix > len(data) {
+				return nil, fmt.Errorf("%w: truncated length of field %d", ErrMalformed, f)
+			}
+			// the length is digits only, strconv.Atoi would take a sign
+			length = 0
+			for _, c := range data[pos : pos+prefix] {
+				if c < '0' || c > '9' {
+					return nil, fmt.Errorf("%w: length of field %d", ErrMalformed, f)
+				}
+				length = length*10 + int(c-'0')
+			}
+			pos += prefix
+		}
+		if pos+length > len(data) {
+			return nil, fmt.Errorf("%w: truncated field %d", ErrMalformed, f)
+		}
+		value := string(data[pos : pos+length])
+		if err := validate(f, spec, value); err != nil {
+			return nil, err
+		}
+		m.fields[f] = value
+		pos += length
+	}
+	if pos != len(data) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformed, len(data)-pos)
+	}
+	return m, nil
+}
+
+func (m *Message) String() string {
+	var b strings.Builder
+	b.WriteString(m.MTI)
+	for _, f := range m.Fields() {
+		value := m.fields[f]
+		if f == 2 && len(value) > 10 {
+			// the card number is masked, as in any log of the card network
+			value = value[:6] + strings.Repeat("*", len(value)-10) + value[len(value)-4:]
+		}
+		if f == 48 {
+			value = "***"
+		}
+		fmt.Fprintf(&b, " %d=%q", f, value)
+	}
+	return b.String()
+}
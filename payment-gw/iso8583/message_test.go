@@ -0,0 +1,122 @@
+package iso8583
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackUnpack(t *testing.T) {
+	m := NewMessage(MTIAuthorizationRequest)
+	assert.NoError(t, m.Set(2, "4111111111111111"))
+	assert.NoError(t, m.Set(3, ProcessingCodePurchase))
+	assert.NoError(t, m.Set(4, "1050"))
+	assert.NoError(t, m.Set(41, "T1"))
+	assert.NoError(t, m.Set(48, "CV123"))
+	assert.Equal(t, "000000001050", m.Get(4), "numeric fields are padded with zeros")
+	assert.Equal(t, "T1      ", m.Get(41), "alphanumeric fields are padded with spaces")
+
+	data, err := m.Pack()
+	assert.NoError(t, err)
+	assert.Equal(t, "0100", string(data[:4]))
+	assert.Equal(t, []byte{0x70, 0, 0, 0, 0, 0x81, 0, 0}, data[4:12])
+	assert.Equal(t, "164111111111111111", string(data[12:30]), "LLVAR fields carry their length")
+	assert.Equal(t, "005CV123", string(data[len(data)-8:]), "LLLVAR fields carry their length")
+
+	u, err := Unpack(data)
+	assert.NoError(t, err)
+	assert.Equal(t, m.MTI, u.MTI)
+	assert.Equal(t, []int{2, 3, 4, 41, 48}, u.Fields())
+	for _, f := range m.Fields() {
+		assert.Equal(t, m.Get(f), u.Get(f))
+	}
+}
+
+func TestSecondaryBitmap(t *testing.T) {
+	m := NewMessage(MTINetworkManagementRequest)
+	assert.NoError(t, m.Set(11, "42"))
+	assert.NoError(t, m.Set(70, NetworkManagementEcho))
+
+	data, err := m.Pack()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x80, 0x20, 0, 0, 0, 0, 0, 0}, data[4:12])
+	assert.Equal(t, []byte{0x04, 0, 0, 0, 0, 0, 0, 0}, data[12:20])
+
+	u, err := Unpack(data)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{11, 70}, u.Fields())
+	assert.Equal(t, "000042", u.Get(11))
+	assert.Equal(t, NetworkManagementEcho, u.Get(70))
+}
+
+func TestSpecViolations(t *testing.T) {
+	m := NewMessage(MTIAuthorizationRequest)
+	assert.True(t, errors.Is(m.Set(5, "1"), ErrUnknownField))
+	assert.True(t, errors.Is(m.Set(4, "10.50"), ErrInvalidValue))
+	assert.True(t, errors.Is(m.Set(4, "1234567890123"), ErrInvalidValue))
+	assert.True(t, errors.Is(m.Set(2, "41111111111111111111"), ErrInvalidValue))
+	assert.True(t, errors.Is(m.Set(37, "ref-1"), ErrInvalidValue))
+	assert.True(t, errors.Is(m.Set(48, "\n"), ErrInvalidValue))
+	assert.False(t, m.Has(4))
+
+	_, err := NewMessage("01").Pack()
+	assert.True(t, errors.Is(err, ErrMalformed))
+
+	m.Set(4, "100")
+	data, _ := m.Pack()
+	_, err = Unpack(data[:len(data)-1])
+	assert.True(t, errors.Is(err, ErrMalformed))
+	_, err = Unpack(append(data, '0'))
+	assert.True(t, errors.Is(err, ErrMalformed))
+	data[4] |= 0x08
+	_, err = Unpack(data)
+	assert.True(t, errors.Is(err, ErrUnknownField))
+}
+
+func TestMalformedLength(t *testing.T) {
+	m := NewMessage(MTIAuthorizationRequest)
+	m.Set(2, "4111111111111111")
+	data, _ := m.Pack()
+	assert.Equal(t, "16", string(data[12:14]))
+
+	for _, prefix := range []string{"-1", "+9", " 9", "1a"} {
+		malformed := append([]byte{}, data...)
+		copy(malformed[12:], prefix)
+		_, err := Unpack(malformed)
+		assert.True(t, errors.Is(err, ErrMalformed), prefix)
+	}
+}
+
+func TestFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for _, mti := range []string{MTIFinancialRequest, MTIReversalRequest} {
+		m := NewMessage(mti)
+		m.Set(37, "000000000001")
+		assert.NoError(t, WriteMessage(&buf, m))
+	}
+	assert.Equal(t, []byte{0, 24}, buf.Bytes()[:2])
+
+	m, err := ReadMessage(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, MTIFinancialRequest, m.MTI)
+	m, err = ReadMessage(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, MTIReversalRequest, m.MTI)
+	assert.Equal(t, "000000000001", m.Get(37))
+}
+
+func TestResponseMTI(t *testing.T) {
+	assert.Equal(t, MTIAuthorizationResponse, ResponseMTI(MTIAuthorizationRequest))
+	assert.Equal(t, MTIFinancialResponse, ResponseMTI(MTIFinancialRequest))
+	assert.Equal(t, MTIReversalResponse, ResponseMTI(MTIReversalRequest))
+	assert.Equal(t, MTINetworkManagementResponse, ResponseMTI(MTINetworkManagementRequest))
+}
+
+func TestStringMasksCardData(t *testing.T) {
+	m := NewMessage(MTIAuthorizationRequest)
+	m.Set(2, "4111111111111111")
+	m.Set(48, "CV123")
+	assert.Equal(t, `0100 2="411111******1111" 48="***"`, m.String())
+}
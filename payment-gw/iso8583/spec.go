@@ -0,0 +1,108 @@
+package iso8583
+
+type Kind int
+
+const (
+	// N is numeric, digits only
+	N Kind = iota
+	// AN is alphanumeric, letters, digits and spaces
+	AN
+	// ANS is alphanumeric and special, any printable ASCII character
+	ANS
+)
+
+type Format int
+
+const (
+	Fixed Format = iota
+	// LLVAR values are prefixed with a two digit length
+	LLVAR
+	// LLLVAR values are prefixed with a three digit length
+	LLLVAR
+)
+
+type Field struct {
+	Description string
+	Kind        Kind
+	Format      Format
+	// Length is the exact length of fixed fields and the maximum length of
+	// variable ones.
+	Length int
+}
+
+// Spec lists the ISO 8583:1987 data elements the gateway exchanges with the
+// card network, values are ASCII encoded.
+var Spec = map[int]Field{
+	2:  {"Primary account number", N, LLVAR, 19},
+	3:  {"Processing code", N, Fixed, 6},
+	4:  {"Amount, transaction", N, Fixed, 12},
+	7:  {"Transmission date and time", N, Fixed, 10},
+	11: {"System trace audit number", N, Fixed, 6},
+	12: {"Time, local transaction", N, Fixed, 6},
+	13: {"Date, local transaction", N, Fixed, 4},
+	14: {"Date, expiration", N, Fixed, 4},
+	22: {"Point of service entry mode", N, Fixed, 3},
+	25: {"Point of service condition code", N, Fixed, 2},
+	32: {"Acquiring institution identification code", N, LLVAR, 11},
+	37: {"Retrieval reference number", AN, Fixed, 12},
+	38: {"Authorization identification response", AN, Fixed, 6},
+	39: {"Response code", AN, Fixed, 2},
+	41: {"Card acceptor terminal identification", ANS, Fixed, 8},
+	42: {"Card acceptor identification code", ANS, Fixed, 15},
+	43: {"Card acceptor name/location", ANS, Fixed, 40},
+	48: {"Additional data, private", ANS, LLLVAR, 999},
+	49: {"Currency code, transaction", N, Fixed, 3},
+	70: {"Network management information code", N, Fixed, 3},
+	90: {"Original data elements", N, Fixed, 42},
+}
+
+// Message type indicators
+const (
+	MTIAuthorizationRequest        = "0100"
+	MTIAuthorizationResponse       = "0110"
+	MTIFinancialRequest            = "0200"
+	MTIFinancialResponse           = "0210"
+	MTIReversalRequest             = "0400"
+	MTIReversalResponse            = "0410"
+	MTINetworkManagementRequest    = "0800"
+	MTINetworkManagementResponse   = "0810"
+	NetworkManagementSignOn        = "001"
+	NetworkManagementEcho          = "301"
+	ProcessingCodePurchase         = "000000"
+	ProcessingCodeRefund           = "200000"
+	ResponseCodeApproved           = "00"
+	ResponseCodeInvalidTransaction = "12"
+	ResponseCodeNoRecord           = "25"
+)
+
+// ResponseMTI returns the message type answering a request, e.g. 0110 for
+// 0100.
+func ResponseMTI(mti string) string {
+	if len(mti) != 4 {
+		return ""
+	}
+	b := []byte(mti)
+	b[2]++
+	return string(b)
+}
+
+var currencies = map[string]string{
+	"AUD": "036",
+	"CAD": "124",
+	"CHF": "756",
+	"CZK": "203",
+	"DKK": "208",
+	"EUR": "978",
+	"GBP": "826",
+	"JPY": "392",
+	"NOK": "578",
+	"PLN": "985",
+	"SEK": "752",
+	"USD": "840",
+}
+
+// CurrencyCode returns the ISO 4217 numeric code used in field 49.
+func CurrencyCode(alpha string) (string, bool) {
+	code, ok := currencies[alpha]
+	return code, ok
+}
@@ -0,0 +1,276 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const JournalCol = "journal"
+
+var (
+	ErrUnbalanced = errors.New("journal entry does not balance")
+	ErrPosted     = errors.New("journal entry was already posted")
+)
+
+type Account string
+
+// Accounts of the books. Merchant accounts are kept per merchant, postings to
+// them carry the merchant id.
+const (
+	// AcquirerReceivable is what the acquirers owe for captured payments
+	AcquirerReceivable Account = "acquirer_receivable"
+	// MerchantPending is captured money not settled to the merchant yet
+	MerchantPending Account = "merchant_pending"
+	// MerchantAvailable is settled money that can be paid out
+	MerchantAvailable Account = "merchant_available"
+	// Fees is the revenue of the gateway
+	Fees Account = "fees"
+	// RefundsPayable is refunded money owed back to cardholders
+	RefundsPayable Account = "refunds_payable"
+	// PayoutsInTransit is money sent to merchants but not confirmed by the bank
+	PayoutsInTransit Account = "payouts_in_transit"
+	// Bank is the account of the gateway payouts are made from
+	Bank Account = "bank"
+	// Transfers clears the money a platform sends to its connected accounts
+	Transfers Account = "transfers"
+)
+
+const (
+	KindCapture      = "capture"
+	KindRefund       = "refund"
+	KindChargeback   = "chargeback"
+	KindFee          = "fee"
+	KindSettlement   = "settlement"
+	KindPayout       = "payout"
+	KindPayoutPaid   = "payout_paid"
+	KindPayoutFailed = "payout_failed"
+	KindTransfer     = "transfer"
+)
+
+// Posting debits the account with a positive amount and credits it with a
+// negative one, amounts are in minor units.
+type Posting struct {
+	Account    Account `bson:"account" json:"account"`
+	MerchantId string  `bson:"merchantid,omitempty" json:"merchant_id,omitempty"`
+	Amount     int     `bson:"amount" json:"amount"`
+}
+
+// Entry is a journal entry, its postings sum to zero.
+type Entry struct {
+	Id         string    `bson:"id"`
+	Kind       string    `bson:"kind"`
+	PaymentId  string    `bson:"paymentid,omitempty"`
+	MerchantId string    `bson:"merchantid"`
+	Currency   string    `bson:"currency"`
+	Postings   []Posting `bson:"postings"`
+	CreatedAt  time.Time `bson:"createdat"`
+	// BatchId is set once the entry is settled to the merchant
+	BatchId string `bson:"batchid,omitempty"`
+}
+
+func (e Entry) Balanced() bool {
+	sum := 0
+	for _, p := range e.Postings {
+		sum += p.Amount
+	}
+	return sum == 0 && len(e.Postings) > 1
+}
+
+// Transfer builds an entry moving amount from one account to another.
+func Transfer(kind, merchantId, currency string, amount int, debit, credit Posting) Entry {
+	debit.Amount, credit.Amount = amount, -amount
+	return Entry{Kind: kind, MerchantId: merchantId, Currency: currency, Postings: []Posting{debit, credit}}
+}
+
+// CaptureEntries books a capture as owed by the acquirer and pending for the
+// merchant, minus the fee of the gateway.
+func CaptureEntries(paymentId, merchantId, currency string, amount, fee int) []Entry {
+	entries := []Entry{Transfer(KindCapture, merchantId, currency, amount,
+		Posting{Account: AcquirerReceivable}, Posting{Account: MerchantPending, MerchantId: merchantId})}
+	if fee > 0 {
+		entries = append(entries, Transfer(KindFee, merchantId, currency, fee,
+			Posting{Account: MerchantPending, MerchantId: merchantId}, Posting{Account: Fees}))
+	}
+	return withPayment(paymentId, entries)
+}
+
+// RefundEntries books a refund as owed to the cardholder by the merchant. A
+// negative fee gives back a part of the capture fee.
+func RefundEntries(paymentId, merchantId, currency string, amount, fee int) []Entry {
+	entries := []Entry{Transfer(KindRefund, merchantId, currency, amount,
+		Posting{Account: MerchantPending, MerchantId: merchantId}, Posting{Account: RefundsPayable})}
+	if fee != 0 {
+		entries = append(entries, Transfer(KindFee, merchantId, currency, fee,
+			Posting{Account: MerchantPending, MerchantId: merchantId}, Posting{Account: Fees}))
+	}
+	return withPayment(paymentId, entries)
+}
+
+// ChargebackEntries books a lost dispute, the acquirer takes the amount back
+// from the merchant.
+func ChargebackEntries(paymentId, merchantId, currency string, amount int) []Entry {
+	return withPayment(paymentId, []Entry{Transfer(KindChargeback, merchantId, currency, amount,
+		Posting{Account: MerchantPending, MerchantId: merchantId}, Posting{Account: AcquirerReceivable})})
+}
+
+// TransferEntries books the part of a payment a platform sends to one of its
+// connected accounts, a negative amount takes it back. Each side is an entry
+// of its own merchant so both balances and settlements see it.
+func TransferEntries(paymentId, platformId, accountId, currency string, amount int) []Entry {
+	return withPayment(paymentId, []Entry{
+		Transfer(KindTransfer, platformId, currency, amount,
+			Posting{Account: MerchantPending, MerchantId: platformId}, Posting{Account: Transfers}),
+		Transfer(KindTransfer, accountId, currency, amount,
+			Posting{Account: Transfers}, Posting{Account: MerchantPending, MerchantId: accountId}),
+	})
+}
+
+func withPayment(paymentId string, entries []Entry) []Entry {
+	for i := range entries {
+		entries[i].PaymentId = paymentId
+	}
+	return entries
+}
+
+// journalEntry is an entry as stored, its id is the id of the document so
+// the same entry cannot be written twice.
+type journalEntry struct {
+	Key   string `bson:"_id"`
+	Entry `bson:",inline"`
+}
+
+// Post writes the entries, with ctx being a session context they are part of
+// its transaction. Entries without an id are given one derived from key,
+// posting the same operation twice fails with ErrPosted.
+func Post(ctx context.Context, db *mongo.Database, key string, entries ...Entry) error {
+	docs := make([]interface{}, 0, len(entries))
+	now := time.Now().UTC()
+	for i, e := range entries {
+		if !e.Balanced() {
+			return fmt.Errorf("%w: %s %s", ErrUnbalanced, e.Kind, key)
+		}
+		if e.Id == "" {
+			e.Id = fmt.Sprintf("%s/%s/%d", key, e.Kind, i)
+		}
+		if e.CreatedAt.IsZero() {
+			e.CreatedAt = now
+		}
+		docs = append(docs, journalEntry{e.Id, e})
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	_, err := db.Collection(JournalCol).InsertMany(ctx, docs)
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %s", ErrPosted, key)
+	}
+	return err
+}
+
+type Balance struct {
+	MerchantId string
+	Currency   string
+	Pending    int
+	Available  int
+}
+
+// Report is the result of checking the books. Every entry must balance and
+// so must the accounts of every currency together.
+type Report struct {
+	Entries    int
+	Unbalanced []string
+	Totals     map[string]int
+}
+
+func (r Report) OK() bool {
+	for _, total := range r.Totals {
+		if total != 0 {
+			return false
+		}
+	}
+	return len(r.Unbalanced) == 0
+}
+
+type LedgerRepository interface {
+	Balance(ctx context.Context, merchantId, currency string) (Balance, error)
+	Check(ctx context.Context) (Report, error)
+}
+
+type MongoLedgerRepository struct {
+	db *mongo.Database
+}
+
+func NewRepository(db *mongo.Database) MongoLedgerRepository {
+	return MongoLedgerRepository{db: db}
+}
+
+// Balance sums the merchant accounts, they are liabilities so credits count
+// as positive.
+func (l MongoLedgerRepository) Balance(ctx context.Context, merchantId, currency string) (Balance, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	cursor, err := l.db.Collection(JournalCol).Aggregate(ctx, []bson.M{
+		{"$match": bson.M{"merchantid": merchantId, "currency": currency}},
+		{"$unwind": "$postings"},
+		{"$match": bson.M{"postings.merchantid": merchantId}},
+		{"$group": bson.M{"_id": "$postings.account", "amount": bson.M{"$sum": "$postings.amount"}}},
+	})
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Balance{}, err
+	}
+	var sums []struct {
+		Account Account `bson:"_id"`
+		Amount  int     `bson:"amount"`
+	}
+	if err := cursor.All(ctx, &sums); err != nil {
+		lg.Error().Msg(err.Error())
+		return Balance{}, err
+	}
+
+	balance := Balance{MerchantId: merchantId, Currency: currency}
+	for _, s := range sums {
+		switch s.Account {
+		case MerchantPending:
+			balance.Pending = -s.Amount
+		case MerchantAvailable:
+			balance.Available = -s.Amount
+		}
+	}
+	return balance, nil
+}
+
+func (l MongoLedgerRepository) Check(ctx context.Context) (Report, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	cursor, err := l.db.Collection(JournalCol).Aggregate(ctx, []bson.M{
+		{"$project": bson.M{"id": 1, "currency": 1, "sum": bson.M{"$sum": "$postings.amount"}, "postings": bson.M{"$size": "$postings"}}},
+	})
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Report{}, err
+	}
+	var entries []struct {
+		Id       string `bson:"id"`
+		Currency string `bson:"currency"`
+		Sum      int    `bson:"sum"`
+		Postings int    `bson:"postings"`
+	}
+	if err := cursor.All(ctx, &entries); err != nil {
+		lg.Error().Msg(err.Error())
+		return Report{}, err
+	}
+
+	report := Report{Entries: len(entries), Totals: map[string]int{}}
+	for _, e := range entries {
+		if e.Sum != 0 || e.Postings < 2 {
+			report.Unbalanced = append(report.Unbalanced, e.Id)
+		}
+		report.Totals[e.Currency] += e.Sum
+	}
+	return report, nil
+}
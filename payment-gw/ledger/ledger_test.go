@@ -0,0 +1,71 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureEntries(t *testing.T) {
+	entries := CaptureEntries("p1", "m1", "EUR", 1000, 30)
+	assert.Len(t, entries, 2)
+	for _, e := range entries {
+		assert.True(t, e.Balanced())
+		assert.Equal(t, "p1", e.PaymentId)
+		assert.Equal(t, "EUR", e.Currency)
+	}
+	assert.Equal(t, []Posting{{AcquirerReceivable, "", 1000}, {MerchantPending, "m1", -1000}}, entries[0].Postings)
+	assert.Equal(t, []Posting{{MerchantPending, "m1", 30}, {Fees, "", -30}}, entries[1].Postings)
+
+	assert.Len(t, CaptureEntries("p1", "m1", "EUR", 1000, 0), 1, "no fee entry without a fee")
+}
+
+func TestRefundEntries(t *testing.T) {
+	entries := RefundEntries("p1", "m1", "EUR", 400, 0)
+	assert.Len(t, entries, 1)
+	assert.True(t, entries[0].Balanced())
+	assert.Equal(t, KindRefund, entries[0].Kind)
+	assert.Equal(t, []Posting{{MerchantPending, "m1", 400}, {RefundsPayable, "", -400}}, entries[0].Postings)
+
+	entries = RefundEntries("p1", "m1", "EUR", 400, -12)
+	assert.Len(t, entries, 2)
+	assert.True(t, entries[1].Balanced())
+	assert.Equal(t, []Posting{{MerchantPending, "m1", -12}, {Fees, "", 12}}, entries[1].Postings, "the capture fee is given back")
+}
+
+func TestChargebackEntries(t *testing.T) {
+	entries := ChargebackEntries("p1", "m1", "EUR", 700)
+	assert.Len(t, entries, 1)
+	assert.True(t, entries[0].Balanced())
+	assert.Equal(t, KindChargeback, entries[0].Kind)
+	assert.Equal(t, []Posting{{MerchantPending, "m1", 700}, {AcquirerReceivable, "", -700}}, entries[0].Postings)
+}
+
+func TestTransferEntries(t *testing.T) {
+	entries := TransferEntries("p1", "platform", "seller", "EUR", 600)
+	assert.Len(t, entries, 2)
+	for _, e := range entries {
+		assert.True(t, e.Balanced())
+		assert.Equal(t, KindTransfer, e.Kind)
+		assert.Equal(t, "p1", e.PaymentId)
+	}
+	assert.Equal(t, "platform", entries[0].MerchantId)
+	assert.Equal(t, []Posting{{MerchantPending, "platform", 600}, {Transfers, "", -600}}, entries[0].Postings)
+	assert.Equal(t, "seller", entries[1].MerchantId)
+	assert.Equal(t, []Posting{{Transfers, "", 600}, {MerchantPending, "seller", -600}}, entries[1].Postings)
+
+	entries = TransferEntries("p1", "platform", "seller", "EUR", -200)
+	assert.Equal(t, []Posting{{Transfers, "", -200}, {MerchantPending, "seller", 200}}, entries[1].Postings, "a reversal takes it back")
+}
+
+func TestBalanced(t *testing.T) {
+	assert.False(t, Entry{Postings: []Posting{{Fees, "", 10}, {MerchantPending, "m1", -9}}}.Balanced())
+	assert.False(t, Entry{Postings: []Posting{{Fees, "", 0}}}.Balanced(), "an entry needs two sides")
+	assert.False(t, Entry{}.Balanced())
+}
+
+func TestReport(t *testing.T) {
+	assert.True(t, Report{Totals: map[string]int{"EUR": 0}}.OK())
+	assert.False(t, Report{Totals: map[string]int{"EUR": 0, "USD": 5}}.OK())
+	assert.False(t, Report{Unbalanced: []string{"p1/2/capture/0"}}.OK())
+}
@@ -0,0 +1,32 @@
+package ledger
+
+import (
+	"context"
+	"payment-gw/tracing"
+)
+
+type tracedRepository struct {
+	next LedgerRepository
+}
+
+func NewTracedRepository(next LedgerRepository) LedgerRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) Balance(ctx context.Context, merchantId, currency string) (Balance, error) {
+	ctx, span := tracing.Start(ctx, "ledger.Balance", tracing.WithAttributes(
+		tracing.String("merchant.id", merchantId), tracing.String("payment.currency", currency)))
+	defer span.End()
+	balance, err := t.next.Balance(ctx, merchantId, currency)
+	span.RecordError(err)
+	return balance, err
+}
+
+func (t tracedRepository) Check(ctx context.Context) (Report, error) {
+	ctx, span := tracing.Start(ctx, "ledger.Check")
+	defer span.End()
+	report, err := t.next.Check(ctx)
+	span.SetAttributes(tracing.Int("ledger.entries", report.Entries), tracing.Int("ledger.unbalanced", len(report.Unbalanced)))
+	span.RecordError(err)
+	return report, err
+}
@@ -2,23 +2,36 @@ package main
 
 import (
 	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
 func main() {
-	a := App{}
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(reconcileCommand(os.Args[2:], os.Getenv, os.Stdout))
+	}
 
-	dbUsername := os.Getenv("MONGO_ROOT_USERNAME")
-	dbPassword := os.Getenv("MONGO_ROOT_PASSWORD")
-	dbPortNumber := os.Getenv("MONGO_PORT_NUMBER")
-	appPortNumber := os.Getenv("APP_PORT_NUMBER")
+	c, err := LoadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	setupLogging(c.Log)
 
-	c := Config{
-		dbName:     "task",
-		dbUsername: dbUsername,
-		dbPassword: dbPassword,
-		dbPort:     dbPortNumber,
+	a := App{}
+	if err := a.Initialize(c); err != nil {
+		log.Fatal().Err(err).Msg("")
 	}
-	a.Initialize(c)
 
-	a.Run(":" + appPortNumber)
+	if err := a.Run(); err != nil {
+		log.Fatal().Err(err).Msg("")
+	}
+}
+
+func setupLogging(c LogConfig) {
+	level, _ := zerolog.ParseLevel(c.Level)
+	zerolog.SetGlobalLevel(level)
+	if c.Format == "console" {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	}
 }
@@ -1,43 +1,78 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"payment-gw/dispute"
+	"payment-gw/events"
+	"payment-gw/fraud"
 	"payment-gw/gateway"
+	"payment-gw/ledger"
 	"payment-gw/merchant"
+	"payment-gw/paymentlink"
+	"payment-gw/reconciliation"
+	"payment-gw/risk"
+	"payment-gw/settlement"
+	"payment-gw/threeds"
 	"testing"
 
 	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 var a App
 
+const adminKey = "test-admin-key"
+
 func TestMain(m *testing.M) {
 	a = App{}
 
-	dbUsername := os.Getenv("MONGO_ROOT_USERNAME")
-	dbPassword := os.Getenv("MONGO_ROOT_PASSWORD")
-	dbPortNumber := os.Getenv("MONGO_PORT_NUMBER")
-
-	c := Config{
-		dbName:     "test",
-		dbUsername: dbUsername,
-		dbPassword: dbPassword,
-		dbPort:     dbPortNumber,
+	c, err := LoadConfig(nil, os.Getenv)
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	c.Mongo.Database = "test"
+	c.Mongo.ConnectAttempts = 1
+	c.Acquirers[0].Simulator.ScenariosFile = "testdata/scenarios.yaml"
+	// tests settle with a clock of their own
+	c.Settlement.Interval = 0
+	c.Admin.Key = adminKey
+	c.FX.RatesFile = "fx/testdata/rates.yaml"
+	evidenceDir, err := os.MkdirTemp("", "evidence")
+	if err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	c.Disputes.EvidenceDir = evidenceDir
+	if err := a.Initialize(c); err != nil {
+		log.Fatal().Err(err).Msg("")
 	}
-	a.Initialize(c)
 
 	code := m.Run()
+	os.RemoveAll(evidenceDir)
 	os.Exit(code)
 }
 
 func clearTable() {
 	a.collection(merchant.MerchantCol).DeleteMany(context.Background(), bson.D{})
 	a.collection(gateway.PaymentsCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(ledger.JournalCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(settlement.BatchesCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(settlement.PayoutsCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(reconciliation.RunsCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(dispute.DisputesCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(events.EventsCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(risk.SettingsCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(risk.VolumesCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(fraud.AttemptsCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(threeds.ChallengesCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(paymentlink.LinksCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(paymentlink.FailuresCol).DeleteMany(context.Background(), bson.D{})
+	a.collection(gateway.ReferencesCol).DeleteMany(context.Background(), bson.D{})
 }
 
 func register(t *testing.T) (string, string) {
@@ -62,6 +97,16 @@ func executeRequest(req *http.Request) *httptest.ResponseRecorder {
 	return rr
 }
 
+// sendRequest sends a request authorized with key and returns the status and
+// the JSON answered.
+func sendRequest(method, path, key string, body []byte) (int, *jsonvalue.V) {
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	req.Header.Set("Authorization", key)
+	response := executeRequest(req)
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	return response.Code, j
+}
+
 func makeErrorResponse(err error) string {
 	return `{"error":"` + err.Error() + `"}`
 }
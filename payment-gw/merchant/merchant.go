@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"math/rand"
+	"payment-gw/metrics"
+	"time"
 
 	"github.com/rs/xid"
 	"github.com/rs/zerolog"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -17,16 +20,42 @@ const MerchantCol = "merchants"
 var (
 	ErrMerchantNotFound = errors.New("merchant with the given id not found")
 	ErrWrongSecretKey   = errors.New("wrong secret key")
+	ErrNotPlatform      = errors.New("connected accounts cannot have connected accounts")
 )
 
+var bcryptDuration = metrics.NewHistogramVec("merchant_authentication_bcrypt_duration_seconds",
+	"Time spent comparing merchant secret keys with bcrypt.", nil)
+
 type merchant struct {
-	HashedKey string `bson:"hashedkey"`
-	Id        string `bson:"id"`
+	HashedKey             string `bson:"hashedkey"`
+	Id                    string `bson:"id"`
+	ClientCertFingerprint string `bson:"clientcertfingerprint,omitempty"`
+	SettlementCurrency    string `bson:"settlementcurrency,omitempty"`
+	// PlatformId is set on the connected accounts of a platform
+	PlatformId string    `bson:"platformid,omitempty"`
+	Name       string    `bson:"name,omitempty"`
+	CreatedAt  time.Time `bson:"createdat,omitempty"`
+}
+
+// ConnectedAccount is a merchant onboarded by a platform, which can send it
+// parts of its payments and act on its behalf.
+type ConnectedAccount struct {
+	Id         string
+	PlatformId string
+	Name       string
+	CreatedAt  time.Time
 }
 
 type MerchantRepository interface {
 	Register(ctx context.Context) (string, string, error)
 	IsAuthenticated(ctx context.Context, merchantId, secretKey string) error
+	GetClientCertFingerprint(ctx context.Context, merchantId string) (string, error)
+	SetClientCertFingerprint(ctx context.Context, merchantId, fingerprint string) error
+	GetSettlementCurrency(ctx context.Context, merchantId string) (string, error)
+	SetSettlementCurrency(ctx context.Context, merchantId, currency string) error
+	Connect(ctx context.Context, platformId, name string) (ConnectedAccount, string, error)
+	ListConnected(ctx context.Context, platformId string) ([]ConnectedAccount, error)
+	GetPlatformId(ctx context.Context, merchantId string) (string, error)
 }
 
 type MongoMerchanyRepository struct {
@@ -48,22 +77,91 @@ func generateRandomKey(n int) string {
 }
 
 func (g MongoMerchanyRepository) Register(ctx context.Context) (string, string, error) {
+	m, secretKey, err := g.insert(ctx, merchant{})
+	return m.Id, secretKey, err
+}
+
+// insert stores a new merchant with a fresh id and secret key.
+func (g MongoMerchanyRepository) insert(ctx context.Context, m merchant) (merchant, string, error) {
 	lg := ctx.Value("logger").(*zerolog.Logger)
-	merchantId := xid.New().String()
+	m.Id = xid.New().String()
 	secretKey := generateRandomKey(25)
 	hashedKey, err := bcrypt.GenerateFromPassword([]byte(secretKey), bcrypt.DefaultCost)
 	if err != nil {
 		lg.Error().Msg(err.Error())
-		return "", "", err
+		return merchant{}, "", err
+	}
+	m.HashedKey = string(hashedKey)
+	_, err = g.db.Collection(MerchantCol).InsertOne(ctx, m)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return merchant{}, "", err
+	}
+
+	return m, secretKey, nil
+}
+
+func (m merchant) connectedAccount() ConnectedAccount {
+	return ConnectedAccount{Id: m.Id, PlatformId: m.PlatformId, Name: m.Name, CreatedAt: m.CreatedAt}
+}
+
+// Connect registers a connected account of the platform, it gets a secret key
+// of its own.
+func (g MongoMerchanyRepository) Connect(ctx context.Context, platformId, name string) (ConnectedAccount, string, error) {
+	platform, err := g.get(ctx, platformId)
+	if err != nil {
+		return ConnectedAccount{}, "", err
+	}
+	if platform.PlatformId != "" {
+		return ConnectedAccount{}, "", ErrNotPlatform
+	}
+
+	m, secretKey, err := g.insert(ctx, merchant{PlatformId: platformId, Name: name, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return ConnectedAccount{}, "", err
+	}
+	return m.connectedAccount(), secretKey, nil
+}
+
+func (g MongoMerchanyRepository) ListConnected(ctx context.Context, platformId string) ([]ConnectedAccount, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+
+	var merchants []merchant
+	cursor, err := g.db.Collection(MerchantCol).Find(ctx, bson.M{"platformid": platformId},
+		options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}}))
+	if err == nil {
+		err = cursor.All(ctx, &merchants)
 	}
-	merchant := merchant{HashedKey: string(hashedKey), Id: merchantId}
-	_, err = g.db.Collection(MerchantCol).InsertOne(ctx, merchant)
 	if err != nil {
 		lg.Error().Msg(err.Error())
-		return "", "", err
+		return nil, err
+	}
+
+	accounts := make([]ConnectedAccount, 0, len(merchants))
+	for _, m := range merchants {
+		accounts = append(accounts, m.connectedAccount())
 	}
+	return accounts, nil
+}
+
+// GetPlatformId returns the platform of a connected account, empty for the
+// other merchants.
+func (g MongoMerchanyRepository) GetPlatformId(ctx context.Context, merchantId string) (string, error) {
+	m, err := g.get(ctx, merchantId)
+	return m.PlatformId, err
+}
+
+func (g MongoMerchanyRepository) get(ctx context.Context, merchantId string) (merchant, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
 
-	return merchantId, secretKey, nil
+	var result merchant
+	if err := g.db.Collection(MerchantCol).FindOne(ctx, bson.M{"id": merchantId}).Decode(&result); err == mongo.ErrNoDocuments {
+		return merchant{}, ErrMerchantNotFound
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		return merchant{}, err
+	}
+	return result, nil
 }
 
 func (g MongoMerchanyRepository) IsAuthenticated(ctx context.Context, merchantId string, secretKey string) error {
@@ -77,9 +175,80 @@ func (g MongoMerchanyRepository) IsAuthenticated(ctx context.Context, merchantId
 		return err
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(result["hashedkey"].(string)), []byte(secretKey)); err != nil {
+	start := time.Now()
+	err := bcrypt.CompareHashAndPassword([]byte(result["hashedkey"].(string)), []byte(secretKey))
+	bcryptDuration.WithLabelValues().Observe(time.Since(start).Seconds())
+	if err != nil {
 		return ErrWrongSecretKey
 	}
 
 	return nil
 }
+
+func (g MongoMerchanyRepository) GetClientCertFingerprint(ctx context.Context, merchantId string) (string, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+
+	var result merchant
+	if err := g.db.Collection(MerchantCol).FindOne(ctx, bson.M{"id": merchantId}).Decode(&result); err == mongo.ErrNoDocuments {
+		return "", ErrMerchantNotFound
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		return "", err
+	}
+
+	return result.ClientCertFingerprint, nil
+}
+
+func (g MongoMerchanyRepository) SetClientCertFingerprint(ctx context.Context, merchantId, fingerprint string) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+
+	update := bson.M{"$set": bson.M{"clientcertfingerprint": fingerprint}}
+	if fingerprint == "" {
+		update = bson.M{"$unset": bson.M{"clientcertfingerprint": ""}}
+	}
+	result, err := g.db.Collection(MerchantCol).UpdateOne(ctx, bson.M{"id": merchantId}, update)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrMerchantNotFound
+	}
+
+	return nil
+}
+
+// GetSettlementCurrency returns the currency the merchant is paid in, empty
+// when payments settle in the currency they were made in.
+func (g MongoMerchanyRepository) GetSettlementCurrency(ctx context.Context, merchantId string) (string, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+
+	var result merchant
+	if err := g.db.Collection(MerchantCol).FindOne(ctx, bson.M{"id": merchantId}).Decode(&result); err == mongo.ErrNoDocuments {
+		return "", ErrMerchantNotFound
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		return "", err
+	}
+
+	return result.SettlementCurrency, nil
+}
+
+func (g MongoMerchanyRepository) SetSettlementCurrency(ctx context.Context, merchantId, currency string) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+
+	update := bson.M{"$set": bson.M{"settlementcurrency": currency}}
+	if currency == "" {
+		update = bson.M{"$unset": bson.M{"settlementcurrency": ""}}
+	}
+	result, err := g.db.Collection(MerchantCol).UpdateOne(ctx, bson.M{"id": merchantId}, update)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrMerchantNotFound
+	}
+
+	return nil
+}
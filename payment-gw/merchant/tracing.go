@@ -0,0 +1,90 @@
+package merchant
+
+import (
+	"context"
+	"payment-gw/tracing"
+)
+
+type tracedRepository struct {
+	next MerchantRepository
+}
+
+func NewTracedRepository(next MerchantRepository) MerchantRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) Register(ctx context.Context) (string, string, error) {
+	ctx, span := tracing.Start(ctx, "merchant.Register")
+	defer span.End()
+	merchantId, secretKey, err := t.next.Register(ctx)
+	span.SetAttributes(tracing.String("merchant.id", merchantId))
+	span.RecordError(err)
+	return merchantId, secretKey, err
+}
+
+func (t tracedRepository) IsAuthenticated(ctx context.Context, merchantId, secretKey string) error {
+	ctx, span := tracing.Start(ctx, "merchant.IsAuthenticated", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	err := t.next.IsAuthenticated(ctx, merchantId, secretKey)
+	span.RecordError(err)
+	return err
+}
+
+func (t tracedRepository) GetClientCertFingerprint(ctx context.Context, merchantId string) (string, error) {
+	ctx, span := tracing.Start(ctx, "merchant.GetClientCertFingerprint", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	fingerprint, err := t.next.GetClientCertFingerprint(ctx, merchantId)
+	span.RecordError(err)
+	return fingerprint, err
+}
+
+func (t tracedRepository) SetClientCertFingerprint(ctx context.Context, merchantId, fingerprint string) error {
+	ctx, span := tracing.Start(ctx, "merchant.SetClientCertFingerprint", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	err := t.next.SetClientCertFingerprint(ctx, merchantId, fingerprint)
+	span.RecordError(err)
+	return err
+}
+
+func (t tracedRepository) GetSettlementCurrency(ctx context.Context, merchantId string) (string, error) {
+	ctx, span := tracing.Start(ctx, "merchant.GetSettlementCurrency", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	currency, err := t.next.GetSettlementCurrency(ctx, merchantId)
+	span.RecordError(err)
+	return currency, err
+}
+
+func (t tracedRepository) SetSettlementCurrency(ctx context.Context, merchantId, currency string) error {
+	ctx, span := tracing.Start(ctx, "merchant.SetSettlementCurrency", tracing.WithAttributes(
+		tracing.String("merchant.id", merchantId), tracing.String("merchant.settlement_currency", currency)))
+	defer span.End()
+	err := t.next.SetSettlementCurrency(ctx, merchantId, currency)
+	span.RecordError(err)
+	return err
+}
+
+func (t tracedRepository) Connect(ctx context.Context, platformId, name string) (ConnectedAccount, string, error) {
+	ctx, span := tracing.Start(ctx, "merchant.Connect", tracing.WithAttributes(tracing.String("merchant.platform_id", platformId)))
+	defer span.End()
+	account, secretKey, err := t.next.Connect(ctx, platformId, name)
+	span.SetAttributes(tracing.String("merchant.id", account.Id))
+	span.RecordError(err)
+	return account, secretKey, err
+}
+
+func (t tracedRepository) ListConnected(ctx context.Context, platformId string) ([]ConnectedAccount, error) {
+	ctx, span := tracing.Start(ctx, "merchant.ListConnected", tracing.WithAttributes(tracing.String("merchant.platform_id", platformId)))
+	defer span.End()
+	accounts, err := t.next.ListConnected(ctx, platformId)
+	span.SetAttributes(tracing.Int("merchant.connected_count", len(accounts)))
+	span.RecordError(err)
+	return accounts, err
+}
+
+func (t tracedRepository) GetPlatformId(ctx context.Context, merchantId string) (string, error) {
+	ctx, span := tracing.Start(ctx, "merchant.GetPlatformId", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	platformId, err := t.next.GetPlatformId(ctx, merchantId)
+	span.RecordError(err)
+	return platformId, err
+}
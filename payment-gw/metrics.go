@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"payment-gw/gateway"
+	"payment-gw/metrics"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	outcomeSuccess  = "success"
+	outcomeDeclined = "declined"
+	outcomeRejected = "rejected"
+	outcomeError    = "error"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("http_requests_total",
+		"Number of HTTP requests by route, method and status code.", "route", "method", "code")
+	httpRequestDuration = metrics.NewHistogramVec("http_request_duration_seconds",
+		"HTTP request latency by route, method and status code.", nil, "route", "method", "code")
+	paymentOperations = metrics.NewCounterVec("payment_operations_total",
+		"Number of payment operations by operation, currency and outcome.", "operation", "currency", "outcome")
+	paymentAmounts = metrics.NewCounterVec("payment_amount_processed_total",
+		"Sum of successfully processed amounts in major currency units.", "operation", "currency")
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (a *App) measure(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := routeTemplate(r)
+		code := strconv.Itoa(rec.code)
+		httpRequests.WithLabelValues(route, r.Method, code).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeTemplate returns the matched mux path template with the variable
+// patterns removed, so "/merchant/{merchant_id:.{20}}/authorize" becomes
+// "/merchant/{merchant_id}/authorize".
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unmatched"
+	}
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "unmatched"
+	}
+
+	var b strings.Builder
+	depth := 0
+	skip := false
+	for _, c := range tpl {
+		switch {
+		case c == '{':
+			depth++
+			if depth == 1 {
+				b.WriteRune(c)
+			}
+		case c == '}':
+			depth--
+			if depth == 0 {
+				skip = false
+				b.WriteRune(c)
+			}
+		case c == ':' && depth == 1:
+			skip = true
+		case depth == 0 || !skip && depth == 1:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func recordOperation(operation, currency string, amount int, outcome string) {
+	if currency == "" {
+		currency = "unknown"
+	}
+	paymentOperations.WithLabelValues(operation, currency, outcome).Inc()
+	if outcome == outcomeSuccess {
+		paymentAmounts.WithLabelValues(operation, currency).Add(float64(amount) / 100)
+	}
+}
+
+func operationOutcome(err error) string {
+	if errors.Is(err, gateway.ErrBasedOnCreditCardNumber) {
+		return outcomeDeclined
+	}
+	return outcomeRejected
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExposition(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Test counter.", "code")
+	c.WithLabelValues("200").Inc()
+	c.WithLabelValues("500").Add(2)
+	h := NewHistogramVec("test_latency_seconds", "Test histogram.", []float64{0.1, 1}, "route")
+	h.WithLabelValues(`/a"b`).Observe(0.5)
+
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := rr.Body.String()
+	assert.Contains(t, body, "# TYPE test_requests_total counter\n")
+	assert.Contains(t, body, "test_requests_total{code=\"200\"} 1\n")
+	assert.Contains(t, body, "test_requests_total{code=\"500\"} 2\n")
+	assert.Contains(t, body, "test_latency_seconds_bucket{route=\"/a\\\"b\",le=\"0.1\"} 0\n")
+	assert.Contains(t, body, "test_latency_seconds_bucket{route=\"/a\\\"b\",le=\"1\"} 1\n")
+	assert.Contains(t, body, "test_latency_seconds_bucket{route=\"/a\\\"b\",le=\"+Inf\"} 1\n")
+	assert.Contains(t, body, "test_latency_seconds_sum{route=\"/a\\\"b\"} 0.5\n")
+	assert.Contains(t, body, "test_latency_seconds_count{route=\"/a\\\"b\"} 1\n")
+}
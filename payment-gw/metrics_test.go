@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeMetrics(t *testing.T) string {
+	req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	return response.Body.String()
+}
+
+func Test_MetricsExposeOperations(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{Amount: "10.00", Currency: "EUR"}, merchantId, secretKey)
+	sendCaptureRequest("10.00", merchantId, paymentId, secretKey)
+	sendAuthorizationRequest(authorizationPayload{CardNumber: authorizationFailureCardNumber, Currency: "EUR"}, merchantId, secretKey)
+
+	body := scrapeMetrics(t)
+	assert.Contains(t, body, `payment_operations_total{operation="authorize",currency="EUR",outcome="success"}`)
+	assert.Contains(t, body, `payment_operations_total{operation="authorize",currency="EUR",outcome="declined"}`)
+	assert.Contains(t, body, `payment_operations_total{operation="capture",currency="EUR",outcome="success"}`)
+	assert.Contains(t, body, `payment_amount_processed_total{operation="capture",currency="EUR"}`)
+	assert.Contains(t, body, `http_requests_total{route="/merchant/{merchant_id}/capture/{payment_id}",method="POST",code="200"}`)
+	assert.Contains(t, body, `http_request_duration_seconds_bucket{route="/merchant/register",method="POST",code="201",le="+Inf"}`)
+	assert.Contains(t, body, "merchant_authentication_bcrypt_duration_seconds_count")
+	assert.Contains(t, body, "# TYPE gateway_optimistic_lock_conflicts_total counter")
+}
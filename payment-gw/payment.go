@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"payment-gw/gateway"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+type operationResponse struct {
+	Type             string    `json:"type"`
+	Amount           string    `json:"amount"`
+	Fee              string    `json:"fee"`
+	SettlementAmount string    `json:"settlement_amount"`
+	SettlementFee    string    `json:"settlement_fee"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// settlementResponse reports the payment in the settlement currency of the
+// merchant.
+type settlementResponse struct {
+	Currency    string  `json:"currency"`
+	Rate        float64 `json:"rate"`
+	Authorized  string  `json:"authorized"`
+	Captured    string  `json:"captured"`
+	Refunded    string  `json:"refunded"`
+	Chargebacks string  `json:"chargebacks"`
+	Fee         string  `json:"fee"`
+	Net         string  `json:"net"`
+}
+
+type screeningResponse struct {
+	Decision string   `json:"decision"`
+	Rules    []string `json:"rules"`
+}
+
+type paymentResponse struct {
+	PaymentId        string                    `json:"payment_id"`
+	MerchantId       string                    `json:"merchant_id"`
+	Currency         string                    `json:"currency"`
+	Authorized       string                    `json:"authorized"`
+	Captured         string                    `json:"captured"`
+	Refunded         string                    `json:"refunded"`
+	Voided           bool                      `json:"voided"`
+	Brand            string                    `json:"brand,omitempty"`
+	Fee              string                    `json:"fee"`
+	Net              string                    `json:"net"`
+	Settlement       *settlementResponse       `json:"settlement,omitempty"`
+	Screening        *screeningResponse        `json:"screening,omitempty"`
+	Authentication   *authenticationResponse   `json:"authentication,omitempty"`
+	Review           *reviewResponse           `json:"review,omitempty"`
+	ScheduledCapture *scheduledCaptureResponse `json:"scheduled_capture,omitempty"`
+	Splits           []splitRequest            `json:"splits,omitempty"`
+	Transfers        []transferResponse        `json:"transfers,omitempty"`
+	Operations       []operationResponse       `json:"operations"`
+	detailsResponse
+}
+
+func (a *App) getPayment(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	p, err := a.gateway.Get(ctx, mux.Vars(r)["payment_id"])
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, createPaymentResponse(p))
+}
+
+func createPaymentResponse(p gateway.Payment) paymentResponse {
+	res := paymentResponse{
+		PaymentId:       p.Id,
+		MerchantId:      p.MerchantId,
+		Currency:        p.Currency,
+		Authorized:      formatMinorUnits(p.Authorized),
+		Captured:        formatMinorUnits(p.Captured),
+		Refunded:        formatMinorUnits(p.Refunded),
+		Voided:          p.Voided,
+		Brand:           p.Brand,
+		Fee:             formatMinorUnits(p.Fees),
+		Net:             formatMinorUnits(p.Net()),
+		detailsResponse: createDetailsResponse(p.Details),
+		Operations:      []operationResponse{},
+	}
+	if s := p.Settlement; s.Currency != "" {
+		res.Settlement = &settlementResponse{s.Currency, s.Rate, formatMinorUnits(s.Authorized), formatMinorUnits(s.Captured),
+			formatMinorUnits(s.Refunded), formatMinorUnits(s.Chargebacks), formatMinorUnits(s.Fees), formatMinorUnits(s.Net())}
+	}
+	if s := p.Screening; s.Decision != "" {
+		res.Screening = &screeningResponse{s.Decision, append([]string{}, s.Rules...)}
+	}
+	if p.Authentication != nil {
+		res.Authentication = createAuthenticationResponse(p.Authentication.Result)
+	}
+	if p.ScheduledCapture != nil {
+		res.ScheduledCapture = createScheduledCaptureResponse(*p.ScheduledCapture)
+	}
+	if p.Review != nil {
+		review := createReviewResponse(*p.Review)
+		res.Review = &review
+	}
+	for _, s := range p.Splits {
+		split := splitRequest{Destination: s.Destination, Percentage: s.Percentage}
+		if s.Amount > 0 {
+			split.Amount = formatMinorUnits(s.Amount)
+		}
+		if s.ApplicationFee > 0 {
+			split.ApplicationFee = formatMinorUnits(s.ApplicationFee)
+		}
+		res.Splits = append(res.Splits, split)
+	}
+	for _, t := range p.Transfers {
+		res.Transfers = append(res.Transfers, createTransferResponse(p, t))
+	}
+	for _, op := range p.Operations {
+		res.Operations = append(res.Operations, operationResponse{op.Type, formatMinorUnits(op.Amount), formatMinorUnits(op.Fee),
+			formatMinorUnits(op.SettlementAmount), formatMinorUnits(op.SettlementFee), op.CreatedAt})
+	}
+	return res
+}
@@ -0,0 +1,282 @@
+package paymentlink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"payment-gw/events"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	LinksCol    = "payment_links"
+	FailuresCol = "payment_link_failures"
+)
+
+// Statuses of a link.
+const (
+	StatusActive      = "active"
+	StatusExpired     = "expired"
+	StatusCompleted   = "completed"
+	StatusDeactivated = "deactivated"
+)
+
+// EventPaid is emitted for every payment made with a link.
+const EventPaid = "payment_link.paid"
+
+var (
+	ErrLinkNotFound = errors.New("payment link not found")
+	ErrLinkInactive = errors.New("payment link is no longer active")
+	// ErrTooManyFailures refuses the payments of a shopper whose payments
+	// were declined too many times
+	ErrTooManyFailures = errors.New("too many declined payments")
+)
+
+type Config struct {
+	// BaseURL is where shoppers reach the checkout pages, the address of the
+	// request when empty
+	BaseURL string `yaml:"base_url"`
+	// DefaultExpiry is how long links are active when the merchant does not
+	// say
+	DefaultExpiry time.Duration `yaml:"default_expiry"`
+	// MaxExpiry is the longest time a link can be active
+	MaxExpiry time.Duration `yaml:"max_expiry"`
+	// MaxFailures is the number of declined payments that deactivates a
+	// link, 0 for no limit
+	MaxFailures int `yaml:"max_failures"`
+	// MaxFailuresPerIP is the number of declined payments, with any link,
+	// after which the payments of a shopper IP are refused for FailureWindow,
+	// 0 for no limit
+	MaxFailuresPerIP int           `yaml:"max_failures_per_ip"`
+	FailureWindow    time.Duration `yaml:"failure_window"`
+}
+
+func (c Config) Validate() error {
+	var errs []string
+	if c.BaseURL != "" && !strings.HasPrefix(c.BaseURL, "http://") && !strings.HasPrefix(c.BaseURL, "https://") {
+		errs = append(errs, fmt.Sprintf("base_url %q must be an http or https URL", c.BaseURL))
+	}
+	if c.DefaultExpiry <= 0 {
+		errs = append(errs, "default_expiry must be positive")
+	}
+	if c.MaxExpiry < c.DefaultExpiry {
+		errs = append(errs, "max_expiry must not be shorter than default_expiry")
+	}
+	if c.MaxFailures < 0 || c.MaxFailuresPerIP < 0 {
+		errs = append(errs, "max_failures and max_failures_per_ip must not be negative")
+	}
+	if c.MaxFailuresPerIP > 0 && c.FailureWindow <= 0 {
+		errs = append(errs, "failure_window must be positive with max_failures_per_ip")
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Link is a payment a merchant asks shoppers for on a hosted checkout page.
+// It can be paid MaxUses times, any number of times when MaxUses is 0, until
+// it expires. Uses counts the payments made or being made that were not
+// declined, PaymentIds every payment made.
+type Link struct {
+	Id          string `bson:"id"`
+	MerchantId  string `bson:"merchantid"`
+	Amount      int    `bson:"amount"`
+	Currency    string `bson:"currency"`
+	Description string `bson:"description"`
+	// AutoCapture captures the payments as soon as they are authorized
+	AutoCapture bool `bson:"autocapture"`
+	// ReturnURL is where shoppers go back to the merchant after paying
+	ReturnURL  string   `bson:"returnurl,omitempty"`
+	MaxUses    int      `bson:"maxuses"`
+	Uses       int      `bson:"uses"`
+	PaymentIds []string `bson:"paymentids"`
+	// Failures counts the payments declined at checkout
+	Failures  int       `bson:"failures"`
+	CreatedAt time.Time `bson:"createdat"`
+	ExpiresAt time.Time `bson:"expiresat"`
+	// DeactivatedAt is set when the merchant stopped the link before it
+	// expired, or when too many of its payments were declined
+	DeactivatedAt time.Time `bson:"deactivatedat,omitempty"`
+}
+
+// Status tells whether the link can be paid at a time.
+func (l Link) Status(at time.Time) string {
+	switch {
+	case !l.DeactivatedAt.IsZero():
+		return StatusDeactivated
+	case l.MaxUses > 0 && l.Uses >= l.MaxUses:
+		return StatusCompleted
+	case !at.Before(l.ExpiresAt):
+		return StatusExpired
+	}
+	return StatusActive
+}
+
+type LinkRepository interface {
+	Create(ctx context.Context, l Link) (Link, error)
+	Get(ctx context.Context, linkId string) (Link, error)
+	List(ctx context.Context, merchantId string) ([]Link, error)
+	Deactivate(ctx context.Context, merchantId, linkId string) (Link, error)
+	// Use reserves a use of an active link for a payment being made by a
+	// shopper IP
+	Use(ctx context.Context, linkId, ip string) (Link, error)
+	// Release gives back the use of a payment that was not made, or that
+	// was declined after checkout
+	Release(ctx context.Context, linkId string) error
+	// Fail gives back the use of a payment declined at checkout and counts
+	// it in the failures of the link and of the shopper IP
+	Fail(ctx context.Context, linkId, ip string) error
+	// AddPayment records a payment made with the link and emits EventPaid
+	AddPayment(ctx context.Context, l Link, paymentId, status string) error
+}
+
+type MongoLinkRepository struct {
+	db *mongo.Database
+	c  Config
+}
+
+func NewRepository(db *mongo.Database, c Config) MongoLinkRepository {
+	return MongoLinkRepository{db: db, c: c}
+}
+
+func (m MongoLinkRepository) Create(ctx context.Context, l Link) (Link, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	l.Id, l.Uses, l.Failures, l.PaymentIds = xid.New().String(), 0, 0, []string{}
+	l.CreatedAt, l.ExpiresAt = l.CreatedAt.UTC(), l.ExpiresAt.UTC()
+	if _, err := m.db.Collection(LinksCol).InsertOne(ctx, l); err != nil {
+		lg.Error().Msg(err.Error())
+		return Link{}, err
+	}
+	return l, nil
+}
+
+func (m MongoLinkRepository) Get(ctx context.Context, linkId string) (Link, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	var l Link
+	err := m.db.Collection(LinksCol).FindOne(ctx, bson.M{"id": linkId}).Decode(&l)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Link{}, ErrLinkNotFound
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Link{}, err
+	}
+	return l, nil
+}
+
+// List returns the links of the merchant, newest first.
+func (m MongoLinkRepository) List(ctx context.Context, merchantId string) ([]Link, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	links := []Link{}
+	cursor, err := m.db.Collection(LinksCol).Find(ctx, bson.M{"merchantid": merchantId},
+		options.Find().SetSort(bson.D{{Key: "createdat", Value: -1}, {Key: "id", Value: -1}}))
+	if err == nil {
+		err = cursor.All(ctx, &links)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+	return links, nil
+}
+
+func (m MongoLinkRepository) Deactivate(ctx context.Context, merchantId, linkId string) (Link, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	var l Link
+	err := m.db.Collection(LinksCol).FindOneAndUpdate(ctx, bson.M{"id": linkId, "merchantid": merchantId},
+		bson.M{"$set": bson.M{"deactivatedat": time.Now().UTC()}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&l)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Link{}, ErrLinkNotFound
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Link{}, err
+	}
+	return l, nil
+}
+
+// Use counts the payments being made along with the ones made, so a single
+// use link is not paid twice by shoppers paying at the same time. Shopper IPs
+// with MaxFailuresPerIP declined payments in the last FailureWindow are
+// refused, so the links cannot be used to test cards.
+func (m MongoLinkRepository) Use(ctx context.Context, linkId, ip string) (Link, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	if m.c.MaxFailuresPerIP > 0 {
+		failures, err := m.db.Collection(FailuresCol).CountDocuments(ctx, bson.M{"ip": ip,
+			"at": bson.M{"$gt": time.Now().Add(-m.c.FailureWindow).UTC()}})
+		if err != nil {
+			lg.Error().Msg(err.Error())
+			return Link{}, err
+		}
+		if int(failures) >= m.c.MaxFailuresPerIP {
+			return Link{}, ErrTooManyFailures
+		}
+	}
+
+	filter := bson.M{"id": linkId, "deactivatedat": bson.M{"$exists": false}, "expiresat": bson.M{"$gt": time.Now().UTC()},
+		"$or": bson.A{bson.M{"maxuses": 0}, bson.M{"$expr": bson.M{"$lt": bson.A{"$uses", "$maxuses"}}}}}
+	var l Link
+	err := m.db.Collection(LinksCol).FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"uses": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&l)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, err := m.Get(ctx, linkId); err != nil {
+			return Link{}, err
+		}
+		return Link{}, ErrLinkInactive
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Link{}, err
+	}
+	return l, nil
+}
+
+func (m MongoLinkRepository) Release(ctx context.Context, linkId string) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	_, err := m.db.Collection(LinksCol).UpdateOne(ctx, bson.M{"id": linkId, "uses": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"uses": -1}})
+	if err != nil {
+		lg.Error().Msg(err.Error())
+	}
+	return err
+}
+
+// Fail deactivates the link once MaxFailures of its payments were declined.
+func (m MongoLinkRepository) Fail(ctx context.Context, linkId, ip string) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	now := time.Now().UTC()
+	var l Link
+	err := m.db.Collection(LinksCol).FindOneAndUpdate(ctx, bson.M{"id": linkId, "uses": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"uses": -1, "failures": 1}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&l)
+	if err == nil {
+		_, err = m.db.Collection(FailuresCol).InsertOne(ctx, bson.M{"linkid": linkId, "ip": ip, "at": now})
+	}
+	if err == nil && m.c.MaxFailures > 0 && l.Failures >= m.c.MaxFailures {
+		_, err = m.db.Collection(LinksCol).UpdateOne(ctx, bson.M{"id": linkId, "deactivatedat": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"deactivatedat": now}})
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+	}
+	return err
+}
+
+func (m MongoLinkRepository) AddPayment(ctx context.Context, l Link, paymentId, status string) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	_, err := m.db.Collection(LinksCol).UpdateOne(ctx, bson.M{"id": l.Id}, bson.M{"$push": bson.M{"paymentids": paymentId}})
+	if err == nil {
+		err = events.Emit(ctx, m.db, events.Event{Type: EventPaid, MerchantId: l.MerchantId, PaymentId: paymentId,
+			Data: map[string]string{"link_id": l.Id, "status": status}})
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package paymentlink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+	now := time.Now()
+	l := Link{MaxUses: 1, ExpiresAt: now.Add(time.Hour)}
+	assert.Equal(t, StatusActive, l.Status(now))
+	assert.Equal(t, StatusExpired, l.Status(now.Add(time.Hour)))
+
+	l.Uses = 1
+	assert.Equal(t, StatusCompleted, l.Status(now))
+
+	l.MaxUses = 0
+	assert.Equal(t, StatusActive, l.Status(now))
+
+	l.DeactivatedAt = now
+	assert.Equal(t, StatusDeactivated, l.Status(now))
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{DefaultExpiry: time.Hour, MaxExpiry: time.Hour}.Validate())
+	assert.EqualError(t, Config{BaseURL: "pay.example.com", DefaultExpiry: time.Hour}.Validate(),
+		`base_url "pay.example.com" must be an http or https URL; max_expiry must not be shorter than default_expiry`)
+	assert.EqualError(t, Config{}.Validate(), "default_expiry must be positive")
+	assert.EqualError(t, Config{DefaultExpiry: time.Hour, MaxExpiry: time.Hour, MaxFailures: -1, MaxFailuresPerIP: 10}.Validate(),
+		"max_failures and max_failures_per_ip must not be negative; failure_window must be positive with max_failures_per_ip")
+}
@@ -0,0 +1,83 @@
+package paymentlink
+
+import (
+	"context"
+	"payment-gw/tracing"
+)
+
+type tracedRepository struct {
+	next LinkRepository
+}
+
+func NewTracedRepository(next LinkRepository) LinkRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) Create(ctx context.Context, l Link) (Link, error) {
+	ctx, span := tracing.Start(ctx, "paymentlink.Create", tracing.WithAttributes(
+		tracing.String("merchant.id", l.MerchantId), tracing.String("payment.currency", l.Currency), tracing.Int("payment.amount", l.Amount)))
+	defer span.End()
+	l, err := t.next.Create(ctx, l)
+	span.SetAttributes(tracing.String("paymentlink.id", l.Id))
+	span.RecordError(err)
+	return l, err
+}
+
+func (t tracedRepository) Get(ctx context.Context, linkId string) (Link, error) {
+	ctx, span := tracing.Start(ctx, "paymentlink.Get", tracing.WithAttributes(tracing.String("paymentlink.id", linkId)))
+	defer span.End()
+	l, err := t.next.Get(ctx, linkId)
+	span.RecordError(err)
+	return l, err
+}
+
+func (t tracedRepository) List(ctx context.Context, merchantId string) ([]Link, error) {
+	ctx, span := tracing.Start(ctx, "paymentlink.List", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	links, err := t.next.List(ctx, merchantId)
+	span.SetAttributes(tracing.Int("paymentlink.count", len(links)))
+	span.RecordError(err)
+	return links, err
+}
+
+func (t tracedRepository) Deactivate(ctx context.Context, merchantId, linkId string) (Link, error) {
+	ctx, span := tracing.Start(ctx, "paymentlink.Deactivate", tracing.WithAttributes(
+		tracing.String("merchant.id", merchantId), tracing.String("paymentlink.id", linkId)))
+	defer span.End()
+	l, err := t.next.Deactivate(ctx, merchantId, linkId)
+	span.RecordError(err)
+	return l, err
+}
+
+func (t tracedRepository) Use(ctx context.Context, linkId, ip string) (Link, error) {
+	ctx, span := tracing.Start(ctx, "paymentlink.Use", tracing.WithAttributes(tracing.String("paymentlink.id", linkId)))
+	defer span.End()
+	l, err := t.next.Use(ctx, linkId, ip)
+	span.RecordError(err)
+	return l, err
+}
+
+func (t tracedRepository) Release(ctx context.Context, linkId string) error {
+	ctx, span := tracing.Start(ctx, "paymentlink.Release", tracing.WithAttributes(tracing.String("paymentlink.id", linkId)))
+	defer span.End()
+	err := t.next.Release(ctx, linkId)
+	span.RecordError(err)
+	return err
+}
+
+func (t tracedRepository) Fail(ctx context.Context, linkId, ip string) error {
+	ctx, span := tracing.Start(ctx, "paymentlink.Fail", tracing.WithAttributes(tracing.String("paymentlink.id", linkId)))
+	defer span.End()
+	err := t.next.Fail(ctx, linkId, ip)
+	span.RecordError(err)
+	return err
+}
+
+func (t tracedRepository) AddPayment(ctx context.Context, l Link, paymentId, status string) error {
+	ctx, span := tracing.Start(ctx, "paymentlink.AddPayment", tracing.WithAttributes(
+		tracing.String("paymentlink.id", l.Id), tracing.String("payment.id", paymentId)))
+	defer span.End()
+	err := t.next.AddPayment(ctx, l, paymentId, status)
+	span.RecordError(err)
+	return err
+}
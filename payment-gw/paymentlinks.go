@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"payment-gw/fraud"
+	"payment-gw/gateway"
+	"payment-gw/paymentlink"
+	"payment-gw/risk"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"gopkg.in/validator.v2"
+)
+
+type paymentLinkResponse struct {
+	LinkId      string    `json:"link_id"`
+	URL         string    `json:"url"`
+	Amount      string    `json:"amount"`
+	Currency    string    `json:"currency"`
+	Description string    `json:"description"`
+	AutoCapture bool      `json:"auto_capture"`
+	ReturnURL   string    `json:"return_url,omitempty"`
+	MaxUses     int       `json:"max_uses"`
+	Status      string    `json:"status"`
+	PaymentIds  []string  `json:"payment_ids"`
+	Failures    int       `json:"failures"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+func (a *App) checkoutURL(r *http.Request, linkId string) string {
+	return publicURL(r, a.cfg.PaymentLinks.BaseURL, "/checkout/"+linkId)
+}
+
+func (a *App) createPaymentLinkResponse(r *http.Request, l paymentlink.Link) paymentLinkResponse {
+	return paymentLinkResponse{l.Id, a.checkoutURL(r, l.Id), formatMinorUnits(l.Amount), l.Currency, l.Description, l.AutoCapture, l.ReturnURL,
+		l.MaxUses, l.Status(time.Now()), append([]string{}, l.PaymentIds...), l.Failures, l.CreatedAt, l.ExpiresAt}
+}
+
+// createPaymentLink creates a link to a checkout page, paid once unless
+// max_uses says otherwise (0 for no limit).
+func (a *App) createPaymentLink(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+	req := struct {
+		Amount      string     `json:"amount" validate:"regexp=^[0-9]{1\\,10}[.][0-9]{2}$"`
+		Currency    string     `json:"currency" validate:"regexp=^[A-Z]{3}$"`
+		Description string     `json:"description" validate:"nonzero,max=200"`
+		AutoCapture bool       `json:"auto_capture"`
+		ReturnURL   string     `json:"return_url" validate:"max=2000"`
+		MaxUses     *int       `json:"max_uses"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validator.Validate(req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	amount, err := parseMinorUnits(req.Amount)
+	if err == nil && amount <= 0 {
+		err = gateway.ErrAmountIsZero
+	}
+	if err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.ReturnURL != "" {
+		if u, err := url.ParseRequestURI(req.ReturnURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			lg.Debug().Str("return_url", req.ReturnURL).Msg("invalid return_url")
+			respondWithError(w, http.StatusBadRequest, "ReturnURL: must be an http or https URL")
+			return
+		}
+	}
+	maxUses := 1
+	if req.MaxUses != nil {
+		maxUses = *req.MaxUses
+	}
+	if maxUses < 0 {
+		lg.Debug().Int("max_uses", maxUses).Msg("invalid max_uses")
+		respondWithError(w, http.StatusBadRequest, "MaxUses: must not be negative")
+		return
+	}
+	now := time.Now()
+	expiresAt := now.Add(a.cfg.PaymentLinks.DefaultExpiry)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+	if !expiresAt.After(now) || expiresAt.After(now.Add(a.cfg.PaymentLinks.MaxExpiry)) {
+		lg.Debug().Time("expires_at", expiresAt).Msg("invalid expires_at")
+		respondWithError(w, http.StatusBadRequest, "ExpiresAt: must be in the future and within "+a.cfg.PaymentLinks.MaxExpiry.String())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	l, err := a.paymentLinks.Create(ctx, paymentlink.Link{MerchantId: mux.Vars(r)["merchant_id"], Amount: amount, Currency: req.Currency,
+		Description: req.Description, AutoCapture: req.AutoCapture, ReturnURL: req.ReturnURL, MaxUses: maxUses, CreatedAt: now, ExpiresAt: expiresAt})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, a.createPaymentLinkResponse(r, l))
+}
+
+func (a *App) listPaymentLinks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	links, err := a.paymentLinks.List(ctx, mux.Vars(r)["merchant_id"])
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	res := []paymentLinkResponse{}
+	for _, l := range links {
+		res = append(res, a.createPaymentLinkResponse(r, l))
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// getPaymentLink returns a link of the merchant with the payments made with
+// it.
+func (a *App) getPaymentLink(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	l, err := a.paymentLinks.Get(ctx, mux.Vars(r)["link_id"])
+	if err == nil && l.MerchantId != mux.Vars(r)["merchant_id"] {
+		err = paymentlink.ErrLinkNotFound
+	}
+	if errors.Is(err, paymentlink.ErrLinkNotFound) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, a.createPaymentLinkResponse(r, l))
+}
+
+// deactivatePaymentLink stops a link from being paid before it expires.
+func (a *App) deactivatePaymentLink(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	l, err := a.paymentLinks.Deactivate(ctx, mux.Vars(r)["merchant_id"], mux.Vars(r)["link_id"])
+	if errors.Is(err, paymentlink.ErrLinkNotFound) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, a.createPaymentLinkResponse(r, l))
+}
+
+var checkoutTemplate = template.Must(template.New("checkout").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Checkout</title></head>
+<body>
+<h1>{{.Description}}</h1>
+<p>{{.Amount}} {{.Currency}}</p>
+{{if .PaymentId}}
+<p>Thank you, {{if eq .Status "held"}}your payment was received and is being reviewed{{else}}your payment was accepted{{end}}.</p>
+<p>Payment reference: {{.PaymentId}}</p>
+{{if .ReturnURL}}<p><a href="{{.ReturnURL}}">Return to the merchant</a></p>{{end}}
+{{else if .Active}}
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<p><label>Name on card <input name="name_surname" autocomplete="cc-name" required></label></p>
+<p><label>Card number <input name="card_number" inputmode="numeric" autocomplete="cc-number" maxlength="16" required></label></p>
+<p><label>Expiry <input name="expiry_month" placeholder="MM" autocomplete="cc-exp-month" maxlength="2" required>
+/ <input name="expiry_year" placeholder="YY" autocomplete="cc-exp-year" maxlength="2" required></label></p>
+<p><label>CVV <input name="CCV" inputmode="numeric" autocomplete="cc-csc" maxlength="3" required></label></p>
+<button type="submit">Pay {{.Amount}} {{.Currency}}</button>
+</form>
+{{else}}
+<p>{{.Error}}</p>
+{{end}}
+</body>
+</html>
+`))
+
+type checkoutPage struct {
+	Description, Amount, Currency string
+	Active                        bool
+	Error                         string
+	Token                         string
+	PaymentId, Status, ReturnURL  string
+}
+
+func renderCheckout(w http.ResponseWriter, code int, page checkoutPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	checkoutTemplate.Execute(w, page)
+}
+
+// checkoutCookie holds the token the checkout form is posted with. A form
+// posted from another site cannot send it, the cookie staying on the site of
+// the checkout page.
+const checkoutCookie = "checkout_token"
+
+func setCheckoutToken(w http.ResponseWriter, r *http.Request, linkId string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: checkoutCookie, Value: token, Path: "/checkout/" + linkId, HttpOnly: true,
+		Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode})
+	return token, nil
+}
+
+func validCheckoutToken(r *http.Request) bool {
+	c, err := r.Cookie(checkoutCookie)
+	token := r.PostFormValue("token")
+	return err == nil && token != "" && subtle.ConstantTimeCompare([]byte(c.Value), []byte(token)) == 1
+}
+
+func newCheckoutPage(l paymentlink.Link) checkoutPage {
+	page := checkoutPage{Description: l.Description, Amount: formatMinorUnits(l.Amount), Currency: l.Currency}
+	switch l.Status(time.Now()) {
+	case paymentlink.StatusActive:
+		page.Active = true
+	case paymentlink.StatusCompleted:
+		page.Error = "This payment link was already paid."
+	default:
+		page.Error = "This payment link is no longer active."
+	}
+	return page
+}
+
+// checkoutError tells the shopper why a payment failed without the details
+// meant for the merchant.
+func checkoutError(err error) (int, string) {
+	switch {
+	case errors.Is(err, gateway.ErrBasedOnCreditCardNumber):
+		return http.StatusPaymentRequired, "Your card was declined, please use another card."
+	case errors.Is(err, fraud.ErrBlocked), errors.Is(err, gateway.ErrAuthenticationFailed), risk.Code(err) != "":
+		return http.StatusPaymentRequired, "The payment could not be accepted."
+	case errors.Is(err, paymentlink.ErrLinkInactive):
+		return http.StatusGone, "This payment link is no longer active."
+	case errors.Is(err, paymentlink.ErrTooManyFailures):
+		return http.StatusTooManyRequests, "Too many payments were declined, please try again later."
+	}
+	return http.StatusInternalServerError, "The payment could not be processed, please try again later."
+}
+
+func (a *App) getCheckoutLink(ctx context.Context, w http.ResponseWriter, r *http.Request) (paymentlink.Link, bool) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	l, err := a.paymentLinks.Get(ctx, mux.Vars(r)["link_id"])
+	if errors.Is(err, paymentlink.ErrLinkNotFound) {
+		lg.Debug().Msg(err.Error())
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return l, false
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return l, false
+	}
+	return l, true
+}
+
+// checkoutPage serves the hosted checkout page of a link to the shopper.
+func (a *App) checkoutPage(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	l, ok := a.getCheckoutLink(ctx, w, r)
+	if !ok {
+		return
+	}
+	page := newCheckoutPage(l)
+	if !page.Active {
+		renderCheckout(w, http.StatusGone, page)
+		return
+	}
+	token, err := setCheckoutToken(w, r, l.Id)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	page.Token = token
+	renderCheckout(w, http.StatusOK, page)
+}
+
+// checkout pays a link with the card the shopper entered on the checkout
+// page. It is authorized like the payments of the authorize endpoint, with an
+// automatic capture when the link asks for it. Declined payments count in the
+// failures of the link and of the shopper IP, which stop the link from being
+// used to test cards.
+func (a *App) checkout(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	l, ok := a.getCheckoutLink(ctx, w, r)
+	if !ok {
+		return
+	}
+	page := newCheckoutPage(l)
+	if !page.Active {
+		renderCheckout(w, http.StatusGone, page)
+		return
+	}
+	if !validCheckoutToken(r) {
+		lg.Debug().Msg("checkout posted without a valid token")
+		token, err := setCheckoutToken(w, r, l.Id)
+		if err != nil {
+			lg.Error().Msg(err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		page.Token, page.Error = token, "Your session expired, please try again."
+		renderCheckout(w, http.StatusForbidden, page)
+		return
+	}
+	page.Token = r.PostFormValue("token")
+
+	req := authorizeRequest{NameSurname: r.PostFormValue("name_surname"), CardNumber: r.PostFormValue("card_number"),
+		ExpiryMonth: r.PostFormValue("expiry_month"), ExpiryYear: r.PostFormValue("expiry_year"), CCV: r.PostFormValue("CCV"),
+		Amount: formatMinorUnits(l.Amount), Currency: l.Currency, Capture: captureManual,
+		Description: l.Description, Metadata: map[string]string{"payment_link_id": l.Id}}
+	if l.AutoCapture {
+		req.Capture = captureAutomatic
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.ShopperIP = host
+	}
+	if _, err := req.validate(a.cfg.Captures.MaxDelay); err != nil {
+		lg.Debug().Msg(err.Error())
+		page.Error = "Please check the card details."
+		renderCheckout(w, http.StatusBadRequest, page)
+		return
+	}
+
+	if _, err := a.paymentLinks.Use(ctx, l.Id, req.ShopperIP); err != nil {
+		code, message := checkoutError(err)
+		page.Active, page.Error = false, message
+		renderCheckout(w, code, page)
+		return
+	}
+	res, err := a.authorizePayment(ctx, r, l.MerchantId, req, l.Amount)
+	if err != nil {
+		code, message := checkoutError(err)
+		if code == http.StatusPaymentRequired {
+			a.paymentLinks.Fail(ctx, l.Id, req.ShopperIP)
+		} else {
+			a.paymentLinks.Release(ctx, l.Id)
+		}
+		page.Error = message
+		renderCheckout(w, code, page)
+		return
+	}
+
+	// the payment is made and counted in the uses of the link, the shopper
+	// must not pay again when it could not be recorded on the link
+	if err := a.paymentLinks.AddPayment(ctx, l, res.Id, res.Status); err != nil {
+		lg.Error().Str("link_id", l.Id).Str("payment_id", res.Id).Msg("payment not recorded on the link: " + err.Error())
+	}
+
+	page.PaymentId, page.Status = res.Id, res.Status
+	if l.ReturnURL != "" {
+		u, _ := url.Parse(l.ReturnURL)
+		q := u.Query()
+		q.Set("link_id", l.Id)
+		q.Set("payment_id", res.Id)
+		u.RawQuery = q.Encode()
+		page.ReturnURL = u.String()
+	}
+	renderCheckout(w, http.StatusOK, page)
+}
+
+// releaseLinkUse gives back the use of the link a payment was made with when
+// it is declined after checkout, once the shopper failed to authenticate or
+// the review of the payment declined it.
+func (a *App) releaseLinkUse(ctx context.Context, p gateway.Payment) {
+	linkId := p.Metadata["payment_link_id"]
+	if linkId == "" {
+		return
+	}
+	// the metadata comes from the merchant, the link has to be the one the
+	// payment was made with
+	l, err := a.paymentLinks.Get(ctx, linkId)
+	if err != nil || l.MerchantId != p.MerchantId {
+		return
+	}
+	for _, id := range l.PaymentIds {
+		if id == p.Id {
+			a.paymentLinks.Release(ctx, linkId)
+			return
+		}
+	}
+}
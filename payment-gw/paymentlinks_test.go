@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"payment-gw/fraud"
+	"payment-gw/paymentlink"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createPaymentLink(t *testing.T, merchantId, secretKey, body string) (string, string) {
+	code, j := sendRequest(http.MethodPost, "/merchant/"+merchantId+"/payment-links", secretKey, []byte(body))
+	assert.Equal(t, http.StatusCreated, code)
+	linkId, _ := j.GetString("link_id")
+	checkoutURL, _ := j.GetString("url")
+	return linkId, checkoutURL
+}
+
+var checkoutToken = regexp.MustCompile(`name="token" value="([0-9a-f]+)"`)
+
+func sendCheckout(checkoutURL, cardNumber string) (int, string) {
+	return sendCheckoutFrom(checkoutURL, cardNumber, "198.51.100.7")
+}
+
+// sendCheckoutFrom posts the checkout form of the page like a browser, with
+// the token of the page and its cookie.
+func sendCheckoutFrom(checkoutURL, cardNumber, ip string) (int, string) {
+	u, _ := url.Parse(checkoutURL)
+	page, _ := http.NewRequest(http.MethodGet, u.Path, nil)
+	pageResponse := executeRequest(page)
+
+	form := url.Values{"name_surname": {"Krystian Bednarczuk"}, "card_number": {cardNumber}, "expiry_month": {"12"}, "expiry_year": {"23"}, "CCV": {"123"}}
+	if m := checkoutToken.FindStringSubmatch(pageResponse.Body.String()); m != nil {
+		form.Set("token", m[1])
+	}
+	req, _ := http.NewRequest(http.MethodPost, u.Path, strings.NewReader(form.Encode()))
+	for _, c := range pageResponse.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = ip + ":52000"
+	response := executeRequest(req)
+	return response.Code, response.Body.String()
+}
+
+func Test_InvalidPaymentLinkRequest(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	for _, body := range []string{
+		`{"amount":"0.00","currency":"USD","description":"Yoga class"}`,
+		`{"amount":"10.00","currency":"USD"}`,
+		`{"amount":"10.00","currency":"USD","description":"Yoga class","max_uses":-1}`,
+		`{"amount":"10.00","currency":"USD","description":"Yoga class","return_url":"javascript:alert(1)"}`,
+		`{"amount":"10.00","currency":"USD","description":"Yoga class","expires_at":"2020-01-01T00:00:00Z"}`,
+	} {
+		code, _ := sendRequest(http.MethodPost, "/merchant/"+merchantId+"/payment-links", secretKey, []byte(body))
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+}
+
+func Test_PaymentLinkSingleUse(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	linkId, checkoutURL := createPaymentLink(t, merchantId, secretKey,
+		`{"amount":"25.00","currency":"USD","description":"Yoga class","auto_capture":true,"return_url":"https://shop.example.com/done?order=7"}`)
+	assert.Contains(t, checkoutURL, "/checkout/"+linkId)
+
+	u, _ := url.Parse(checkoutURL)
+	req, _ := http.NewRequest(http.MethodGet, u.Path, nil)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), "Yoga class")
+	assert.Contains(t, response.Body.String(), "25.00 USD")
+
+	code, body := sendCheckout(checkoutURL, "1234")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "check the card details")
+
+	code, body = sendCheckout(checkoutURL, authorizationFailureCardNumber)
+	assert.Equal(t, http.StatusPaymentRequired, code)
+	assert.Contains(t, body, "declined")
+
+	code, body = sendCheckout(checkoutURL, "4111111111111111")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "https://shop.example.com/done?link_id="+linkId)
+
+	code, j := sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payment-links/"+linkId, secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("status")
+	assert.Equal(t, paymentlink.StatusCompleted, status)
+	paymentIds, _ := j.GetArray("payment_ids")
+	assert.Equal(t, 1, paymentIds.Len())
+	paymentId, _ := j.GetString("payment_ids", 0)
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payment/"+paymentId, secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	captured, _ := j.GetString("captured")
+	assert.Equal(t, "25.00", captured)
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/events?type="+paymentlink.EventPaid, secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	eventPaymentId, _ := j.GetString(0, "payment_id")
+	assert.Equal(t, paymentId, eventPaymentId)
+
+	code, _ = sendCheckout(checkoutURL, "4111111111111111")
+	assert.Equal(t, http.StatusGone, code)
+}
+
+func Test_PaymentLinkMultiUse(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	linkId, checkoutURL := createPaymentLink(t, merchantId, secretKey, `{"amount":"10.00","currency":"USD","description":"Donation","max_uses":2}`)
+
+	for i := 0; i < 2; i++ {
+		code, _ := sendCheckout(checkoutURL, "4111111111111111")
+		assert.Equal(t, http.StatusOK, code)
+	}
+	code, _ := sendCheckout(checkoutURL, "4111111111111111")
+	assert.Equal(t, http.StatusGone, code)
+
+	code, j := sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payment-links/"+linkId, secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	paymentId, _ := j.GetString("payment_ids", 0)
+	code, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payment/"+paymentId, secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	captured, _ := j.GetString("captured")
+	assert.Equal(t, "0.00", captured)
+}
+
+func Test_PaymentLinkDeactivated(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	otherMerchantId, otherSecretKey := register(t)
+	linkId, checkoutURL := createPaymentLink(t, merchantId, secretKey, `{"amount":"10.00","currency":"USD","description":"Donation","max_uses":0}`)
+
+	code, _ := sendRequest(http.MethodGet, "/merchant/"+otherMerchantId+"/payment-links/"+linkId, otherSecretKey, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = sendRequest(http.MethodPost, "/merchant/"+otherMerchantId+"/payment-links/"+linkId+"/deactivate", otherSecretKey, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, j := sendRequest(http.MethodPost, "/merchant/"+merchantId+"/payment-links/"+linkId+"/deactivate", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("status")
+	assert.Equal(t, paymentlink.StatusDeactivated, status)
+
+	code, _ = sendCheckout(checkoutURL, "4111111111111111")
+	assert.Equal(t, http.StatusGone, code)
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payment-links", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, j.Len())
+}
+
+func Test_CheckoutNeedsToken(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	_, checkoutURL := createPaymentLink(t, merchantId, secretKey, `{"amount":"10.00","currency":"USD","description":"Donation"}`)
+
+	u, _ := url.Parse(checkoutURL)
+	form := url.Values{"name_surname": {"Krystian Bednarczuk"}, "card_number": {"4111111111111111"}, "expiry_month": {"12"},
+		"expiry_year": {"23"}, "CCV": {"123"}, "token": {"0123456789abcdef0123456789abcdef"}}
+	req, _ := http.NewRequest(http.MethodPost, u.Path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusForbidden, response.Code, "a form posted from another site has no cookie")
+	assert.Contains(t, response.Body.String(), "session expired")
+
+	code, _ := sendCheckout(checkoutURL, "4111111111111111")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func Test_PaymentLinkDeclines(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	linkId, checkoutURL := createPaymentLink(t, merchantId, secretKey, `{"amount":"10.00","currency":"USD","description":"Donation","max_uses":0}`)
+
+	for i := 0; i < a.cfg.PaymentLinks.MaxFailuresPerIP; i++ {
+		code, _ := sendCheckoutFrom(checkoutURL, authorizationFailureCardNumber, "198.51.100.8")
+		assert.Equal(t, http.StatusPaymentRequired, code)
+	}
+	code, _ := sendCheckoutFrom(checkoutURL, "4111111111111111", "198.51.100.8")
+	assert.Equal(t, http.StatusTooManyRequests, code, "the shopper IP is throttled")
+	code, _ = sendCheckoutFrom(checkoutURL, "4111111111111111", "198.51.100.9")
+	assert.Equal(t, http.StatusOK, code)
+
+	for i := a.cfg.PaymentLinks.MaxFailuresPerIP; i < a.cfg.PaymentLinks.MaxFailures; i++ {
+		code, _ := sendCheckoutFrom(checkoutURL, authorizationFailureCardNumber, "203.0.113."+strconv.Itoa(i))
+		assert.Equal(t, http.StatusPaymentRequired, code)
+	}
+	code, _ = sendCheckoutFrom(checkoutURL, "4111111111111111", "198.51.100.9")
+	assert.Equal(t, http.StatusGone, code)
+
+	code, j := sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payment-links/"+linkId, secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("status")
+	assert.Equal(t, paymentlink.StatusDeactivated, status, "too many declines deactivate the link")
+	failures, _ := j.GetInt("failures")
+	assert.Equal(t, a.cfg.PaymentLinks.MaxFailures, failures)
+}
+
+func Test_PaymentLinkUseReleasedByRejectedReview(t *testing.T) {
+	clearTable()
+	withFraud(t, fraud.Config{Rules: []fraud.Rule{{Name: "review", When: `ip == "198.51.100.7"`, Action: fraud.DecisionReview}}})
+	merchantId, secretKey := register(t)
+	linkId, checkoutURL := createPaymentLink(t, merchantId, secretKey, `{"amount":"10.00","currency":"USD","description":"Donation"}`)
+
+	code, body := sendCheckout(checkoutURL, "4111111111111111")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "being reviewed")
+	code, j := sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payment-links/"+linkId, secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("status")
+	assert.Equal(t, paymentlink.StatusCompleted, status)
+	paymentId, _ := j.GetString("payment_ids", 0)
+
+	code, _ = sendRequest(http.MethodPost, "/merchant/"+merchantId+"/reviews/"+paymentId+"/reject", secretKey, []byte(`{"reviewer":"Jane Doe"}`))
+	assert.Equal(t, http.StatusOK, code)
+	_, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/payment-links/"+linkId, secretKey, nil)
+	status, _ = j.GetString("status")
+	assert.Equal(t, paymentlink.StatusActive, status, "the rejected payment gives the use back")
+
+	code, _ = sendCheckoutFrom(checkoutURL, "4111111111111111", "198.51.100.9")
+	assert.Equal(t, http.StatusOK, code)
+}
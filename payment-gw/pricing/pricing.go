@@ -0,0 +1,156 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	OperationCapture = "capture"
+	OperationRefund  = "refund"
+)
+
+// Refund policies tell what happens to the capture fee when a payment is
+// refunded.
+const (
+	// RefundKeep keeps the capture fee, the default
+	RefundKeep = "keep"
+	// RefundReturn returns the share of the capture fee of the refunded amount
+	RefundReturn = "return"
+)
+
+// Fee is a percentage of the amount plus a fixed part in minor units.
+type Fee struct {
+	Percent float64 `yaml:"percent"`
+	Fixed   int     `yaml:"fixed"`
+}
+
+func (f Fee) For(amount int) int {
+	return f.Fixed + int(math.Round(float64(amount)*f.Percent/100))
+}
+
+// Override replaces the fee for the operations it matches, empty criteria
+// match everything and the operation defaults to capture.
+type Override struct {
+	Name       string   `yaml:"name"`
+	Operation  string   `yaml:"operation"`
+	Brands     []string `yaml:"brands"`
+	Currencies []string `yaml:"currencies"`
+	Fee        `yaml:",inline"`
+}
+
+func (o Override) Matches(operation, brand, currency string) bool {
+	op := o.Operation
+	if op == "" {
+		op = OperationCapture
+	}
+	return op == operation && matchesAny(o.Brands, brand) && matchesAny(o.Currencies, currency)
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Schedule prices the operations of a merchant. Captures are charged the
+// fee of the schedule and refunds are free, unless an override matches; the
+// first matching one wins.
+type Schedule struct {
+	Fee       `yaml:",inline"`
+	Refunds   string     `yaml:"refunds"`
+	Overrides []Override `yaml:"overrides"`
+}
+
+func (s Schedule) fee(operation, brand, currency string) Fee {
+	for _, o := range s.Overrides {
+		if o.Matches(operation, brand, currency) {
+			return o.Fee
+		}
+	}
+	if operation == OperationCapture {
+		return s.Fee
+	}
+	return Fee{}
+}
+
+// Payment is what the fee of an operation depends on besides its amount.
+type Payment struct {
+	MerchantId  string
+	Brand       string
+	Currency    string
+	Captured    int
+	CaptureFees int
+}
+
+type Config struct {
+	Default   Schedule            `yaml:"default"`
+	Merchants map[string]Schedule `yaml:"merchants"`
+}
+
+func (c Config) Schedule(merchantId string) Schedule {
+	if s, ok := c.Merchants[merchantId]; ok {
+		return s
+	}
+	return c.Default
+}
+
+// CaptureFee is charged to the merchant for capturing amount.
+func (c Config) CaptureFee(p Payment, amount int) int {
+	return c.Schedule(p.MerchantId).fee(OperationCapture, p.Brand, p.Currency).For(amount)
+}
+
+// RefundFee is charged to the merchant for refunding amount. With the return
+// policy the share of the capture fees of the refunded amount is given back,
+// so the fee can be negative.
+func (c Config) RefundFee(p Payment, amount int) int {
+	s := c.Schedule(p.MerchantId)
+	fee := s.fee(OperationRefund, p.Brand, p.Currency).For(amount)
+	if s.Refunds == RefundReturn && p.Captured > 0 {
+		fee -= int(math.Round(float64(p.CaptureFees) * float64(amount) / float64(p.Captured)))
+	}
+	return fee
+}
+
+func (c Config) Validate() error {
+	var errs []string
+	validate := func(name string, s Schedule) {
+		if err := s.Fee.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+		if s.Refunds != "" && s.Refunds != RefundKeep && s.Refunds != RefundReturn {
+			errs = append(errs, fmt.Sprintf("%s.refunds must be keep or return, got %q", name, s.Refunds))
+		}
+		for i, o := range s.Overrides {
+			if o.Operation != "" && o.Operation != OperationCapture && o.Operation != OperationRefund {
+				errs = append(errs, fmt.Sprintf("%s.overrides[%d].operation must be capture or refund, got %q", name, i, o.Operation))
+			}
+			if err := o.Fee.validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s.overrides[%d]: %v", name, i, err))
+			}
+		}
+	}
+	validate("default", c.Default)
+	for id, s := range c.Merchants {
+		validate("merchants."+id, s)
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (f Fee) validate() error {
+	if f.Percent < 0 || f.Percent > 100 || f.Fixed < 0 {
+		return errors.New("percent must be between 0 and 100 and fixed must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package pricing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var config = Config{
+	Default: Schedule{Fee: Fee{Percent: 1.5, Fixed: 25}},
+	Merchants: map[string]Schedule{
+		"m1": {
+			Fee:     Fee{Percent: 1, Fixed: 10},
+			Refunds: RefundReturn,
+			Overrides: []Override{
+				{Name: "amex", Brands: []string{"amex"}, Fee: Fee{Percent: 3}},
+				{Name: "visa in USD", Brands: []string{"visa"}, Currencies: []string{"USD"}, Fee: Fee{Fixed: 50}},
+				{Name: "refunds", Operation: OperationRefund, Currencies: []string{"EUR"}, Fee: Fee{Fixed: 15}},
+			},
+		},
+	},
+}
+
+func TestCaptureFee(t *testing.T) {
+	assert.Equal(t, 175, config.CaptureFee(Payment{MerchantId: "m0", Brand: "visa", Currency: "EUR"}, 10000), "default schedule")
+	assert.Equal(t, 110, config.CaptureFee(Payment{MerchantId: "m1", Brand: "visa", Currency: "EUR"}, 10000))
+	assert.Equal(t, 300, config.CaptureFee(Payment{MerchantId: "m1", Brand: "amex", Currency: "EUR"}, 10000))
+	assert.Equal(t, 50, config.CaptureFee(Payment{MerchantId: "m1", Brand: "visa", Currency: "USD"}, 10000))
+	assert.Equal(t, 110, config.CaptureFee(Payment{MerchantId: "m1", Brand: "mastercard", Currency: "USD"}, 10000))
+	assert.Equal(t, 0, Config{}.CaptureFee(Payment{MerchantId: "m1"}, 10000))
+}
+
+func TestRefundFee(t *testing.T) {
+	assert.Equal(t, 0, config.RefundFee(Payment{MerchantId: "m0", Currency: "EUR", Captured: 10000, CaptureFees: 175}, 5000),
+		"refunds are free and the capture fee is kept by default")
+
+	p := Payment{MerchantId: "m1", Brand: "visa", Currency: "USD", Captured: 10000, CaptureFees: 110}
+	assert.Equal(t, -55, config.RefundFee(p, 5000), "half of the capture fee is returned")
+	assert.Equal(t, -110, config.RefundFee(p, 10000))
+
+	p.Currency = "EUR"
+	assert.Equal(t, 15-55, config.RefundFee(p, 5000), "the refund fee is charged")
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, config.Validate())
+
+	err := Config{
+		Default: Schedule{Fee: Fee{Percent: 101}, Refunds: "split"},
+		Merchants: map[string]Schedule{"m1": {Overrides: []Override{
+			{Operation: "void", Fee: Fee{Fixed: -1}},
+		}}},
+	}.Validate()
+	assert.Error(t, err)
+	for _, msg := range []string{
+		"default: percent must be between 0 and 100",
+		`default.refunds must be keep or return, got "split"`,
+		`merchants.m1.overrides[0].operation must be capture or refund, got "void"`,
+		"merchants.m1.overrides[0]: percent",
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
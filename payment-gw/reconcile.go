@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"payment-gw/reconciliation"
+	"text/tabwriter"
+
+	"github.com/rs/zerolog/log"
+)
+
+// reconcileCommand reconciles a settlement file from the command line:
+//
+//	payment-gw reconcile -acquirer NAME -day YYYY-MM-DD [-config FILE] FILE
+//
+// The run is saved like the ones sent to the API and its report printed. The
+// exit status is 1 when the file cannot be reconciled and 2 when some items
+// did not reconcile.
+func reconcileCommand(args []string, getenv func(string) string, out io.Writer) int {
+	fs := flag.NewFlagSet("payment-gw reconcile", flag.ContinueOnError)
+	configFile := fs.String("config", getenv("PAYMENT_GW_CONFIG"), "path to a YAML configuration file")
+	acquirer := fs.String("acquirer", "", "name of the acquirer that sent the file")
+	day := fs.String("day", "", "day settled by the file, as YYYY-MM-DD")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() != 1 || *acquirer == "" || *day == "" {
+		fmt.Fprintln(fs.Output(), "usage: payment-gw reconcile -acquirer NAME -day YYYY-MM-DD [-config FILE] FILE")
+		return 1
+	}
+
+	var configArgs []string
+	if *configFile != "" {
+		configArgs = []string{"-config", *configFile}
+	}
+	c, err := LoadConfig(configArgs, getenv)
+	if err != nil {
+		log.Error().Msg(err.Error())
+		return 1
+	}
+	setupLogging(c.Log)
+	lg := log.With().Str("acquirer", *acquirer).Str("day", *day).Logger()
+	if !c.hasAcquirer(*acquirer) {
+		lg.Error().Msg(ErrUnknownAcquirer.Error())
+		return 1
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return 1
+	}
+	defer f.Close()
+
+	client, err := connectDB(c, &lg)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return 1
+	}
+	ctx := context.WithValue(context.Background(), "logger", &lg)
+	defer client.Disconnect(ctx)
+
+	repo := reconciliation.NewRepository(client.Database(c.Mongo.Database), c.Reconciliation)
+	run, err := repo.Reconcile(ctx, *acquirer, *day, filepath.Base(fs.Arg(0)), f)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return 1
+	}
+
+	printReconciliation(out, run)
+	if !run.OK() {
+		return 2
+	}
+	return 0
+}
+
+func printReconciliation(out io.Writer, run reconciliation.Run) {
+	fmt.Fprintf(out, "run %s: %s %s %s\n", run.Id, run.Acquirer, run.Day, run.File)
+	fmt.Fprintf(out, "lines %d, skipped %d, matched %d, missing %d, extra %d, amount mismatched %d\n",
+		run.Lines, run.Skipped, run.Matched, run.Missing, run.Extra, run.Mismatched)
+	if run.OK() {
+		return
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nSTATUS\tTYPE\tREFERENCE\tPAYMENT\tCURRENCY\tEXPECTED\tACTUAL\tLINE")
+	for _, item := range run.Items {
+		payment, expected, actual, line := item.PaymentId, formatMinorUnits(item.Expected), formatMinorUnits(item.Actual), fmt.Sprint(item.Row)
+		switch item.Status {
+		case reconciliation.StatusMissing:
+			actual, line = "-", "-"
+		case reconciliation.StatusExtra:
+			payment, expected = "-", "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", item.Status, item.Type, item.Reference, payment,
+			item.Currency, expected, actual, line)
+	}
+	w.Flush()
+}
@@ -0,0 +1,174 @@
+package reconciliation
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	TypeCapture = "capture"
+	TypeRefund  = "refund"
+)
+
+const (
+	// AmountsDecimal are amounts with two decimals, e.g. 100.00
+	AmountsDecimal = "decimal"
+	// AmountsMinor are amounts in minor units, e.g. 10000
+	AmountsMinor = "minor"
+)
+
+var ErrMalformedFile = errors.New("malformed settlement file")
+
+// Line is a capture or refund the acquirer settled, as read from its file.
+// Row is the number of the line in the file, and the amount is
+// positive even when the file lists refunds as negative amounts.
+type Line struct {
+	Row       int
+	Reference string
+	Type      string
+	Amount    int
+	Currency  string
+}
+
+// Format reads the settlement file of an acquirer. Lines of types other than
+// captures and refunds, like chargebacks or scheme fees, are skipped and
+// counted.
+type Format interface {
+	Parse(r io.Reader) (lines []Line, skipped int, err error)
+}
+
+// Columns are the names of the columns in the header row of the file.
+type Columns struct {
+	Reference string `yaml:"reference"`
+	Type      string `yaml:"type"`
+	Amount    string `yaml:"amount"`
+	Currency  string `yaml:"currency"`
+}
+
+// CSVFormat describes a delimited settlement file with a header row. Types
+// maps the transaction types used in the file to capture or refund.
+type CSVFormat struct {
+	Delimiter string            `yaml:"delimiter"`
+	Columns   Columns           `yaml:"columns"`
+	Types     map[string]string `yaml:"types"`
+	Amounts   string            `yaml:"amounts"`
+}
+
+func DefaultCSVFormat() CSVFormat {
+	return CSVFormat{
+		Delimiter: ",",
+		Columns:   Columns{Reference: "reference", Type: "type", Amount: "amount", Currency: "currency"},
+		Types:     map[string]string{TypeCapture: TypeCapture, TypeRefund: TypeRefund},
+		Amounts:   AmountsDecimal,
+	}
+}
+
+func (f CSVFormat) Validate() error {
+	var errs []string
+	if utf8.RuneCountInString(f.Delimiter) != 1 {
+		errs = append(errs, fmt.Sprintf("delimiter must be a single character, got %q", f.Delimiter))
+	}
+	c := f.Columns
+	if c.Reference == "" || c.Type == "" || c.Amount == "" || c.Currency == "" {
+		errs = append(errs, "columns reference, type, amount and currency are required")
+	}
+	if len(f.Types) == 0 {
+		errs = append(errs, "types is required")
+	}
+	for k, v := range f.Types {
+		if v != TypeCapture && v != TypeRefund {
+			errs = append(errs, fmt.Sprintf("types.%s must be capture or refund, got %q", k, v))
+		}
+	}
+	if f.Amounts != AmountsDecimal && f.Amounts != AmountsMinor {
+		errs = append(errs, fmt.Sprintf("amounts must be decimal or minor, got %q", f.Amounts))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (f CSVFormat) Parse(r io.Reader) ([]Line, int, error) {
+	delimiter, _ := utf8.DecodeRuneInString(f.Delimiter)
+	cr := csv.NewReader(r)
+	cr.Comma = delimiter
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, 0, fmt.Errorf("%w: empty file", ErrMalformedFile)
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrMalformedFile, err)
+	}
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+	var columns [4]int
+	for i, name := range []string{f.Columns.Reference, f.Columns.Type, f.Columns.Amount, f.Columns.Currency} {
+		c, ok := index[name]
+		if !ok {
+			return nil, 0, fmt.Errorf("%w: no %q column", ErrMalformedFile, name)
+		}
+		columns[i] = c
+	}
+
+	var lines []Line
+	skipped := 0
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return lines, skipped, nil
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrMalformedFile, err)
+		}
+		row, _ := cr.FieldPos(0)
+		typ, ok := f.Types[strings.TrimSpace(record[columns[1]])]
+		if !ok {
+			skipped++
+			continue
+		}
+		amount, err := f.amount(strings.TrimSpace(record[columns[2]]))
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: line %d: %v", ErrMalformedFile, row, err)
+		}
+		if amount < 0 {
+			amount = -amount
+		}
+		lines = append(lines, Line{
+			Row:       row,
+			Reference: strings.TrimSpace(record[columns[0]]),
+			Type:      typ,
+			Amount:    amount,
+			Currency:  strings.ToUpper(strings.TrimSpace(record[columns[3]])),
+		})
+	}
+}
+
+func (f CSVFormat) amount(v string) (int, error) {
+	if f.Amounts == AmountsMinor {
+		return strconv.Atoi(v)
+	}
+	units, cents, ok := strings.Cut(v, ".")
+	if !ok || len(cents) != 2 || strings.HasPrefix(cents, "-") {
+		return 0, fmt.Errorf("amount %q must have two decimals", v)
+	}
+	u, err := strconv.Atoi(units)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", v)
+	}
+	c, err := strconv.Atoi(cents)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", v)
+	}
+	if strings.HasPrefix(units, "-") {
+		return u*100 - c, nil
+	}
+	return u*100 + c, nil
+}
@@ -0,0 +1,333 @@
+package reconciliation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"payment-gw/gateway"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const RunsCol = "reconciliation_runs"
+
+// Statuses of the items that did not reconcile.
+const (
+	// StatusMissing is an operation of the gateway the acquirer did not settle
+	StatusMissing = "missing"
+	// StatusExtra is a line of the file no operation of the gateway matches
+	StatusExtra = "extra"
+	// StatusAmountMismatch is a line settled for another amount than the
+	// operation it refers to
+	StatusAmountMismatch = "amount_mismatch"
+)
+
+var (
+	ErrRunNotFound = errors.New("reconciliation run not found")
+	ErrInvalidDay  = errors.New("day must be formatted as YYYY-MM-DD")
+)
+
+// Item is a discrepancy between the file and the records of the gateway.
+// Expected is the amount of the gateway operation and Actual the amount of
+// the line, Row is zero for missing items.
+type Item struct {
+	Status     string `bson:"status"`
+	Type       string `bson:"type"`
+	Reference  string `bson:"reference"`
+	PaymentId  string `bson:"paymentid,omitempty"`
+	MerchantId string `bson:"merchantid,omitempty"`
+	Currency   string `bson:"currency"`
+	Expected   int    `bson:"expected"`
+	Actual     int    `bson:"actual"`
+	Row        int    `bson:"row,omitempty"`
+}
+
+// Run is the report of the reconciliation of one settlement file.
+type Run struct {
+	Id         string `bson:"id"`
+	Acquirer   string `bson:"acquirer"`
+	Day        string `bson:"day"`
+	File       string `bson:"file"`
+	Lines      int    `bson:"lines"`
+	Skipped    int    `bson:"skipped"`
+	Matched    int    `bson:"matched"`
+	Missing    int    `bson:"missing"`
+	Extra      int    `bson:"extra"`
+	Mismatched int    `bson:"mismatched"`
+	Items      []Item `bson:"items"`
+	// Operations are the ids of the operations the lines settled, see
+	// OperationId, later files cannot settle them again
+	Operations []string  `bson:"operations"`
+	CreatedAt  time.Time `bson:"createdat"`
+}
+
+func (r Run) OK() bool {
+	return len(r.Items) == 0
+}
+
+type Config struct {
+	// TimeZone in which the days of settlement files start at midnight
+	TimeZone string `yaml:"time_zone"`
+	// Formats of the settlement files by acquirer name, acquirers without
+	// one use the default CSV format
+	Formats map[string]CSVFormat `yaml:"formats"`
+}
+
+func (c Config) Format(acquirer string) Format {
+	if f, ok := c.Formats[acquirer]; ok {
+		return f
+	}
+	return DefaultCSVFormat()
+}
+
+func (c Config) Validate() error {
+	var errs []string
+	if _, err := time.LoadLocation(c.TimeZone); err != nil {
+		errs = append(errs, fmt.Sprintf("time_zone: %v", err))
+	}
+	for name, f := range c.Formats {
+		if err := f.Validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("formats.%s: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// OperationId identifies an operation of a payment, operations are only ever
+// appended so their index does not change.
+func OperationId(paymentId string, i int) string {
+	return fmt.Sprintf("%s/%d", paymentId, i)
+}
+
+type expected struct {
+	id      string
+	payment gateway.Payment
+	op      gateway.Operation
+	inDay   bool
+	matched bool
+}
+
+// Match pairs the lines of the file with the captures and refunds of the
+// payments by processor reference, type and amount. Operations booked between
+// from and to the file did not settle are missing, operations of other days
+// are only used to match lines, since acquirers settle late operations with
+// the next file. Operations reconciled by previous files are left out, a line
+// settling one again is extra. The ids of the operations the lines settled,
+// for the right amount or not, are returned.
+func Match(lines []Line, payments []gateway.Payment, reconciled map[string]bool, from, to time.Time) (matched int, items []Item, operations []string) {
+	type key struct{ reference, typ string }
+	ops := map[key][]*expected{}
+	var all []*expected
+	for _, p := range payments {
+		for i, op := range p.Operations {
+			if op.Type != TypeCapture && op.Type != TypeRefund || reconciled[OperationId(p.Id, i)] {
+				continue
+			}
+			e := &expected{id: OperationId(p.Id, i), payment: p, op: op, inDay: !op.CreatedAt.Before(from) && op.CreatedAt.Before(to)}
+			k := key{p.ProcessorReference, op.Type}
+			ops[k] = append(ops[k], e)
+			all = append(all, e)
+		}
+	}
+
+	// exact matches first, so a mismatched line cannot take the operation
+	// another line settles for the right amount
+	var unmatched []Line
+	for _, l := range lines {
+		if e := pick(ops[key{l.Reference, l.Type}], func(e *expected) bool { return e.op.Amount == l.Amount }); e != nil {
+			e.matched = true
+			matched++
+			operations = append(operations, e.id)
+			continue
+		}
+		unmatched = append(unmatched, l)
+	}
+	for _, l := range unmatched {
+		e := pick(ops[key{l.Reference, l.Type}], func(e *expected) bool { return e.inDay })
+		if e == nil {
+			e = pick(ops[key{l.Reference, l.Type}], func(e *expected) bool { return true })
+		}
+		if e == nil {
+			items = append(items, Item{Status: StatusExtra, Type: l.Type, Reference: l.Reference, Currency: l.Currency, Actual: l.Amount, Row: l.Row})
+			continue
+		}
+		e.matched = true
+		operations = append(operations, e.id)
+		items = append(items, Item{Status: StatusAmountMismatch, Type: l.Type, Reference: l.Reference, PaymentId: e.payment.Id,
+			MerchantId: e.payment.MerchantId, Currency: e.payment.Currency, Expected: e.op.Amount, Actual: l.Amount, Row: l.Row})
+	}
+	for _, e := range all {
+		if e.inDay && !e.matched {
+			items = append(items, Item{Status: StatusMissing, Type: e.op.Type, Reference: e.payment.ProcessorReference,
+				PaymentId: e.payment.Id, MerchantId: e.payment.MerchantId, Currency: e.payment.Currency, Expected: e.op.Amount})
+		}
+	}
+	return matched, items, operations
+}
+
+func pick(candidates []*expected, ok func(*expected) bool) *expected {
+	for _, e := range candidates {
+		if !e.matched && ok(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+type ReconciliationRepository interface {
+	Reconcile(ctx context.Context, acquirer, day, file string, r io.Reader) (Run, error)
+	ListRuns(ctx context.Context, acquirer string) ([]Run, error)
+	GetRun(ctx context.Context, runId string) (Run, error)
+}
+
+type MongoReconciliationRepository struct {
+	db     *mongo.Database
+	config Config
+}
+
+func NewRepository(db *mongo.Database, c Config) MongoReconciliationRepository {
+	return MongoReconciliationRepository{db: db, config: c}
+}
+
+// Reconcile matches the settlement file of an acquirer for a day against the
+// payments routed to it, leaving out the operations settled by the previous
+// runs, and saves the run.
+func (m MongoReconciliationRepository) Reconcile(ctx context.Context, acquirer, day, file string, r io.Reader) (Run, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	location, err := time.LoadLocation(m.config.TimeZone)
+	if err != nil {
+		return Run{}, err
+	}
+	from, err := time.ParseInLocation("2006-01-02", day, location)
+	if err != nil {
+		return Run{}, ErrInvalidDay
+	}
+	to := from.AddDate(0, 0, 1)
+
+	lines, skipped, err := m.config.Format(acquirer).Parse(r)
+	if err != nil {
+		return Run{}, err
+	}
+	references := make([]string, 0, len(lines))
+	for _, l := range lines {
+		references = append(references, l.Reference)
+	}
+
+	payments := []gateway.Payment{}
+	cursor, err := m.db.Collection(gateway.PaymentsCol).Find(ctx, bson.M{"acquirer": acquirer, "$or": []bson.M{
+		{"processorreference": bson.M{"$in": references}},
+		{"operations.createdat": bson.M{"$gte": from, "$lt": to}},
+	}})
+	if err == nil {
+		err = cursor.All(ctx, &payments)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Run{}, err
+	}
+	reconciled, err := m.reconciled(ctx, acquirer, payments)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Run{}, err
+	}
+
+	run := Run{Id: xid.New().String(), Acquirer: acquirer, Day: day, File: file, Lines: len(lines), Skipped: skipped,
+		Items: []Item{}, CreatedAt: time.Now().UTC()}
+	matched, items, operations := Match(lines, payments, reconciled, from, to)
+	run.Matched, run.Operations = matched, append([]string{}, operations...)
+	for _, item := range items {
+		switch item.Status {
+		case StatusMissing:
+			run.Missing++
+		case StatusExtra:
+			run.Extra++
+		case StatusAmountMismatch:
+			run.Mismatched++
+		}
+		run.Items = append(run.Items, item)
+	}
+
+	if _, err := m.db.Collection(RunsCol).InsertOne(ctx, run); err != nil {
+		lg.Error().Msg(err.Error())
+		return Run{}, err
+	}
+	return run, nil
+}
+
+// reconciled returns which operations of the payments previous runs settled.
+func (m MongoReconciliationRepository) reconciled(ctx context.Context, acquirer string, payments []gateway.Payment) (map[string]bool, error) {
+	ids := map[string]bool{}
+	for _, p := range payments {
+		for i := range p.Operations {
+			ids[OperationId(p.Id, i)] = true
+		}
+	}
+	candidates := make([]string, 0, len(ids))
+	for id := range ids {
+		candidates = append(candidates, id)
+	}
+
+	var runs []Run
+	cursor, err := m.db.Collection(RunsCol).Find(ctx, bson.M{"acquirer": acquirer, "operations": bson.M{"$in": candidates}},
+		options.Find().SetProjection(bson.M{"operations": 1}))
+	if err == nil {
+		err = cursor.All(ctx, &runs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reconciled := map[string]bool{}
+	for _, run := range runs {
+		for _, id := range run.Operations {
+			if ids[id] {
+				reconciled[id] = true
+			}
+		}
+	}
+	return reconciled, nil
+}
+
+func (m MongoReconciliationRepository) ListRuns(ctx context.Context, acquirer string) ([]Run, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	filter := bson.M{}
+	if acquirer != "" {
+		filter["acquirer"] = acquirer
+	}
+	runs := []Run{}
+	cursor, err := m.db.Collection(RunsCol).Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "day", Value: -1}, {Key: "createdat", Value: -1}}).SetProjection(bson.M{"items": 0}))
+	if err == nil {
+		err = cursor.All(ctx, &runs)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+	return runs, nil
+}
+
+func (m MongoReconciliationRepository) GetRun(ctx context.Context, runId string) (Run, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	var run Run
+	err := m.db.Collection(RunsCol).FindOne(ctx, bson.M{"id": runId}).Decode(&run)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Run{}, ErrRunNotFound
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		return Run{}, err
+	}
+	return run, nil
+}
@@ -0,0 +1,139 @@
+package reconciliation
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"payment-gw/gateway"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseFile(t *testing.T, f Format, path string) ([]Line, int) {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	lines, skipped, err := f.Parse(file)
+	assert.NoError(t, err)
+	return lines, skipped
+}
+
+var processorFormat = CSVFormat{
+	Delimiter: ";",
+	Columns:   Columns{Reference: "TXN_REF", Type: "TXN_TYPE", Amount: "AMOUNT_MINOR", Currency: "CCY"},
+	Types:     map[string]string{"SALE": TypeCapture, "CREDIT": TypeRefund},
+	Amounts:   AmountsMinor,
+}
+
+func TestParse(t *testing.T) {
+	lines, skipped := parseFile(t, DefaultCSVFormat(), "testdata/settlement.csv")
+	assert.Equal(t, 1, skipped, "the chargeback is skipped")
+	assert.Equal(t, []Line{
+		{Row: 2, Reference: "REF000000001", Type: TypeCapture, Amount: 10000, Currency: "EUR"},
+		{Row: 3, Reference: "REF000000002", Type: TypeCapture, Amount: 2550, Currency: "EUR"},
+		{Row: 4, Reference: "REF000000002", Type: TypeRefund, Amount: 1000, Currency: "EUR"},
+		{Row: 5, Reference: "REF000000003", Type: TypeCapture, Amount: 4999, Currency: "USD"},
+		{Row: 6, Reference: "REF000000009", Type: TypeCapture, Amount: 1200, Currency: "EUR"},
+	}, lines)
+
+	other, skipped := parseFile(t, processorFormat, "testdata/processor.csv")
+	assert.Equal(t, 1, skipped)
+	assert.Equal(t, lines, other, "both files settle the same operations")
+}
+
+func TestParseMalformed(t *testing.T) {
+	file, err := os.Open("testdata/malformed.csv")
+	assert.NoError(t, err)
+	defer file.Close()
+	_, _, err = DefaultCSVFormat().Parse(file)
+	assert.True(t, errors.Is(err, ErrMalformedFile))
+	assert.Contains(t, err.Error(), "line 2")
+
+	_, _, err = processorFormat.Parse(strings.NewReader("reference;type\n"))
+	assert.True(t, errors.Is(err, ErrMalformedFile))
+	assert.Contains(t, err.Error(), `no "TXN_REF" column`)
+
+	_, _, err = DefaultCSVFormat().Parse(strings.NewReader(""))
+	assert.True(t, errors.Is(err, ErrMalformedFile))
+}
+
+func TestMatch(t *testing.T) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	at := day.Add(10 * time.Hour)
+	payment := func(id, reference string, ops ...gateway.Operation) gateway.Payment {
+		return gateway.Payment{Id: id, MerchantId: "m1", Currency: "EUR", ProcessorReference: reference, Operations: ops}
+	}
+	payments := []gateway.Payment{
+		payment("p1", "REF000000001", gateway.Operation{Type: TypeCapture, Amount: 10000, CreatedAt: at}),
+		payment("p2", "REF000000002",
+			gateway.Operation{Type: TypeCapture, Amount: 2550, CreatedAt: day.Add(-time.Hour)},
+			gateway.Operation{Type: TypeRefund, Amount: 1000, CreatedAt: at}),
+		payment("p3", "REF000000003",
+			gateway.Operation{Type: TypeCapture, Amount: 5000, CreatedAt: at},
+			gateway.Operation{Type: gateway.OperationChargeback, Amount: 5000, CreatedAt: at}),
+		payment("p4", "REF000000004",
+			gateway.Operation{Type: TypeCapture, Amount: 3000, CreatedAt: at},
+			gateway.Operation{Type: TypeCapture, Amount: 700, CreatedAt: day.AddDate(0, 0, 1)}),
+	}
+	lines, _ := parseFile(t, DefaultCSVFormat(), "testdata/settlement.csv")
+
+	matched, items, operations := Match(lines, payments, nil, day, day.AddDate(0, 0, 1))
+	assert.Equal(t, 3, matched, "the capture of the day before is matched too")
+	assert.ElementsMatch(t, []string{"p1/0", "p2/0", "p2/1", "p3/0"}, operations, "mismatched operations are settled too")
+	assert.Equal(t, []Item{
+		{Status: StatusAmountMismatch, Type: TypeCapture, Reference: "REF000000003", PaymentId: "p3", MerchantId: "m1", Currency: "EUR", Expected: 5000, Actual: 4999, Row: 5},
+		{Status: StatusExtra, Type: TypeCapture, Reference: "REF000000009", Currency: "EUR", Actual: 1200, Row: 6},
+		{Status: StatusMissing, Type: TypeCapture, Reference: "REF000000004", PaymentId: "p4", MerchantId: "m1", Currency: "EUR", Expected: 3000},
+	}, items, "the capture of the next day is not missing")
+
+	matched, items, operations = Match(lines, payments, map[string]bool{"p1/0": true, "p3/0": true}, day, day.AddDate(0, 0, 1))
+	assert.Equal(t, 2, matched)
+	assert.ElementsMatch(t, []string{"p2/0", "p2/1"}, operations)
+	var extra []string
+	for _, item := range items {
+		if item.Status == StatusExtra {
+			extra = append(extra, item.Reference)
+		}
+	}
+	assert.Equal(t, []string{"REF000000001", "REF000000003", "REF000000009"}, extra, "lines of operations settled before are extra")
+}
+
+func TestMatchPartialCaptures(t *testing.T) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	p := gateway.Payment{Id: "p1", ProcessorReference: "R1", Operations: []gateway.Operation{
+		{Type: TypeCapture, Amount: 300, CreatedAt: day},
+		{Type: TypeCapture, Amount: 200, CreatedAt: day},
+	}}
+	lines := []Line{
+		{Row: 2, Reference: "R1", Type: TypeCapture, Amount: 250},
+		{Row: 3, Reference: "R1", Type: TypeCapture, Amount: 200},
+	}
+	matched, items, _ := Match(lines, []gateway.Payment{p}, nil, day, day.AddDate(0, 0, 1))
+	assert.Equal(t, 1, matched)
+	assert.Len(t, items, 1)
+	assert.Equal(t, StatusAmountMismatch, items[0].Status)
+	assert.Equal(t, 300, items[0].Expected, "the exact match takes the capture of 200")
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{TimeZone: "UTC", Formats: map[string]CSVFormat{"processor": processorFormat}}.Validate())
+
+	err := Config{TimeZone: "Mars/Olympus", Formats: map[string]CSVFormat{"processor": {
+		Delimiter: ";;",
+		Types:     map[string]string{"SALE": "purchase"},
+		Amounts:   "cents",
+	}}}.Validate()
+	assert.Error(t, err)
+	for _, msg := range []string{
+		"time_zone",
+		`formats.processor: delimiter must be a single character, got ";;"`,
+		"columns reference, type, amount and currency are required",
+		`types.SALE must be capture or refund, got "purchase"`,
+		`amounts must be decimal or minor, got "cents"`,
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
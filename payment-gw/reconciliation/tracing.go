@@ -0,0 +1,40 @@
+package reconciliation
+
+import (
+	"context"
+	"io"
+	"payment-gw/tracing"
+)
+
+type tracedRepository struct {
+	next ReconciliationRepository
+}
+
+func NewTracedRepository(next ReconciliationRepository) ReconciliationRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) Reconcile(ctx context.Context, acquirer, day, file string, r io.Reader) (Run, error) {
+	ctx, span := tracing.Start(ctx, "reconciliation.Reconcile", tracing.WithAttributes(
+		tracing.String("acquirer.name", acquirer), tracing.String("reconciliation.day", day)))
+	defer span.End()
+	run, err := t.next.Reconcile(ctx, acquirer, day, file, r)
+	span.RecordError(err)
+	return run, err
+}
+
+func (t tracedRepository) ListRuns(ctx context.Context, acquirer string) ([]Run, error) {
+	ctx, span := tracing.Start(ctx, "reconciliation.ListRuns", tracing.WithAttributes(tracing.String("acquirer.name", acquirer)))
+	defer span.End()
+	runs, err := t.next.ListRuns(ctx, acquirer)
+	span.RecordError(err)
+	return runs, err
+}
+
+func (t tracedRepository) GetRun(ctx context.Context, runId string) (Run, error) {
+	ctx, span := tracing.Start(ctx, "reconciliation.GetRun", tracing.WithAttributes(tracing.String("reconciliation.run_id", runId)))
+	defer span.End()
+	run, err := t.next.GetRun(ctx, runId)
+	span.RecordError(err)
+	return run, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"payment-gw/reconciliation"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+const maxSettlementFileSize = 32 << 20
+
+var ErrUnknownAcquirer = errors.New("unknown acquirer")
+
+type reconciliationItemResponse struct {
+	Status     string `json:"status"`
+	Type       string `json:"type"`
+	Reference  string `json:"reference"`
+	PaymentId  string `json:"payment_id,omitempty"`
+	MerchantId string `json:"merchant_id,omitempty"`
+	Currency   string `json:"currency"`
+	Expected   string `json:"expected,omitempty"`
+	Actual     string `json:"actual,omitempty"`
+	Line       int    `json:"line,omitempty"`
+}
+
+type reconciliationResponse struct {
+	RunId      string                       `json:"run_id"`
+	Acquirer   string                       `json:"acquirer"`
+	Day        string                       `json:"day"`
+	File       string                       `json:"file,omitempty"`
+	Lines      int                          `json:"lines"`
+	Skipped    int                          `json:"skipped"`
+	Matched    int                          `json:"matched"`
+	Missing    int                          `json:"missing"`
+	Extra      int                          `json:"extra"`
+	Mismatched int                          `json:"amount_mismatched"`
+	Items      []reconciliationItemResponse `json:"items,omitempty"`
+	CreatedAt  time.Time                    `json:"created_at"`
+}
+
+func createReconciliationResponse(run reconciliation.Run) reconciliationResponse {
+	res := reconciliationResponse{run.Id, run.Acquirer, run.Day, run.File, run.Lines, run.Skipped, run.Matched,
+		run.Missing, run.Extra, run.Mismatched, nil, run.CreatedAt}
+	for _, item := range run.Items {
+		i := reconciliationItemResponse{item.Status, item.Type, item.Reference, item.PaymentId, item.MerchantId, item.Currency, "", "", item.Row}
+		if item.Status != reconciliation.StatusExtra {
+			i.Expected = formatMinorUnits(item.Expected)
+		}
+		if item.Status != reconciliation.StatusMissing {
+			i.Actual = formatMinorUnits(item.Actual)
+		}
+		res.Items = append(res.Items, i)
+	}
+	return res
+}
+
+// reconcile reconciles the settlement file sent as the request body, the
+// acquirer and the day are given in the query string.
+func (a *App) reconcile(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	acquirer, day := r.URL.Query().Get("acquirer"), r.URL.Query().Get("day")
+	if !a.cfg.hasAcquirer(acquirer) {
+		lg.Debug().Str("acquirer", acquirer).Msg(ErrUnknownAcquirer.Error())
+		respondWithError(w, http.StatusBadRequest, ErrUnknownAcquirer.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	body := http.MaxBytesReader(w, r.Body, maxSettlementFileSize)
+	defer body.Close()
+	run, err := a.reconciliation.Reconcile(ctx, acquirer, day, r.URL.Query().Get("file"), body)
+	if errors.Is(err, reconciliation.ErrInvalidDay) || errors.Is(err, reconciliation.ErrMalformedFile) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, createReconciliationResponse(run))
+}
+
+func (a *App) listReconciliations(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	runs, err := a.reconciliation.ListRuns(ctx, r.URL.Query().Get("acquirer"))
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	res := make([]reconciliationResponse, 0, len(runs))
+	for _, run := range runs {
+		res = append(res, createReconciliationResponse(run))
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+func (a *App) getReconciliation(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	run, err := a.reconciliation.GetRun(ctx, mux.Vars(r)["run_id"])
+	if errors.Is(err, reconciliation.ErrRunNotFound) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, createReconciliationResponse(run))
+}
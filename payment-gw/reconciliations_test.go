@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func processorReference(t *testing.T, paymentId string) string {
+	p, err := a.gateway.Get(context.WithValue(context.Background(), "logger", a.lg), paymentId)
+	assert.NoError(t, err)
+	return p.ProcessorReference
+}
+
+func Test_Reconciliation(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	var paymentIds, references []string
+	for _, amount := range []string{"10.00", "20.00", "30.00"} {
+		_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{Amount: amount}, merchantId, secretKey)
+		code, _, _, _ := sendCaptureRequest(amount, merchantId, paymentId, secretKey)
+		assert.Equal(t, http.StatusOK, code)
+		paymentIds = append(paymentIds, paymentId)
+		references = append(references, processorReference(t, paymentId))
+	}
+	code, _, _, _ := sendRefundRequest("5.00", merchantId, paymentIds[0], secretKey)
+	assert.Equal(t, http.StatusOK, code)
+
+	file := fmt.Sprintf("reference,type,amount,currency\n%s,capture,10.00,USD\n%s,refund,-5.00,USD\n%s,capture,19.99,USD\nUNKNOWN,capture,1.00,USD\n%s,chargeback,10.00,USD\n",
+		references[0], references[0], references[1], references[0])
+	day := time.Now().UTC().Format("2006-01-02")
+	code, j := sendRequest(http.MethodPost, "/reconciliations?acquirer=simulator&day="+day+"&file=simulator.csv", adminKey, []byte(file))
+	assert.Equal(t, http.StatusCreated, code)
+	runId, _ := j.GetString("run_id")
+	lines, _ := j.GetInt("lines")
+	skipped, _ := j.GetInt("skipped")
+	matched, _ := j.GetInt("matched")
+	missing, _ := j.GetInt("missing")
+	extra, _ := j.GetInt("extra")
+	mismatched, _ := j.GetInt("amount_mismatched")
+	assert.Equal(t, 4, lines)
+	assert.Equal(t, 1, skipped)
+	assert.Equal(t, 2, matched)
+	assert.Equal(t, 1, missing)
+	assert.Equal(t, 1, extra)
+	assert.Equal(t, 1, mismatched)
+
+	code, j = sendRequest(http.MethodGet, "/reconciliations/"+runId, adminKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("items", 0, "status")
+	expected, _ := j.GetString("items", 0, "expected")
+	actual, _ := j.GetString("items", 0, "actual")
+	assert.Equal(t, "amount_mismatch", status)
+	assert.Equal(t, "20.00", expected)
+	assert.Equal(t, "19.99", actual)
+	status, _ = j.GetString("items", 2, "status")
+	reference, _ := j.GetString("items", 2, "reference")
+	paymentId, _ := j.GetString("items", 2, "payment_id")
+	assert.Equal(t, "missing", status)
+	assert.Equal(t, references[2], reference)
+	assert.Equal(t, paymentIds[2], paymentId)
+
+	code, j = sendRequest(http.MethodGet, "/reconciliations?acquirer=simulator", adminKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, j.Len())
+
+	file = fmt.Sprintf("reference,type,amount,currency\n%s,capture,10.00,USD\n%s,capture,30.00,USD\n", references[0], references[2])
+	code, j = sendRequest(http.MethodPost, "/reconciliations?acquirer=simulator&day="+day, adminKey, []byte(file))
+	assert.Equal(t, http.StatusCreated, code)
+	matched, _ = j.GetInt("matched")
+	missing, _ = j.GetInt("missing")
+	extra, _ = j.GetInt("extra")
+	assert.Equal(t, 1, matched)
+	assert.Equal(t, 0, missing, "operations settled by the first file are not missing")
+	assert.Equal(t, 1, extra, "a capture settled twice is extra")
+	reference, _ = j.GetString("items", 0, "reference")
+	assert.Equal(t, references[0], reference)
+}
+
+func Test_ReconciliationErrors(t *testing.T) {
+	clearTable()
+	day := time.Now().UTC().Format("2006-01-02")
+
+	code, _ := sendRequest(http.MethodGet, "/reconciliations", "", nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = sendRequest(http.MethodPost, "/reconciliations?acquirer=simulator&day="+day, "wrong", []byte("reference,type,amount,currency\n"))
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, _ = sendRequest(http.MethodPost, "/reconciliations?acquirer=visanet&day="+day, adminKey, []byte("reference,type,amount,currency\n"))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = sendRequest(http.MethodPost, "/reconciliations?acquirer=simulator&day=yesterday", adminKey, []byte("reference,type,amount,currency\n"))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = sendRequest(http.MethodPost, "/reconciliations?acquirer=simulator&day="+day, adminKey, []byte("reference,amount\n"))
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, j := sendRequest(http.MethodPost, "/reconciliations?acquirer=simulator&day="+day, adminKey, []byte("reference,type,amount,currency\n"))
+	assert.Equal(t, http.StatusCreated, code)
+	lines, _ := j.GetInt("lines")
+	assert.Equal(t, 0, lines)
+
+	code, _ = sendRequest(http.MethodGet, "/reconciliations/cbs5ed2ngh6v0ckfvvng", adminKey, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
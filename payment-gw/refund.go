@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"payment-gw/gateway"
 	"strconv"
-	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
@@ -19,6 +18,7 @@ type refundResponse struct {
 	AvailableToRefund  string `json:"available_to_refund"`
 	Currency           string `json:"currency,omitempty"`
 	Error              string `json:"error,omitempty"`
+	DeclineCode        string `json:"decline_code,omitempty"`
 }
 
 func (a *App) refund(w http.ResponseWriter, r *http.Request) {
@@ -41,50 +41,59 @@ func (a *App) refund(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
 	defer cancel()
 
-	amount, err := strconv.ParseFloat(req.Amount, 64)
+	amount, err := parseMinorUnits(req.Amount)
 	if err != nil {
 		lg.Debug().Msg(err.Error())
 		respondWithError(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
 		return
 	}
 
-	payment, err := a.gateway.Refund(ctx, mux.Vars(r)["payment_id"], int(amount*100))
+	payment, err := a.gateway.Refund(ctx, mux.Vars(r)["payment_id"], amount)
 	res := createRefundResponse(payment, err)
 
-	if errors.Is(gateway.ErrPaymentIsCancelled, err) || errors.Is(gateway.ErrNotCaptured, err) ||
-		errors.Is(gateway.ErrAmountIsZero, err) || errors.Is(gateway.ErrRefundToHigh, err) ||
-		errors.Is(gateway.ErrBasedOnCreditCardNumber, err) {
+	if errors.Is(err, gateway.ErrPaymentIsCancelled) || errors.Is(err, gateway.ErrNotCaptured) ||
+		errors.Is(err, gateway.ErrPaymentOnHold) || errors.Is(err, gateway.ErrPaymentRequiresAction) ||
+		errors.Is(err, gateway.ErrAmountIsZero) || errors.Is(err, gateway.ErrRefundToHigh) ||
+		errors.Is(err, gateway.ErrBasedOnCreditCardNumber) {
+		recordOperation("refund", payment.Currency, amount, operationOutcome(err))
 		lg.Debug().Msg(err.Error())
 		respondWithJSON(w, http.StatusBadRequest, res)
 		return
 	}
+	if errors.Is(err, gateway.ErrOperationInProgress) || errors.Is(err, gateway.ErrOptimisticLocking) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
 	if err != nil {
+		recordOperation("refund", payment.Currency, amount, outcomeError)
 		lg.Error().Msg(err.Error())
-		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		respondWithFailure(w, err)
 		return
 	}
+	recordOperation("refund", payment.Currency, amount, outcomeSuccess)
 
 	respondWithJSON(w, http.StatusOK, res)
 }
 
 func createRefundResponse(p gateway.Payment, err error) refundResponse {
-	availableToRefund := float64(p.Captured-p.Refunded) / 100
+	availableToRefund := float64(p.Refundable()) / 100
 	availableToCapture := float64(p.Authorized-p.Captured) / 100
 
-	res := refundResponse{"0.00", "0.00", p.Currency, ""}
-	if errors.Is(gateway.ErrPaymentIsCancelled, err) {
+	res := refundResponse{"0.00", "0.00", p.Currency, "", declineCode(err)}
+	if errors.Is(err, gateway.ErrPaymentIsCancelled) || errors.Is(err, gateway.ErrPaymentOnHold) || errors.Is(err, gateway.ErrPaymentRequiresAction) {
 		res.Error = err.Error()
 		return res
 	}
-	if errors.Is(gateway.ErrNotCaptured, err) {
+	if errors.Is(err, gateway.ErrNotCaptured) {
 		res.Error = err.Error()
 		res.AvailableToCapture = strconv.FormatFloat(availableToCapture, 'f', 2, 64)
 		return res
 	}
-	if errors.Is(gateway.ErrAmountIsZero, err) || errors.Is(gateway.ErrRefundToHigh, err) || errors.Is(gateway.ErrBasedOnCreditCardNumber, err) {
+	if errors.Is(err, gateway.ErrAmountIsZero) || errors.Is(err, gateway.ErrRefundToHigh) || errors.Is(err, gateway.ErrBasedOnCreditCardNumber) {
 		res.Error = err.Error()
 		res.AvailableToCapture = strconv.FormatFloat(availableToCapture, 'f', 2, 64)
 		res.AvailableToRefund = strconv.FormatFloat(availableToRefund, 'f', 2, 64)
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"net/http"
-	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -12,7 +11,7 @@ func (a *App) register(w http.ResponseWriter, r *http.Request) {
 	lg := r.Context().Value("logger").(*zerolog.Logger)
 	w.Header().Set("Content-Type", "application/json")
 
-	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
 	defer cancel()
 
 	merchantId, secretKey, err := a.merchant.Register(ctx)
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"payment-gw/gateway"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"gopkg.in/validator.v2"
+)
+
+type reviewResponse struct {
+	Status    string     `json:"status"`
+	Amount    string     `json:"amount"`
+	HeldAt    time.Time  `json:"held_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	Reviewer  string     `json:"reviewer,omitempty"`
+	Note      string     `json:"note,omitempty"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+}
+
+type heldPaymentResponse struct {
+	PaymentId string            `json:"payment_id"`
+	Currency  string            `json:"currency"`
+	Brand     string            `json:"brand,omitempty"`
+	Screening screeningResponse `json:"screening"`
+	Review    reviewResponse    `json:"review"`
+	detailsResponse
+}
+
+func createReviewResponse(r gateway.Review) reviewResponse {
+	res := reviewResponse{r.Status, formatMinorUnits(r.Amount), r.HeldAt, r.ExpiresAt, r.Reviewer, r.Note, nil}
+	if !r.DecidedAt.IsZero() {
+		res.DecidedAt = &r.DecidedAt
+	}
+	return res
+}
+
+func createHeldPaymentResponse(p gateway.Payment) heldPaymentResponse {
+	return heldPaymentResponse{p.Id, p.Currency, p.Brand, screeningResponse{p.Screening.Decision, append([]string{}, p.Screening.Rules...)},
+		createReviewResponse(*p.Review), createDetailsResponse(p.Details)}
+}
+
+// listReviews returns the payments of the merchant waiting for a review
+// decision, the ones expiring first first.
+func (a *App) listReviews(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	payments, err := a.gateway.Held(ctx, mux.Vars(r)["merchant_id"])
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	res := []heldPaymentResponse{}
+	for _, p := range payments {
+		res = append(res, createHeldPaymentResponse(p))
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+func (a *App) approveReview(w http.ResponseWriter, r *http.Request) {
+	a.decideReview(w, r, "approve", a.gateway.Approve)
+}
+
+func (a *App) rejectReview(w http.ResponseWriter, r *http.Request) {
+	a.decideReview(w, r, "reject", a.gateway.Reject)
+}
+
+// decideReview approves or rejects a held payment with the name and note of
+// the reviewer. An approved payment is authorized, the acquirer may still
+// decline it.
+func (a *App) decideReview(w http.ResponseWriter, r *http.Request, operation string,
+	decide func(ctx context.Context, paymentId, reviewer, note string) (gateway.Payment, error)) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+	req := struct {
+		Reviewer string `json:"reviewer" validate:"nonzero,max=64"`
+		Note     string `json:"note" validate:"max=1024"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	if err := validator.Validate(req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	p, err := decide(ctx, mux.Vars(r)["payment_id"], req.Reviewer, req.Note)
+	if errors.Is(err, gateway.ErrNotHeld) || errors.Is(err, gateway.ErrReviewDecided) || errors.Is(err, gateway.ErrOptimisticLocking) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if p.Voided {
+		a.releaseLinkUse(ctx, p)
+	}
+	if errors.Is(err, gateway.ErrBasedOnCreditCardNumber) {
+		recordOperation(operation, p.Currency, p.Review.Amount, operationOutcome(err))
+		lg.Debug().Str("decline_code", declineCode(err)).Msg(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error(), "decline_code": declineCode(err),
+			"review": createReviewResponse(*p.Review)})
+		return
+	}
+	if err != nil {
+		recordOperation(operation, p.Currency, 0, outcomeError)
+		lg.Error().Msg(err.Error())
+		respondWithFailure(w, err)
+		return
+	}
+	recordOperation(operation, p.Currency, p.Review.Amount, outcomeSuccess)
+
+	res := struct {
+		heldPaymentResponse
+		AvailableToCapture string `json:"available_to_capture"`
+	}{createHeldPaymentResponse(p), formatMinorUnits(p.Authorized - p.Captured)}
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// expireReviews declines every expiry interval the held payments nobody
+// decided on in time and voids the payments whose challenge expired.
+func (a *App) expireReviews(ctx context.Context) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	ticker := time.NewTicker(a.cfg.Reviews.ExpiryInterval)
+	defer ticker.Stop()
+	for {
+		expired, err := a.gateway.Expire(ctx, time.Now())
+		for _, p := range expired {
+			a.releaseLinkUse(ctx, p)
+		}
+		if err != nil && ctx.Err() == nil {
+			lg.Warn().Err(err).Msg("could not expire payments")
+		} else if len(expired) > 0 {
+			lg.Info().Int("expired", len(expired)).Msg("held and unauthenticated payments expired")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
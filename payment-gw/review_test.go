@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"payment-gw/fraud"
+	"payment-gw/gateway"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func heldPayment(t *testing.T, p authorizationPayload, merchantId, secretKey string) string {
+	code, j := sendScreenedAuthorization(p, "198.51.100.20", "KP", merchantId, secretKey)
+	assert.Equal(t, http.StatusAccepted, code)
+	status, _ := j.GetString("status")
+	assert.Equal(t, "held", status)
+	paymentId, _ := j.GetString("payment_id")
+	return paymentId
+}
+
+func Test_ReviewApproved(t *testing.T) {
+	clearTable()
+	withFraud(t, fraud.Config{Rules: []fraud.Rule{{Name: "high risk country", When: `country == "KP"`, Action: fraud.DecisionReview}}})
+	merchantId, secretKey := register(t)
+	paymentId := heldPayment(t, authorizationPayload{}, merchantId, secretKey)
+
+	code, j := sendRequest(http.MethodGet, "/merchant/"+merchantId+"/reviews", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, j.Len())
+	id, _ := j.GetString(0, "payment_id")
+	assert.Equal(t, paymentId, id)
+	amount, _ := j.GetString(0, "review", "amount")
+	assert.Equal(t, "100.00", amount)
+
+	raw, err := a.collection(gateway.PaymentsCol).FindOne(context.Background(), bson.M{"id": paymentId}).DecodeBytes()
+	assert.NoError(t, err)
+	assert.NotContains(t, raw.String(), "5555555555554444", "the card number is encrypted")
+	card := raw.Lookup("review", "card").Document()
+	_, err = card.LookupErr("cvv")
+	assert.Error(t, err, "the CVV is not kept")
+	assert.Equal(t, "4444", card.Lookup("last4").StringValue())
+
+	code, _, _, _ = sendCaptureRequest("10.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = sendRequest(http.MethodPost, "/merchant/"+merchantId+"/reviews/"+paymentId+"/approve", secretKey, []byte(`{"note":"known customer"}`))
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, j = sendRequest(http.MethodPost, "/merchant/"+merchantId+"/reviews/"+paymentId+"/approve", secretKey,
+		[]byte(`{"reviewer":"Jane Doe","note":"known customer"}`))
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("review", "status")
+	assert.Equal(t, gateway.ReviewApproved, status)
+	availableToCapture, _ := j.GetString("available_to_capture")
+	assert.Equal(t, "100.00", availableToCapture)
+	payment, err := a.gateway.Get(context.WithValue(context.Background(), "logger", a.lg), paymentId)
+	assert.NoError(t, err)
+	assert.Empty(t, payment.InProgress, "the claim of the authorization is cleared with its result")
+
+	code, _ = sendRequest(http.MethodPost, "/merchant/"+merchantId+"/reviews/"+paymentId+"/reject", secretKey, []byte(`{"reviewer":"Jane Doe"}`))
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _, _, _ = sendCaptureRequest("100.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+
+	_, p := sendPaymentRequest(merchantId, paymentId, secretKey)
+	reviewer, _ := p.GetString("review", "reviewer")
+	assert.Equal(t, "Jane Doe", reviewer)
+	note, _ := p.GetString("review", "note")
+	assert.Equal(t, "known customer", note)
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/reviews", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 0, j.Len())
+
+	code, j = sendRequest(http.MethodGet, "/merchant/"+merchantId+"/events?type=review.approved", secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, j.Len())
+}
+
+func Test_ReviewRejectedAndDeclined(t *testing.T) {
+	clearTable()
+	withFraud(t, fraud.Config{Rules: []fraud.Rule{{Name: "high risk country", When: `country == "KP"`, Action: fraud.DecisionReview}}})
+	merchantId, secretKey := register(t)
+
+	paymentId := heldPayment(t, authorizationPayload{}, merchantId, secretKey)
+	code, j := sendRequest(http.MethodPost, "/merchant/"+merchantId+"/reviews/"+paymentId+"/reject", secretKey,
+		[]byte(`{"reviewer":"Jane Doe","note":"stolen card reported"}`))
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("review", "status")
+	assert.Equal(t, gateway.ReviewRejected, status)
+
+	code, _, _, _ = sendCaptureRequest("100.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// approved payments can still be declined by the acquirer
+	paymentId = heldPayment(t, authorizationPayload{Amount: "10.05"}, merchantId, secretKey)
+	code, j = sendRequest(http.MethodPost, "/merchant/"+merchantId+"/reviews/"+paymentId+"/approve", secretKey, []byte(`{"reviewer":"Jane Doe"}`))
+	assert.Equal(t, http.StatusBadRequest, code)
+	declineCode, _ := j.GetString("decline_code")
+	assert.NotEmpty(t, declineCode)
+	status, _ = j.GetString("review", "status")
+	assert.Equal(t, gateway.ReviewDeclined, status)
+
+	// reviews of another merchant are forbidden
+	otherId, otherKey := register(t)
+	code, _ = sendRequest(http.MethodPost, "/merchant/"+otherId+"/reviews/"+paymentId+"/reject", otherKey, []byte(`{"reviewer":"Jane Doe"}`))
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// payments that were not held have no review
+	_, _, authorizedId, _, _ := sendAuthorizationRequest(authorizationPayload{}, merchantId, secretKey)
+	code, _ = sendRequest(http.MethodPost, "/merchant/"+merchantId+"/reviews/"+authorizedId+"/approve", secretKey, []byte(`{"reviewer":"Jane Doe"}`))
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func Test_ReviewExpires(t *testing.T) {
+	clearTable()
+	withFraud(t, fraud.Config{Rules: []fraud.Rule{{Name: "high risk country", When: `country == "KP"`, Action: fraud.DecisionReview}}})
+	merchantId, secretKey := register(t)
+	paymentId := heldPayment(t, authorizationPayload{}, merchantId, secretKey)
+
+	ctx := context.WithValue(context.Background(), "logger", a.lg)
+	expired, err := a.gateway.Expire(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Empty(t, expired)
+
+	expired, err = a.gateway.Expire(ctx, time.Now().Add(a.cfg.Reviews.HoldTime+time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, expired, 1)
+
+	_, p := sendPaymentRequest(merchantId, paymentId, secretKey)
+	status, _ := p.GetString("review", "status")
+	assert.Equal(t, gateway.ReviewExpired, status)
+	voided, _ := p.GetBool("voided")
+	assert.True(t, voided)
+
+	code, _ := sendRequest(http.MethodPost, "/merchant/"+merchantId+"/reviews/"+paymentId+"/approve", secretKey, []byte(`{"reviewer":"Jane Doe"}`))
+	assert.Equal(t, http.StatusConflict, code)
+}
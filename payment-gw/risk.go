@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"payment-gw/risk"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"gopkg.in/validator.v2"
+)
+
+// limitsRequest holds decimal amounts, an empty amount is no limit.
+type limitsRequest struct {
+	Min     string `json:"min,omitempty" validate:"regexp=^([0-9]{1\\,10}[.][0-9]{2})?$"`
+	Max     string `json:"max,omitempty" validate:"regexp=^([0-9]{1\\,10}[.][0-9]{2})?$"`
+	Daily   string `json:"daily,omitempty" validate:"regexp=^([0-9]{1\\,12}[.][0-9]{2})?$"`
+	Monthly string `json:"monthly,omitempty" validate:"regexp=^([0-9]{1\\,12}[.][0-9]{2})?$"`
+}
+
+type volumeResponse struct {
+	Currency string `json:"currency"`
+	Period   string `json:"period"`
+	Amount   string `json:"amount"`
+}
+
+type riskResponse struct {
+	MerchantId string                   `json:"merchant_id"`
+	Currencies []string                 `json:"currencies"`
+	Limits     map[string]limitsRequest `json:"limits"`
+	Volumes    []volumeResponse         `json:"volumes"`
+	UpdatedAt  *time.Time               `json:"updated_at,omitempty"`
+}
+
+func formatLimit(amount int) string {
+	if amount == 0 {
+		return ""
+	}
+	return formatMinorUnits(amount)
+}
+
+func createRiskResponse(s risk.Settings, volumes []risk.Volume) riskResponse {
+	res := riskResponse{MerchantId: s.MerchantId, Currencies: []string{}, Limits: map[string]limitsRequest{}, Volumes: []volumeResponse{}}
+	res.Currencies = append(res.Currencies, s.Currencies...)
+	for c, l := range s.Limits {
+		res.Limits[c] = limitsRequest{formatLimit(l.Min), formatLimit(l.Max), formatLimit(l.Daily), formatLimit(l.Monthly)}
+	}
+	for _, v := range volumes {
+		res.Volumes = append(res.Volumes, volumeResponse{v.Currency, v.Period, formatMinorUnits(v.Amount)})
+	}
+	if !s.UpdatedAt.IsZero() {
+		res.UpdatedAt = &s.UpdatedAt
+	}
+	return res
+}
+
+// respondWithLimitError answers authorizations outside the risk settings of
+// the merchant with the code of the limit.
+func respondWithLimitError(w http.ResponseWriter, err error) {
+	respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error(), "error_code": risk.Code(err)})
+}
+
+func (a *App) getRiskSettings(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	merchantId := mux.Vars(r)["merchant_id"]
+	s, err := a.risk.GetSettings(ctx, merchantId)
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	volumes, err := a.risk.Volumes(ctx, merchantId, time.Now())
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, createRiskResponse(s, volumes))
+}
+
+// setRiskSettings replaces the risk settings of a merchant, they apply to the
+// authorizations that follow.
+func (a *App) setRiskSettings(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+	req := struct {
+		Currencies []string                 `json:"currencies"`
+		Limits     map[string]limitsRequest `json:"limits"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	s := risk.Settings{MerchantId: mux.Vars(r)["merchant_id"], Currencies: req.Currencies, Limits: map[string]risk.Limits{}}
+	for c, l := range req.Limits {
+		if err := validator.Validate(l); err != nil {
+			lg.Debug().Msg(err.Error())
+			respondWithError(w, http.StatusBadRequest, "limits."+c+": "+err.Error())
+			return
+		}
+		var limits risk.Limits
+		for _, f := range []struct {
+			amount string
+			to     *int
+		}{{l.Min, &limits.Min}, {l.Max, &limits.Max}, {l.Daily, &limits.Daily}, {l.Monthly, &limits.Monthly}} {
+			amount, err := parseMinorUnits(f.amount)
+			if err != nil {
+				lg.Debug().Msg(err.Error())
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			*f.to = amount
+		}
+		s.Limits[c] = limits
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	s, err := a.risk.SetSettings(ctx, s)
+	if errors.Is(err, risk.ErrInvalidSettings) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	volumes, err := a.risk.Volumes(ctx, s.MerchantId, time.Now())
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	respondWithJSON(w, http.StatusOK, createRiskResponse(s, volumes))
+}
@@ -0,0 +1,271 @@
+package risk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SettingsCol = "risk_settings"
+	VolumesCol  = "risk_volumes"
+)
+
+// Errors of authorizations outside the risk settings of the merchant.
+var (
+	ErrCurrencyNotAllowed    = errors.New("currency is not allowed for the merchant")
+	ErrAmountBelowMinimum    = errors.New("amount is below the minimum of the merchant")
+	ErrAmountAboveMaximum    = errors.New("amount is above the maximum of the merchant")
+	ErrDailyVolumeExceeded   = errors.New("daily volume of the merchant would be exceeded")
+	ErrMonthlyVolumeExceeded = errors.New("monthly volume of the merchant would be exceeded")
+)
+
+var ErrInvalidSettings = errors.New("invalid risk settings")
+
+var codes = []struct {
+	err  error
+	code string
+}{
+	{ErrCurrencyNotAllowed, "currency_not_allowed"},
+	{ErrAmountBelowMinimum, "amount_below_minimum"},
+	{ErrAmountAboveMaximum, "amount_above_maximum"},
+	{ErrDailyVolumeExceeded, "daily_volume_exceeded"},
+	{ErrMonthlyVolumeExceeded, "monthly_volume_exceeded"},
+}
+
+// Code is the error code of a limit error, empty for other errors.
+func Code(err error) string {
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return ""
+}
+
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Limits of a currency in minor units, zero means no limit.
+type Limits struct {
+	Min     int `bson:"min"`
+	Max     int `bson:"max"`
+	Daily   int `bson:"daily"`
+	Monthly int `bson:"monthly"`
+}
+
+// Settings restrict the authorizations of a merchant. Merchants without
+// settings can authorize any currency and amount.
+type Settings struct {
+	MerchantId string `bson:"merchantid"`
+	// Currencies the merchant accepts, any when empty
+	Currencies []string `bson:"currencies"`
+	// Limits by currency
+	Limits    map[string]Limits `bson:"limits"`
+	UpdatedAt time.Time         `bson:"updatedat"`
+}
+
+func (s Settings) Validate() error {
+	var errs []string
+	allowed := map[string]bool{}
+	for _, c := range s.Currencies {
+		if !currencyCode.MatchString(c) {
+			errs = append(errs, fmt.Sprintf("currencies: %q is not a currency code", c))
+		}
+		allowed[c] = true
+	}
+	for c, l := range s.Limits {
+		switch {
+		case !currencyCode.MatchString(c):
+			errs = append(errs, fmt.Sprintf("limits: %q is not a currency code", c))
+		case len(allowed) > 0 && !allowed[c]:
+			errs = append(errs, fmt.Sprintf("limits.%s: currency is not allowed", c))
+		}
+		if l.Min < 0 || l.Max < 0 || l.Daily < 0 || l.Monthly < 0 {
+			errs = append(errs, fmt.Sprintf("limits.%s must not be negative", c))
+		}
+		if l.Max > 0 && l.Min > l.Max {
+			errs = append(errs, fmt.Sprintf("limits.%s: min is above max", c))
+		}
+		if l.Daily > 0 && l.Monthly > 0 && l.Daily > l.Monthly {
+			errs = append(errs, fmt.Sprintf("limits.%s: daily is above monthly", c))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%w: %s", ErrInvalidSettings, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Check applies the limits of a single transaction.
+func (s Settings) Check(currency string, amount int) error {
+	if len(s.Currencies) > 0 {
+		allowed := false
+		for _, c := range s.Currencies {
+			allowed = allowed || c == currency
+		}
+		if !allowed {
+			return ErrCurrencyNotAllowed
+		}
+	}
+	l := s.Limits[currency]
+	if l.Min > 0 && amount < l.Min {
+		return ErrAmountBelowMinimum
+	}
+	if l.Max > 0 && amount > l.Max {
+		return ErrAmountAboveMaximum
+	}
+	return nil
+}
+
+// Volume is the amount authorized by a merchant in a currency during a day
+// (2006-01-02) or a month (2006-01) in UTC.
+type Volume struct {
+	Id         string `bson:"_id"`
+	MerchantId string `bson:"merchantid"`
+	Currency   string `bson:"currency"`
+	Period     string `bson:"period"`
+	Amount     int    `bson:"amount"`
+}
+
+// Reservation is an amount counted in the volumes of its day and month.
+type Reservation struct {
+	MerchantId string
+	Currency   string
+	Amount     int
+	Day        string
+	Month      string
+}
+
+func volumeId(merchantId, currency, period string) string {
+	return merchantId + "/" + currency + "/" + period
+}
+
+// Reserve checks an authorization against the settings of the merchant and
+// counts it in the volumes of the day and the month. The counters are
+// incremented only while they stay within the caps, in one transaction, so
+// concurrent authorizations cannot exceed them together.
+func Reserve(ctx context.Context, db *mongo.Database, merchantId, currency string, amount int, at time.Time) (Reservation, error) {
+	var s Settings
+	err := db.Collection(SettingsCol).FindOne(ctx, bson.M{"merchantid": merchantId}).Decode(&s)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return Reservation{}, err
+	}
+	if err := s.Check(currency, amount); err != nil {
+		return Reservation{}, err
+	}
+
+	at = at.UTC()
+	r := Reservation{MerchantId: merchantId, Currency: currency, Amount: amount, Day: at.Format("2006-01-02"), Month: at.Format("2006-01")}
+	l := s.Limits[currency]
+	err = db.Client().UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			if err := count(sc, db, r, r.Day, l.Daily, ErrDailyVolumeExceeded); err != nil {
+				return nil, err
+			}
+			return nil, count(sc, db, r, r.Month, l.Monthly, ErrMonthlyVolumeExceeded)
+		})
+		return err
+	})
+	return r, err
+}
+
+// count adds the reservation to the volume of a period unless it would go
+// over the cap. A volume over the cap does not match the filter, so the
+// upsert tries to insert it again and fails on its id.
+func count(sc mongo.SessionContext, db *mongo.Database, r Reservation, period string, cap int, exceeded error) error {
+	if cap > 0 && r.Amount > cap {
+		return exceeded
+	}
+	filter := bson.M{"_id": volumeId(r.MerchantId, r.Currency, period)}
+	if cap > 0 {
+		filter["amount"] = bson.M{"$lte": cap - r.Amount}
+	}
+	_, err := db.Collection(VolumesCol).UpdateOne(sc, filter, bson.M{
+		"$inc":         bson.M{"amount": r.Amount},
+		"$setOnInsert": bson.M{"merchantid": r.MerchantId, "currency": r.Currency, "period": period},
+	}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return exceeded
+	}
+	return err
+}
+
+// Release takes back a reservation whose authorization did not go through.
+func Release(ctx context.Context, db *mongo.Database, r Reservation) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	for _, period := range []string{r.Day, r.Month} {
+		if _, err := db.Collection(VolumesCol).UpdateOne(ctx, bson.M{"_id": volumeId(r.MerchantId, r.Currency, period)},
+			bson.M{"$inc": bson.M{"amount": -r.Amount}}); err != nil {
+			lg.Error().Msg(err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+type RiskRepository interface {
+	GetSettings(ctx context.Context, merchantId string) (Settings, error)
+	SetSettings(ctx context.Context, s Settings) (Settings, error)
+	// Volumes returns the volumes of the merchant for the day and month of at
+	Volumes(ctx context.Context, merchantId string, at time.Time) ([]Volume, error)
+}
+
+type MongoRiskRepository struct {
+	db *mongo.Database
+}
+
+func NewRepository(db *mongo.Database) MongoRiskRepository {
+	return MongoRiskRepository{db: db}
+}
+
+func (m MongoRiskRepository) GetSettings(ctx context.Context, merchantId string) (Settings, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	s := Settings{MerchantId: merchantId}
+	err := m.db.Collection(SettingsCol).FindOne(ctx, bson.M{"merchantid": merchantId}).Decode(&s)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		lg.Error().Msg(err.Error())
+		return Settings{}, err
+	}
+	return s, nil
+}
+
+func (m MongoRiskRepository) SetSettings(ctx context.Context, s Settings) (Settings, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	if err := s.Validate(); err != nil {
+		return Settings{}, err
+	}
+	s.UpdatedAt = time.Now().UTC()
+	if _, err := m.db.Collection(SettingsCol).ReplaceOne(ctx, bson.M{"merchantid": s.MerchantId}, s,
+		options.Replace().SetUpsert(true)); err != nil {
+		lg.Error().Msg(err.Error())
+		return Settings{}, err
+	}
+	return s, nil
+}
+
+func (m MongoRiskRepository) Volumes(ctx context.Context, merchantId string, at time.Time) ([]Volume, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	at = at.UTC()
+	volumes := []Volume{}
+	cursor, err := m.db.Collection(VolumesCol).Find(ctx, bson.M{"merchantid": merchantId,
+		"period": bson.M{"$in": []string{at.Format("2006-01-02"), at.Format("2006-01")}}},
+		options.Find().SetSort(bson.D{{Key: "currency", Value: 1}, {Key: "period", Value: 1}}))
+	if err == nil {
+		err = cursor.All(ctx, &volumes)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+	return volumes, nil
+}
@@ -0,0 +1,57 @@
+package risk
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	s := Settings{Currencies: []string{"USD", "EUR"}, Limits: map[string]Limits{"USD": {Min: 100, Max: 50000}}}
+	for _, tc := range []struct {
+		currency string
+		amount   int
+		err      error
+	}{
+		{"USD", 100, nil},
+		{"USD", 50000, nil},
+		{"USD", 99, ErrAmountBelowMinimum},
+		{"USD", 50001, ErrAmountAboveMaximum},
+		{"EUR", 1, nil},
+		{"GBP", 100, ErrCurrencyNotAllowed},
+	} {
+		err := s.Check(tc.currency, tc.amount)
+		assert.True(t, errors.Is(err, tc.err), fmt.Sprintf("%s %d: %v", tc.currency, tc.amount, err))
+	}
+	assert.NoError(t, Settings{}.Check("JPY", 999999999999), "merchants without settings are not limited")
+}
+
+func TestCode(t *testing.T) {
+	assert.Equal(t, "currency_not_allowed", Code(ErrCurrencyNotAllowed))
+	assert.Equal(t, "monthly_volume_exceeded", Code(fmt.Errorf("authorize: %w", ErrMonthlyVolumeExceeded)))
+	assert.Equal(t, "", Code(errors.New("other")))
+	assert.Equal(t, "", Code(nil))
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Settings{Currencies: []string{"USD"}, Limits: map[string]Limits{"USD": {Min: 1, Max: 10, Daily: 100, Monthly: 1000}}}.Validate())
+
+	err := Settings{Currencies: []string{"usd", "EUR"}, Limits: map[string]Limits{
+		"GBP":  {},
+		"EUR":  {Min: 10, Max: 5, Daily: 1000, Monthly: 100},
+		"EURO": {Max: -1},
+	}}.Validate()
+	assert.True(t, errors.Is(err, ErrInvalidSettings))
+	for _, msg := range []string{
+		`currencies: "usd" is not a currency code`,
+		"limits.GBP: currency is not allowed",
+		"limits.EUR: min is above max",
+		"limits.EUR: daily is above monthly",
+		`limits: "EURO" is not a currency code`,
+		"limits.EURO must not be negative",
+	} {
+		assert.Contains(t, err.Error(), msg)
+	}
+}
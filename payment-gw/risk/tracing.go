@@ -0,0 +1,39 @@
+package risk
+
+import (
+	"context"
+	"payment-gw/tracing"
+	"time"
+)
+
+type tracedRepository struct {
+	next RiskRepository
+}
+
+func NewTracedRepository(next RiskRepository) RiskRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) GetSettings(ctx context.Context, merchantId string) (Settings, error) {
+	ctx, span := tracing.Start(ctx, "risk.GetSettings", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	s, err := t.next.GetSettings(ctx, merchantId)
+	span.RecordError(err)
+	return s, err
+}
+
+func (t tracedRepository) SetSettings(ctx context.Context, s Settings) (Settings, error) {
+	ctx, span := tracing.Start(ctx, "risk.SetSettings", tracing.WithAttributes(tracing.String("merchant.id", s.MerchantId)))
+	defer span.End()
+	s, err := t.next.SetSettings(ctx, s)
+	span.RecordError(err)
+	return s, err
+}
+
+func (t tracedRepository) Volumes(ctx context.Context, merchantId string, at time.Time) ([]Volume, error) {
+	ctx, span := tracing.Start(ctx, "risk.Volumes", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	volumes, err := t.next.Volumes(ctx, merchantId, at)
+	span.RecordError(err)
+	return volumes, err
+}
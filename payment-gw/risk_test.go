@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RiskSettings(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	code, _ := sendRequest(http.MethodPut, "/merchants/"+merchantId+"/risk", secretKey, []byte(`{"currencies":["USD"]}`))
+	assert.Equal(t, http.StatusForbidden, code, "merchants cannot change their limits")
+	code, _ = sendRequest(http.MethodPut, "/merchants/"+merchantId+"/risk", adminKey, []byte(`{"currencies":["USD"],"limits":{"EUR":{"max":"10.00"}}}`))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = sendRequest(http.MethodPut, "/merchants/"+merchantId+"/risk", adminKey, []byte(`{"limits":{"USD":{"max":"10"}}}`))
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = sendRequest(http.MethodPut, "/merchants/"+merchantId+"/risk", adminKey,
+		[]byte(`{"currencies":["USD","EUR"],"limits":{"USD":{"min":"1.00","max":"200.00","daily":"300.00","monthly":"1000.00"}}}`))
+	assert.Equal(t, http.StatusOK, code)
+
+	for _, tc := range []struct {
+		payload   authorizationPayload
+		code      int
+		errorCode string
+	}{
+		{authorizationPayload{Currency: "GBP"}, http.StatusBadRequest, "currency_not_allowed"},
+		{authorizationPayload{Amount: "0.99"}, http.StatusBadRequest, "amount_below_minimum"},
+		{authorizationPayload{Amount: "200.01"}, http.StatusBadRequest, "amount_above_maximum"},
+		{authorizationPayload{Amount: "200.00"}, http.StatusOK, ""},
+		{authorizationPayload{Amount: "10.05"}, http.StatusBadRequest, ""},
+		{authorizationPayload{Amount: "100.01"}, http.StatusBadRequest, "daily_volume_exceeded"},
+		{authorizationPayload{Amount: "100.00"}, http.StatusOK, ""},
+		{authorizationPayload{Amount: "5000.00", Currency: "EUR"}, http.StatusOK, ""},
+	} {
+		code, _, errorCode, _ := sendAuthorizationWithDeclineCode(tc.payload, merchantId, secretKey)
+		assert.Equal(t, tc.code, code, tc.payload)
+		assert.Equal(t, tc.errorCode, errorCode, tc.payload)
+	}
+
+	code, j := sendRequest(http.MethodGet, "/merchants/"+merchantId+"/risk", adminKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	max, _ := j.GetString("limits", "USD", "max")
+	assert.Equal(t, "200.00", max)
+	volumes, _ := j.Get("volumes")
+	assert.Equal(t, 4, volumes.Len(), "the day and month of EUR and USD")
+	usdDay, _ := j.GetString("volumes", 3, "amount")
+	assert.Equal(t, "300.00", usdDay, "the authorization declined by the acquirer is released")
+}
+
+func Test_RiskVolumeConcurrentAuthorizations(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	code, _ := sendRequest(http.MethodPut, "/merchants/"+merchantId+"/risk", adminKey, []byte(`{"limits":{"USD":{"daily":"500.00"}}}`))
+	assert.Equal(t, http.StatusOK, code)
+
+	var wg sync.WaitGroup
+	codes := make(chan string, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, _, errorCode, _ := sendAuthorizationWithDeclineCode(authorizationPayload{Amount: "100.00"}, merchantId, secretKey)
+			if code == http.StatusOK {
+				errorCode = "approved"
+			}
+			codes <- errorCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[string]int{}
+	for c := range codes {
+		counts[c]++
+	}
+	assert.Equal(t, map[string]int{"approved": 5, "daily_volume_exceeded": 15}, counts)
+}
+
+func Test_RiskVolumeReleasedOnVoid(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	code, _ := sendRequest(http.MethodPut, "/merchants/"+merchantId+"/risk", adminKey, []byte(`{"limits":{"USD":{"daily":"100.00"}}}`))
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{Amount: "100.00"}, merchantId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	code, _, errorCode, _ := sendAuthorizationWithDeclineCode(authorizationPayload{Amount: "100.00"}, merchantId, secretKey)
+	assert.Equal(t, "daily_volume_exceeded", errorCode)
+
+	code, _, _, _ = sendVoidRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	_, j := sendRequest(http.MethodGet, "/merchants/"+merchantId+"/risk", adminKey, nil)
+	usdDay, _ := j.GetString("volumes", 0, "amount")
+	assert.Equal(t, "0.00", usdDay, "the voided authorization is released")
+
+	code, _, _, _ = sendAuthorizationWithDeclineCode(authorizationPayload{Amount: "100.00"}, merchantId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,340 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"payment-gw/acquirer"
+	"payment-gw/breaker"
+	"payment-gw/metrics"
+	"payment-gw/tracing"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	StrategyOrdered  = "ordered"
+	StrategyCheapest = "cheapest"
+)
+
+var (
+	ErrUnknownAcquirer = errors.New("payment was routed to an unknown acquirer")
+	ErrCircuitOpen     = errors.New("acquirer circuit breaker is open")
+	ErrBudgetExhausted = errors.New("request deadline leaves no time to call the acquirer")
+)
+
+var (
+	failovers = metrics.NewCounterVec("routing_failovers_total",
+		"Number of authorizations retried on the next route, by the acquirer that failed and the reason.", "acquirer", "reason")
+	circuitState = metrics.NewGaugeVec("acquirer_circuit_breaker_state",
+		"State of the acquirer circuit breaker: 0 closed, 1 half-open, 2 open.", "acquirer")
+	circuitTransitions = metrics.NewCounterVec("acquirer_circuit_breaker_transitions_total",
+		"Number of acquirer circuit breaker state changes.", "acquirer", "from", "to")
+	circuitRejections = metrics.NewCounterVec("acquirer_circuit_breaker_rejections_total",
+		"Number of acquirer calls failed fast by an open circuit breaker.", "acquirer", "operation")
+)
+
+// Cost is what an acquirer charges for an authorization, used by the cheapest
+// strategy. Fixed is in minor units.
+type Cost struct {
+	Percent float64 `yaml:"percent"`
+	Fixed   int     `yaml:"fixed"`
+}
+
+func (c Cost) For(amount int) float64 {
+	return float64(c.Fixed) + float64(amount)*c.Percent/100
+}
+
+// Rule routes the authorizations it matches to its acquirers, tried in order.
+// Empty criteria match everything, amounts are in minor units and a zero
+// max_amount means no upper limit.
+type Rule struct {
+	Name       string   `yaml:"name"`
+	Currencies []string `yaml:"currencies"`
+	Brands     []string `yaml:"brands"`
+	Merchants  []string `yaml:"merchants"`
+	MinAmount  int      `yaml:"min_amount"`
+	MaxAmount  int      `yaml:"max_amount"`
+	Acquirers  []string `yaml:"acquirers"`
+	Strategy   string   `yaml:"strategy"`
+}
+
+func (r Rule) Matches(req acquirer.AuthorizeRequest) bool {
+	return matchesAny(r.Currencies, req.Currency) && matchesAny(r.Brands, CardBrand(req.Card.Number)) &&
+		matchesAny(r.Merchants, req.MerchantId) &&
+		req.Amount >= r.MinAmount && (r.MaxAmount == 0 || req.Amount <= r.MaxAmount)
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+type Route struct {
+	Name     string
+	Acquirer acquirer.Acquirer
+	Cost     Cost
+
+	breaker *breaker.Breaker
+}
+
+type Config struct {
+	// AttemptTimeout bounds a single attempt, so a hanging acquirer leaves
+	// time to try the next route.
+	AttemptTimeout time.Duration
+	// Reserve is the part of the request deadline kept for storing the
+	// outcome, attempts are not started with less than MinAttempt left.
+	Reserve    time.Duration
+	MinAttempt time.Duration
+	// CircuitBreaker settings apply to a breaker per route, none are used
+	// with a zero FailureThreshold.
+	CircuitBreaker breaker.Settings
+	// Default lists the routes used when no rule matches, all routes in
+	// their order when empty.
+	Default []string
+	Rules   []Rule
+}
+
+// Router implements acquirer.Acquirer on top of several acquirers. An
+// authorization is sent to the routes of the first matching rule and moves to
+// the next route on a soft decline, a timeout or an unavailable acquirer.
+// Later operations go to the acquirer recorded on the payment.
+type Router struct {
+	config Config
+	routes map[string]Route
+	order  []string
+}
+
+func NewRouter(c Config, routes ...Route) (*Router, error) {
+	r := &Router{config: c, routes: map[string]Route{}}
+	for _, route := range routes {
+		if _, ok := r.routes[route.Name]; ok {
+			return nil, fmt.Errorf("duplicate route %q", route.Name)
+		}
+		if c.CircuitBreaker.FailureThreshold > 0 {
+			route.breaker = breaker.New(route.Name, c.CircuitBreaker, reportStateChange)
+			circuitState.WithLabelValues(route.Name).Set(float64(breaker.StateClosed))
+		}
+		r.routes[route.Name] = route
+		r.order = append(r.order, route.Name)
+	}
+	if len(r.order) == 0 {
+		return nil, errors.New("at least one route is required")
+	}
+
+	names := append([]string(nil), c.Default...)
+	for _, rule := range c.Rules {
+		names = append(names, rule.Acquirers...)
+	}
+	for _, name := range names {
+		if _, ok := r.routes[name]; !ok {
+			return nil, fmt.Errorf("unknown route %q", name)
+		}
+	}
+	return r, nil
+}
+
+func (r *Router) Name() string {
+	return "router"
+}
+
+// Plan returns the names of the routes an authorization is tried on.
+func (r *Router) Plan(req acquirer.AuthorizeRequest) []string {
+	for _, rule := range r.config.Rules {
+		if !rule.Matches(req) {
+			continue
+		}
+		plan := append([]string(nil), rule.Acquirers...)
+		if rule.Strategy == StrategyCheapest {
+			sort.SliceStable(plan, func(i, j int) bool {
+				return r.routes[plan[i]].Cost.For(req.Amount) < r.routes[plan[j]].Cost.For(req.Amount)
+			})
+		}
+		return plan
+	}
+	if len(r.config.Default) > 0 {
+		return r.config.Default
+	}
+	return r.order
+}
+
+func reportStateChange(name string, from, to breaker.State) {
+	circuitState.WithLabelValues(name).Set(float64(to))
+	circuitTransitions.WithLabelValues(name, from.String(), to.String()).Inc()
+	log.Warn().Str("acquirer", name).Str("from", from.String()).Str("to", to.String()).Msg("acquirer circuit breaker state changed")
+}
+
+// State returns the circuit breaker state of every route with a breaker.
+func (r *Router) State() map[string]breaker.State {
+	states := map[string]breaker.State{}
+	for name, route := range r.routes {
+		if route.breaker != nil {
+			states[name] = route.breaker.State()
+		}
+	}
+	return states
+}
+
+// Authorize tries the planned routes one after another within the request
+// deadline. After a timeout the outcome on the previous acquirer is unknown,
+// such authorizations are left to expire there.
+func (r *Router) Authorize(ctx context.Context, req acquirer.AuthorizeRequest) (acquirer.Response, error) {
+	plan := r.Plan(req)
+
+	var res acquirer.Response
+	var err error
+	for i, name := range plan {
+		route := r.routes[name]
+		next, nextErr := r.call(ctx, route, acquirer.OperationAuthorize, func(ctx context.Context) (acquirer.Response, error) {
+			return route.Acquirer.Authorize(ctx, req)
+		})
+		if i > 0 && errors.Is(nextErr, ErrBudgetExhausted) {
+			return res, err
+		}
+		res, err = next, nextErr
+		res.Acquirer = name
+		reason := retryReason(err)
+		if reason == "" || i == len(plan)-1 || ctx.Err() != nil {
+			return res, err
+		}
+
+		failovers.WithLabelValues(name, reason).Inc()
+		if span := tracing.SpanFromContext(ctx); span != nil {
+			span.AddEvent("failover", tracing.String("acquirer.name", name), tracing.String("reason", reason))
+		}
+		if lg, ok := ctx.Value("logger").(*zerolog.Logger); ok {
+			lg.Warn().Err(err).Str("acquirer", name).Str("next_acquirer", plan[i+1]).Msg("authorization failed over")
+		}
+	}
+	return res, err
+}
+
+// call runs a single attempt against a route, bounded by the attempt timeout
+// and what is left of the request deadline, and guarded by the route's
+// circuit breaker.
+func (r *Router) call(ctx context.Context, route Route, op acquirer.Operation, fn func(context.Context) (acquirer.Response, error)) (acquirer.Response, error) {
+	timeout := r.config.AttemptTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline) - r.config.Reserve
+		if left < r.config.MinAttempt || left <= 0 {
+			return acquirer.Response{}, ErrBudgetExhausted
+		}
+		if timeout <= 0 || left < timeout {
+			timeout = left
+		}
+	}
+
+	var done func(breaker.Outcome)
+	if route.breaker != nil {
+		var err error
+		if done, err = route.breaker.Allow(); err != nil {
+			circuitRejections.WithLabelValues(route.Name, string(op)).Inc()
+			return acquirer.Response{}, fmt.Errorf("%w: %s", ErrCircuitOpen, route.Name)
+		}
+	}
+
+	attemptCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	res, err := fn(attemptCtx)
+	if done != nil {
+		done(outcome(ctx, err))
+	}
+	return res, err
+}
+
+// outcome counts every answer of the acquirer, declines included, as a
+// success. The request giving up is no sign of an unhealthy acquirer.
+func outcome(ctx context.Context, err error) breaker.Outcome {
+	switch {
+	case err == nil, errors.Is(err, acquirer.ErrDeclined):
+		return breaker.Success
+	case ctx.Err() != nil:
+		return breaker.Ignored
+	}
+	return breaker.Failure
+}
+
+func retryReason(err error) string {
+	var decline *acquirer.DeclineError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &decline):
+		if decline.Soft() {
+			return "soft_decline"
+		}
+		return ""
+	case errors.Is(err, acquirer.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, acquirer.ErrUnavailable):
+		return "unavailable"
+	case errors.Is(err, ErrCircuitOpen):
+		return "circuit_open"
+	}
+	return ""
+}
+
+// route returns the acquirer a payment was authorized with. Payments
+// authorized before routing existed have none and go to the first route.
+func (r *Router) route(req acquirer.Request) (Route, error) {
+	name := req.Acquirer
+	if name == "" {
+		name = r.order[0]
+	}
+	route, ok := r.routes[name]
+	if !ok {
+		return Route{}, fmt.Errorf("%w: %s", ErrUnknownAcquirer, name)
+	}
+	return route, nil
+}
+
+func (r *Router) Capture(ctx context.Context, req acquirer.Request) (acquirer.Response, error) {
+	route, err := r.route(req)
+	if err != nil {
+		return acquirer.Response{}, err
+	}
+	res, err := r.call(ctx, route, acquirer.OperationCapture, func(ctx context.Context) (acquirer.Response, error) {
+		return route.Acquirer.Capture(ctx, req)
+	})
+	res.Acquirer = req.Acquirer
+	return res, err
+}
+
+func (r *Router) Refund(ctx context.Context, req acquirer.Request) (acquirer.Response, error) {
+	route, err := r.route(req)
+	if err != nil {
+		return acquirer.Response{}, err
+	}
+	res, err := r.call(ctx, route, acquirer.OperationRefund, func(ctx context.Context) (acquirer.Response, error) {
+		return route.Acquirer.Refund(ctx, req)
+	})
+	res.Acquirer = req.Acquirer
+	return res, err
+}
+
+func (r *Router) Void(ctx context.Context, req acquirer.Request) (acquirer.Response, error) {
+	route, err := r.route(req)
+	if err != nil {
+		return acquirer.Response{}, err
+	}
+	res, err := r.call(ctx, route, acquirer.OperationVoid, func(ctx context.Context) (acquirer.Response, error) {
+		return route.Acquirer.Void(ctx, req)
+	})
+	res.Acquirer = req.Acquirer
+	return res, err
+}
@@ -0,0 +1,158 @@
+package routing
+
+import (
+	"context"
+	"errors"
+	"payment-gw/acquirer"
+	"payment-gw/breaker"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func simulator(t *testing.T, scenarios ...acquirer.Scenario) acquirer.Acquirer {
+	s, err := acquirer.NewSimulator(acquirer.SimulatorConfig{Scenarios: scenarios})
+	assert.NoError(t, err)
+	return s
+}
+
+func TestCardBrand(t *testing.T) {
+	for number, brand := range map[string]string{
+		"4000000000000119": BrandVisa,
+		"5555555555554444": BrandMastercard,
+		"2223003122003222": BrandMastercard,
+		"378282246310005":  BrandAmex,
+		"6011111111111117": BrandDiscover,
+		"3056930009020004": BrandUnknown,
+		"":                 BrandUnknown,
+	} {
+		assert.Equal(t, brand, CardBrand(number), number)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	r, err := NewRouter(Config{
+		Rules: []Rule{
+			{Name: "eur", Currencies: []string{"EUR"}, Brands: []string{"visa"}, Acquirers: []string{"b", "a"}},
+			{Name: "large", MinAmount: 100000, Acquirers: []string{"a", "b", "c"}, Strategy: StrategyCheapest},
+			{Name: "merchant", Merchants: []string{"m1"}, MaxAmount: 1000, Acquirers: []string{"c"}},
+		},
+	},
+		Route{Name: "a", Acquirer: simulator(t), Cost: Cost{Percent: 2}},
+		Route{Name: "b", Acquirer: simulator(t), Cost: Cost{Percent: 1, Fixed: 30}},
+		Route{Name: "c", Acquirer: simulator(t), Cost: Cost{Percent: 1.5}},
+	)
+	assert.NoError(t, err)
+
+	visa := acquirer.Card{Number: "4000000000000119"}
+	mastercard := acquirer.Card{Number: "5555555555554444"}
+	assert.Equal(t, []string{"b", "a"}, r.Plan(acquirer.AuthorizeRequest{Currency: "EUR", Amount: 100, Card: visa}))
+	assert.Equal(t, []string{"a", "b", "c"}, r.Plan(acquirer.AuthorizeRequest{Currency: "EUR", Amount: 100, Card: mastercard}))
+	assert.Equal(t, []string{"b", "c", "a"}, r.Plan(acquirer.AuthorizeRequest{Currency: "USD", Amount: 100000, Card: mastercard}))
+	assert.Equal(t, []string{"c"}, r.Plan(acquirer.AuthorizeRequest{Currency: "USD", Amount: 1000, MerchantId: "m1", Card: mastercard}))
+	assert.Equal(t, []string{"a", "b", "c"}, r.Plan(acquirer.AuthorizeRequest{Currency: "USD", Amount: 1001, MerchantId: "m1", Card: mastercard}))
+
+	_, err = NewRouter(Config{Default: []string{"missing"}}, Route{Name: "a", Acquirer: simulator(t)})
+	assert.Error(t, err)
+}
+
+func TestFailover(t *testing.T) {
+	r, err := NewRouter(Config{AttemptTimeout: 20 * time.Millisecond},
+		Route{Name: "primary", Acquirer: simulator(t,
+			acquirer.Scenario{Operation: acquirer.OperationAuthorize, AmountSuffix: "91", Code: acquirer.CodeIssuerUnavailable},
+			acquirer.Scenario{Operation: acquirer.OperationAuthorize, AmountSuffix: "51", Code: acquirer.CodeInsufficientFunds},
+			acquirer.Scenario{Operation: acquirer.OperationAuthorize, AmountSuffix: "08", Timeout: true},
+			acquirer.Scenario{Operation: acquirer.OperationAuthorize, AmountSuffix: "02", ErrorRate: 1},
+		)},
+		Route{Name: "secondary", Acquirer: simulator(t)},
+	)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	res, err := r.Authorize(ctx, acquirer.AuthorizeRequest{Amount: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", res.Acquirer)
+
+	for _, amount := range []int{191, 108, 102} {
+		res, err = r.Authorize(ctx, acquirer.AuthorizeRequest{Amount: amount})
+		assert.NoError(t, err, amount)
+		assert.Equal(t, "secondary", res.Acquirer, amount)
+	}
+
+	res, err = r.Authorize(ctx, acquirer.AuthorizeRequest{Amount: 151})
+	assert.True(t, errors.Is(err, acquirer.ErrDeclined), "hard declines are not retried")
+	assert.Equal(t, "primary", res.Acquirer)
+}
+
+func TestFollowUpOperationsUseRecordedAcquirer(t *testing.T) {
+	r, err := NewRouter(Config{},
+		Route{Name: "primary", Acquirer: simulator(t)},
+		Route{Name: "secondary", Acquirer: simulator(t,
+			acquirer.Scenario{Operation: acquirer.OperationCapture, Code: acquirer.CodeDoNotHonor})},
+	)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	_, err = r.Capture(ctx, acquirer.Request{Acquirer: "secondary", Amount: 100})
+	assert.True(t, errors.Is(err, acquirer.ErrDeclined))
+	res, err := r.Capture(ctx, acquirer.Request{Acquirer: "primary", Amount: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", res.Acquirer)
+	_, err = r.Capture(ctx, acquirer.Request{Amount: 100})
+	assert.NoError(t, err, "payments without an acquirer go to the first route")
+	_, err = r.Refund(ctx, acquirer.Request{Acquirer: "gone", Amount: 100})
+	assert.True(t, errors.Is(err, ErrUnknownAcquirer))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	r, err := NewRouter(Config{CircuitBreaker: breaker.Settings{FailureThreshold: 2, OpenTimeout: time.Hour}},
+		Route{Name: "primary", Acquirer: simulator(t,
+			acquirer.Scenario{Operation: acquirer.OperationAuthorize, AmountSuffix: "02", ErrorRate: 1},
+			acquirer.Scenario{Operation: acquirer.OperationAuthorize, AmountSuffix: "05", Code: acquirer.CodeDoNotHonor},
+		)},
+		Route{Name: "secondary", Acquirer: simulator(t)},
+	)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err = r.Authorize(ctx, acquirer.AuthorizeRequest{Amount: 105})
+		assert.True(t, errors.Is(err, acquirer.ErrDeclined))
+	}
+	assert.Equal(t, breaker.StateClosed, r.State()["primary"], "declines are answers of a healthy acquirer")
+
+	for i := 0; i < 2; i++ {
+		res, err := r.Authorize(ctx, acquirer.AuthorizeRequest{Amount: 102})
+		assert.NoError(t, err)
+		assert.Equal(t, "secondary", res.Acquirer)
+	}
+	assert.Equal(t, breaker.StateOpen, r.State()["primary"])
+
+	res, err := r.Authorize(ctx, acquirer.AuthorizeRequest{Amount: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, "secondary", res.Acquirer, "open routes are skipped")
+
+	_, err = r.Capture(ctx, acquirer.Request{Acquirer: "primary", Amount: 100})
+	assert.True(t, errors.Is(err, ErrCircuitOpen), "follow-up operations fail fast")
+}
+
+func TestDeadlineBudget(t *testing.T) {
+	r, err := NewRouter(Config{AttemptTimeout: time.Second, Reserve: 20 * time.Millisecond, MinAttempt: 20 * time.Millisecond},
+		Route{Name: "primary", Acquirer: simulator(t, acquirer.Scenario{Operation: acquirer.OperationAuthorize, Timeout: true})},
+		Route{Name: "secondary", Acquirer: simulator(t)},
+	)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = r.Authorize(ctx, acquirer.AuthorizeRequest{Amount: 100})
+	assert.Equal(t, acquirer.ErrTimeout, err, "the first attempt used up the budget")
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "the reserve is left for the caller")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = r.Authorize(ctx, acquirer.AuthorizeRequest{Amount: 100})
+	assert.Equal(t, ErrBudgetExhausted, err)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"payment-gw/acquirer"
+	"testing"
+	"time"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/stretchr/testify/assert"
+)
+
+func sendAuthorizationWithDeclineCode(p authorizationPayload, merchantId, secretKey string) (responseCode int, declineCode, errorCode, paymentId string) {
+	req, _ := http.NewRequest(http.MethodPost, "/merchant/"+merchantId+"/authorize", bytes.NewBuffer(createAuthorizationPayload(p)))
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(req)
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+
+	declineCode, _ = j.GetString("decline_code")
+	errorCode, _ = j.GetString("error_code")
+	paymentId, _ = j.GetString("payment_id")
+	responseCode = response.Code
+	return
+}
+
+func Test_AuthorizationScenarios(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	for _, tc := range []struct {
+		name        string
+		payload     authorizationPayload
+		code        int
+		declineCode string
+	}{
+		{"do not honor", authorizationPayload{Amount: "10.05"}, http.StatusBadRequest, acquirer.CodeDoNotHonor},
+		{"insufficient funds", authorizationPayload{Amount: "10.51"}, http.StatusBadRequest, acquirer.CodeInsufficientFunds},
+		{"stolen card", authorizationPayload{CardNumber: "4000000000009979"}, http.StatusBadRequest, acquirer.CodeStolenCard},
+		{"expired card", authorizationPayload{CardNumber: "4000000000000069"}, http.StatusBadRequest, acquirer.CodeExpiredCard},
+		{"CVV mismatch", authorizationPayload{CardNumber: "4000000000000127"}, http.StatusBadRequest, acquirer.CodeCVVMismatch},
+		{"acquirer unavailable", authorizationPayload{CardNumber: "4000000000000333"}, http.StatusBadGateway, ""},
+		{"slow acquirer", authorizationPayload{Amount: "10.77"}, http.StatusOK, ""},
+	} {
+		code, declineCode, _, _ := sendAuthorizationWithDeclineCode(tc.payload, merchantId, secretKey)
+		assert.Equal(t, tc.code, code, tc.name)
+		assert.Equal(t, tc.declineCode, declineCode, tc.name)
+	}
+}
+
+func Test_AuthorizationSoftDeclineThenApprove(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	p := authorizationPayload{CardNumber: "4000000000000341"}
+
+	code, declineCode, _, _ := sendAuthorizationWithDeclineCode(p, merchantId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, acquirer.CodeIssuerUnavailable, declineCode)
+
+	code, declineCode, _, paymentId := sendAuthorizationWithDeclineCode(p, merchantId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "", declineCode)
+	assert.NotEmpty(t, paymentId)
+}
+
+func Test_AuthorizationAcquirerTimeout(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	handlerTimeout := a.cfg.Server.HandlerTimeout
+	a.cfg.Server.HandlerTimeout = 500 * time.Millisecond
+	defer func() { a.cfg.Server.HandlerTimeout = handlerTimeout }()
+
+	code, _, errorCode, _ := sendAuthorizationWithDeclineCode(authorizationPayload{CardNumber: "4000000000000408"}, merchantId, secretKey)
+	assert.Equal(t, http.StatusGatewayTimeout, code)
+	assert.Equal(t, "acquirer_timeout", errorCode)
+}
+
+func Test_CaptureScenario(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{Amount: "20.00"}, merchantId, secretKey)
+
+	responseCode, _, availableToCapture, _ := sendCaptureRequest("10.51", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, responseCode)
+	assert.Equal(t, "20.00", availableToCapture)
+
+	responseCode, _, availableToCapture, _ = sendCaptureRequest("10.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, responseCode)
+	assert.Equal(t, "10.00", availableToCapture)
+}
+
+func Test_VoidScenario(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{CardNumber: "4000000000000424", Amount: "20.00"}, merchantId, secretKey)
+
+	responseCode, errorMessage, availableToCapture, _ := sendVoidRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, responseCode)
+	assert.NotEmpty(t, errorMessage)
+	assert.Equal(t, "20.00", availableToCapture)
+}
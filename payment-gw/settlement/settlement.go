@@ -0,0 +1,393 @@
+package settlement
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"payment-gw/ledger"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	BatchesCol = "settlement_batches"
+	PayoutsCol = "payouts"
+)
+
+const (
+	PayoutPending = "pending"
+	// PayoutProcessing is a payout being sent to the bank, one the job
+	// stopped sending is left processing for an operator to check
+	PayoutProcessing = "processing"
+	PayoutPaid       = "paid"
+	PayoutFailed     = "failed"
+)
+
+var (
+	ErrBatchNotFound  = errors.New("settlement batch not found")
+	ErrAlreadySettled = errors.New("entries were settled concurrently")
+)
+
+// Batch settles the captures, refunds, chargebacks, fees and transfers of a
+// merchant booked on one day in one currency. Amounts are in minor units, net
+// is what the merchant is paid. Transfers are received from a platform when
+// positive and sent to connected accounts when negative.
+type Batch struct {
+	Id          string    `bson:"id"`
+	MerchantId  string    `bson:"merchantid"`
+	Currency    string    `bson:"currency"`
+	Day         string    `bson:"day"`
+	Captured    int       `bson:"captured"`
+	Refunded    int       `bson:"refunded"`
+	Chargebacks int       `bson:"chargebacks"`
+	Fees        int       `bson:"fees"`
+	Transfers   int       `bson:"transfers"`
+	Net         int       `bson:"net"`
+	Entries     []string  `bson:"entries"`
+	PayoutId    string    `bson:"payoutid,omitempty"`
+	CreatedAt   time.Time `bson:"createdat"`
+}
+
+type Payout struct {
+	Id         string    `bson:"id"`
+	BatchId    string    `bson:"batchid"`
+	MerchantId string    `bson:"merchantid"`
+	Currency   string    `bson:"currency"`
+	Amount     int       `bson:"amount"`
+	Status     string    `bson:"status"`
+	Failure    string    `bson:"failure,omitempty"`
+	CreatedAt  time.Time `bson:"createdat"`
+	UpdatedAt  time.Time `bson:"updatedat"`
+}
+
+// Payer sends payouts to the bank accounts of merchants.
+type Payer interface {
+	Pay(ctx context.Context, p Payout) error
+}
+
+// SimulatedPayer pays every payout.
+type SimulatedPayer struct{}
+
+func (SimulatedPayer) Pay(ctx context.Context, p Payout) error {
+	return ctx.Err()
+}
+
+type Config struct {
+	// Interval is how often the job looks for days to settle
+	Interval time.Duration `yaml:"interval"`
+	// TimeZone in which settlement days start at midnight
+	TimeZone string `yaml:"time_zone"`
+}
+
+type Result struct {
+	Batches []Batch
+	Paid    int
+	Failed  int
+}
+
+// Job settles every day that has ended by the time of its clock, so it can
+// catch up after downtime and tests can move the clock over many days.
+// Entries are marked with their batch in the same transaction that creates
+// it, which keeps an operation from being settled twice.
+type Job struct {
+	db       *mongo.Database
+	payer    Payer
+	now      func() time.Time
+	location *time.Location
+	interval time.Duration
+}
+
+func NewJob(db *mongo.Database, c Config, payer Payer, now func() time.Time) (*Job, error) {
+	location, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	return &Job{db: db, payer: payer, now: now, location: location, interval: c.Interval}, nil
+}
+
+func (j *Job) Run(ctx context.Context) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		res, err := j.Settle(ctx)
+		if err != nil && ctx.Err() == nil {
+			lg.Warn().Err(err).Msg("settlement failed")
+		} else if len(res.Batches) > 0 || res.Paid > 0 || res.Failed > 0 {
+			lg.Info().Int("batches", len(res.Batches)).Int("paid", res.Paid).Int("failed", res.Failed).Msg("settlement done")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Settle creates the batches and payouts of the days that have ended and
+// sends the pending payouts.
+func (j *Job) Settle(ctx context.Context) (Result, error) {
+	now := j.now()
+	y, m, d := now.In(j.location).Date()
+	cutoff := time.Date(y, m, d, 0, 0, 0, 0, j.location)
+
+	cursor, err := j.db.Collection(ledger.JournalCol).Find(ctx, bson.M{
+		"kind":      bson.M{"$in": []string{ledger.KindCapture, ledger.KindRefund, ledger.KindChargeback, ledger.KindFee, ledger.KindTransfer}},
+		"batchid":   bson.M{"$exists": false},
+		"createdat": bson.M{"$lt": cutoff},
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	var entries []ledger.Entry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return Result{}, err
+	}
+
+	var res Result
+	for _, b := range Group(entries, j.location) {
+		b.Id = xid.New().String()
+		b.CreatedAt = now.UTC()
+		if err := j.settle(ctx, &b); errors.Is(err, ErrAlreadySettled) {
+			continue
+		} else if err != nil {
+			return res, err
+		}
+		res.Batches = append(res.Batches, b)
+	}
+
+	res.Paid, res.Failed, err = j.pay(ctx)
+	return res, err
+}
+
+// Group sums the entries per merchant, currency and day.
+func Group(entries []ledger.Entry, location *time.Location) []Batch {
+	type key struct{ merchantId, currency, day string }
+	batches := map[key]*Batch{}
+	var keys []key
+	for _, e := range entries {
+		k := key{e.MerchantId, e.Currency, e.CreatedAt.In(location).Format("2006-01-02")}
+		b, ok := batches[k]
+		if !ok {
+			b = &Batch{MerchantId: k.merchantId, Currency: k.currency, Day: k.day}
+			batches[k] = b
+			keys = append(keys, k)
+		}
+		amount := 0
+		for _, p := range e.Postings {
+			if p.Account == ledger.MerchantPending && p.MerchantId == e.MerchantId {
+				amount -= p.Amount
+			}
+		}
+		switch e.Kind {
+		case ledger.KindCapture:
+			b.Captured += amount
+		case ledger.KindRefund:
+			b.Refunded -= amount
+		case ledger.KindChargeback:
+			b.Chargebacks -= amount
+		case ledger.KindFee:
+			b.Fees -= amount
+		case ledger.KindTransfer:
+			b.Transfers += amount
+		}
+		b.Net += amount
+		b.Entries = append(b.Entries, e.Id)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].day != keys[j].day {
+			return keys[i].day < keys[j].day
+		}
+		if keys[i].merchantId != keys[j].merchantId {
+			return keys[i].merchantId < keys[j].merchantId
+		}
+		return keys[i].currency < keys[j].currency
+	})
+	res := make([]Batch, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, *batches[k])
+	}
+	return res
+}
+
+// settle books the batch: its entries are marked and the net amount moves
+// from pending to available. A payout is created for the available balance,
+// which also covers payouts that failed before and takes negative batches
+// into account.
+func (j *Job) settle(ctx context.Context, b *Batch) error {
+	return j.transaction(ctx, func(sc mongo.SessionContext) error {
+		res, err := j.db.Collection(ledger.JournalCol).UpdateMany(sc,
+			bson.M{"id": bson.M{"$in": b.Entries}, "batchid": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"batchid": b.Id}})
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount != int64(len(b.Entries)) {
+			return ErrAlreadySettled
+		}
+
+		pending := ledger.Posting{Account: ledger.MerchantPending, MerchantId: b.MerchantId}
+		available := ledger.Posting{Account: ledger.MerchantAvailable, MerchantId: b.MerchantId}
+		if b.Net != 0 {
+			entry := ledger.Transfer(ledger.KindSettlement, b.MerchantId, b.Currency, b.Net, pending, available)
+			entry.CreatedAt = b.CreatedAt
+			if err := ledger.Post(sc, j.db, "batch/"+b.Id, entry); err != nil {
+				return err
+			}
+		}
+
+		balance, err := ledger.NewRepository(j.db).Balance(sc, b.MerchantId, b.Currency)
+		if err != nil {
+			return err
+		}
+		b.PayoutId = ""
+		if balance.Available > 0 {
+			payout := Payout{Id: xid.New().String(), BatchId: b.Id, MerchantId: b.MerchantId, Currency: b.Currency,
+				Amount: balance.Available, Status: PayoutPending, CreatedAt: b.CreatedAt, UpdatedAt: b.CreatedAt}
+			if _, err := j.db.Collection(PayoutsCol).InsertOne(sc, payout); err != nil {
+				return err
+			}
+			entry := ledger.Transfer(ledger.KindPayout, b.MerchantId, b.Currency, payout.Amount,
+				available, ledger.Posting{Account: ledger.PayoutsInTransit})
+			entry.CreatedAt = b.CreatedAt
+			if err := ledger.Post(sc, j.db, "payout/"+payout.Id, entry); err != nil {
+				return err
+			}
+			b.PayoutId = payout.Id
+		}
+
+		_, err = j.db.Collection(BatchesCol).InsertOne(sc, b)
+		return err
+	})
+}
+
+// pay claims each pending payout before sending it, so a payout is sent once
+// even when jobs run concurrently or a previous run stopped half way.
+func (j *Job) pay(ctx context.Context) (paid, failed int, err error) {
+	cursor, err := j.db.Collection(PayoutsCol).Find(ctx, bson.M{"status": PayoutPending},
+		options.Find().SetSort(bson.M{"createdat": 1}))
+	if err != nil {
+		return 0, 0, err
+	}
+	var payouts []Payout
+	if err := cursor.All(ctx, &payouts); err != nil {
+		return 0, 0, err
+	}
+
+	for _, p := range payouts {
+		res, err := j.db.Collection(PayoutsCol).UpdateOne(ctx, bson.M{"id": p.Id, "status": PayoutPending},
+			bson.M{"$set": bson.M{"status": PayoutProcessing, "updatedat": j.now().UTC()}})
+		if err != nil {
+			return paid, failed, err
+		}
+		if res.ModifiedCount == 0 {
+			continue
+		}
+
+		status, failure := PayoutPaid, ""
+		entry := ledger.Transfer(ledger.KindPayoutPaid, p.MerchantId, p.Currency, p.Amount,
+			ledger.Posting{Account: ledger.PayoutsInTransit}, ledger.Posting{Account: ledger.Bank})
+		if err := j.payer.Pay(ctx, p); ctx.Err() != nil {
+			return paid, failed, ctx.Err()
+		} else if err != nil {
+			// the money is available again and paid out with the next batch
+			status, failure = PayoutFailed, err.Error()
+			entry = ledger.Transfer(ledger.KindPayoutFailed, p.MerchantId, p.Currency, p.Amount,
+				ledger.Posting{Account: ledger.PayoutsInTransit}, ledger.Posting{Account: ledger.MerchantAvailable, MerchantId: p.MerchantId})
+		}
+		now := j.now().UTC()
+		entry.CreatedAt = now
+
+		err = j.transaction(ctx, func(sc mongo.SessionContext) error {
+			_, err := j.db.Collection(PayoutsCol).UpdateOne(sc, bson.M{"id": p.Id, "status": PayoutProcessing},
+				bson.M{"$set": bson.M{"status": status, "failure": failure, "updatedat": now}})
+			if err != nil {
+				return err
+			}
+			return ledger.Post(sc, j.db, "payout/"+p.Id+"/"+status, entry)
+		})
+		if err != nil {
+			return paid, failed, err
+		}
+		if status == PayoutPaid {
+			paid++
+		} else {
+			failed++
+		}
+	}
+	return paid, failed, nil
+}
+
+func (j *Job) transaction(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	return j.db.Client().UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, fn(sc)
+		})
+		return err
+	})
+}
+
+type SettlementRepository interface {
+	ListBatches(ctx context.Context, merchantId string) ([]Batch, error)
+	GetBatch(ctx context.Context, merchantId, batchId string) (Batch, error)
+	ListPayouts(ctx context.Context, merchantId string) ([]Payout, error)
+}
+
+type MongoSettlementRepository struct {
+	db *mongo.Database
+}
+
+func NewRepository(db *mongo.Database) MongoSettlementRepository {
+	return MongoSettlementRepository{db: db}
+}
+
+func (s MongoSettlementRepository) ListBatches(ctx context.Context, merchantId string) ([]Batch, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	batches := []Batch{}
+	cursor, err := s.db.Collection(BatchesCol).Find(ctx, bson.M{"merchantid": merchantId},
+		options.Find().SetSort(bson.D{{Key: "day", Value: -1}, {Key: "createdat", Value: -1}}))
+	if err == nil {
+		err = cursor.All(ctx, &batches)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+	return batches, nil
+}
+
+func (s MongoSettlementRepository) GetBatch(ctx context.Context, merchantId, batchId string) (Batch, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	var batch Batch
+	err := s.db.Collection(BatchesCol).FindOne(ctx, bson.M{"merchantid": merchantId, "id": batchId}).Decode(&batch)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Batch{}, ErrBatchNotFound
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		return Batch{}, err
+	}
+	return batch, nil
+}
+
+func (s MongoSettlementRepository) ListPayouts(ctx context.Context, merchantId string) ([]Payout, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	payouts := []Payout{}
+	cursor, err := s.db.Collection(PayoutsCol).Find(ctx, bson.M{"merchantid": merchantId},
+		options.Find().SetSort(bson.M{"createdat": -1}))
+	if err == nil {
+		err = cursor.All(ctx, &payouts)
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return nil, err
+	}
+	return payouts, nil
+}
@@ -0,0 +1,67 @@
+package settlement
+
+import (
+	"testing"
+	"time"
+
+	"payment-gw/ledger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func at(entries []ledger.Entry, t time.Time) []ledger.Entry {
+	for i := range entries {
+		entries[i].Id = entries[i].PaymentId + "/" + entries[i].Kind
+		entries[i].CreatedAt = t
+	}
+	return entries
+}
+
+func TestGroup(t *testing.T) {
+	day := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	var entries []ledger.Entry
+	entries = append(entries, at(ledger.CaptureEntries("p1", "m1", "EUR", 1000, 30), day)...)
+	entries = append(entries, at(ledger.RefundEntries("p1", "m1", "EUR", 200, 0), day.Add(time.Hour))...)
+	entries = append(entries, at(ledger.CaptureEntries("p2", "m1", "USD", 500, 0), day)...)
+	entries = append(entries, at(ledger.ChargebackEntries("p2", "m1", "USD", 150), day)...)
+	entries = append(entries, at(ledger.CaptureEntries("p3", "m2", "EUR", 700, 0), day)...)
+	entries = append(entries, at(ledger.CaptureEntries("p4", "m1", "EUR", 100, 0), day.Add(24*time.Hour))...)
+
+	batches := Group(entries, time.UTC)
+	assert.Len(t, batches, 4)
+	assert.Equal(t, Batch{MerchantId: "m1", Currency: "EUR", Day: "2024-03-01", Captured: 1000, Refunded: 200, Fees: 30, Net: 770,
+		Entries: []string{"p1/capture", "p1/fee", "p1/refund"}}, batches[0])
+	assert.Equal(t, "USD", batches[1].Currency)
+	assert.Equal(t, 150, batches[1].Chargebacks)
+	assert.Equal(t, 350, batches[1].Net)
+	assert.Equal(t, "m2", batches[2].MerchantId)
+	assert.Equal(t, "2024-03-02", batches[3].Day)
+	assert.Equal(t, 100, batches[3].Net)
+}
+
+func TestGroupTimeZone(t *testing.T) {
+	late := time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC)
+	entries := at(ledger.CaptureEntries("p1", "m1", "EUR", 1000, 0), late)
+
+	warsaw, err := time.LoadLocation("Europe/Warsaw")
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-03-01", Group(entries, time.UTC)[0].Day)
+	assert.Equal(t, "2024-03-02", Group(entries, warsaw)[0].Day)
+}
+
+func TestGroupTransfers(t *testing.T) {
+	day := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	var entries []ledger.Entry
+	entries = append(entries, at(ledger.CaptureEntries("p1", "platform", "EUR", 1000, 0), day)...)
+	entries = append(entries, at(ledger.TransferEntries("p1", "platform", "seller", "EUR", 600), day)...)
+	entries = append(entries, at(ledger.TransferEntries("p2", "platform", "seller", "EUR", -100), day)...)
+
+	batches := Group(entries, time.UTC)
+	assert.Len(t, batches, 2)
+	assert.Equal(t, "platform", batches[0].MerchantId)
+	assert.Equal(t, -500, batches[0].Transfers)
+	assert.Equal(t, 500, batches[0].Net)
+	assert.Equal(t, "seller", batches[1].MerchantId)
+	assert.Equal(t, 500, batches[1].Transfers)
+	assert.Equal(t, 500, batches[1].Net)
+}
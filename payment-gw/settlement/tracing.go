@@ -0,0 +1,39 @@
+package settlement
+
+import (
+	"context"
+	"payment-gw/tracing"
+)
+
+type tracedRepository struct {
+	next SettlementRepository
+}
+
+func NewTracedRepository(next SettlementRepository) SettlementRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) ListBatches(ctx context.Context, merchantId string) ([]Batch, error) {
+	ctx, span := tracing.Start(ctx, "settlement.ListBatches", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	batches, err := t.next.ListBatches(ctx, merchantId)
+	span.RecordError(err)
+	return batches, err
+}
+
+func (t tracedRepository) GetBatch(ctx context.Context, merchantId, batchId string) (Batch, error) {
+	ctx, span := tracing.Start(ctx, "settlement.GetBatch", tracing.WithAttributes(
+		tracing.String("merchant.id", merchantId), tracing.String("settlement.batch_id", batchId)))
+	defer span.End()
+	batch, err := t.next.GetBatch(ctx, merchantId, batchId)
+	span.RecordError(err)
+	return batch, err
+}
+
+func (t tracedRepository) ListPayouts(ctx context.Context, merchantId string) ([]Payout, error) {
+	ctx, span := tracing.Start(ctx, "settlement.ListPayouts", tracing.WithAttributes(tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	payouts, err := t.next.ListPayouts(ctx, merchantId)
+	span.RecordError(err)
+	return payouts, err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"payment-gw/settlement"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+type batchResponse struct {
+	BatchId     string    `json:"batch_id"`
+	Currency    string    `json:"currency"`
+	Day         string    `json:"day"`
+	Captured    string    `json:"captured"`
+	Refunded    string    `json:"refunded"`
+	Chargebacks string    `json:"chargebacks"`
+	Fees        string    `json:"fees"`
+	Transfers   string    `json:"transfers"`
+	Net         string    `json:"net"`
+	PayoutId    string    `json:"payout_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type payoutResponse struct {
+	PayoutId  string    `json:"payout_id"`
+	BatchId   string    `json:"batch_id"`
+	Currency  string    `json:"currency"`
+	Amount    string    `json:"amount"`
+	Status    string    `json:"status"`
+	Failure   string    `json:"failure,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func createBatchResponse(b settlement.Batch) batchResponse {
+	return batchResponse{b.Id, b.Currency, b.Day, formatMinorUnits(b.Captured), formatMinorUnits(b.Refunded),
+		formatMinorUnits(b.Chargebacks), formatMinorUnits(b.Fees), formatMinorUnits(b.Transfers), formatMinorUnits(b.Net), b.PayoutId, b.CreatedAt}
+}
+
+func (a *App) listSettlements(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	batches, err := a.settlement.ListBatches(ctx, mux.Vars(r)["merchant_id"])
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	res := make([]batchResponse, 0, len(batches))
+	for _, b := range batches {
+		res = append(res, createBatchResponse(b))
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+func (a *App) getSettlement(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	batch, err := a.settlement.GetBatch(ctx, mux.Vars(r)["merchant_id"], mux.Vars(r)["batch_id"])
+	if errors.Is(err, settlement.ErrBatchNotFound) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, createBatchResponse(batch))
+}
+
+func (a *App) listPayouts(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	payouts, err := a.settlement.ListPayouts(ctx, mux.Vars(r)["merchant_id"])
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	res := make([]payoutResponse, 0, len(payouts))
+	for _, p := range payouts {
+		res = append(res, payoutResponse{p.Id, p.BatchId, p.Currency, formatMinorUnits(p.Amount), p.Status, p.Failure, p.CreatedAt, p.UpdatedAt})
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
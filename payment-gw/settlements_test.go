@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"payment-gw/ledger"
+	"payment-gw/settlement"
+	"sync"
+	"testing"
+	"time"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type failingPayer struct{}
+
+func (failingPayer) Pay(ctx context.Context, p settlement.Payout) error {
+	return errors.New("account closed")
+}
+
+// countingPayer pays every payout, slowly, and counts them.
+type countingPayer struct {
+	mu   sync.Mutex
+	paid map[string]int
+}
+
+func (c *countingPayer) Pay(ctx context.Context, p settlement.Payout) error {
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paid[p.Id]++
+	return nil
+}
+
+func postEntries(t *testing.T, createdAt time.Time, entries ...ledger.Entry) {
+	for i := range entries {
+		entries[i].CreatedAt = createdAt
+	}
+	ctx := context.WithValue(context.Background(), "logger", a.lg)
+	assert.NoError(t, ledger.Post(ctx, a.db.Database(a.dbname), entries[0].PaymentId+"/"+createdAt.String(), entries...))
+}
+
+func sendSettlementRequest(merchantId, secretKey, path string) (int, *jsonvalue.V) {
+	req, _ := http.NewRequest(http.MethodGet, "/merchant/"+merchantId+path, nil)
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(req)
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	return response.Code, j
+}
+
+func Test_SettlementOverManyDays(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	ctx := context.WithValue(context.Background(), "logger", a.lg)
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	postEntries(t, day.Add(10*time.Hour), ledger.CaptureEntries("p1", merchantId, "EUR", 1000, 30)...)
+	postEntries(t, day.Add(11*time.Hour), ledger.RefundEntries("p1", merchantId, "EUR", 200, 0)...)
+	postEntries(t, day.Add(34*time.Hour), ledger.CaptureEntries("p2", merchantId, "EUR", 500, 0)...)
+	postEntries(t, day.Add(58*time.Hour), ledger.CaptureEntries("p3", merchantId, "EUR", 100, 0)...)
+
+	now := day.Add(12 * time.Hour)
+	clock := func() time.Time { return now }
+	job, err := settlement.NewJob(a.db.Database(a.dbname), settlement.Config{TimeZone: "UTC"}, settlement.SimulatedPayer{}, clock)
+	assert.NoError(t, err)
+	failing, err := settlement.NewJob(a.db.Database(a.dbname), settlement.Config{TimeZone: "UTC"}, failingPayer{}, clock)
+	assert.NoError(t, err)
+
+	res, err := job.Settle(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, res.Batches, "the day has not ended")
+
+	now = day.Add(25 * time.Hour)
+	res, err = job.Settle(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, res.Batches, 1)
+	assert.Equal(t, 770, res.Batches[0].Net)
+	assert.Equal(t, 30, res.Batches[0].Fees)
+	assert.Equal(t, 1, res.Paid)
+
+	res, err = job.Settle(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, res.Batches, "entries are settled once")
+	assert.Equal(t, 0, res.Paid)
+
+	now = day.Add(49 * time.Hour)
+	res, err = failing.Settle(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, res.Batches, 1)
+	assert.Equal(t, 1, res.Failed)
+
+	now = day.Add(73 * time.Hour)
+	res, err = job.Settle(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, res.Batches, 1)
+	assert.Equal(t, 100, res.Batches[0].Net)
+	assert.Equal(t, 1, res.Paid)
+
+	balance, err := a.ledger.Balance(ctx, merchantId, "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, balance.Pending)
+	assert.Equal(t, 0, balance.Available)
+	report, err := a.ledger.Check(ctx)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+
+	code, j := sendSettlementRequest(merchantId, secretKey, "/payouts")
+	assert.Equal(t, http.StatusOK, code)
+	var statuses, amounts []string
+	for i := 0; i < j.Len(); i++ {
+		status, _ := j.GetString(i, "status")
+		amount, _ := j.GetString(i, "amount")
+		statuses, amounts = append(statuses, status), append(amounts, amount)
+	}
+	assert.Equal(t, []string{"paid", "failed", "paid"}, statuses)
+	assert.Equal(t, []string{"6.00", "5.00", "7.70"}, amounts, "the failed payout is paid with the next batch")
+
+	code, j = sendSettlementRequest(merchantId, secretKey, "/settlements")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, j.Len())
+	batchId, _ := j.GetString(0, "batch_id")
+	dayOfBatch, _ := j.GetString(0, "day")
+	assert.Equal(t, "2024-03-03", dayOfBatch)
+
+	code, j = sendSettlementRequest(merchantId, secretKey, "/settlements/"+batchId)
+	assert.Equal(t, http.StatusOK, code)
+	net, _ := j.GetString("net")
+	assert.Equal(t, "1.00", net)
+
+	code, _ = sendSettlementRequest(merchantId, secretKey, "/settlements/"+xid.New().String())
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func Test_PayoutsPaidOnce(t *testing.T) {
+	clearTable()
+	merchantId, _ := register(t)
+	ctx := context.WithValue(context.Background(), "logger", a.lg)
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	postEntries(t, day.Add(10*time.Hour), ledger.CaptureEntries("p1", merchantId, "EUR", 1000, 0)...)
+
+	now := day.Add(25 * time.Hour)
+	clock := func() time.Time { return now }
+	payer := &countingPayer{paid: map[string]int{}}
+	job, err := settlement.NewJob(a.db.Database(a.dbname), settlement.Config{TimeZone: "UTC"}, payer, clock)
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := job.Settle(ctx)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, payer.paid, 1)
+	for _, n := range payer.paid {
+		assert.Equal(t, 1, n, "a payout is sent once")
+	}
+
+	var entries []ledger.Entry
+	cursor, err := a.db.Database(a.dbname).Collection(ledger.JournalCol).Find(ctx,
+		bson.M{"kind": bson.M{"$in": []string{ledger.KindSettlement, ledger.KindPayout, ledger.KindPayoutPaid}}})
+	assert.NoError(t, err)
+	assert.NoError(t, cursor.All(ctx, &entries))
+	assert.Len(t, entries, 3)
+	for _, e := range entries {
+		assert.True(t, now.Equal(e.CreatedAt), "%s is booked at the time of the job", e.Kind)
+	}
+}
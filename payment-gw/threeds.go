@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"payment-gw/gateway"
+	"payment-gw/risk"
+	"payment-gw/threeds"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+)
+
+type authenticationResponse struct {
+	Status         string `json:"status"`
+	Flow           string `json:"flow"`
+	ECI            string `json:"eci,omitempty"`
+	LiabilityShift bool   `json:"liability_shift"`
+}
+
+type nextActionResponse struct {
+	Type      string    `json:"type"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func createAuthenticationResponse(r threeds.Result) *authenticationResponse {
+	return &authenticationResponse{r.Status, r.Flow, r.ECI, r.LiabilityShift}
+}
+
+func respondWithAuthenticationFailed(w http.ResponseWriter) {
+	respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": gateway.ErrAuthenticationFailed.Error(), "error_code": "authentication_failed"})
+}
+
+// challengeURL is the page of the simulated ACS where the shopper completes
+// a challenge.
+func (a *App) challengeURL(r *http.Request, challengeId string) string {
+	return publicURL(r, a.cfg.ThreeDS.BaseURL, "/3ds/challenge/"+challengeId)
+}
+
+var challengeTemplate = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>3-D Secure</title></head>
+<body>
+<h1>Simulated 3-D Secure</h1>
+<p>{{.Brand}} card ending in {{.Last4}}, {{.Amount}} {{.Currency}}</p>
+{{if eq .Status "pending"}}
+<form method="post">
+<button type="submit" name="outcome" value="authenticate">Authenticate</button>
+<button type="submit" name="outcome" value="fail">Fail authentication</button>
+</form>
+{{else}}
+<p>Authentication {{.Status}}. You can return to the merchant.</p>
+{{end}}
+</body>
+</html>
+`))
+
+func (a *App) renderChallenge(w http.ResponseWriter, code int, c threeds.Challenge) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	challengeTemplate.Execute(w, struct {
+		Brand, Last4, Amount, Currency, Status string
+	}{c.Brand, c.Last4, formatMinorUnits(c.Amount), c.Currency, c.Outcome(time.Now()).Status})
+}
+
+// challengePage serves the challenge of the simulated ACS to the shopper.
+func (a *App) challengePage(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	c, err := a.threeds.Get(ctx, mux.Vars(r)["challenge_id"])
+	if errors.Is(err, threeds.ErrChallengeNotFound) {
+		lg.Debug().Msg(err.Error())
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	a.renderChallenge(w, http.StatusOK, c)
+}
+
+// completeChallenge records whether the shopper passed the challenge, the
+// merchant confirms the payment afterwards.
+func (a *App) completeChallenge(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+
+	outcome := r.FormValue("outcome")
+	if outcome != "authenticate" && outcome != "fail" {
+		lg.Debug().Str("outcome", outcome).Msg("invalid challenge outcome")
+		http.Error(w, "outcome must be authenticate or fail", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	c, err := a.threeds.Complete(ctx, mux.Vars(r)["challenge_id"], outcome == "authenticate")
+	if errors.Is(err, threeds.ErrChallengeNotFound) {
+		lg.Debug().Msg(err.Error())
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, threeds.ErrChallengeCompleted) || errors.Is(err, threeds.ErrChallengeExpired) {
+		lg.Debug().Msg(err.Error())
+		a.renderChallenge(w, http.StatusConflict, c)
+		return
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	a.renderChallenge(w, http.StatusOK, c)
+}
+
+// confirm finishes the authorization of a payment once the shopper completed
+// the challenge, or failed to before it expired.
+func (a *App) confirm(w http.ResponseWriter, r *http.Request) {
+	lg := r.Context().Value("logger").(*zerolog.Logger)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
+	defer cancel()
+
+	paymentId := mux.Vars(r)["payment_id"]
+	c, err := a.threeds.GetByPayment(ctx, paymentId)
+	if errors.Is(err, threeds.ErrChallengeNotFound) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusConflict, gateway.ErrNoActionRequired.Error())
+		return
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	result := c.Outcome(time.Now())
+	if result.Status == threeds.StatusPending {
+		lg.Debug().Msg(gateway.ErrPaymentRequiresAction.Error())
+		respondWithJSON(w, http.StatusConflict, map[string]interface{}{"error": gateway.ErrPaymentRequiresAction.Error(),
+			"next_action": nextActionResponse{"redirect_to_url", a.challengeURL(r, c.Id), c.ExpiresAt}})
+		return
+	}
+
+	holdUntil := time.Now().Add(a.cfg.Reviews.HoldTime).UTC()
+	p, err := a.gateway.Confirm(ctx, paymentId, result, holdUntil)
+	if errors.Is(err, gateway.ErrNoActionRequired) || errors.Is(err, gateway.ErrOptimisticLocking) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if p.Voided {
+		a.releaseLinkUse(ctx, p)
+	}
+	if errors.Is(err, gateway.ErrAuthenticationFailed) {
+		recordOperation("confirm", p.Currency, c.Amount, outcomeRejected)
+		lg.Debug().Msg(err.Error())
+		respondWithAuthenticationFailed(w)
+		return
+	}
+	if errors.Is(err, gateway.ErrBasedOnCreditCardNumber) {
+		recordOperation("confirm", p.Currency, c.Amount, operationOutcome(err))
+		lg.Debug().Str("decline_code", declineCode(err)).Msg(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error(), "decline_code": declineCode(err)})
+		return
+	}
+	if risk.Code(err) != "" {
+		recordOperation("confirm", p.Currency, c.Amount, operationOutcome(err))
+		lg.Debug().Str("error_code", risk.Code(err)).Msg(err.Error())
+		respondWithLimitError(w, err)
+		return
+	}
+	if err != nil {
+		recordOperation("confirm", p.Currency, c.Amount, outcomeError)
+		lg.Error().Msg(err.Error())
+		respondWithFailure(w, err)
+		return
+	}
+	recordOperation("confirm", p.Currency, c.Amount, outcomeSuccess)
+
+	res := authorizeResponse{Id: p.Id, Status: statusAuthorized, AvailableToCapture: formatMinorUnits(p.Authorized - p.Captured),
+		AvailableToRefund: "0.00", Currency: p.Currency, Screening: screeningResponse{p.Screening.Decision, append([]string{}, p.Screening.Rules...)},
+		Authentication: createAuthenticationResponse(p.Authentication.Result), detailsResponse: createDetailsResponse(p.Details)}
+	if p.Held() {
+		res.Status, res.ExpiresAt = statusHeld, &p.Review.ExpiresAt
+	}
+	respondWithJSON(w, http.StatusOK, res)
+}
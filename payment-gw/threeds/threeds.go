@@ -0,0 +1,215 @@
+package threeds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"payment-gw/routing"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/rs/zerolog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const ChallengesCol = "threeds_challenges"
+
+// Statuses of an authentication.
+const (
+	StatusPending       = "pending"
+	StatusAuthenticated = "authenticated"
+	StatusFailed        = "failed"
+)
+
+// Flows of an authentication.
+const (
+	FlowFrictionless = "frictionless"
+	FlowChallenge    = "challenge"
+)
+
+// Test cards of the simulated directory server, the other cards are
+// authenticated without a challenge.
+const (
+	ChallengeCard = "4000000000003220"
+	FailedCard    = "4000008400001629"
+)
+
+var (
+	ErrChallengeNotFound  = errors.New("challenge not found")
+	ErrChallengeCompleted = errors.New("challenge was already completed")
+	ErrChallengeExpired   = errors.New("challenge expired")
+)
+
+// Result is the outcome of the authentication of the shopper. The ECI
+// (electronic commerce indicator) tells the acquirer how the payment was
+// authenticated, the liability for fraud shifts to the issuer on
+// authenticated payments.
+type Result struct {
+	Status         string `bson:"status"`
+	Flow           string `bson:"flow"`
+	ECI            string `bson:"eci,omitempty"`
+	LiabilityShift bool   `bson:"liabilityshift"`
+}
+
+func eci(brand string, authenticated bool) string {
+	switch {
+	case brand == routing.BrandMastercard && authenticated:
+		return "02"
+	case brand == routing.BrandMastercard:
+		return "00"
+	case authenticated:
+		return "05"
+	}
+	return "07"
+}
+
+func result(brand, flow string, authenticated bool) Result {
+	r := Result{Status: StatusFailed, Flow: flow, ECI: eci(brand, authenticated)}
+	if authenticated {
+		r.Status, r.LiabilityShift = StatusAuthenticated, true
+	}
+	return r
+}
+
+// Authenticate starts the authentication of a card, it is pending when the
+// shopper has to complete a challenge.
+func Authenticate(cardNumber string) Result {
+	switch cardNumber {
+	case ChallengeCard:
+		return Result{Status: StatusPending, Flow: FlowChallenge}
+	case FailedCard:
+		return result(routing.CardBrand(cardNumber), FlowFrictionless, false)
+	}
+	return result(routing.CardBrand(cardNumber), FlowFrictionless, true)
+}
+
+type Config struct {
+	// BaseURL is where shoppers reach the simulated ACS, the address of the
+	// request when empty
+	BaseURL string `yaml:"base_url"`
+	// ChallengeTimeout is the time shoppers have to complete a challenge
+	ChallengeTimeout time.Duration `yaml:"challenge_timeout"`
+}
+
+func (c Config) Validate() error {
+	var errs []string
+	if c.BaseURL != "" && !strings.HasPrefix(c.BaseURL, "http://") && !strings.HasPrefix(c.BaseURL, "https://") {
+		errs = append(errs, fmt.Sprintf("base_url %q must be an http or https URL", c.BaseURL))
+	}
+	if c.ChallengeTimeout <= 0 {
+		errs = append(errs, "challenge_timeout must be positive")
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Challenge is the step of the simulated ACS where the shopper authenticates
+// a payment.
+type Challenge struct {
+	Id          string    `bson:"id"`
+	PaymentId   string    `bson:"paymentid"`
+	MerchantId  string    `bson:"merchantid"`
+	Last4       string    `bson:"last4"`
+	Brand       string    `bson:"brand"`
+	Amount      int       `bson:"amount"`
+	Currency    string    `bson:"currency"`
+	Result      Result    `bson:"result"`
+	CreatedAt   time.Time `bson:"createdat"`
+	ExpiresAt   time.Time `bson:"expiresat"`
+	CompletedAt time.Time `bson:"completedat"`
+}
+
+// Outcome is the result of the challenge at a time, challenges not completed
+// before they expire failed.
+func (c Challenge) Outcome(at time.Time) Result {
+	if c.Result.Status == StatusPending && !at.Before(c.ExpiresAt) {
+		return result(c.Brand, FlowChallenge, false)
+	}
+	return c.Result
+}
+
+type ChallengeRepository interface {
+	Create(ctx context.Context, paymentId, merchantId, cardNumber string, amount int, currency string) (Challenge, error)
+	Get(ctx context.Context, challengeId string) (Challenge, error)
+	GetByPayment(ctx context.Context, paymentId string) (Challenge, error)
+	// Complete records whether the shopper passed the challenge
+	Complete(ctx context.Context, challengeId string, passed bool) (Challenge, error)
+}
+
+type MongoChallengeRepository struct {
+	db     *mongo.Database
+	config Config
+}
+
+func NewRepository(db *mongo.Database, c Config) MongoChallengeRepository {
+	return MongoChallengeRepository{db: db, config: c}
+}
+
+func (m MongoChallengeRepository) Create(ctx context.Context, paymentId, merchantId, cardNumber string, amount int, currency string) (Challenge, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	now := time.Now().UTC()
+	c := Challenge{Id: xid.New().String(), PaymentId: paymentId, MerchantId: merchantId, Brand: routing.CardBrand(cardNumber),
+		Amount: amount, Currency: currency, Result: Result{Status: StatusPending, Flow: FlowChallenge},
+		CreatedAt: now, ExpiresAt: now.Add(m.config.ChallengeTimeout)}
+	if len(cardNumber) >= 4 {
+		c.Last4 = cardNumber[len(cardNumber)-4:]
+	}
+	if _, err := m.db.Collection(ChallengesCol).InsertOne(ctx, c); err != nil {
+		lg.Error().Msg(err.Error())
+		return Challenge{}, err
+	}
+	return c, nil
+}
+
+func (m MongoChallengeRepository) find(ctx context.Context, filter bson.M) (Challenge, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	var c Challenge
+	err := m.db.Collection(ChallengesCol).FindOne(ctx, filter).Decode(&c)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Challenge{}, ErrChallengeNotFound
+	}
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Challenge{}, err
+	}
+	return c, nil
+}
+
+func (m MongoChallengeRepository) Get(ctx context.Context, challengeId string) (Challenge, error) {
+	return m.find(ctx, bson.M{"id": challengeId})
+}
+
+func (m MongoChallengeRepository) GetByPayment(ctx context.Context, paymentId string) (Challenge, error) {
+	return m.find(ctx, bson.M{"paymentid": paymentId})
+}
+
+func (m MongoChallengeRepository) Complete(ctx context.Context, challengeId string, passed bool) (Challenge, error) {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	c, err := m.Get(ctx, challengeId)
+	if err != nil {
+		return Challenge{}, err
+	}
+	now := time.Now().UTC()
+	if c.Result.Status != StatusPending {
+		return c, ErrChallengeCompleted
+	}
+	if !now.Before(c.ExpiresAt) {
+		return c, ErrChallengeExpired
+	}
+
+	c.Result, c.CompletedAt = result(c.Brand, FlowChallenge, passed), now
+	res, err := m.db.Collection(ChallengesCol).UpdateOne(ctx, bson.M{"id": c.Id, "result.status": StatusPending},
+		bson.M{"$set": bson.M{"result": c.Result, "completedat": c.CompletedAt}})
+	if err != nil {
+		lg.Error().Msg(err.Error())
+		return Challenge{}, err
+	}
+	if res.ModifiedCount == 0 {
+		return c, ErrChallengeCompleted
+	}
+	return c, nil
+}
@@ -0,0 +1,33 @@
+package threeds
+
+import (
+	"payment-gw/routing"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticate(t *testing.T) {
+	assert.Equal(t, Result{Status: StatusAuthenticated, Flow: FlowFrictionless, ECI: "05", LiabilityShift: true}, Authenticate("4111111111111111"))
+	assert.Equal(t, Result{Status: StatusAuthenticated, Flow: FlowFrictionless, ECI: "02", LiabilityShift: true}, Authenticate("5555555555554444"))
+	assert.Equal(t, Result{Status: StatusPending, Flow: FlowChallenge}, Authenticate(ChallengeCard))
+	assert.Equal(t, Result{Status: StatusFailed, Flow: FlowFrictionless, ECI: "07"}, Authenticate(FailedCard))
+}
+
+func TestOutcome(t *testing.T) {
+	now := time.Now()
+	c := Challenge{Brand: routing.BrandVisa, Result: Result{Status: StatusPending, Flow: FlowChallenge}, ExpiresAt: now.Add(time.Minute)}
+	assert.Equal(t, StatusPending, c.Outcome(now).Status)
+	assert.Equal(t, Result{Status: StatusFailed, Flow: FlowChallenge, ECI: "07"}, c.Outcome(now.Add(time.Minute)))
+
+	c.Result = Result{Status: StatusAuthenticated, Flow: FlowChallenge, ECI: "05", LiabilityShift: true}
+	assert.Equal(t, c.Result, c.Outcome(now.Add(time.Hour)))
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{ChallengeTimeout: time.Minute}.Validate())
+	assert.NoError(t, Config{BaseURL: "https://pay.example.com", ChallengeTimeout: time.Minute}.Validate())
+	assert.EqualError(t, Config{BaseURL: "pay.example.com"}.Validate(),
+		`base_url "pay.example.com" must be an http or https URL; challenge_timeout must be positive`)
+}
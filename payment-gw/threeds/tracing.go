@@ -0,0 +1,49 @@
+package threeds
+
+import (
+	"context"
+	"payment-gw/tracing"
+)
+
+type tracedRepository struct {
+	next ChallengeRepository
+}
+
+func NewTracedRepository(next ChallengeRepository) ChallengeRepository {
+	return tracedRepository{next: next}
+}
+
+func (t tracedRepository) Create(ctx context.Context, paymentId, merchantId, cardNumber string, amount int, currency string) (Challenge, error) {
+	ctx, span := tracing.Start(ctx, "threeds.Create", tracing.WithAttributes(
+		tracing.String("payment.id", paymentId), tracing.String("merchant.id", merchantId)))
+	defer span.End()
+	c, err := t.next.Create(ctx, paymentId, merchantId, cardNumber, amount, currency)
+	span.SetAttributes(tracing.String("threeds.challenge_id", c.Id))
+	span.RecordError(err)
+	return c, err
+}
+
+func (t tracedRepository) Get(ctx context.Context, challengeId string) (Challenge, error) {
+	ctx, span := tracing.Start(ctx, "threeds.Get", tracing.WithAttributes(tracing.String("threeds.challenge_id", challengeId)))
+	defer span.End()
+	c, err := t.next.Get(ctx, challengeId)
+	span.RecordError(err)
+	return c, err
+}
+
+func (t tracedRepository) GetByPayment(ctx context.Context, paymentId string) (Challenge, error) {
+	ctx, span := tracing.Start(ctx, "threeds.GetByPayment", tracing.WithAttributes(tracing.String("payment.id", paymentId)))
+	defer span.End()
+	c, err := t.next.GetByPayment(ctx, paymentId)
+	span.RecordError(err)
+	return c, err
+}
+
+func (t tracedRepository) Complete(ctx context.Context, challengeId string, passed bool) (Challenge, error) {
+	ctx, span := tracing.Start(ctx, "threeds.Complete", tracing.WithAttributes(tracing.String("threeds.challenge_id", challengeId)))
+	defer span.End()
+	c, err := t.next.Complete(ctx, challengeId, passed)
+	span.SetAttributes(tracing.String("threeds.status", c.Result.Status))
+	span.RecordError(err)
+	return c, err
+}
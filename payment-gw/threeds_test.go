@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"payment-gw/gateway"
+	"payment-gw/threeds"
+	"strings"
+	"testing"
+	"time"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func sendThreeDSAuthorization(p authorizationPayload, merchantId, secretKey string) (int, *jsonvalue.V) {
+	body := map[string]interface{}{}
+	json.Unmarshal(createAuthorizationPayload(p), &body)
+	body["three_ds"] = true
+	payload, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, "/merchant/"+merchantId+"/authorize", bytes.NewBuffer(payload))
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(req)
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	return response.Code, j
+}
+
+func sendChallengeOutcome(challengeURL, outcome string) int {
+	u, _ := url.Parse(challengeURL)
+	req, _ := http.NewRequest(http.MethodPost, u.Path, strings.NewReader(url.Values{"outcome": {outcome}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return executeRequest(req).Code
+}
+
+func sendConfirmRequest(merchantId, paymentId, secretKey string) (int, *jsonvalue.V) {
+	req, _ := http.NewRequest(http.MethodPost, "/merchant/"+merchantId+"/confirm/"+paymentId, nil)
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(req)
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	return response.Code, j
+}
+
+func challengedPayment(t *testing.T, merchantId, secretKey string) (string, string) {
+	code, j := sendThreeDSAuthorization(authorizationPayload{CardNumber: threeds.ChallengeCard}, merchantId, secretKey)
+	assert.Equal(t, http.StatusAccepted, code)
+	status, _ := j.GetString("status")
+	assert.Equal(t, "requires_action", status)
+	paymentId, _ := j.GetString("payment_id")
+	challengeURL, _ := j.GetString("next_action", "url")
+	assert.Contains(t, challengeURL, "/3ds/challenge/")
+	return paymentId, challengeURL
+}
+
+func Test_ThreeDSFrictionless(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	code, j := sendThreeDSAuthorization(authorizationPayload{CardNumber: "4111111111111111"}, merchantId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("status")
+	assert.Equal(t, "authorized", status)
+	flow, _ := j.GetString("authentication", "flow")
+	assert.Equal(t, threeds.FlowFrictionless, flow)
+	eci, _ := j.GetString("authentication", "eci")
+	assert.Equal(t, "05", eci)
+	liabilityShift, _ := j.GetBool("authentication", "liability_shift")
+	assert.True(t, liabilityShift)
+
+	paymentId, _ := j.GetString("payment_id")
+	code, _, _, _ = sendCaptureRequest("100.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func Test_ThreeDSFailed(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+
+	code, j := sendThreeDSAuthorization(authorizationPayload{CardNumber: threeds.FailedCard}, merchantId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+	errorCode, _ := j.GetString("error_code")
+	assert.Equal(t, "authentication_failed", errorCode)
+}
+
+func Test_ThreeDSChallenge(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	paymentId, challengeURL := challengedPayment(t, merchantId, secretKey)
+
+	raw, err := a.collection(gateway.PaymentsCol).FindOne(context.Background(), bson.M{"id": paymentId}).DecodeBytes()
+	assert.NoError(t, err)
+	assert.NotContains(t, raw.String(), threeds.ChallengeCard, "the card number is encrypted")
+	_, err = raw.Lookup("authentication", "card").Document().LookupErr("cvv")
+	assert.Error(t, err, "the CVV is not kept")
+
+	code, _, _, _ := sendCaptureRequest("10.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, j := sendConfirmRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusConflict, code)
+	nextAction, _ := j.GetString("next_action", "url")
+	assert.Equal(t, challengeURL, nextAction)
+
+	u, _ := url.Parse(challengeURL)
+	req, _ := http.NewRequest(http.MethodGet, u.Path, nil)
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), "ending in 3220")
+
+	assert.Equal(t, http.StatusBadRequest, sendChallengeOutcome(challengeURL, "maybe"))
+	assert.Equal(t, http.StatusOK, sendChallengeOutcome(challengeURL, "authenticate"))
+	assert.Equal(t, http.StatusConflict, sendChallengeOutcome(challengeURL, "fail"))
+
+	code, j = sendConfirmRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+	status, _ := j.GetString("status")
+	assert.Equal(t, "authorized", status)
+	flow, _ := j.GetString("authentication", "flow")
+	assert.Equal(t, threeds.FlowChallenge, flow)
+	availableToCapture, _ := j.GetString("available_to_capture")
+	assert.Equal(t, "100.00", availableToCapture)
+
+	code, _ = sendConfirmRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _, _, _ = sendCaptureRequest("100.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusOK, code)
+
+	req, _ = http.NewRequest(http.MethodGet, "/merchant/"+merchantId+"/payment/"+paymentId, nil)
+	req.Header.Set("Authorization", secretKey)
+	response = executeRequest(req)
+	j, _ = jsonvalue.Unmarshal(response.Body.Bytes())
+	eci, _ := j.GetString("authentication", "eci")
+	assert.Equal(t, "05", eci)
+}
+
+func Test_ThreeDSChallengeFailed(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	paymentId, challengeURL := challengedPayment(t, merchantId, secretKey)
+
+	assert.Equal(t, http.StatusOK, sendChallengeOutcome(challengeURL, "fail"))
+
+	code, j := sendConfirmRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+	errorCode, _ := j.GetString("error_code")
+	assert.Equal(t, "authentication_failed", errorCode)
+
+	code, _, _, _ = sendCaptureRequest("10.00", merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func Test_ThreeDSChallengeExpires(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	paymentId, _ := challengedPayment(t, merchantId, secretKey)
+
+	ctx := context.WithValue(context.Background(), "logger", a.lg)
+	expired, err := a.gateway.Expire(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Empty(t, expired)
+
+	expired, err = a.gateway.Expire(ctx, time.Now().Add(a.cfg.ThreeDS.ChallengeTimeout+time.Minute))
+	assert.NoError(t, err)
+	assert.Len(t, expired, 1)
+
+	_, p := sendPaymentRequest(merchantId, paymentId, secretKey)
+	status, _ := p.GetString("authentication", "status")
+	assert.Equal(t, threeds.StatusFailed, status)
+	voided, _ := p.GetBool("voided")
+	assert.True(t, voided)
+
+	raw, err := a.collection(gateway.PaymentsCol).FindOne(context.Background(), bson.M{"id": paymentId}).DecodeBytes()
+	assert.NoError(t, err)
+	_, err = raw.LookupErr("authentication", "card")
+	assert.Error(t, err, "the card is dropped")
+
+	code, _ := sendConfirmRequest(merchantId, paymentId, secretKey)
+	assert.Equal(t, http.StatusConflict, code)
+}
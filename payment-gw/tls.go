@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+var (
+	ErrClientCertificateMismatch      = errors.New("client certificate does not match the merchant")
+	ErrClientCertificateNotRegistered = errors.New("merchant has no client certificate registered")
+	ErrInvalidClientCertificate       = errors.New("certificate must be a PEM encoded certificate or a SHA-256 fingerprint")
+)
+
+// certReloader serves the certificate from disk and picks up a renewed
+// certificate once both files were rewritten, without restarting the server.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the key pair if the files changed since the last load. A
+// broken pair, e.g. caught in the middle of a rotation, keeps the old one.
+func (r *certReloader) reload() (bool, error) {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return true, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) error {
+	lg := ctx.Value("logger").(*zerolog.Logger)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				lg.Warn().Err(err).Msg("could not reload TLS certificate")
+			} else if reloaded {
+				lg.Info().Str("cert_file", r.certFile).Msg("TLS certificate reloaded")
+			}
+		}
+	}
+}
+
+func (a *App) tlsConfig() (*tls.Config, error) {
+	reloader, err := newCertReloader(a.cfg.TLS.CertFile, a.cfg.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	a.workers.Go("tls-reloader", func(ctx context.Context) error {
+		return reloader.watch(ctx, a.cfg.TLS.ReloadInterval)
+	})
+
+	c := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	// Merchant certificates are pinned by fingerprint instead of being
+	// verified against a CA, so self-signed certificates are accepted here and
+	// matched against the merchant in needAuthentication. They are only asked
+	// for in the handshake, even with client_auth "require", which is enforced
+	// per merchant: probes, registration, checkout and 3-D Secure pages are
+	// reached without one.
+	if a.cfg.TLS.ClientAuth == clientAuthOptional || a.cfg.TLS.ClientAuth == clientAuthRequire {
+		c.ClientAuth = tls.RequestClientCert
+	}
+	return c, nil
+}
+
+func certificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint accepts the usual notations of a SHA-256 fingerprint,
+// e.g. "AB:CD:..." as printed by openssl, and returns lowercase hex.
+func normalizeFingerprint(fingerprint string) (string, error) {
+	f := strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+	if b, err := hex.DecodeString(f); err != nil || len(b) != sha256.Size {
+		return "", ErrInvalidClientCertificate
+	}
+	return f, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jsonvalue "github.com/Andrew-M-C/go.jsonvalue"
+	"github.com/stretchr/testify/assert"
+)
+
+func generateCertificate(t *testing.T, commonName string) (*x509.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func withClientCertificate(req *http.Request, cert *x509.Certificate) *http.Request {
+	if cert != nil {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	return req
+}
+
+func sendCertificateRequest(certPEM []byte, merchantId, secretKey string, presented *x509.Certificate) (responseCode int, fingerprint string) {
+	body, _ := json.Marshal(map[string]string{"certificate": string(certPEM)})
+	req, _ := http.NewRequest(http.MethodPut, "/merchant/"+merchantId+"/certificate", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", secretKey)
+	response := executeRequest(withClientCertificate(req, presented))
+
+	j, _ := jsonvalue.Unmarshal(response.Body.Bytes())
+	fingerprint, _ = j.GetString("fingerprint")
+	responseCode = response.Code
+	return
+}
+
+func sendAuthorizationWithCertificate(merchantId, secretKey string, presented *x509.Certificate) int {
+	req, _ := http.NewRequest(http.MethodPost, "/merchant/"+merchantId+"/authorize", bytes.NewBuffer(createAuthorizationPayload(authorizationPayload{})))
+	req.Header.Set("Authorization", secretKey)
+	return executeRequest(withClientCertificate(req, presented)).Code
+}
+
+func Test_MutualTLS(t *testing.T) {
+	clearTable()
+	clientAuth := a.cfg.TLS.ClientAuth
+	defer func() { a.cfg.TLS.ClientAuth = clientAuth }()
+	a.cfg.TLS.ClientAuth = clientAuthOptional
+
+	merchantId, secretKey := register(t)
+	cert, certPEM, _ := generateCertificate(t, "merchant")
+	other, otherPEM, _ := generateCertificate(t, "other")
+
+	assert.Equal(t, http.StatusOK, sendAuthorizationWithCertificate(merchantId, secretKey, nil))
+
+	code, fingerprint := sendCertificateRequest(certPEM, merchantId, secretKey, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, certificateFingerprint(cert), fingerprint)
+
+	assert.Equal(t, http.StatusOK, sendAuthorizationWithCertificate(merchantId, secretKey, cert))
+	assert.Equal(t, http.StatusForbidden, sendAuthorizationWithCertificate(merchantId, secretKey, other))
+	assert.Equal(t, http.StatusForbidden, sendAuthorizationWithCertificate(merchantId, secretKey, nil))
+
+	code, _ = sendCertificateRequest(otherPEM, merchantId, secretKey, other)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	a.cfg.TLS.ClientAuth = clientAuthRequire
+	otherMerchantId, otherSecretKey := register(t)
+	assert.Equal(t, http.StatusForbidden, sendAuthorizationWithCertificate(otherMerchantId, otherSecretKey, other))
+
+	code, fingerprint = sendCertificateRequest(otherPEM, otherMerchantId, otherSecretKey, other)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, certificateFingerprint(other), fingerprint)
+	assert.Equal(t, http.StatusOK, sendAuthorizationWithCertificate(otherMerchantId, otherSecretKey, other))
+}
+
+func Test_ClientCertificateRequired(t *testing.T) {
+	clearTable()
+	saved := a.cfg.TLS
+	defer func() { a.cfg.TLS = saved }()
+	dir := t.TempDir()
+	a.cfg.TLS.CertFile, a.cfg.TLS.KeyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_, certPEM, keyPEM := generateCertificate(t, "localhost")
+	assert.NoError(t, os.WriteFile(a.cfg.TLS.CertFile, certPEM, 0600))
+	assert.NoError(t, os.WriteFile(a.cfg.TLS.KeyFile, keyPEM, 0600))
+	a.cfg.TLS.ClientAuth = clientAuthRequire
+
+	server := httptest.NewUnstartedServer(a.router)
+	c, err := a.tlsConfig()
+	assert.NoError(t, err)
+	server.TLS = c
+	server.StartTLS()
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	response, err := client.Get(server.URL + "/healthz")
+	assert.NoError(t, err, "the handshake does not require a certificate")
+	if err == nil {
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		response.Body.Close()
+	}
+
+	merchantId, secretKey := register(t)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/merchant/"+merchantId+"/authorize", bytes.NewBuffer(createAuthorizationPayload(authorizationPayload{})))
+	req.Header.Set("Authorization", secretKey)
+	response, err = client.Do(req)
+	assert.NoError(t, err)
+	if err == nil {
+		assert.Equal(t, http.StatusForbidden, response.StatusCode, "merchants must present a certificate")
+		response.Body.Close()
+	}
+}
+
+func Test_CertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first, certPEM, keyPEM := generateCertificate(t, "localhost")
+	assert.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	served, _ := reloader.GetCertificate(nil)
+	assert.Equal(t, first.Raw, served.Certificate[0])
+
+	reloaded, err := reloader.reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	second, certPEM, keyPEM := generateCertificate(t, "localhost")
+	assert.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+
+	reloaded, err = reloader.reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	served, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, second.Raw, served.Certificate[0])
+
+	assert.NoError(t, os.WriteFile(keyFile, []byte("broken"), 0600))
+	assert.NoError(t, os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute)))
+	_, err = reloader.reload()
+	assert.Error(t, err)
+	served, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, second.Raw, served.Certificate[0], "a broken pair keeps the previous certificate")
+}
+
+func Test_NormalizeFingerprint(t *testing.T) {
+	cert, _, _ := generateCertificate(t, "merchant")
+	fingerprint := certificateFingerprint(cert)
+
+	colons := ""
+	for i := 0; i < len(fingerprint); i += 2 {
+		if i > 0 {
+			colons += ":"
+		}
+		colons += fingerprint[i : i+2]
+	}
+	normalized, err := normalizeFingerprint(string(bytes.ToUpper([]byte(colons))))
+	assert.NoError(t, err)
+	assert.Equal(t, fingerprint, normalized)
+
+	_, err = normalizeFingerprint("abcd")
+	assert.Equal(t, ErrInvalidClientCertificate, err)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"payment-gw/tracing"
+
+	"github.com/gorilla/mux"
+)
+
+const serviceName = "payment-gw"
+
+func newTracerProvider(c Config) *tracing.Provider {
+	switch c.Tracing.Exporter {
+	case "otlp":
+		return tracing.NewProvider(tracing.NewOTLPExporter(c.Tracing.OTLPEndpoint, serviceName))
+	case "stdout":
+		return tracing.NewProvider(tracing.NewStdoutExporter(os.Stdout))
+	default:
+		return tracing.NewProvider(nil)
+	}
+}
+
+func (a *App) trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		ctx := tracing.Extract(r.Context(), r.Header)
+		ctx, span := tracing.Start(ctx, r.Method+" "+route, tracing.WithKind(tracing.KindServer), tracing.WithAttributes(
+			tracing.String("http.method", r.Method),
+			tracing.String("http.route", route),
+			tracing.String("http.target", r.URL.Path),
+		))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(tracing.Int("http.status_code", rec.code))
+		if rec.code >= http.StatusInternalServerError {
+			span.SetStatus(tracing.StatusError, http.StatusText(rec.code))
+		}
+	})
+}
+
+// traceHandler wraps a route handler in its own span below the server span.
+func traceHandler(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), "handler."+name)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, r.WithContext(ctx))
+		span.SetAttributes(tracing.Int("http.status_code", rec.code))
+		if rec.code >= http.StatusBadRequest {
+			span.SetStatus(tracing.StatusError, http.StatusText(rec.code))
+		}
+	}
+}
+
+// traceMiddleware gives a middleware its own span which ends as soon as the
+// middleware passes the request on, so the spans of auth, ownership check and
+// handler are siblings instead of being nested in each other.
+func traceMiddleware(name string, mw mux.MiddlewareFunc) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			parent := tracing.SpanFromContext(r.Context())
+			ctx, span := tracing.Start(r.Context(), "middleware."+name)
+			defer span.End()
+
+			rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+			passed := false
+			mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				passed = true
+				span.End()
+				next.ServeHTTP(w, r.WithContext(tracing.ContextWithSpan(r.Context(), parent)))
+			})).ServeHTTP(rec, r.WithContext(ctx))
+
+			if !passed {
+				span.SetAttributes(tracing.Int("http.status_code", rec.code))
+				span.SetStatus(tracing.StatusError, http.StatusText(rec.code))
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxQueueSize   = 2048
+	maxBatchSize   = 512
+	exportInterval = 5 * time.Second
+)
+
+type batchProcessor struct {
+	exporter Exporter
+	queue    chan SpanData
+	flush    chan chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newBatchProcessor(exporter Exporter) *batchProcessor {
+	b := &batchProcessor{
+		exporter: exporter,
+		queue:    make(chan SpanData, maxQueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batchProcessor) enqueue(data SpanData) {
+	select {
+	case b.queue <- data:
+	default:
+		// the exporter is falling behind, dropping spans is preferable to
+		// blocking request handling
+	}
+}
+
+func (b *batchProcessor) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, maxBatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportInterval)
+		if err := b.exporter.Export(ctx, batch); err != nil {
+			log.Warn().Err(err).Int("spans", len(batch)).Msg("could not export spans")
+		}
+		cancel()
+		batch = make([]SpanData, 0, maxBatchSize)
+	}
+	drain := func() {
+		for {
+			select {
+			case s := <-b.queue:
+				batch = append(batch, s)
+				if len(batch) == maxBatchSize {
+					export()
+				}
+			default:
+				export()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case s := <-b.queue:
+			batch = append(batch, s)
+			if len(batch) == maxBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case ack := <-b.flush:
+			drain()
+			close(ack)
+		case <-b.done:
+			drain()
+			return
+		}
+	}
+}
+
+func (b *batchProcessor) shutdown(ctx context.Context) error {
+	var err error
+	b.once.Do(func() {
+		ack := make(chan struct{})
+		select {
+		case b.flush <- ack:
+			<-ack
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		close(b.done)
+		if shutdownErr := b.exporter.Shutdown(ctx); err == nil {
+			err = shutdownErr
+		}
+	})
+	return err
+}
+
+// StdoutExporter writes one JSON document per span, meant for local runs.
+type StdoutExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	return &StdoutExporter{w: w}
+}
+
+func (e *StdoutExporter) Export(_ context.Context, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		attrs := make(map[string]interface{}, len(s.Attributes))
+		for _, a := range s.Attributes {
+			attrs[a.Key] = a.Value
+		}
+		var parent string
+		if s.ParentSpanID.IsValid() {
+			parent = s.ParentSpanID.String()
+		}
+		err := enc.Encode(struct {
+			Name       string                 `json:"name"`
+			TraceID    string                 `json:"trace_id"`
+			SpanID     string                 `json:"span_id"`
+			ParentID   string                 `json:"parent_span_id,omitempty"`
+			Start      time.Time              `json:"start"`
+			DurationMs float64                `json:"duration_ms"`
+			Status     string                 `json:"status,omitempty"`
+			Attributes map[string]interface{} `json:"attributes,omitempty"`
+		}{s.Name, s.TraceID.String(), s.SpanID.String(), parent, s.Start,
+			float64(s.End.Sub(s.Start).Microseconds()) / 1000, s.StatusMessage, attrs})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *StdoutExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector using the OTLP/HTTP
+// protocol with JSON encoding.
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	return &OTLPExporter{endpoint: endpoint, serviceName: serviceName, client: &http.Client{Timeout: exportInterval}}
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func otlpAttributes(attrs []Attribute) []otlpKeyValue {
+	res := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		kv := otlpKeyValue{Key: a.Key}
+		switch v := a.Value.(type) {
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			kv.Value.IntValue = &s
+		case bool:
+			b := v
+			kv.Value.BoolValue = &b
+		default:
+			s := fmt.Sprint(v)
+			kv.Value.StringValue = &s
+		}
+		res = append(res, kv)
+	}
+	return res
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, spans []SpanData) error {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              int(s.Kind),
+			StartTimeUnixNano: unixNano(s.Start),
+			EndTimeUnixNano:   unixNano(s.End),
+			Attributes:        otlpAttributes(s.Attributes),
+			Status:            otlpStatus{Code: int(s.Status), Message: s.StatusMessage},
+		}
+		if s.ParentSpanID.IsValid() {
+			span.ParentSpanID = s.ParentSpanID.String()
+		}
+		for _, ev := range s.Events {
+			span.Events = append(span.Events, otlpEvent{unixNano(ev.Time), ev.Name, otlpAttributes(ev.Attributes)})
+		}
+		out = append(out, span)
+	}
+
+	type scope struct {
+		Name string `json:"name"`
+	}
+	type scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	type resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	payload := struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{{
+		Resource:   resource{otlpAttributes([]Attribute{String("service.name", e.serviceName)})},
+		ScopeSpans: []scopeSpans{{Scope: scope{"payment-gw/tracing"}, Spans: out}},
+	}}}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("otlp exporter: collector responded with %s", res.Status)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Shutdown(context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
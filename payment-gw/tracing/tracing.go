@@ -0,0 +1,370 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+type SpanID [8]byte
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	Remote  bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOk    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Attribute {
+	return Attribute{key, value}
+}
+
+func Int(key string, value int) Attribute {
+	return Attribute{key, int64(value)}
+}
+
+func Bool(key string, value bool) Attribute {
+	return Attribute{key, value}
+}
+
+type Event struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+type Span struct {
+	mu            sync.Mutex
+	provider      *Provider
+	name          string
+	kind          SpanKind
+	spanContext   SpanContext
+	parent        SpanID
+	start         time.Time
+	end           time.Time
+	attributes    []Attribute
+	events        []Event
+	status        StatusCode
+	statusMessage string
+	ended         bool
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.spanContext
+}
+
+func (s *Span) SetName(name string) {
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	s.attributes = append(s.attributes, attrs...)
+	s.mu.Unlock()
+}
+
+func (s *Span) AddEvent(name string, attrs ...Attribute) {
+	s.mu.Lock()
+	s.events = append(s.events, Event{Name: name, Time: time.Now(), Attributes: attrs})
+	s.mu.Unlock()
+}
+
+func (s *Span) SetStatus(code StatusCode, message string) {
+	s.mu.Lock()
+	s.status = code
+	s.statusMessage = message
+	s.mu.Unlock()
+}
+
+// RecordError adds an exception event and marks the span as failed. A nil
+// error is ignored so it can be called unconditionally before returning.
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.AddEvent("exception", String("exception.message", err.Error()))
+	s.SetStatus(StatusError, err.Error())
+}
+
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	data := s.snapshot()
+	s.mu.Unlock()
+
+	if s.spanContext.Sampled && s.provider != nil {
+		s.provider.onEnd(data)
+	}
+}
+
+func (s *Span) snapshot() SpanData {
+	return SpanData{
+		Name:          s.name,
+		Kind:          s.kind,
+		TraceID:       s.spanContext.TraceID,
+		SpanID:        s.spanContext.SpanID,
+		ParentSpanID:  s.parent,
+		Start:         s.start,
+		End:           s.end,
+		Attributes:    append([]Attribute(nil), s.attributes...),
+		Events:        append([]Event(nil), s.events...),
+		Status:        s.status,
+		StatusMessage: s.statusMessage,
+	}
+}
+
+type SpanData struct {
+	Name          string
+	Kind          SpanKind
+	TraceID       TraceID
+	SpanID        SpanID
+	ParentSpanID  SpanID
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	Events        []Event
+	Status        StatusCode
+	StatusMessage string
+}
+
+type contextKey struct{}
+
+var spanKey = contextKey{}
+
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey, s)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+type remoteKey struct{}
+
+func contextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+type StartOption func(*Span)
+
+func WithKind(kind SpanKind) StartOption {
+	return func(s *Span) {
+		s.kind = kind
+	}
+}
+
+func WithAttributes(attrs ...Attribute) StartOption {
+	return func(s *Span) {
+		s.attributes = append(s.attributes, attrs...)
+	}
+}
+
+// Start creates a child of the span stored in ctx, or of the remote parent
+// extracted from an incoming request, using the global provider.
+func Start(ctx context.Context, name string, opts ...StartOption) (context.Context, *Span) {
+	return global().Start(ctx, name, opts...)
+}
+
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+	Shutdown(ctx context.Context) error
+}
+
+type Provider struct {
+	processor *batchProcessor
+}
+
+func NewProvider(exporter Exporter) *Provider {
+	p := &Provider{}
+	if exporter != nil {
+		p.processor = newBatchProcessor(exporter)
+	}
+	return p
+}
+
+func (p *Provider) Start(ctx context.Context, name string, opts ...StartOption) (context.Context, *Span) {
+	s := &Span{provider: p, name: name, kind: KindInternal, start: time.Now()}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	parent := SpanFromContext(ctx).SpanContext()
+	if !parent.IsValid() {
+		parent, _ = ctx.Value(remoteKey{}).(SpanContext)
+	}
+	if parent.IsValid() {
+		s.spanContext.TraceID = parent.TraceID
+		s.spanContext.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		s.spanContext.TraceID = newTraceID()
+		s.spanContext.Sampled = true
+	}
+	s.spanContext.SpanID = newSpanID()
+
+	return ContextWithSpan(ctx, s), s
+}
+
+func (p *Provider) onEnd(data SpanData) {
+	if p.processor != nil {
+		p.processor.enqueue(data)
+	}
+}
+
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if p.processor == nil {
+		return nil
+	}
+	return p.processor.shutdown(ctx)
+}
+
+var (
+	globalMu       sync.RWMutex
+	globalProvider = NewProvider(nil)
+)
+
+func SetProvider(p *Provider) {
+	globalMu.Lock()
+	globalProvider = p
+	globalMu.Unlock()
+}
+
+func global() *Provider {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	return globalProvider
+}
+
+func newTraceID() TraceID {
+	var t TraceID
+	for !t.IsValid() {
+		rand.Read(t[:])
+	}
+	return t
+}
+
+func newSpanID() SpanID {
+	var s SpanID
+	for !s.IsValid() {
+		rand.Read(s[:])
+	}
+	return s
+}
+
+const traceparentHeader = "traceparent"
+
+var ErrInvalidTraceparent = errors.New("invalid traceparent header")
+
+// ParseTraceparent parses a W3C Trace Context traceparent header value,
+// e.g. "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceparent(value string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	var sc SpanContext
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || !sc.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+	sc.Remote = true
+	return sc, nil
+}
+
+func FormatTraceparent(sc SpanContext) string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// Extract returns ctx carrying the remote parent from the traceparent header,
+// or ctx unchanged when the header is missing or malformed.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, err := ParseTraceparent(h.Get(traceparentHeader))
+	if err != nil {
+		return ctx
+	}
+	return contextWithRemote(ctx, sc)
+}
+
+func Inject(ctx context.Context, h http.Header) {
+	if sc := SpanFromContext(ctx).SpanContext(); sc.IsValid() {
+		h.Set(traceparentHeader, FormatTraceparent(sc))
+	}
+}
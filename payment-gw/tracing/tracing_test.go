@@ -0,0 +1,56 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", FormatTraceparent(sc))
+
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err := ParseTraceparent(value)
+		assert.Equal(t, ErrInvalidTraceparent, err, value)
+	}
+}
+
+func TestChildSpansShareTrace(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewProvider(NewStdoutExporter(&buf))
+
+	h := http.Header{}
+	h.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := p.Start(Extract(context.Background(), h), "root")
+	_, child := p.Start(ctx, "child")
+	child.End()
+	root.End()
+
+	assert.Equal(t, root.SpanContext().TraceID, child.SpanContext().TraceID)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.SpanContext().TraceID.String())
+	assert.Equal(t, root.SpanContext().SpanID, child.parent)
+
+	out := http.Header{}
+	Inject(ctx, out)
+	assert.Equal(t, FormatTraceparent(root.SpanContext()), out.Get("traceparent"))
+
+	assert.NoError(t, p.Shutdown(context.Background()))
+	assert.Contains(t, buf.String(), `"name":"child"`)
+	assert.Contains(t, buf.String(), `"parent_span_id":"00f067aa0ba902b7"`)
+}
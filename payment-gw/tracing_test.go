@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"payment-gw/tracing"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (e *recordingExporter) Export(_ context.Context, spans []tracing.SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func Test_TraceparentIsHonored(t *testing.T) {
+	clearTable()
+	merchantId, secretKey := register(t)
+	_, _, paymentId, _, _ := sendAuthorizationRequest(authorizationPayload{Amount: "10.00"}, merchantId, secretKey)
+
+	exporter := &recordingExporter{}
+	provider := tracing.NewProvider(exporter)
+	tracing.SetProvider(provider)
+	defer tracing.SetProvider(a.tracer)
+
+	req, _ := http.NewRequest(http.MethodPost, "/merchant/"+merchantId+"/capture/"+paymentId, bytes.NewBufferString(`{"amount":"10.00"}`))
+	req.Header.Set("Authorization", secretKey)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	response := executeRequest(req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, provider.Shutdown(context.Background()))
+
+	names := map[string]tracing.SpanData{}
+	for _, s := range exporter.spans {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.TraceID.String())
+		names[s.Name] = s
+	}
+	server := names["POST /merchant/{merchant_id}/capture/{payment_id}"]
+	assert.Equal(t, "00f067aa0ba902b7", server.ParentSpanID.String())
+	for _, name := range []string{"middleware.needAuthentication", "middleware.needAutorization", "handler.capture"} {
+		assert.Equal(t, server.SpanID, names[name].ParentSpanID, name)
+	}
+	assert.Equal(t, names["handler.capture"].SpanID, names["gateway.Capture"].ParentSpanID)
+	assert.Equal(t, names["middleware.needAuthentication"].SpanID, names["merchant.IsAuthenticated"].ParentSpanID)
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"payment-gw/gateway"
 	"strconv"
-	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
@@ -16,37 +16,47 @@ type voidResponse struct {
 	AvailableToRefund  string `json:"available_to_refund,omitempty"`
 	Currency           string `json:"currency,omitempty"`
 	Error              string `json:"error,omitempty"`
+	DeclineCode        string `json:"decline_code,omitempty"`
 }
 
 func (a *App) void(w http.ResponseWriter, r *http.Request) {
 	lg := r.Context().Value("logger").(*zerolog.Logger)
 	w.Header().Set("Content-Type", "application/json")
 
-	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), a.cfg.Server.HandlerTimeout)
 	defer cancel()
 
 	payment, err := a.gateway.Void(ctx, mux.Vars(r)["payment_id"])
 
 	res := createVoidResponse(payment, err)
-	if err == gateway.ErrAlreadyCaptured || err == gateway.ErrAlreadyRefunded || err == gateway.ErrAlreadyVoided {
+	if err == gateway.ErrAlreadyCaptured || err == gateway.ErrAlreadyRefunded || err == gateway.ErrAlreadyVoided || err == gateway.ErrPaymentOnHold || err == gateway.ErrPaymentRequiresAction ||
+		errors.Is(err, gateway.ErrBasedOnCreditCardNumber) {
+		recordOperation("void", payment.Currency, payment.Authorized, operationOutcome(err))
 		lg.Debug().Msg(err.Error())
 		respondWithJSON(w, http.StatusBadRequest, res)
 		return
 	}
+	if errors.Is(err, gateway.ErrOperationInProgress) || errors.Is(err, gateway.ErrOptimisticLocking) {
+		lg.Debug().Msg(err.Error())
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
 	if err != nil {
+		recordOperation("void", payment.Currency, payment.Authorized, outcomeError)
 		lg.Error().Msg(err.Error())
-		respondWithError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		respondWithFailure(w, err)
 		return
 	}
+	recordOperation("void", payment.Currency, payment.Authorized, outcomeSuccess)
 	respondWithJSON(w, http.StatusOK, res)
 }
 
 func createVoidResponse(p gateway.Payment, err error) voidResponse {
 	availableToCapture_f := float64(p.Authorized-p.Captured) / 100
-	availableToRefund_f := float64(p.Captured-p.Refunded) / 100
-	res := voidResponse{strconv.FormatFloat(availableToCapture_f, 'f', 2, 64), strconv.FormatFloat(availableToRefund_f, 'f', 2, 64), p.Currency, ""}
+	availableToRefund_f := float64(p.Refundable()) / 100
+	res := voidResponse{strconv.FormatFloat(availableToCapture_f, 'f', 2, 64), strconv.FormatFloat(availableToRefund_f, 'f', 2, 64), p.Currency, "", declineCode(err)}
 
-	if err == gateway.ErrAlreadyCaptured {
+	if err == gateway.ErrAlreadyCaptured || err == gateway.ErrPaymentOnHold || err == gateway.ErrPaymentRequiresAction {
 		res.Error = err.Error()
 		return res
 	}
@@ -57,6 +67,11 @@ func createVoidResponse(p gateway.Payment, err error) voidResponse {
 		return res
 	}
 
+	if errors.Is(err, gateway.ErrBasedOnCreditCardNumber) {
+		res.Error = err.Error()
+		return res
+	}
+
 	if err == gateway.ErrAlreadyVoided {
 		res.AvailableToCapture = "0.00"
 		res.AvailableToRefund = "0.00"
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	workerRunning = "running"
+	workerStopped = "stopped"
+	workerFailed  = "failed"
+)
+
+type worker struct {
+	name   string
+	status string
+	err    error
+}
+
+// workerGroup runs the background jobs of the application and stops them
+// together when the server shuts down.
+type workerGroup struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	lg      *zerolog.Logger
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	workers []*worker
+}
+
+func newWorkerGroup(lg *zerolog.Logger) *workerGroup {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "logger", lg))
+	return &workerGroup{ctx: ctx, cancel: cancel, lg: lg}
+}
+
+func (g *workerGroup) Go(name string, fn func(ctx context.Context) error) {
+	w := &worker{name: name, status: workerRunning}
+	g.mu.Lock()
+	g.workers = append(g.workers, w)
+	g.mu.Unlock()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		lg := g.lg.With().Str("worker", name).Logger()
+		lg.Debug().Msg("worker started")
+		err := fn(context.WithValue(g.ctx, "logger", &lg))
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if err != nil && g.ctx.Err() == nil {
+			lg.Error().Err(err).Msg("worker failed")
+			w.status, w.err = workerFailed, err
+			return
+		}
+		lg.Debug().Msg("worker stopped")
+		w.status = workerStopped
+	}()
+}
+
+// Stop cancels the workers and waits for them to return or for ctx to expire.
+func (g *workerGroup) Stop(ctx context.Context) error {
+	g.cancel()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *workerGroup) check() dependencyStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	res := dependencyStatus{Status: statusUp, Details: map[string]string{}}
+	for _, w := range g.workers {
+		res.Details[w.name] = w.status
+		if w.status == workerFailed {
+			res.Status = statusDown
+			res.Error = w.name + ": " + w.err.Error()
+		}
+	}
+	return res
+}
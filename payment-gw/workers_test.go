@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_WorkerGroupStopWaitsForWorkers(t *testing.T) {
+	lg := zerolog.Nop()
+	g := newWorkerGroup(&lg)
+
+	finished := make(chan struct{})
+	g.Go("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		close(finished)
+		return ctx.Err()
+	})
+
+	assert.NoError(t, g.Stop(context.Background()))
+	select {
+	case <-finished:
+	default:
+		t.Fatal("Stop returned before the worker finished")
+	}
+	assert.Equal(t, workerStopped, g.workers[0].status)
+}
+
+func Test_WorkerGroupStopDeadline(t *testing.T) {
+	lg := zerolog.Nop()
+	g := newWorkerGroup(&lg)
+	release := make(chan struct{})
+	defer close(release)
+	g.Go("stuck", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, g.Stop(ctx))
+}
+
+func Test_WorkerGroupFailedWorker(t *testing.T) {
+	lg := zerolog.Nop()
+	g := newWorkerGroup(&lg)
+	done := make(chan struct{})
+	g.Go("broken", func(ctx context.Context) error {
+		defer close(done)
+		return errors.New("boom")
+	})
+	<-done
+	assert.NoError(t, g.Stop(context.Background()))
+	assert.Equal(t, workerFailed, g.workers[0].status)
+}